@@ -0,0 +1,386 @@
+//go:build integration
+
+// The integration tests run bgtables against the fake GoBGP server of
+// gobgptest, with its routes and rules programmed into a throwaway network
+// namespace.
+// They need root:
+//
+//	go test -tags integration ./cmd/bgtables
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/karasz/bgtables/internal/gobgptest"
+	"github.com/karasz/bgtables/routes"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	blackhole = 65535<<16 | 666
+	upstreamA = 65000<<16 | 100
+)
+
+// integrationConfig installs paths tagged blackhole into table 100, with
+// the address of veth0 as preferred source, and routes traffic from the
+// paths of upstream A through table 100. Drift is repaired.
+const integrationConfig = `
+reconcile_interval: 0s
+drift:
+  enabled: true
+policy:
+  - name: blackhole
+    match:
+      communities: ["65535:666"]
+    action:
+      type: blackhole
+      table: 100
+      mtu: 1400
+      prefsrc: 192.0.2.1
+rules:
+  - name: upstream-a
+    match:
+      communities: ["65000:100"]
+    priority: 1000
+    table: 100
+`
+
+// scriptedPath returns the best path of cidr carrying communities.
+func scriptedPath(cidr string, communities ...uint32) *apipb.Path {
+	return gobgptest.NewPath(cidr, &apipb.NextHopAttribute{NextHop: "192.0.2.2"},
+		&apipb.CommunitiesAttribute{Communities: communities})
+}
+
+// harness is a network namespace holding a veth pair, veth0 with
+// 192.0.2.1/24 and 2001:db8:ffff::1/64 and veth1 with 192.0.2.2/24, and
+// the fake GoBGP server bgtables connects to. IPv6 refuses local gateways,
+// so 2001:db8:ffff::2 stands for a neighbour on the link of veth0.
+type harness struct {
+	t      *testing.T
+	ns     netns.NsHandle
+	handle *netlink.Handle
+	gobgp  *gobgptest.Server
+	done   chan error
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	h := &harness{t: t, ns: newNamespace(t), gobgp: gobgptest.NewServer()}
+	t.Cleanup(h.gobgp.Close)
+	handle, err := netlink.NewHandleAt(h.ns)
+	require.NoError(t, err)
+	h.handle = handle
+	t.Cleanup(handle.Close)
+	h.setupLinks()
+	return h
+}
+
+// newNamespace creates a network namespace from a thread that is thrown
+// away afterwards, so no other goroutine ever runs inside it.
+func newNamespace(t *testing.T) netns.NsHandle {
+	t.Helper()
+	type result struct {
+		ns  netns.NsHandle
+		err error
+	}
+	created := make(chan result)
+	go func() {
+		runtime.LockOSThread()
+		ns, err := netns.New()
+		created <- result{ns, err}
+	}()
+	r := <-created
+	require.NoError(t, r.err)
+	t.Cleanup(func() { r.ns.Close() })
+	return r.ns
+}
+
+func (h *harness) setupLinks() {
+	lo, err := h.handle.LinkByName("lo")
+	require.NoError(h.t, err)
+	require.NoError(h.t, h.handle.LinkSetUp(lo))
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	require.NoError(h.t, h.handle.LinkAdd(veth))
+	for i, name := range []string{"veth0", "veth1"} {
+		link, err := h.handle.LinkByName(name)
+		require.NoError(h.t, err)
+		cidrs := []string{fmt.Sprintf("192.0.2.%d/24", i+1)}
+		if i == 0 {
+			cidrs = append(cidrs, "2001:db8:ffff::1/64")
+		}
+		for _, cidr := range cidrs {
+			addr, err := netlink.ParseAddr(cidr)
+			require.NoError(h.t, err)
+			// Skip duplicate address detection, which would keep the
+			// IPv6 address tentative.
+			addr.Flags = unix.IFA_F_NODAD
+			require.NoError(h.t, h.handle.AddrAdd(link, addr))
+		}
+		require.NoError(h.t, h.handle.LinkSetUp(link))
+	}
+}
+
+// start runs bgtables with cfg inside the namespace, through its own
+// configuration loading and connection code, until the test ends.
+func (h *harness) start(cfg string) {
+	h.launch(cfg, func() error {
+		// The thread never leaves the namespace, it is thrown away with
+		// the goroutine.
+		runtime.LockOSThread()
+		return netns.Set(h.ns)
+	})
+}
+
+// startOutside runs bgtables with cfg in the namespace of the test, from
+// which it reaches the namespace of the harness through the namespaces
+// of cfg.
+func (h *harness) startOutside(cfg string) {
+	h.launch(cfg, func() error { return nil })
+}
+
+// nsPath returns a path of the namespace of the harness.
+func (h *harness) nsPath() string {
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), int(h.ns))
+}
+
+// launch runs bgtables with cfg, from a goroutine that calls enter first.
+func (h *harness) launch(cfg string, enter func() error) {
+	path := filepath.Join(h.t.TempDir(), "config.yaml")
+	cfg = fmt.Sprintf("gobgp_server: %q\n%s", gobgptest.Target, cfg)
+	require.NoError(h.t, os.WriteFile(path, []byte(cfg), 0o600))
+	cf, client, closeConn := setupConnection(path, h.gobgp.DialOption())
+	require.NotNil(h.t, cf)
+
+	h.done = make(chan error, 1)
+	go func() {
+		if err := enter(); err != nil {
+			h.done <- err
+			return
+		}
+		h.done <- run(cf, client)
+	}()
+	h.t.Cleanup(func() {
+		h.gobgp.Disconnect(nil)
+		select {
+		case err := <-h.done:
+			assert.NoError(h.t, err)
+		case <-time.After(5 * time.Second):
+			h.t.Error("bgtables did not stop")
+		}
+		closeConn()
+	})
+}
+
+// routes returns the destinations of the routes of table, owned by
+// bgtables when owned is set.
+func (h *harness) routes(table int, owned bool) []string {
+	filter := &netlink.Route{Table: table, Protocol: routes.RouteProtocol}
+	mask := uint64(netlink.RT_FILTER_TABLE)
+	if owned {
+		mask |= netlink.RT_FILTER_PROTOCOL
+	}
+	listed, err := h.handle.RouteListFiltered(netlink.FAMILY_ALL, filter, mask)
+	require.NoError(h.t, err)
+	dsts := make([]string, 0, len(listed))
+	for _, route := range listed {
+		dsts = append(dsts, route.Dst.String())
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+func (h *harness) route(table int, cidr string) netlink.Route {
+	_, dst, err := net.ParseCIDR(cidr)
+	require.NoError(h.t, err)
+	family := netlink.FAMILY_V4
+	if dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	listed, err := h.handle.RouteListFiltered(family, &netlink.Route{Table: table, Dst: dst},
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
+	require.NoError(h.t, err)
+	require.Len(h.t, listed, 1)
+	return listed[0]
+}
+
+// rules returns the ip rules bgtables owns.
+func (h *harness) rules() []string {
+	rules, err := h.handle.RuleList(netlink.FAMILY_ALL)
+	require.NoError(h.t, err)
+	var owned []string
+	for _, rule := range rules {
+		if rule.Protocol == uint8(routes.RouteProtocol) {
+			owned = append(owned, fmt.Sprintf("%d: from %s lookup %d", rule.Priority, rule.Src, rule.Table))
+		}
+	}
+	sort.Strings(owned)
+	return owned
+}
+
+func TestIntegrationRoutesAndRules(t *testing.T) {
+	h := newHarness(t)
+	_, foreign, _ := net.ParseCIDR("10.0.9.0/24")
+	require.NoError(t, h.handle.RouteAdd(&netlink.Route{
+		Dst: foreign, Table: 100, Type: unix.RTN_BLACKHOLE, Protocol: unix.RTPROT_BGP,
+	}), "a route of another BGP daemon")
+	zebra := netlink.NewRule()
+	zebra.Priority, zebra.Src, zebra.Table, zebra.Protocol = 900, foreign, 100, unix.RTPROT_BGP
+	require.NoError(t, h.handle.RuleAdd(zebra), "a rule of another BGP daemon")
+	stale := netlink.NewRule()
+	stale.Priority, stale.Src, stale.Table, stale.Protocol = 1000, foreign, 100, uint8(routes.RouteProtocol)
+	require.NoError(t, h.handle.RuleAdd(stale), "an owned rule left behind by an earlier run")
+
+	tagged := scriptedPath("10.0.0.0/24", blackhole, upstreamA)
+	h.gobgp.Announce(tagged)
+	h.start(integrationConfig)
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.0/24"}, h.routes(100, true))
+		assert.Equal(c, []string{"1000: from 10.0.0.0/24 lookup 100"}, h.rules())
+	}, 5*time.Second, 20*time.Millisecond)
+
+	route := h.route(100, "10.0.0.0/24")
+	assert.Equal(t, unix.RTN_BLACKHOLE, route.Type)
+	assert.Equal(t, 1400, route.MTU)
+	assert.Equal(t, "192.0.2.1", route.Src.String())
+
+	h.gobgp.Announce(scriptedPath("10.0.1.0/24", blackhole), gobgptest.Withdrawal(tagged))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.1.0/24"}, h.routes(100, true))
+		assert.Empty(c, h.rules())
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []string{"10.0.1.0/24", "10.0.9.0/24"}, h.routes(100, false), "foreign routes are left alone")
+	rules, err := h.handle.RuleList(netlink.FAMILY_V4)
+	require.NoError(t, err)
+	assert.True(t, slices.ContainsFunc(rules, func(rule netlink.Rule) bool {
+		return rule.Priority == 900 && rule.Protocol == unix.RTPROT_BGP
+	}), "foreign rules are left alone")
+}
+
+func TestIntegrationRepairsDeletedRoute(t *testing.T) {
+	h := newHarness(t)
+	h.gobgp.Announce(scriptedPath("10.0.0.0/24", blackhole))
+	h.start(integrationConfig)
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.0/24"}, h.routes(100, true))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	route := h.route(100, "10.0.0.0/24")
+	require.NoError(t, h.handle.RouteDel(&route))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.0/24"}, h.routes(100, true))
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestIntegrationUnicastViaNextHop(t *testing.T) {
+	h := newHarness(t)
+	plain := scriptedPath("10.0.5.0/24")
+	h.gobgp.Announce(plain)
+	h.start(integrationConfig)
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.5.0/24"}, h.routes(unix.RT_TABLE_MAIN, true))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	route := h.route(unix.RT_TABLE_MAIN, "10.0.5.0/24")
+	assert.Equal(t, unix.RTN_UNICAST, route.Type)
+	assert.Equal(t, "192.0.2.2", route.Gw.String(), "the next hop is the gateway")
+
+	h.gobgp.Announce(gobgptest.Withdrawal(plain))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Empty(c, h.routes(unix.RT_TABLE_MAIN, true))
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// auditConfig audits the kernel every 50ms.
+const auditConfig = `
+reconcile_interval: 0s
+drift:
+  enabled: true
+  audit_interval: 50ms
+`
+
+// driftRepairs returns the number of drift repairs so far, made or
+// suppressed by the hold-down.
+func driftRepairs() int64 {
+	var total int64
+	for _, name := range []string{"drift_repairs", "drift_repairs_suppressed"} {
+		if repairs, ok := routes.Metrics.Get(name).(*expvar.Int); ok {
+			total += repairs.Value()
+		}
+	}
+	return total
+}
+
+func TestIntegrationIPv6(t *testing.T) {
+	h := newHarness(t)
+	h.gobgp.Announce(gobgptest.NewPath("2001:db8:1::/48",
+		&apipb.MpReachNLRIAttribute{NextHops: []string{"2001:db8:ffff::2"}}))
+	h.start(auditConfig)
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"2001:db8:1::/48"}, h.routes(unix.RT_TABLE_MAIN, true))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	route := h.route(unix.RT_TABLE_MAIN, "2001:db8:1::/48")
+	assert.Equal(t, "2001:db8:ffff::2", route.Gw.String())
+	assert.Equal(t, 1024, route.Priority, "the kernel gives IPv6 routes its default metric")
+	repairs := driftRepairs()
+	assert.Never(t, func() bool { return driftRepairs() != repairs }, 300*time.Millisecond, 20*time.Millisecond,
+		"audits leave an IPv6 route in line with the RIB alone")
+
+	require.NoError(t, h.handle.RouteDel(&route))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"2001:db8:1::/48"}, h.routes(unix.RT_TABLE_MAIN, true))
+	}, 5*time.Second, 20*time.Millisecond, "a deleted IPv6 route is repaired")
+}
+
+// targetConfig programs the namespace at the path it is formatted with,
+// where the routes of table 100 go to table 300.
+const targetConfig = `
+namespaces:
+  - name: workload
+    path: %s
+    tables:
+      100: 300
+`
+
+func TestIntegrationTargetNamespace(t *testing.T) {
+	h := newHarness(t)
+	h.gobgp.Announce(scriptedPath("10.0.0.0/24", blackhole, upstreamA))
+	h.startOutside(fmt.Sprintf(targetConfig, h.nsPath()) + integrationConfig)
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.0/24"}, h.routes(300, true))
+		assert.Equal(c, []string{"1000: from 10.0.0.0/24 lookup 300"}, h.rules())
+	}, 5*time.Second, 20*time.Millisecond)
+	own, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 300}, netlink.RT_FILTER_TABLE)
+	require.NoError(t, err)
+	assert.Empty(t, own, "the namespace of bgtables is left alone")
+
+	route := h.route(300, "10.0.0.0/24")
+	require.NoError(t, h.handle.RouteDel(&route))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.0/24"}, h.routes(300, true))
+	}, 5*time.Second, 20*time.Millisecond, "drift in the namespace is repaired")
+}
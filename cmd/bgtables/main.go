@@ -3,73 +3,251 @@ package main
 
 import (
 	"context"
+	_ "expvar"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/embedded"
 	"github.com/karasz/bgtables/routes"
 
 	apipb "github.com/osrg/gobgp/v3/api"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// watchRetryMin and watchRetryMax bound the delay before a failed watch
+// stream is reopened.
+var (
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
 )
 
 func main() {
-	cf, client, conn := setupConnection("config.yaml")
+	cf, client, closeConn := setupConnection("config.yaml")
 	if cf == nil {
 		os.Exit(1)
 	}
-	defer conn.Close()
 
-	stream := setupRouteStream(client)
+	err := run(cf, client)
+	closeConn()
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(cf *config.Config, client apipb.GobgpApiClient) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	managers, err := routes.NewManagers(*cf)
+	if err != nil {
+		return fmt.Errorf("failed to create route managers: %w", err)
+	}
+	defer routes.CloseManagers(managers)
+
+	startMetricsServer(cf.MetricsAddress)
+	var streams sync.WaitGroup
+	for _, manager := range managers {
+		stream, err := startManager(ctx, client, manager, cf)
+		if err != nil {
+			return err
+		}
+		streams.Add(1)
+		go func(manager *routes.Manager) {
+			defer streams.Done()
+			processRouteUpdates(ctx, client, manager, stream)
+		}(manager)
+	}
+	resetLimitsOnSignal(ctx, managers)
+
+	streams.Wait()
+	return nil
+}
+
+// startManager starts the kernel watch, reconciliation and revalidation of
+// manager, and returns the watch stream of its source.
+func startManager(ctx context.Context, client apipb.GobgpApiClient, manager *routes.Manager,
+	cf *config.Config) (apipb.GobgpApi_WatchEventClient, error) {
+	if err := manager.Source().Load(ctx, client); err != nil {
+		return nil, fmt.Errorf("failed to load watched table: %w", err)
+	}
+	if err := startKernelWatch(ctx, manager, cf.Drift); err != nil {
+		return nil, fmt.Errorf("failed to watch kernel routes: %w", err)
+	}
+	startReconciler(ctx, client, manager, cf.ReconcileInterval)
+	go manager.RunRevalidator(ctx, client, cf.RPKI)
+
+	stream, err := setupRouteStream(ctx, client, manager.Source().WatchRequest())
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch paths: %w", err)
+	}
+	return stream, nil
+}
+
+func startMetricsServer(address string) {
+	if address == "" {
+		return
+	}
+	go func() {
+		log.Printf("Serving metrics on %s", address)
+		if err := http.ListenAndServe(address, nil); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
+
+func startKernelWatch(ctx context.Context, manager *routes.Manager, cfg config.Drift) error {
+	if !cfg.Enabled {
+		return manager.Start(ctx)
+	}
+	watcher := routes.NewDriftWatcher(manager, cfg)
+	go watcher.Run(ctx)
+	return manager.Start(ctx, watcher.HandleUpdate)
+}
+
+func startReconciler(ctx context.Context, client apipb.GobgpApiClient, manager *routes.Manager,
+	interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go manager.RunReconciler(ctx, client, interval)
+}
 
-	processRouteUpdates(stream)
+// resetLimitsOnSignal lifts exceeded route limits of every manager whenever
+// bgtables receives SIGUSR1.
+func resetLimitsOnSignal(ctx context.Context, managers []*routes.Manager) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				log.Println("Resetting route limits")
+				for _, manager := range managers {
+					manager.ResetLimits()
+				}
+			}
+		}
+	}()
 }
 
-func setupConnection(configPath string) (*config.Config, apipb.GobgpApiClient, *grpc.ClientConn) {
+// setupConnection loads the configuration at configPath and connects to its
+// GoBGP server, with opts added to the default dial options, or starts the
+// embedded server. The returned function closes the connection or stops
+// the embedded server.
+func setupConnection(configPath string, opts ...grpc.DialOption) (*config.Config, apipb.GobgpApiClient,
+	func()) {
 	cfg := loadConfig(configPath)
-	conn := createGRPCClient(cfg)
+	if cfg != nil && cfg.Embedded.Enabled {
+		return startEmbeddedServer(cfg)
+	}
+	conn := createGRPCClient(cfg, opts...)
 	client := apipb.NewGobgpApiClient(conn)
-	return cfg, client, conn
+	return cfg, client, func() { conn.Close() }
 }
 
-func setupRouteStream(client apipb.GobgpApiClient) apipb.GobgpApi_WatchEventClient {
-	log.Println("Starting route monitoring...")
-	stream, err := client.WatchEvent(context.Background(), &apipb.WatchEventRequest{
-		Table: &apipb.WatchEventRequest_Table{
-			Filters: []*apipb.WatchEventRequest_Table_Filter{
-				{
-					Type: apipb.WatchEventRequest_Table_Filter_BEST,
-					Init: true,
-				},
-			},
-		},
-	})
+func startEmbeddedServer(cfg *config.Config) (*config.Config, apipb.GobgpApiClient, func()) {
+	server, err := embedded.Start(context.Background(), cfg.Embedded)
 	if err != nil {
-		log.Printf("Error creating route monitor stream: %v", err)
+		log.Printf("Error starting embedded GoBGP server: %v", err)
+		return nil, nil, func() {}
 	}
-	return stream
+	log.Println("Started embedded GoBGP server")
+	return cfg, server.Client(), server.Stop
+}
+
+func setupRouteStream(ctx context.Context, client apipb.GobgpApiClient,
+	req *apipb.WatchEventRequest) (apipb.GobgpApi_WatchEventClient, error) {
+	log.Println("Starting route monitoring...")
+	return client.WatchEvent(ctx, req)
 }
 
-func processRouteUpdates(stream apipb.GobgpApi_WatchEventClient) {
+// processRouteUpdates applies the paths received on stream to manager until
+// the server closes the stream or bgtables shuts down. A stream that fails
+// is reopened after a backoff, and manager is reconciled with its source to
+// catch up on the events missed meanwhile.
+func processRouteUpdates(ctx context.Context, client apipb.GobgpApiClient, manager *routes.Manager,
+	stream apipb.GobgpApi_WatchEventClient) {
+	delay := watchRetryMin
 	for {
-		if done := handleRouteUpdate(stream); done {
+		received, err := receiveRouteUpdates(stream, manager)
+		if handleStreamError(err) {
+			return
+		}
+		if received {
+			delay = watchRetryMin
+		}
+		if stream, delay = reopenRouteStream(ctx, client, manager, delay); stream == nil {
 			return
 		}
 	}
 }
 
-func handleRouteUpdate(stream apipb.GobgpApi_WatchEventClient) bool {
-	resp, err := stream.Recv()
-	if err != nil {
-		return handleStreamError(err)
+// receiveRouteUpdates applies the paths received on stream to manager until
+// the stream fails, and reports whether it received anything before.
+func receiveRouteUpdates(stream apipb.GobgpApi_WatchEventClient, manager *routes.Manager) (bool, error) {
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if paths := resp.GetTable().GetPaths(); len(paths) > 0 {
+			handleRoutePaths(manager, paths)
+		}
 	}
+}
 
-	if resp.GetTable() != nil && len(resp.GetTable().Paths) > 0 {
-		handleRoutePaths(resp.GetTable().Paths)
+// reopenRouteStream reopens the watch stream of manager after delay, which
+// doubles up to watchRetryMax after every attempt, and reconciles manager
+// once it succeeds. It returns the stream and the next delay, or a nil
+// stream when ctx is done.
+func reopenRouteStream(ctx context.Context, client apipb.GobgpApiClient, manager *routes.Manager,
+	delay time.Duration) (apipb.GobgpApi_WatchEventClient, time.Duration) {
+	for {
+		log.Printf("Reopening route monitor stream in %v", delay)
+		if !sleep(ctx, delay) {
+			return nil, delay
+		}
+		delay = min(2*delay, watchRetryMax)
+		stream, err := setupRouteStream(ctx, client, manager.Source().WatchRequest())
+		if err != nil {
+			log.Printf("Error creating route monitor stream: %v", err)
+			continue
+		}
+		if err := manager.Reconcile(ctx, client); err != nil {
+			log.Printf("Error reconciling routes: %v", err)
+		}
+		return stream, delay
+	}
+}
+
+// sleep waits for d and reports whether ctx is still live afterwards.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
-	return false
 }
 
 func handleStreamError(err error) bool {
@@ -77,12 +255,16 @@ func handleStreamError(err error) bool {
 		log.Println("Stream closed by server")
 		return true
 	}
+	if status.Code(err) == codes.Canceled {
+		log.Println("Stream closed on shutdown")
+		return true
+	}
 	log.Printf("Error receiving from stream: %v", err)
 	return false
 }
 
-func handleRoutePaths(paths []*apipb.Path) {
-	if err := routes.UpdateLocalRoutes(paths); err != nil {
+func handleRoutePaths(manager *routes.Manager, paths []*apipb.Path) {
+	if err := manager.UpdateLocalRoutes(manager.Source().Select(paths)); err != nil {
 		log.Printf("Error updating routes: %v", err)
 	}
 }
@@ -96,9 +278,10 @@ func loadConfig(configPath string) *config.Config {
 	return cfg
 }
 
-func createGRPCClient(cfg *config.Config) *grpc.ClientConn {
+func createGRPCClient(cfg *config.Config, opts ...grpc.DialOption) *grpc.ClientConn {
 	if cfg != nil {
-		conn, err := grpc.NewClient(cfg.GoBGPServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+		conn, err := grpc.NewClient(cfg.GoBGPServer, opts...)
 		if err != nil {
 			log.Printf("Error creating gRPC client: %v", err)
 			return nil
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/internal/gobgptest"
+	"github.com/karasz/bgtables/routes"
 	apipb "github.com/osrg/gobgp/v3/api"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"google.golang.org/protobuf/types/known/anypb"
 )
@@ -41,11 +55,11 @@ func TestSetupConnection(t *testing.T) {
 				}
 			}()
 
-			cfg, client, conn := setupConnection(tt.configPath)
+			cfg, client, closeConn := setupConnection(tt.configPath)
 			if !tt.shouldError {
 				assert.NotNil(t, cfg)
 				assert.NotNil(t, client)
-				conn.Close()
+				closeConn()
 			}
 		})
 	}
@@ -62,6 +76,11 @@ func TestHandleStreamError(t *testing.T) {
 			err:          io.EOF,
 			expectedDone: true,
 		},
+		{
+			name:         "Canceled",
+			err:          status.Error(codes.Canceled, "context canceled"),
+			expectedDone: true,
+		},
 		{
 			name:         "Other error",
 			err:          errors.New("random error"),
@@ -77,7 +96,7 @@ func TestHandleStreamError(t *testing.T) {
 	}
 }
 
-func TestHandleRoutePaths(_ *testing.T) {
+func TestHandleRoutePaths(t *testing.T) {
 	paths := []*apipb.Path{
 		{
 			Nlri: &anypb.Any{
@@ -88,5 +107,218 @@ func TestHandleRoutePaths(_ *testing.T) {
 		},
 	}
 
-	handleRoutePaths(paths)
+	manager, err := routes.NewManager(config.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	handleRoutePaths(manager, paths)
+}
+
+// fileSinkConfig programs the routes into a file instead of the kernel, so
+// that bgtables runs without privileges.
+const fileSinkConfig = `
+gobgp_server: %q
+reconcile_interval: 0s
+sinks:
+  - name: file
+    type: file
+    path: %s
+`
+
+// routeFile returns the destinations a file sink holds, replaying its
+// lines as a consumer does. The tests use a single table.
+func routeFile(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	require.NoError(t, err)
+	defer file.Close()
+
+	held := make(map[string]bool)
+	for dec := json.NewDecoder(file); dec.More(); {
+		var route struct {
+			Dst     string `json:"dst"`
+			Removed bool   `json:"removed"`
+		}
+		require.NoError(t, dec.Decode(&route))
+		held[route.Dst] = !route.Removed
+	}
+	var dsts []string
+	for dst, ok := range held {
+		if ok {
+			dsts = append(dsts, dst)
+		}
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+// runAgainst runs bgtables against server with a file sink until it
+// watches the server, and returns the path of the sink file and the
+// channel run returns on.
+func runAgainst(t *testing.T, server *gobgptest.Server) (string, <-chan error) {
+	t.Helper()
+	dir := t.TempDir()
+	routeFilePath := filepath.Join(dir, "routes.json")
+	configPath := filepath.Join(dir, "config.yaml")
+	cfg := fmt.Sprintf(fileSinkConfig, gobgptest.Target, routeFilePath)
+	require.NoError(t, os.WriteFile(configPath, []byte(cfg), 0o600))
+
+	cf, client, closeConn := setupConnection(configPath, server.DialOption())
+	require.NotNil(t, cf)
+	t.Cleanup(closeConn)
+	watched := server.Watched()
+	done := make(chan error, 1)
+	go func() { done <- run(cf, client) }()
+	awaitWatch(t, watched, done)
+	return routeFilePath, done
+}
+
+// awaitWatch waits until watched is closed, failing if run returns first.
+func awaitWatch(t *testing.T, watched <-chan struct{}, done <-chan error) {
+	t.Helper()
+	select {
+	case <-watched:
+	case err := <-done:
+		t.Fatalf("run returned before watching: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("bgtables did not watch the server")
+	}
+}
+
+func TestRunAgainstFakeServer(t *testing.T) {
+	server := gobgptest.NewServer()
+	defer server.Close()
+	nextHop := &apipb.NextHopAttribute{NextHop: "192.0.2.254"}
+	server.Announce(gobgptest.NewPath("192.0.2.0/24", nextHop))
+
+	routeFilePath, done := runAgainst(t, server)
+
+	server.Announce(gobgptest.NewPath("2001:db8::/32", &apipb.NextHopAttribute{NextHop: "2001:db8:ffff::1"}))
+	server.Withdraw(gobgptest.NewPath("192.0.2.0/24"))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"2001:db8::/32"}, routeFile(t, routeFilePath))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	server.Disconnect(nil)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after the server closed the stream")
+	}
+}
+
+func TestRunReopensFailedWatch(t *testing.T) {
+	defer func(delay time.Duration) { watchRetryMin = delay }(watchRetryMin)
+	watchRetryMin = 10 * time.Millisecond
+	server := gobgptest.NewServer()
+	defer server.Close()
+	nextHop := &apipb.NextHopAttribute{NextHop: "192.0.2.254"}
+	server.Announce(gobgptest.NewPath("192.0.2.0/24", nextHop))
+	routeFilePath, done := runAgainst(t, server)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"192.0.2.0/24"}, routeFile(t, routeFilePath))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// The stream fails with these events still queued, so only the
+	// reconciliation after reopening it catches the withdrawal.
+	server.SetSendDelay(time.Hour)
+	server.Withdraw(gobgptest.NewPath("192.0.2.0/24"))
+	server.Announce(gobgptest.NewPath("198.51.100.0/24", nextHop))
+	watched := server.Watched()
+	server.Disconnect(status.Error(codes.Unavailable, "restarting"))
+	awaitWatch(t, watched, done)
+	server.SetSendDelay(0)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"198.51.100.0/24"}, routeFile(t, routeFilePath))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	server.Disconnect(nil)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after the server closed the stream")
+	}
+}
+
+// failingWatchClient fails every WatchEvent call.
+type failingWatchClient struct {
+	apipb.GobgpApiClient
+}
+
+func (failingWatchClient) WatchEvent(context.Context, *apipb.WatchEventRequest,
+	...grpc.CallOption) (apipb.GobgpApi_WatchEventClient, error) {
+	return nil, status.Error(codes.Unavailable, "connection refused")
+}
+
+func TestStartManagerFailsWithoutWatch(t *testing.T) {
+	server := gobgptest.NewServer()
+	defer server.Close()
+	conn, err := server.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	client := failingWatchClient{apipb.NewGobgpApiClient(conn)}
+	cf := config.Default()
+	cf.ReconcileInterval = 0
+	cf.Drift.Enabled = false
+	cf.Sinks = []config.Sink{{Name: "file", Type: config.SinkFile, Path: filepath.Join(t.TempDir(), "routes.json")}}
+	manager, err := routes.NewManager(cf)
+	require.NoError(t, err)
+	defer manager.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := startManager(ctx, client, manager, &cf)
+	assert.ErrorContains(t, err, "failed to watch paths")
+	assert.Nil(t, stream)
+}
+
+// embeddedConfig runs bgtables with an embedded GoBGP server that never
+// listens for peers.
+const embeddedConfig = `
+reconcile_interval: 0s
+embedded:
+  enabled: true
+  global:
+    asn: 65000
+    router_id: 192.0.2.1
+    listen_port: -1
+sinks:
+  - name: file
+    type: file
+    path: %s
+`
+
+func TestRunEmbedded(t *testing.T) {
+	dir := t.TempDir()
+	routeFilePath := filepath.Join(dir, "routes.json")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(embeddedConfig, routeFilePath)), 0o600))
+
+	cf, client, stop := setupConnection(configPath)
+	require.NotNil(t, cf)
+	done := make(chan error, 1)
+	go func() { done <- run(cf, client) }()
+
+	path := gobgptest.NewPath("198.51.100.0/24", &apipb.OriginAttribute{},
+		&apipb.NextHopAttribute{NextHop: "192.0.2.254"})
+	_, err := client.AddPath(context.Background(), &apipb.AddPathRequest{TableType: apipb.TableType_GLOBAL, Path: path})
+	require.NoError(t, err)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"198.51.100.0/24"}, routeFile(t, routeFilePath))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	stop()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after the embedded server stopped")
+	}
 }
@@ -3,14 +3,387 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"os"
+	"time"
 
+	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the configuration for the application.
 type Config struct {
-	GoBGPServer string `yaml:"gobgp_server"`
+	GoBGPServer       string        `yaml:"gobgp_server"`
+	MetricsAddress    string        `yaml:"metrics_address"`
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	Drift             Drift         `yaml:"drift"`
+	Programming       Programming   `yaml:"programming"`
+	Dampening         Dampening     `yaml:"dampening"`
+	Limits            Limits        `yaml:"limits"`
+	Filter            Filter        `yaml:"filter"`
+	Protection        Protection    `yaml:"protection"`
+	Policy            []PolicyRule  `yaml:"policy"`
+	RPKI              RPKI          `yaml:"rpki"`
+	Watch             Watch         `yaml:"watch"`
+	VRFs              []VRF         `yaml:"vrfs"`
+	Rules             []Rule        `yaml:"rules"`
+	Realms            []RealmRule   `yaml:"realms"`
+	// Tables holds the attributes of the routes of each routing table
+	// that policy actions leave unset.
+	Tables map[int]RouteAttributes `yaml:"tables"`
+	Sinks  []Sink                  `yaml:"sinks"`
+	// Namespaces lists the network namespaces routes and rules are
+	// programmed into, instead of the namespace of bgtables.
+	Namespaces []Namespace `yaml:"namespaces"`
+	// Embedded runs a GoBGP server inside bgtables instead of connecting
+	// to gobgp_server.
+	Embedded Embedded `yaml:"embedded"`
+}
+
+// Drift configures detection and repair of owned kernel routes that were
+// removed or overwritten outside of bgtables.
+type Drift struct {
+	Enabled        bool          `yaml:"enabled"`
+	RepairHoldDown time.Duration `yaml:"repair_holddown"`
+	AuditInterval  time.Duration `yaml:"audit_interval"`
+}
+
+// Programming configures the pipeline that writes routes into the kernel.
+type Programming struct {
+	Workers          int           `yaml:"workers"`
+	BatchSize        int           `yaml:"batch_size"`
+	ProgressInterval time.Duration `yaml:"progress_interval"`
+	CoalesceWindow   time.Duration `yaml:"coalesce_window"`
+}
+
+// Dampening configures RFC 2439 style flap dampening of prefixes before
+// they are installed in the kernel.
+type Dampening struct {
+	Enabled           bool          `yaml:"enabled"`
+	HalfLife          time.Duration `yaml:"half_life"`
+	SuppressThreshold float64       `yaml:"suppress_threshold"`
+	ReuseThreshold    float64       `yaml:"reuse_threshold"`
+	MaxSuppressTime   time.Duration `yaml:"max_suppress_time"`
+}
+
+// Actions taken when a route limit is exceeded.
+const (
+	// LimitActionStop keeps the installed routes but installs no new ones.
+	LimitActionStop = "stop"
+	// LimitActionDefaultOnly removes every route but the default route.
+	LimitActionDefaultOnly = "default-only"
+	// LimitActionFlush removes every owned route and installs nothing until
+	// the limits are reset manually.
+	LimitActionFlush = "flush"
+)
+
+// Limits configures the maximum number of routes bgtables installs per
+// address family and per routing table. A zero or missing limit is
+// unlimited.
+type Limits struct {
+	Action string      `yaml:"action"`
+	IPv4   int         `yaml:"ipv4"`
+	IPv6   int         `yaml:"ipv6"`
+	Tables map[int]int `yaml:"tables"`
+}
+
+// Actions of a prefix filter rule.
+const (
+	ActionPermit = "permit"
+	ActionDeny   = "deny"
+)
+
+// Filter configures which prefixes bgtables accepts from GoBGP,
+// independently of any GoBGP policy.
+type Filter struct {
+	// Bogons rejects martian and reserved address space.
+	Bogons bool        `yaml:"bogons"`
+	IPv4   LengthRange `yaml:"ipv4"`
+	IPv6   LengthRange `yaml:"ipv6"`
+	// Prefixes is evaluated in order; the first matching rule decides.
+	Prefixes []PrefixRule `yaml:"prefixes"`
+	// DefaultAction applies to prefixes no rule matches.
+	DefaultAction string `yaml:"default_action"`
+}
+
+// LengthRange bounds the accepted prefix lengths of an address family.
+// A zero MaxLength stands for the longest prefix of the family.
+type LengthRange struct {
+	MinLength int `yaml:"min_length"`
+	MaxLength int `yaml:"max_length"`
+}
+
+// PrefixRule matches the prefixes within Prefix whose length lies between
+// GE and LE. Without GE and LE only Prefix itself matches; with only GE the
+// range extends to the longest prefix of the family; with only LE it
+// starts at the length of Prefix.
+type PrefixRule struct {
+	Prefix string `yaml:"prefix"`
+	GE     int    `yaml:"ge"`
+	LE     int    `yaml:"le"`
+	Action string `yaml:"action"`
+}
+
+// Protection lists destinations bgtables must never redirect. Routes that
+// equal, cover or fall within a protected prefix are neither installed nor
+// removed.
+type Protection struct {
+	Prefixes []string `yaml:"prefixes"`
+	// GoBGPServer refuses the routes that would redirect the connection to
+	// gobgp_server: those covering its address at least as long as the
+	// route it is reached through.
+	GoBGPServer bool `yaml:"gobgp_server"`
+	// DefaultRoute protects the IPv4 and IPv6 default routes.
+	DefaultRoute bool `yaml:"default_route"`
+}
+
+// PolicyRule changes or rejects the routes whose path attributes match.
+// Rules are evaluated in order and the first matching rule applies.
+type PolicyRule struct {
+	Name   string       `yaml:"name"`
+	Match  PolicyMatch  `yaml:"match"`
+	Action PolicyAction `yaml:"action"`
+}
+
+// PolicyMatch lists the conditions of a policy rule. A path matches when it
+// meets every condition that is set, and a list condition is met by any of
+// its entries.
+type PolicyMatch struct {
+	Communities         []string `yaml:"communities"`
+	ExtendedCommunities []string `yaml:"extended_communities"`
+	LargeCommunities    []string `yaml:"large_communities"`
+	// ASPath is a regular expression matched against the AS path written
+	// as space separated AS numbers, for example "^65001 .* 65003$".
+	ASPath   string   `yaml:"as_path"`
+	OriginAS []uint32 `yaml:"origin_as"`
+	// NextHop and Peer hold addresses or prefixes.
+	NextHop []string `yaml:"next_hop"`
+	Peer    []string `yaml:"peer"`
+	PeerAS  []uint32 `yaml:"peer_as"`
+}
+
+// Route types a policy rule may set.
+const (
+	RouteTypeUnicast     = "unicast"
+	RouteTypeBlackhole   = "blackhole"
+	RouteTypeUnreachable = "unreachable"
+	RouteTypeProhibit    = "prohibit"
+)
+
+// PolicyAction is applied to the routes matched by a policy rule. Zero
+// values leave the route unchanged.
+type PolicyAction struct {
+	Reject          bool   `yaml:"reject"`
+	Table           int    `yaml:"table"`
+	Metric          int    `yaml:"metric"`
+	Type            string `yaml:"type"`
+	Realm           int    `yaml:"realm"`
+	RouteAttributes `yaml:",inline"`
+}
+
+// RouteAttributes are the metrics and preferred source address of kernel
+// routes, set by policy actions or for every route of a table. Zero values
+// leave the kernel defaults.
+type RouteAttributes struct {
+	MTU      int `yaml:"mtu"`
+	AdvMSS   int `yaml:"advmss"`
+	InitCwnd int `yaml:"initcwnd"`
+	InitRwnd int `yaml:"initrwnd"`
+	// PrefSrc is the preferred source address of the routes of its
+	// address family.
+	PrefSrc string `yaml:"prefsrc"`
+}
+
+// RealmRule assigns Realm to the routes of the paths matching Match, unless
+// a policy action set their realm already.
+type RealmRule struct {
+	Name  string      `yaml:"name"`
+	Match PolicyMatch `yaml:"match"`
+	Realm int         `yaml:"realm"`
+}
+
+// MaxAccountedRealm is the highest realm the kernel keeps traffic counters
+// for.
+const MaxAccountedRealm = 255
+
+// RPKI configures how the RPKI origin validation state GoBGP attaches to
+// paths affects installation.
+type RPKI struct {
+	Enabled bool `yaml:"enabled"`
+	// RejectInvalid refuses to install routes whose origin is invalid.
+	RejectInvalid bool `yaml:"reject_invalid"`
+	// NotFoundMetric is added to the metric of routes no ROA covers.
+	NotFoundMetric int `yaml:"not_found_metric"`
+	// PollInterval is how often the RPKI servers of GoBGP are polled. The
+	// validation state of every path is fetched from GoBGP, whose watch
+	// events do not carry it, when their ROAs changed.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// RevalidateInterval is how often the validation state of every path
+	// is fetched regardless, 0 for never. Paths first seen in watch events
+	// carry no state and are only refused once it is fetched.
+	RevalidateInterval time.Duration `yaml:"revalidate_interval"`
+}
+
+// Watch filter types, naming the GoBGP tables paths are taken from.
+const (
+	// WatchFilterBest takes the best paths of the global or VRF table.
+	WatchFilterBest = "best"
+	// WatchFilterAdjIn takes the paths received from peers, before import
+	// policy.
+	WatchFilterAdjIn = "adjin"
+	// WatchFilterPostPolicy takes the paths received from peers that pass
+	// import policy.
+	WatchFilterPostPolicy = "post_policy"
+)
+
+// TableGlobal names the GoBGP global table.
+const TableGlobal = "global"
+
+// Watch selects the slice of the GoBGP RIB bgtables consumes.
+type Watch struct {
+	Filter string `yaml:"filter"`
+	// Peers and PeerAS restrict the paths to those received from the
+	// listed peer addresses or AS numbers.
+	Peers  []string `yaml:"peers"`
+	PeerAS []uint32 `yaml:"peer_as"`
+	// Table is TableGlobal or the name of a GoBGP VRF. VRF tables only
+	// support the best filter.
+	Table string `yaml:"table"`
+}
+
+// VRF maps a GoBGP VRF to a Linux VRF. Its routes are installed in the
+// routing table of the Linux VRF, given by Table or read from Device. A
+// missing device is created when Table is set.
+type VRF struct {
+	Name   string `yaml:"name"`
+	Device string `yaml:"device"`
+	Table  int    `yaml:"table"`
+}
+
+// Rule derives an ip rule from the paths matching Match: traffic from the
+// prefix of a path looks up Table. Mark and Mask restrict the rule to
+// packets carrying a firewall mark; Mask defaults to all bits of Mark.
+type Rule struct {
+	Name     string      `yaml:"name"`
+	Match    PolicyMatch `yaml:"match"`
+	Priority int         `yaml:"priority"`
+	Table    int         `yaml:"table"`
+	Mark     uint32      `yaml:"mark"`
+	Mask     uint32      `yaml:"mask"`
+}
+
+// Priorities available to the ip rules of bgtables, between the rule of
+// the local table and those of the main and default tables.
+const (
+	MinRulePriority = 1
+	MaxRulePriority = 32765
+)
+
+// Sink types, naming the backends the routes of the RIB are programmed
+// into.
+const (
+	// SinkNetlink programs the kernel routing tables.
+	SinkNetlink = "netlink"
+	// SinkFile keeps the routes in a JSON file.
+	SinkFile = "file"
+)
+
+// Sink configures a consumer of the routes of the RIB. Every sink receives
+// the same routes. Path is the file of a file sink.
+type Sink struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+// Namespace selects a network namespace by the path of its nsfs file, such
+// as /run/netns/<name>, or by the PID of a process running in it. Tables
+// renumbers the routing tables of bgtables in the namespace; unmapped
+// tables keep their number.
+type Namespace struct {
+	Name   string      `yaml:"name"`
+	Path   string      `yaml:"path"`
+	PID    int         `yaml:"pid"`
+	Tables map[int]int `yaml:"tables"`
+}
+
+// Configuration file formats of the embedded GoBGP server.
+const (
+	EmbeddedConfigTOML = "toml"
+	EmbeddedConfigYAML = "yaml"
+	EmbeddedConfigJSON = "json"
+)
+
+// Embedded configures the GoBGP server bgtables runs in-process when
+// Enabled, either from the gobgpd configuration file ConfigFile, in
+// ConfigType format, or from Global and Neighbors. GRPCAddress optionally
+// serves the GoBGP API of the server, for the gobgp command.
+type Embedded struct {
+	Enabled     bool               `yaml:"enabled"`
+	ConfigFile  string             `yaml:"config_file"`
+	ConfigType  string             `yaml:"config_type"`
+	GRPCAddress string             `yaml:"grpc_address"`
+	Global      EmbeddedGlobal     `yaml:"global"`
+	Neighbors   []EmbeddedNeighbor `yaml:"neighbors"`
+}
+
+// EmbeddedGlobal is the global configuration of the embedded GoBGP
+// server. ListenPort defaults to 179; -1 disables listening for peers.
+type EmbeddedGlobal struct {
+	ASN             uint32   `yaml:"asn"`
+	RouterID        string   `yaml:"router_id"`
+	ListenPort      int32    `yaml:"listen_port"`
+	ListenAddresses []string `yaml:"listen_addresses"`
+}
+
+// EmbeddedNeighbor is a peer of the embedded GoBGP server. A passive
+// neighbor is never connected to, it has to connect.
+type EmbeddedNeighbor struct {
+	Address string `yaml:"address"`
+	PeerAS  uint32 `yaml:"peer_as"`
+	Passive bool   `yaml:"passive"`
+}
+
+// Default returns the configuration used for any setting the file omits.
+func Default() Config {
+	return Config{
+		ReconcileInterval: 10 * time.Minute,
+		Drift: Drift{
+			RepairHoldDown: 5 * time.Second,
+			AuditInterval:  5 * time.Minute,
+		},
+		Programming: Programming{
+			Workers:          4,
+			BatchSize:        256,
+			ProgressInterval: 10 * time.Second,
+			CoalesceWindow:   100 * time.Millisecond,
+		},
+		Dampening: Dampening{
+			HalfLife:          15 * time.Minute,
+			SuppressThreshold: 2000,
+			ReuseThreshold:    750,
+			MaxSuppressTime:   time.Hour,
+		},
+		Limits: Limits{
+			Action: LimitActionStop,
+		},
+		Filter: Filter{
+			DefaultAction: ActionPermit,
+		},
+		RPKI: RPKI{
+			RejectInvalid:      true,
+			PollInterval:       30 * time.Second,
+			RevalidateInterval: 10 * time.Minute,
+		},
+		Watch: Watch{
+			Filter: WatchFilterBest,
+			Table:  TableGlobal,
+		},
+		Sinks: []Sink{{Name: "kernel", Type: SinkNetlink}},
+		Embedded: Embedded{
+			ConfigType: EmbeddedConfigTOML,
+		},
+	}
 }
 
 // Load loads the configuration from the given file path.
@@ -21,11 +394,347 @@ func Load(path string) (*Config, error) {
 	}
 	defer file.Close()
 
-	var config Config
+	config := Default()
 	decoder := yaml.NewDecoder(file)
 	if err := decoder.Decode(&config); err != nil {
 		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
 
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+
 	return &config, nil
 }
+
+// Validate reports settings that cannot work together.
+func (c *Config) Validate() error {
+	validators := []func() error{
+		c.Dampening.validate, c.Limits.validate, c.Filter.validate, c.validatePolicy,
+		c.RPKI.validate, c.Watch.validate, c.validateVRFs, c.validateRules,
+		c.validateRealms, c.validateTables, c.validateSinks, c.validateNamespaces,
+		c.validateEmbedded,
+	}
+	for _, validate := range validators {
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) validatePolicy() error {
+	for i := range c.Policy {
+		if err := c.Policy[i].validate(); err != nil {
+			return fmt.Errorf("policy[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateRules() error {
+	for i := range c.Rules {
+		if err := c.Rules[i].validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (d *Dampening) validate() error {
+	switch {
+	case !d.Enabled:
+		return nil
+	case d.HalfLife <= 0:
+		return fmt.Errorf("dampening.half_life must be positive")
+	case d.ReuseThreshold <= 0 || d.ReuseThreshold >= d.SuppressThreshold:
+		return fmt.Errorf("dampening.reuse_threshold must be positive and below suppress_threshold")
+	}
+	return nil
+}
+
+func (l *Limits) validate() error {
+	switch l.Action {
+	case LimitActionStop, LimitActionDefaultOnly, LimitActionFlush:
+		return nil
+	}
+	return fmt.Errorf("limits.action must be %q, %q or %q", LimitActionStop, LimitActionDefaultOnly, LimitActionFlush)
+}
+
+func (f *Filter) validate() error {
+	if err := validateAction("filter.default_action", f.DefaultAction); err != nil {
+		return err
+	}
+	for i, rule := range f.Prefixes {
+		if err := validateAction(fmt.Sprintf("filter.prefixes[%d].action", i), rule.Action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAction(field, action string) error {
+	if action != ActionPermit && action != ActionDeny {
+		return fmt.Errorf("%s must be %q or %q", field, ActionPermit, ActionDeny)
+	}
+	return nil
+}
+
+func (r *PolicyRule) validate() error {
+	a := r.Action
+	switch a.Type {
+	case "", RouteTypeUnicast, RouteTypeBlackhole, RouteTypeUnreachable, RouteTypeProhibit:
+	default:
+		return fmt.Errorf("action.type must be %q, %q, %q or %q",
+			RouteTypeUnicast, RouteTypeBlackhole, RouteTypeUnreachable, RouteTypeProhibit)
+	}
+	switch {
+	case a.Table < 0 || a.Metric < 0:
+		return fmt.Errorf("action.table and action.metric must not be negative")
+	case a.Realm < 0 || a.Realm > 0xffff:
+		return fmt.Errorf("action.realm must be between 0 and 65535")
+	}
+	if err := a.RouteAttributes.validate(); err != nil {
+		return fmt.Errorf("action.%w", err)
+	}
+	return nil
+}
+
+func (a *RouteAttributes) validate() error {
+	if a.MTU < 0 || a.AdvMSS < 0 || a.InitCwnd < 0 || a.InitRwnd < 0 {
+		return fmt.Errorf("mtu, advmss, initcwnd and initrwnd must not be negative")
+	}
+	if _, err := a.Source(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Source parses PrefSrc. It returns the zero address when PrefSrc is
+// empty.
+func (a *RouteAttributes) Source() (netip.Addr, error) {
+	if a.PrefSrc == "" {
+		return netip.Addr{}, nil
+	}
+	addr, err := netip.ParseAddr(a.PrefSrc)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("prefsrc %q is not an IP address", a.PrefSrc)
+	}
+	return addr.Unmap(), nil
+}
+
+func (r *RPKI) validate() error {
+	switch {
+	case !r.Enabled:
+		return nil
+	case r.NotFoundMetric < 0:
+		return fmt.Errorf("rpki.not_found_metric must not be negative")
+	case r.PollInterval < 0:
+		return fmt.Errorf("rpki.poll_interval must not be negative")
+	case r.RevalidateInterval < 0:
+		return fmt.Errorf("rpki.revalidate_interval must not be negative")
+	}
+	return nil
+}
+
+func (w *Watch) validate() error {
+	switch w.Filter {
+	case WatchFilterBest, WatchFilterAdjIn, WatchFilterPostPolicy:
+	default:
+		return fmt.Errorf("watch.filter must be %q, %q or %q", WatchFilterBest, WatchFilterAdjIn, WatchFilterPostPolicy)
+	}
+	switch {
+	case w.Table == "":
+		return fmt.Errorf("watch.table must be %q or the name of a VRF", TableGlobal)
+	case w.Table != TableGlobal && w.Filter != WatchFilterBest:
+		return fmt.Errorf("watch.filter must be %q for VRF tables", WatchFilterBest)
+	}
+	return nil
+}
+
+func (c *Config) validateVRFs() error {
+	if len(c.VRFs) > 0 && c.Watch.Table != TableGlobal {
+		return fmt.Errorf("watch.table must be %q when vrfs are configured", TableGlobal)
+	}
+	names := make(map[string]bool, len(c.VRFs))
+	tables := make(map[int]bool, len(c.VRFs))
+	for i, vrf := range c.VRFs {
+		if err := vrf.validate(); err != nil {
+			return fmt.Errorf("vrfs[%d]: %w", i, err)
+		}
+		if names[vrf.Name] || tables[vrf.Table] {
+			return fmt.Errorf("vrfs[%d]: VRF %q or table %d is mapped twice", i, vrf.Name, vrf.Table)
+		}
+		names[vrf.Name] = true
+		tables[vrf.Table] = vrf.Table != 0
+	}
+	return nil
+}
+
+func (v *VRF) validate() error {
+	switch {
+	case v.Name == "":
+		return fmt.Errorf("name must be set")
+	case v.Device == "" && v.Table == 0:
+		return fmt.Errorf("device or table must be set")
+	case v.Table < 0:
+		return fmt.Errorf("table must not be negative")
+	case v.Table >= unix.RT_TABLE_DEFAULT && v.Table <= unix.RT_TABLE_LOCAL:
+		return fmt.Errorf("table %d is reserved", v.Table)
+	}
+	return nil
+}
+
+func (c *Config) validateRealms() error {
+	for i, rule := range c.Realms {
+		if rule.Realm < 1 || rule.Realm > MaxAccountedRealm {
+			return fmt.Errorf("realms[%d]: realm must be between 1 and %d", i, MaxAccountedRealm)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateTables() error {
+	for table, attrs := range c.Tables {
+		if table <= 0 {
+			return fmt.Errorf("tables: table %d must be positive", table)
+		}
+		if err := attrs.validate(); err != nil {
+			return fmt.Errorf("tables[%d]: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// validateSinks requires at least one sink, and the netlink sink, which
+// follows the kernel notifications, to come first.
+func (c *Config) validateSinks() error {
+	if len(c.Sinks) == 0 {
+		return fmt.Errorf("sinks must not be empty")
+	}
+	names := make(map[string]bool, len(c.Sinks))
+	for i := range c.Sinks {
+		if err := c.validateSink(i, names); err != nil {
+			return fmt.Errorf("sinks[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateSink(i int, names map[string]bool) error {
+	sink := c.Sinks[i]
+	switch {
+	case names[sink.Name]:
+		return fmt.Errorf("sink %q is configured twice", sink.Name)
+	case i > 0 && sink.Type == SinkNetlink:
+		return fmt.Errorf("the %q sink must be the first one", SinkNetlink)
+	}
+	names[sink.Name] = true
+	return sink.validate()
+}
+
+func (s *Sink) validate() error {
+	switch {
+	case s.Name == "":
+		return fmt.Errorf("name must be set")
+	case s.Type == SinkFile && s.Path == "":
+		return fmt.Errorf("path must be set for %q sinks", SinkFile)
+	case s.Type != SinkNetlink && s.Type != SinkFile:
+		return fmt.Errorf("type must be %q or %q", SinkNetlink, SinkFile)
+	}
+	return nil
+}
+
+func (c *Config) validateNamespaces() error {
+	names := make(map[string]bool, len(c.Namespaces))
+	for i, ns := range c.Namespaces {
+		if names[ns.Name] {
+			return fmt.Errorf("namespaces[%d]: namespace %q is configured twice", i, ns.Name)
+		}
+		names[ns.Name] = true
+		if err := ns.validate(); err != nil {
+			return fmt.Errorf("namespaces[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (n *Namespace) validate() error {
+	switch {
+	case n.Name == "":
+		return fmt.Errorf("name must be set")
+	case (n.Path == "") == (n.PID == 0):
+		return fmt.Errorf("exactly one of path and pid must be set")
+	case n.PID < 0:
+		return fmt.Errorf("pid must be positive")
+	}
+	return n.validateTables()
+}
+
+// validateTables requires a one-to-one mapping, so that the routes of two
+// tables never end up in one.
+func (n *Namespace) validateTables() error {
+	targets := make(map[int]bool, len(n.Tables))
+	for from, to := range n.Tables {
+		if from <= 0 || to <= 0 {
+			return fmt.Errorf("tables: %d: %d must map positive tables", from, to)
+		}
+		if targets[to] {
+			return fmt.Errorf("tables: table %d is mapped twice", to)
+		}
+		targets[to] = true
+	}
+	return nil
+}
+
+// validateEmbedded requires the embedded server to be configured by
+// either a gobgpd configuration file or the global settings, and to
+// replace gobgp_server.
+func (c *Config) validateEmbedded() error {
+	e := &c.Embedded
+	if !e.Enabled {
+		return nil
+	}
+	if c.GoBGPServer != "" {
+		return fmt.Errorf("gobgp_server must not be set with embedded.enabled")
+	}
+	if e.ConfigFile == "" {
+		return e.validateGlobal()
+	}
+	switch {
+	case e.Global.ASN != 0 || len(e.Neighbors) > 0:
+		return fmt.Errorf("embedded: global and neighbors must not be set with config_file")
+	case e.ConfigType != EmbeddedConfigTOML && e.ConfigType != EmbeddedConfigYAML && e.ConfigType != EmbeddedConfigJSON:
+		return fmt.Errorf("embedded.config_type must be %q, %q or %q",
+			EmbeddedConfigTOML, EmbeddedConfigYAML, EmbeddedConfigJSON)
+	}
+	return nil
+}
+
+func (e *Embedded) validateGlobal() error {
+	if e.Global.ASN == 0 {
+		return fmt.Errorf("embedded.global.asn must be set without config_file")
+	}
+	if addr, err := netip.ParseAddr(e.Global.RouterID); err != nil || !addr.Is4() {
+		return fmt.Errorf("embedded.global.router_id must be an IPv4 address")
+	}
+	for i, n := range e.Neighbors {
+		if _, err := netip.ParseAddr(n.Address); err != nil {
+			return fmt.Errorf("embedded.neighbors[%d]: invalid address: %w", i, err)
+		}
+		if n.PeerAS == 0 {
+			return fmt.Errorf("embedded.neighbors[%d]: peer_as must be set", i)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) validate() error {
+	switch {
+	case r.Priority < MinRulePriority || r.Priority > MaxRulePriority:
+		return fmt.Errorf("priority must be between %d and %d", MinRulePriority, MaxRulePriority)
+	case r.Table <= 0:
+		return fmt.Errorf("table must be positive")
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -72,3 +74,471 @@ func TestLoadNonExistentFile(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to open config file")
 }
+
+func TestLoadReconcileInterval(t *testing.T) {
+	config, err := Load(writeConfig(t, `gobgp_server: "localhost:50051"`))
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, config.ReconcileInterval)
+
+	config, err = Load(writeConfig(t, `reconcile_interval: 30s`))
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, config.ReconcileInterval)
+}
+
+func TestLoadDrift(t *testing.T) {
+	tests := []struct {
+		name       string
+		configYAML string
+		expected   Drift
+	}{
+		{
+			name:       "Defaults",
+			configYAML: `gobgp_server: "localhost:50051"`,
+			expected:   Drift{RepairHoldDown: 5 * time.Second, AuditInterval: 5 * time.Minute},
+		},
+		{
+			name: "Overrides",
+			configYAML: `
+drift:
+  enabled: true
+  repair_holddown: 30s
+  audit_interval: 1h
+`,
+			expected: Drift{
+				Enabled:        true,
+				RepairHoldDown: 30 * time.Second,
+				AuditInterval:  time.Hour,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := Load(writeConfig(t, tt.configYAML))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, config.Drift)
+		})
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProgramming(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+programming:
+  workers: 8
+  batch_size: 1024
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Programming{
+		Workers:          8,
+		BatchSize:        1024,
+		ProgressInterval: Default().Programming.ProgressInterval,
+		CoalesceWindow:   Default().Programming.CoalesceWindow,
+	}, config.Programming)
+}
+
+func TestLoadDampening(t *testing.T) {
+	tests := []struct {
+		name        string
+		configYAML  string
+		expectError bool
+	}{
+		{
+			name:       "Disabled by default",
+			configYAML: `gobgp_server: "localhost:50051"`,
+		},
+		{
+			name: "Enabled",
+			configYAML: `
+dampening:
+  enabled: true
+  half_life: 5m
+`,
+		},
+		{
+			name: "Reuse above suppress",
+			configYAML: `
+dampening:
+  enabled: true
+  suppress_threshold: 500
+  reuse_threshold: 750
+`,
+			expectError: true,
+		},
+		{
+			name: "Zero half-life",
+			configYAML: `
+dampening:
+  enabled: true
+  half_life: 0s
+`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.configYAML))
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+limits:
+  action: flush
+  ipv4: 10000
+  tables:
+    100: 500
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Limits{
+		Action: LimitActionFlush,
+		IPv4:   10000,
+		Tables: map[int]int{100: 500},
+	}, config.Limits)
+
+	_, err = Load(writeConfig(t, `
+limits:
+  action: panic
+`))
+	assert.Error(t, err)
+}
+
+func TestLoadFilter(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+filter:
+  bogons: true
+  ipv4:
+    max_length: 24
+  prefixes:
+    - prefix: 10.0.0.0/8
+      le: 32
+      action: deny
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Filter{
+		Bogons:        true,
+		IPv4:          LengthRange{MaxLength: 24},
+		Prefixes:      []PrefixRule{{Prefix: "10.0.0.0/8", LE: 32, Action: ActionDeny}},
+		DefaultAction: ActionPermit,
+	}, config.Filter)
+
+	_, err = Load(writeConfig(t, `
+filter:
+  prefixes:
+    - prefix: 10.0.0.0/8
+`))
+	assert.Error(t, err)
+}
+
+func TestLoadProtection(t *testing.T) {
+	config, err := Load(writeConfig(t, `gobgp_server: "localhost:50051"`))
+	assert.NoError(t, err)
+	assert.Equal(t, Protection{}, config.Protection)
+
+	config, err = Load(writeConfig(t, `
+protection:
+  prefixes: [192.0.2.0/24, "2001:db8::/64"]
+  default_route: true
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Protection{
+		Prefixes:     []string{"192.0.2.0/24", "2001:db8::/64"},
+		DefaultRoute: true,
+	}, config.Protection)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+policy:
+  - name: blackhole
+    match:
+      communities: ["65535:666"]
+      as_path: "^65001 "
+      peer: [192.0.2.1]
+    action:
+      type: blackhole
+      table: 100
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []PolicyRule{{
+		Name: "blackhole",
+		Match: PolicyMatch{
+			Communities: []string{"65535:666"},
+			ASPath:      "^65001 ",
+			Peer:        []string{"192.0.2.1"},
+		},
+		Action: PolicyAction{Type: RouteTypeBlackhole, Table: 100},
+	}}, config.Policy)
+
+	for _, action := range []string{"type: local", "realm: 70000", "metric: -1"} {
+		_, err = Load(writeConfig(t, "policy:\n  - action:\n      "+action+"\n"))
+		assert.Error(t, err, action)
+	}
+}
+
+func TestLoadRPKI(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+rpki:
+  enabled: true
+  not_found_metric: 500
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, RPKI{
+		Enabled:            true,
+		RejectInvalid:      true,
+		NotFoundMetric:     500,
+		PollInterval:       30 * time.Second,
+		RevalidateInterval: 10 * time.Minute,
+	}, config.RPKI)
+
+	for _, rpki := range []string{"not_found_metric: -1", "poll_interval: -1s", "revalidate_interval: -1s"} {
+		_, err = Load(writeConfig(t, "rpki:\n  enabled: true\n  "+rpki+"\n"))
+		assert.Error(t, err, rpki)
+	}
+}
+
+func TestLoadWatch(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+watch:
+  filter: post_policy
+  peers: [192.0.2.1, "2001:db8::1"]
+  peer_as: [65001]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Watch{
+		Filter: WatchFilterPostPolicy,
+		Peers:  []string{"192.0.2.1", "2001:db8::1"},
+		PeerAS: []uint32{65001},
+		Table:  TableGlobal,
+	}, config.Watch)
+
+	config, err = Load(writeConfig(t, "watch:\n  table: blue\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, Watch{Filter: WatchFilterBest, Table: "blue"}, config.Watch)
+
+	for _, watch := range []string{"{filter: all}", "{table: ''}", "{filter: adjin, table: blue}"} {
+		_, err = Load(writeConfig(t, "watch: "+watch+"\n"))
+		assert.Error(t, err, watch)
+	}
+}
+
+func TestLoadVRFs(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+vrfs:
+  - name: blue
+    device: vrf-blue
+  - name: red
+    device: vrf-red
+    table: 200
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []VRF{{Name: "blue", Device: "vrf-blue"}, {Name: "red", Device: "vrf-red", Table: 200}}, config.VRFs)
+
+	for _, vrfs := range []string{
+		"[{device: vrf-blue}]",
+		"[{name: blue}]",
+		"[{name: blue, table: 254}]",
+		"[{name: blue, table: 100}, {name: blue, table: 101}]",
+		"[{name: blue, table: 100}, {name: red, table: 100}]",
+	} {
+		_, err = Load(writeConfig(t, "vrfs: "+vrfs+"\n"))
+		assert.Error(t, err, vrfs)
+	}
+
+	_, err = Load(writeConfig(t, "watch: {table: blue}\nvrfs: [{name: red, table: 100}]\n"))
+	assert.Error(t, err)
+}
+
+func TestLoadRules(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+rules:
+  - name: upstream-a
+    match:
+      communities: ["65000:100"]
+    priority: 1000
+    table: 100
+    mark: 0x10
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Rule{{
+		Name:     "upstream-a",
+		Match:    PolicyMatch{Communities: []string{"65000:100"}},
+		Priority: 1000,
+		Table:    100,
+		Mark:     0x10,
+	}}, config.Rules)
+
+	for _, rules := range []string{"[{priority: 1000}]", "[{table: 100}]", "[{priority: 32766, table: 100}]"} {
+		_, err = Load(writeConfig(t, "rules: "+rules+"\n"))
+		assert.Error(t, err, rules)
+	}
+}
+
+func TestLoadRealms(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+realms:
+  - name: upstream-a
+    match:
+      communities: ["65000:1"]
+    realm: 10
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []RealmRule{{
+		Name:  "upstream-a",
+		Match: PolicyMatch{Communities: []string{"65000:1"}},
+		Realm: 10,
+	}}, config.Realms)
+
+	for _, realms := range []string{"[{name: none}]", "[{realm: 256}]"} {
+		_, err = Load(writeConfig(t, "realms: "+realms+"\n"))
+		assert.Error(t, err, realms)
+	}
+}
+
+func TestLoadRouteAttributes(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+tables:
+  100:
+    mtu: 1400
+    prefsrc: 192.0.2.1
+policy:
+  - name: clamp
+    action:
+      advmss: 1360
+      initcwnd: 10
+      initrwnd: 20
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]RouteAttributes{100: {MTU: 1400, PrefSrc: "192.0.2.1"}}, config.Tables)
+	assert.Equal(t, RouteAttributes{AdvMSS: 1360, InitCwnd: 10, InitRwnd: 20}, config.Policy[0].Action.RouteAttributes)
+
+	for _, bad := range []string{
+		"tables: {0: {mtu: 1400}}",
+		"tables: {100: {mtu: -1}}",
+		"tables: {100: {prefsrc: host}}",
+		"policy: [{action: {initcwnd: -1}}]",
+		"policy: [{action: {prefsrc: 'fe80::1%eth0'}}]",
+	} {
+		_, err = Load(writeConfig(t, bad+"\n"))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLoadSinks(t *testing.T) {
+	config, err := Load(writeConfig(t, `gobgp_server: "localhost:50051"`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Sink{{Name: "kernel", Type: SinkNetlink}}, config.Sinks)
+
+	config, err = Load(writeConfig(t, `
+sinks:
+  - name: kernel
+    type: netlink
+  - name: export
+    type: file
+    path: /run/bgtables/routes.json
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Sink{
+		{Name: "kernel", Type: SinkNetlink},
+		{Name: "export", Type: SinkFile, Path: "/run/bgtables/routes.json"},
+	}, config.Sinks)
+
+	for _, sinks := range []string{
+		"[]",
+		"[{type: netlink}]",
+		"[{name: export, type: file}]",
+		"[{name: kernel, type: bgp}]",
+		"[{name: kernel, type: netlink}, {name: kernel, type: file, path: routes.json}]",
+		"[{name: export, type: file, path: routes.json}, {name: kernel, type: netlink}]",
+	} {
+		_, err = Load(writeConfig(t, "sinks: "+sinks+"\n"))
+		assert.Error(t, err, sinks)
+	}
+}
+
+func TestLoadNamespaces(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+namespaces:
+  - name: host
+    pid: 1
+  - name: edge
+    path: /run/netns/edge
+    tables:
+      254: 100
+      100: 254
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Namespace{
+		{Name: "host", PID: 1},
+		{Name: "edge", Path: "/run/netns/edge", Tables: map[int]int{254: 100, 100: 254}},
+	}, config.Namespaces)
+
+	for _, namespaces := range []string{
+		"[{path: /run/netns/edge}]",
+		"[{name: edge}]",
+		"[{name: edge, path: /run/netns/edge, pid: 1}]",
+		"[{name: edge, pid: -1}]",
+		"[{name: edge, pid: 1}, {name: edge, pid: 2}]",
+		"[{name: edge, pid: 1, tables: {0: 100}}]",
+		"[{name: edge, pid: 1, tables: {100: 200, 101: 200}}]",
+	} {
+		_, err = Load(writeConfig(t, "namespaces: "+namespaces+"\n"))
+		assert.Error(t, err, namespaces)
+	}
+}
+
+func TestLoadEmbedded(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+embedded:
+  enabled: true
+  global:
+    asn: 65000
+    router_id: 192.0.2.1
+    listen_port: -1
+  neighbors:
+    - address: 192.0.2.2
+      peer_as: 65001
+      passive: true
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Embedded{
+		Enabled:    true,
+		ConfigType: EmbeddedConfigTOML,
+		Global:     EmbeddedGlobal{ASN: 65000, RouterID: "192.0.2.1", ListenPort: -1},
+		Neighbors:  []EmbeddedNeighbor{{Address: "192.0.2.2", PeerAS: 65001, Passive: true}},
+	}, config.Embedded)
+
+	config, err = Load(writeConfig(t, "embedded: {enabled: true, config_file: gobgpd.yaml, config_type: yaml}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "gobgpd.yaml", config.Embedded.ConfigFile)
+
+	for _, embedded := range []string{
+		"{enabled: true}",
+		"{enabled: true, global: {asn: 65000}}",
+		"{enabled: true, global: {asn: 65000, router_id: '2001:db8::1'}}",
+		"{enabled: true, global: {asn: 65000, router_id: 192.0.2.1}, neighbors: [{address: 192.0.2.2}]}",
+		"{enabled: true, global: {asn: 65000, router_id: 192.0.2.1}, neighbors: [{address: peer, peer_as: 1}]}",
+		"{enabled: true, config_file: gobgpd.conf, config_type: ini}",
+		"{enabled: true, config_file: gobgpd.conf, global: {asn: 65000}}",
+	} {
+		_, err = Load(writeConfig(t, "embedded: "+embedded+"\n"))
+		assert.Error(t, err, embedded)
+	}
+	_, err = Load(writeConfig(t, "gobgp_server: localhost:50051\nembedded: {enabled: true, config_file: gobgpd.conf}\n"))
+	assert.Error(t, err, "gobgp_server and the embedded server exclude each other")
+}
@@ -0,0 +1,135 @@
+package embedded
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// errStopped fails the watches started after the server stopped.
+var errStopped = errors.New("embedded GoBGP server stopped")
+
+// client calls the API of a GoBGP server in-process. It implements the
+// calls of bgtables; the others fail with codes.Unimplemented.
+type client struct {
+	apipb.GobgpApiClient
+	bgp *server.BgpServer
+
+	mu      sync.Mutex
+	watches map[*stream[*apipb.WatchEventResponse]]bool
+	stopped bool
+}
+
+func newClient(bgp *server.BgpServer) *client {
+	return &client{
+		GobgpApiClient: apipb.NewGobgpApiClient(unimplementedConn{}),
+		bgp:            bgp,
+		watches:        make(map[*stream[*apipb.WatchEventResponse]]bool),
+	}
+}
+
+func (c *client) ListPath(ctx context.Context, in *apipb.ListPathRequest,
+	_ ...grpc.CallOption) (apipb.GobgpApi_ListPathClient, error) {
+	return list(ctx, func(ctx context.Context, send func(*apipb.ListPathResponse)) error {
+		return c.bgp.ListPath(ctx, in, func(d *apipb.Destination) {
+			send(&apipb.ListPathResponse{Destination: d})
+		})
+	}), nil
+}
+
+func (c *client) ListPeer(ctx context.Context, in *apipb.ListPeerRequest,
+	_ ...grpc.CallOption) (apipb.GobgpApi_ListPeerClient, error) {
+	return list(ctx, func(ctx context.Context, send func(*apipb.ListPeerResponse)) error {
+		return c.bgp.ListPeer(ctx, in, func(p *apipb.Peer) {
+			send(&apipb.ListPeerResponse{Peer: p})
+		})
+	}), nil
+}
+
+func (c *client) ListVrf(ctx context.Context, in *apipb.ListVrfRequest,
+	_ ...grpc.CallOption) (apipb.GobgpApi_ListVrfClient, error) {
+	return list(ctx, func(ctx context.Context, send func(*apipb.ListVrfResponse)) error {
+		return c.bgp.ListVrf(ctx, in, func(v *apipb.Vrf) {
+			send(&apipb.ListVrfResponse{Vrf: v})
+		})
+	}), nil
+}
+
+func (c *client) AddPath(ctx context.Context, in *apipb.AddPathRequest,
+	_ ...grpc.CallOption) (*apipb.AddPathResponse, error) {
+	return c.bgp.AddPath(ctx, in)
+}
+
+// WatchEvent streams the events of in until ctx is done or the server
+// stops.
+func (c *client) WatchEvent(ctx context.Context, in *apipb.WatchEventRequest,
+	_ ...grpc.CallOption) (apipb.GobgpApi_WatchEventClient, error) {
+	s := newStream[*apipb.WatchEventResponse](ctx)
+	if !c.track(s) {
+		return nil, errStopped
+	}
+	if err := c.bgp.WatchEvent(s.ctx, in, s.send); err != nil {
+		c.untrack(s)
+		s.finish(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *client) track(s *stream[*apipb.WatchEventResponse]) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return false
+	}
+	c.watches[s] = true
+	go func() {
+		<-s.done
+		c.untrack(s)
+	}()
+	return true
+}
+
+func (c *client) untrack(s *stream[*apipb.WatchEventResponse]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.watches, s)
+}
+
+// stop ends every watch with io.EOF, as a server closing its streams.
+func (c *client) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	for s := range c.watches {
+		s.finish(nil)
+	}
+}
+
+// list streams the results of call, which sends them from a goroutine.
+func list[T proto.Message](ctx context.Context, call func(context.Context, func(T)) error) *stream[T] {
+	s := newStream[T](ctx)
+	go func() {
+		s.finish(call(s.ctx, s.send))
+	}()
+	return s
+}
+
+// unimplementedConn fails the calls the client does not implement.
+type unimplementedConn struct{}
+
+func (unimplementedConn) Invoke(_ context.Context, method string, _, _ any, _ ...grpc.CallOption) error {
+	return status.Errorf(codes.Unimplemented, "%s is not available in-process", method)
+}
+
+func (unimplementedConn) NewStream(_ context.Context, _ *grpc.StreamDesc, method string,
+	_ ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, status.Errorf(codes.Unimplemented, "%s is not available in-process", method)
+}
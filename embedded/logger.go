@@ -0,0 +1,61 @@
+package embedded
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	gobgplog "github.com/osrg/gobgp/v3/pkg/log"
+)
+
+// logger writes the logs of GoBGP to the standard logger, like the rest of
+// bgtables.
+type logger struct {
+	level atomic.Uint32
+}
+
+func newLogger() *logger {
+	l := &logger{}
+	l.SetLevel(gobgplog.InfoLevel)
+	return l
+}
+
+func (l *logger) Panic(msg string, fields gobgplog.Fields) {
+	l.log(gobgplog.PanicLevel, msg, fields)
+	panic(msg)
+}
+
+func (l *logger) Fatal(msg string, fields gobgplog.Fields) {
+	log.Fatalf("GoBGP: %s%s", msg, formatFields(fields))
+}
+
+func (l *logger) Error(msg string, fields gobgplog.Fields) { l.log(gobgplog.ErrorLevel, msg, fields) }
+func (l *logger) Warn(msg string, fields gobgplog.Fields)  { l.log(gobgplog.WarnLevel, msg, fields) }
+func (l *logger) Info(msg string, fields gobgplog.Fields)  { l.log(gobgplog.InfoLevel, msg, fields) }
+func (l *logger) Debug(msg string, fields gobgplog.Fields) { l.log(gobgplog.DebugLevel, msg, fields) }
+
+func (l *logger) SetLevel(level gobgplog.LogLevel) { l.level.Store(uint32(level)) }
+func (l *logger) GetLevel() gobgplog.LogLevel      { return gobgplog.LogLevel(l.level.Load()) }
+
+func (l *logger) log(level gobgplog.LogLevel, msg string, fields gobgplog.Fields) {
+	if level <= l.GetLevel() {
+		log.Printf("GoBGP: %s%s", msg, formatFields(fields))
+	}
+}
+
+// formatFields returns fields as " key=value" pairs sorted by key.
+func formatFields(fields gobgplog.Fields) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, fields[key])
+	}
+	return b.String()
+}
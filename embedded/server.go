@@ -0,0 +1,86 @@
+// Package embedded runs a GoBGP server inside bgtables and serves its API
+// without gRPC.
+package embedded
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	gobgpconfig "github.com/osrg/gobgp/v3/pkg/config"
+	"github.com/osrg/gobgp/v3/pkg/server"
+)
+
+// Server is a GoBGP server running in-process.
+type Server struct {
+	bgp    *server.BgpServer
+	client *client
+}
+
+// Start starts a GoBGP server configured by cfg. Like gobgpd, the process
+// exits when GoBGP fails fatally, such as when GRPCAddress cannot be
+// listened on.
+func Start(ctx context.Context, cfg config.Embedded) (*Server, error) {
+	opts := []server.ServerOption{server.LoggerOption(newLogger())}
+	if cfg.GRPCAddress != "" {
+		opts = append(opts, server.GrpcListenAddress(cfg.GRPCAddress))
+	}
+	bgp := server.NewBgpServer(opts...)
+	go bgp.Serve()
+
+	if err := configure(ctx, bgp, cfg); err != nil {
+		bgp.Stop()
+		return nil, err
+	}
+	return &Server{bgp: bgp, client: newClient(bgp)}, nil
+}
+
+// configure starts BGP from the gobgpd configuration file of cfg, or from
+// its global settings and neighbors.
+func configure(ctx context.Context, bgp *server.BgpServer, cfg config.Embedded) error {
+	if cfg.ConfigFile != "" {
+		set, err := gobgpconfig.ReadConfigFile(cfg.ConfigFile, cfg.ConfigType)
+		if err != nil {
+			return fmt.Errorf("failed to read GoBGP config file: %w", err)
+		}
+		_, err = gobgpconfig.InitialConfig(ctx, bgp, set, false)
+		return err
+	}
+
+	global := &apipb.Global{
+		Asn:             cfg.Global.ASN,
+		RouterId:        cfg.Global.RouterID,
+		ListenPort:      cfg.Global.ListenPort,
+		ListenAddresses: cfg.Global.ListenAddresses,
+	}
+	if err := bgp.StartBgp(ctx, &apipb.StartBgpRequest{Global: global}); err != nil {
+		return fmt.Errorf("failed to start BGP: %w", err)
+	}
+	for _, n := range cfg.Neighbors {
+		if err := bgp.AddPeer(ctx, &apipb.AddPeerRequest{Peer: newPeer(n)}); err != nil {
+			return fmt.Errorf("failed to add neighbor %s: %w", n.Address, err)
+		}
+	}
+	return nil
+}
+
+func newPeer(n config.EmbeddedNeighbor) *apipb.Peer {
+	return &apipb.Peer{
+		Conf:      &apipb.PeerConf{NeighborAddress: n.Address, PeerAsn: n.PeerAS},
+		Transport: &apipb.Transport{PassiveMode: n.Passive},
+	}
+}
+
+// Client returns a client of the API of the server, calling it directly.
+// Calls bgtables does not make fail with codes.Unimplemented.
+func (s *Server) Client() apipb.GobgpApiClient {
+	return s.client
+}
+
+// Stop ends the watch streams of the client with io.EOF and stops the
+// server.
+func (s *Server) Stop() {
+	s.client.stop()
+	s.bgp.Stop()
+}
@@ -0,0 +1,113 @@
+package embedded
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/internal/gobgptest"
+	apipb "github.com/osrg/gobgp/v3/api"
+	gobgplog "github.com/osrg/gobgp/v3/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ipv4Unicast = &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST}
+
+// testConfig configures a server that never listens for peers.
+var testConfig = config.Embedded{
+	Enabled:   true,
+	Global:    config.EmbeddedGlobal{ASN: 65000, RouterID: "192.0.2.1", ListenPort: -1},
+	Neighbors: []config.EmbeddedNeighbor{{Address: "192.0.2.2", PeerAS: 65001, Passive: true}},
+}
+
+func startServer(t *testing.T, cfg config.Embedded) *Server {
+	t.Helper()
+	s, err := Start(context.Background(), cfg)
+	require.NoError(t, err)
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func listPeers(t *testing.T, client apipb.GobgpApiClient) []string {
+	t.Helper()
+	stream, err := client.ListPeer(context.Background(), &apipb.ListPeerRequest{})
+	require.NoError(t, err)
+	var peers []string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return peers
+		}
+		require.NoError(t, err)
+		peers = append(peers, resp.Peer.Conf.NeighborAddress)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := startServer(t, testConfig)
+	client := s.Client()
+	ctx := context.Background()
+	assert.Equal(t, []string{"192.0.2.2"}, listPeers(t, client))
+
+	path := gobgptest.NewPath("198.51.100.0/24", &apipb.OriginAttribute{},
+		&apipb.NextHopAttribute{NextHop: "192.0.2.254"})
+	_, err := client.AddPath(ctx, &apipb.AddPathRequest{TableType: apipb.TableType_GLOBAL, Path: path})
+	require.NoError(t, err)
+
+	paths, err := client.ListPath(ctx, &apipb.ListPathRequest{TableType: apipb.TableType_GLOBAL, Family: ipv4Unicast})
+	require.NoError(t, err)
+	resp, err := paths.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.0/24", resp.Destination.Prefix)
+	_, err = paths.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	watch, err := client.WatchEvent(ctx, &apipb.WatchEventRequest{Table: &apipb.WatchEventRequest_Table{
+		Filters: []*apipb.WatchEventRequest_Table_Filter{{Type: apipb.WatchEventRequest_Table_Filter_BEST, Init: true}},
+	}})
+	require.NoError(t, err)
+	event, err := watch.Recv()
+	require.NoError(t, err)
+	require.Len(t, event.GetTable().GetPaths(), 1, "the watch starts with the best paths")
+
+	_, err = client.GetBgp(ctx, &apipb.GetBgpRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	s.Stop()
+	_, err = watch.Recv()
+	assert.Equal(t, io.EOF, err, "stopping the server closes the watches")
+	_, err = client.WatchEvent(ctx, &apipb.WatchEventRequest{Peer: &apipb.WatchEventRequest_Peer{}})
+	assert.ErrorIs(t, err, errStopped)
+}
+
+func TestServerConfigFile(t *testing.T) {
+	s := startServer(t, config.Embedded{Enabled: true, ConfigFile: "testdata/gobgpd.toml", ConfigType: "toml"})
+	assert.Equal(t, []string{"192.0.2.3"}, listPeers(t, s.Client()))
+
+	_, err := Start(context.Background(), config.Embedded{Enabled: true, ConfigFile: "testdata/missing.toml"})
+	assert.Error(t, err)
+}
+
+func TestWatchCanceled(t *testing.T) {
+	s := startServer(t, testConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	watch, err := s.Client().WatchEvent(ctx, &apipb.WatchEventRequest{Peer: &apipb.WatchEventRequest_Peer{}})
+	require.NoError(t, err)
+
+	cancel()
+	for {
+		if _, err = watch.Recv(); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+func TestFormatFields(t *testing.T) {
+	assert.Equal(t, " Key=192.0.2.2 Topic=Peer", formatFields(gobgplog.Fields{"Topic": "Peer", "Key": "192.0.2.2"}))
+	assert.Empty(t, formatFields(nil))
+}
@@ -0,0 +1,86 @@
+package embedded
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// stream is a server stream of the client, fed by GoBGP through send.
+// Messages are handed over unbuffered, so a slow reader holds GoBGP back
+// instead of losing events.
+type stream[T proto.Message] struct {
+	// parent is the context of the call, ctx the one of GoBGP, canceled
+	// when the stream ends.
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	msgs chan T
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newStream[T proto.Message](parent context.Context) *stream[T] {
+	ctx, cancel := context.WithCancel(parent)
+	return &stream[T]{
+		parent: parent,
+		ctx:    ctx,
+		cancel: cancel,
+		msgs:   make(chan T),
+		done:   make(chan struct{}),
+	}
+}
+
+// send delivers msg to Recv, or drops it once the stream ended.
+func (s *stream[T]) send(msg T) {
+	select {
+	case s.msgs <- msg:
+	case <-s.done:
+	case <-s.ctx.Done():
+	}
+}
+
+// finish ends the stream with err, or with io.EOF when err is nil.
+func (s *stream[T]) finish(err error) {
+	s.once.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		s.err = err
+		close(s.done)
+		s.cancel()
+	})
+}
+
+func (s *stream[T]) Recv() (T, error) {
+	var zero T
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case <-s.done:
+		return zero, s.err
+	case <-s.parent.Done():
+		return zero, status.FromContextError(s.parent.Err()).Err()
+	}
+}
+
+func (s *stream[T]) RecvMsg(m any) error {
+	msg, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m.(proto.Message), msg)
+	return nil
+}
+
+func (s *stream[T]) Header() (metadata.MD, error) { return nil, nil }
+func (s *stream[T]) Trailer() metadata.MD         { return nil }
+func (s *stream[T]) CloseSend() error             { return nil }
+func (s *stream[T]) Context() context.Context     { return s.parent }
+func (s *stream[T]) SendMsg(any) error            { return nil }
@@ -0,0 +1,261 @@
+// Package gobgptest provides an in-process fake of the GoBGP API server,
+// served over an in-memory bufconn listener, so that tests exercise the
+// real gRPC client code of bgtables.
+//
+// The server holds a scripted table of paths, a list of peers and VRFs. It
+// answers ListPath, ListPeer, ListVrf, AddPath and WatchEvent like GoBGP
+// does for the global table, VRFs and the Adj-RIB-In, and can drop its
+// watchers to simulate disconnects and slow consumers.
+package gobgptest
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// Target is the gRPC target of every Server, dialled through DialOption.
+const Target = "passthrough:///gobgptest"
+
+const (
+	bufferSize = 1 << 20
+	// DefaultWatchBuffer is the number of events queued for a watcher
+	// before it is dropped as a slow consumer.
+	DefaultWatchBuffer = 64
+)
+
+// ErrSlowConsumer ends the watch stream of a watcher that fell more than
+// its buffer of events behind.
+var ErrSlowConsumer = status.Error(codes.ResourceExhausted, "gobgptest: watcher too slow")
+
+// Server is a fake GoBGP API server. It is safe for concurrent use.
+type Server struct {
+	apipb.UnimplementedGobgpApiServer
+
+	listener *bufconn.Listener
+	grpc     *grpc.Server
+
+	mu          sync.Mutex
+	table       *table
+	peers       []*apipb.Peer
+	vrfs        map[string]*apipb.Vrf
+	watchers    map[*watcher]bool
+	watchBuffer int
+	sendDelay   time.Duration
+	uuids       uint64
+	watched     chan struct{}
+}
+
+// NewServer starts a server with an empty table. Close stops it.
+func NewServer() *Server {
+	s := &Server{
+		listener:    bufconn.Listen(bufferSize),
+		grpc:        grpc.NewServer(),
+		table:       newTable(),
+		vrfs:        make(map[string]*apipb.Vrf),
+		watchers:    make(map[*watcher]bool),
+		watchBuffer: DefaultWatchBuffer,
+		watched:     make(chan struct{}),
+	}
+	apipb.RegisterGobgpApiServer(s.grpc, s)
+	go func() { _ = s.grpc.Serve(s.listener) }()
+	return s
+}
+
+// Close drops every watcher, then stops the server.
+func (s *Server) Close() {
+	s.Disconnect(nil)
+	s.grpc.Stop()
+}
+
+// DialOption connects clients dialling Target to the server.
+func (s *Server) DialOption() grpc.DialOption {
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return s.listener.DialContext(ctx)
+	})
+}
+
+// Dial returns a client connection to the server.
+func (s *Server) Dial() (*grpc.ClientConn, error) {
+	return grpc.NewClient(Target, s.DialOption(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// SetWatchBuffer sets the number of events queued for the watchers that
+// connect from now on.
+func (s *Server) SetWatchBuffer(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.watchBuffer = n
+}
+
+// SetSendDelay delays every watch event by d, as a slow link or consumer
+// would. Events queue up meanwhile, until the watcher is dropped.
+func (s *Server) SetSendDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sendDelay = d
+}
+
+// Announce applies paths to the table, withdrawals included, and sends
+// them to the watchers.
+func (s *Server) Announce(paths ...*apipb.Path) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, path := range paths {
+		s.table.apply(path)
+	}
+	s.broadcast(&apipb.WatchEventResponse{Event: &apipb.WatchEventResponse_Table{
+		Table: &apipb.WatchEventResponse_TableEvent{Paths: paths},
+	}})
+}
+
+// Withdraw withdraws paths from the table.
+func (s *Server) Withdraw(paths ...*apipb.Path) {
+	withdrawals := make([]*apipb.Path, len(paths))
+	for i, path := range paths {
+		withdrawals[i] = Withdrawal(path)
+	}
+	s.Announce(withdrawals...)
+}
+
+// Paths returns the paths of the table, in a stable order.
+func (s *Server) Paths() []*apipb.Path {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.table.paths(func(*apipb.Path) bool { return true })
+}
+
+// SetPeer adds peer, or replaces the peer of the same neighbor address,
+// and sends its state to the watchers of peer events.
+func (s *Server) SetPeer(peer *apipb.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address := peer.GetConf().GetNeighborAddress()
+	for i, p := range s.peers {
+		if p.GetConf().GetNeighborAddress() == address {
+			s.peers[i] = peer
+			s.broadcast(peerEvent(peer))
+			return
+		}
+	}
+	s.peers = append(s.peers, peer)
+	s.broadcast(peerEvent(peer))
+}
+
+// Disconnect ends the watch stream of every watcher with err, or
+// gracefully when err is nil.
+func (s *Server) Disconnect(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for w := range s.watchers {
+		s.drop(w, err)
+	}
+}
+
+// Watchers returns the number of connected watchers.
+func (s *Server) Watchers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.watchers)
+}
+
+// Watched returns a channel closed when the next watcher has received
+// the initial table, so that tests announce paths once it listens.
+func (s *Server) Watched() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.watched
+}
+
+// ListPath lists the paths of the global table, of a VRF or of the
+// Adj-RIB-In of a neighbor, one destination per prefix.
+func (s *Server) ListPath(req *apipb.ListPathRequest, stream apipb.GobgpApi_ListPathServer) error {
+	s.mu.Lock()
+	destinations, err := s.destinations(req)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, destination := range destinations {
+		if err := stream.Send(&apipb.ListPathResponse{Destination: destination}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destinations returns the destinations ListPath lists for req. Callers
+// must hold s.mu.
+func (s *Server) destinations(req *apipb.ListPathRequest) ([]*apipb.Destination, error) {
+	if req.TableType == apipb.TableType_VRF {
+		return s.vrfDestinations(req)
+	}
+	match, err := listFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.table.destinations(match), nil
+}
+
+// ListPeer lists the peers, or the peer of req.Address.
+func (s *Server) ListPeer(req *apipb.ListPeerRequest, stream apipb.GobgpApi_ListPeerServer) error {
+	s.mu.Lock()
+	peers := append([]*apipb.Peer(nil), s.peers...)
+	s.mu.Unlock()
+
+	for _, peer := range peers {
+		if req.Address != "" && peer.GetConf().GetNeighborAddress() != req.Address {
+			continue
+		}
+		if err := stream.Send(&apipb.ListPeerResponse{Peer: peer}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPath adds a locally originated path to the global table, where it
+// is the best path of its prefix, or withdraws it.
+func (s *Server) AddPath(_ context.Context, req *apipb.AddPathRequest) (*apipb.AddPathResponse, error) {
+	if req.TableType != apipb.TableType_GLOBAL {
+		return nil, status.Errorf(codes.Unimplemented, "gobgptest: AddPath to %s table", req.TableType)
+	}
+	if req.Path == nil || req.Path.Family == nil || req.Path.Nlri == nil {
+		return nil, status.Error(codes.InvalidArgument, "gobgptest: path without family or NLRI")
+	}
+
+	path := proto.Clone(req.Path).(*apipb.Path)
+	path.Best = !path.IsWithdraw
+	path.Uuid = s.nextUUID()
+	s.Announce(path)
+	return &apipb.AddPathResponse{Uuid: path.Uuid}, nil
+}
+
+func (s *Server) nextUUID() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uuids++
+	uuid := make([]byte, 16)
+	binary.BigEndian.PutUint64(uuid[8:], s.uuids)
+	return uuid
+}
@@ -0,0 +1,241 @@
+package gobgptest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var ipv4 = &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST}
+
+func newTestClient(t *testing.T) (*Server, apipb.GobgpApiClient) {
+	t.Helper()
+	s := NewServer()
+	t.Cleanup(s.Close)
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return s, apipb.NewGobgpApiClient(conn)
+}
+
+// watch opens a watch stream and waits until it received the initial
+// table.
+func watch(t *testing.T, s *Server, client apipb.GobgpApiClient,
+	req *apipb.WatchEventRequest) apipb.GobgpApi_WatchEventClient {
+	t.Helper()
+	watched := s.Watched()
+	stream, err := client.WatchEvent(context.Background(), req)
+	require.NoError(t, err)
+	select {
+	case <-watched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not connect")
+	}
+	return stream
+}
+
+func bestWatch() *apipb.WatchEventRequest {
+	return &apipb.WatchEventRequest{Table: &apipb.WatchEventRequest_Table{
+		Filters: []*apipb.WatchEventRequest_Table_Filter{{Type: apipb.WatchEventRequest_Table_Filter_BEST, Init: true}},
+	}}
+}
+
+func fromPeer(path *apipb.Path, neighbor string, best bool) *apipb.Path {
+	path.NeighborIp = neighbor
+	path.Best = best
+	return path
+}
+
+func listPrefixes(t *testing.T, client apipb.GobgpApiClient, req *apipb.ListPathRequest) [][]string {
+	t.Helper()
+	stream, err := client.ListPath(context.Background(), req)
+	require.NoError(t, err)
+	var destinations [][]string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return destinations
+		}
+		require.NoError(t, err)
+		var neighbors []string
+		for _, path := range resp.Destination.Paths {
+			neighbors = append(neighbors, path.NeighborIp)
+		}
+		destinations = append(destinations, neighbors)
+	}
+}
+
+func TestListPath(t *testing.T) {
+	s, client := newTestClient(t)
+	filtered := fromPeer(NewPath("192.0.2.0/24"), "10.0.0.2", false)
+	filtered.Filtered = true
+	s.Announce(
+		fromPeer(NewPath("192.0.2.0/24"), "10.0.0.1", true),
+		filtered,
+		fromPeer(NewPath("198.51.100.0/24"), "10.0.0.2", true),
+		NewPath("2001:db8::/32"),
+	)
+
+	global := listPrefixes(t, client, &apipb.ListPathRequest{TableType: apipb.TableType_GLOBAL, Family: ipv4})
+	assert.ElementsMatch(t, [][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.2"}}, global)
+
+	adjIn := &apipb.ListPathRequest{TableType: apipb.TableType_ADJ_IN, Family: ipv4, Name: "10.0.0.2"}
+	assert.Equal(t, [][]string{{"10.0.0.2"}}, listPrefixes(t, client, adjIn))
+	adjIn.EnableFiltered = true
+	assert.Len(t, listPrefixes(t, client, adjIn), 2)
+
+	s.Withdraw(NewPath("2001:db8::/32"))
+	assert.Len(t, s.Paths(), 3)
+
+	stream, err := client.ListPath(context.Background(), &apipb.ListPathRequest{TableType: apipb.TableType_ADJ_OUT})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func vpnPath(assigned uint32, prefix string, rt *anypb.Any) *apipb.Path {
+	rd := mustAny(&apipb.RouteDistinguisherTwoOctetASN{Admin: 65000, Assigned: assigned})
+	return &apipb.Path{
+		Family: &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_MPLS_VPN},
+		Nlri:   mustAny(&apipb.LabeledVPNIPAddressPrefix{Rd: rd, Prefix: prefix, PrefixLen: 24, Labels: []uint32{16}}),
+		Pattrs: []*anypb.Any{mustAny(&apipb.ExtendedCommunitiesAttribute{Communities: []*anypb.Any{rt}})},
+		Best:   true,
+	}
+}
+
+func TestListPathVRF(t *testing.T) {
+	s, client := newTestClient(t)
+	blue := mustAny(&apipb.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: 65000, LocalAdmin: 1})
+	red := mustAny(&apipb.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: 65000, LocalAdmin: 2})
+	s.SetVrf(&apipb.Vrf{Name: "blue", ImportRt: []*anypb.Any{blue}})
+	s.Announce(vpnPath(1, "192.0.2.0", blue), vpnPath(2, "192.0.2.0", blue), vpnPath(3, "198.51.100.0", red))
+
+	stream, err := client.ListPath(context.Background(),
+		&apipb.ListPathRequest{TableType: apipb.TableType_VRF, Name: "blue", Family: ipv4})
+	require.NoError(t, err)
+	var paths []*apipb.Path
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		paths = append(paths, resp.Destination.Paths...)
+	}
+	require.Len(t, paths, 2, "one destination per route distinguisher")
+	for _, path := range paths {
+		assert.Equal(t, ipv4.Safi, path.Family.Safi)
+		assert.False(t, path.Best, "GoBGP marks no path of a VRF best")
+	}
+
+	vrfs, err := client.ListVrf(context.Background(), &apipb.ListVrfRequest{Name: "blue"})
+	require.NoError(t, err)
+	resp, err := vrfs.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "blue", resp.Vrf.Name)
+
+	stream, err = client.ListPath(context.Background(),
+		&apipb.ListPathRequest{TableType: apipb.TableType_VRF, Name: "red"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestListPeer(t *testing.T) {
+	s, client := newTestClient(t)
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		s.SetPeer(&apipb.Peer{Conf: &apipb.PeerConf{NeighborAddress: address}})
+	}
+
+	stream, err := client.ListPeer(context.Background(), &apipb.ListPeerRequest{Address: "10.0.0.2"})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", resp.Peer.Conf.NeighborAddress)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWatchEvent(t *testing.T) {
+	s, client := newTestClient(t)
+	s.Announce(NewPath("192.0.2.0/24"), fromPeer(NewPath("198.51.100.0/24"), "10.0.0.1", false))
+	s.SetPeer(&apipb.Peer{Conf: &apipb.PeerConf{NeighborAddress: "10.0.0.1"}})
+
+	req := bestWatch()
+	req.Peer = &apipb.WatchEventRequest_Peer{}
+	stream := watch(t, s, client, req)
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Len(t, resp.GetTable().Paths, 1, "the initial table holds the best paths")
+	for _, want := range []apipb.WatchEventResponse_PeerEvent_Type{
+		apipb.WatchEventResponse_PeerEvent_INIT,
+		apipb.WatchEventResponse_PeerEvent_END_OF_INIT,
+	} {
+		resp, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, want, resp.GetPeer().Type)
+	}
+
+	s.Withdraw(NewPath("192.0.2.0/24"))
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.GetTable().Paths[0].IsWithdraw)
+}
+
+func TestAddPath(t *testing.T) {
+	s, client := newTestClient(t)
+	stream := watch(t, s, client, bestWatch())
+
+	added, err := client.AddPath(context.Background(), &apipb.AddPathRequest{
+		TableType: apipb.TableType_GLOBAL,
+		Path:      fromPeer(NewPath("192.0.2.0/24"), "", false),
+	})
+	require.NoError(t, err)
+	assert.Len(t, added.Uuid, 16)
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.GetTable().Paths[0].Best)
+	assert.Equal(t, added.Uuid, resp.GetTable().Paths[0].Uuid)
+	assert.Len(t, s.Paths(), 1)
+
+	_, err = client.AddPath(context.Background(), &apipb.AddPathRequest{TableType: apipb.TableType_GLOBAL})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestDisconnect(t *testing.T) {
+	s, client := newTestClient(t)
+	stream := watch(t, s, client, bestWatch())
+	s.Disconnect(nil)
+	_, err := stream.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.Zero(t, s.Watchers())
+
+	stream = watch(t, s, client, bestWatch())
+	s.Disconnect(status.Error(codes.Unavailable, "peer reset"))
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestSlowConsumer(t *testing.T) {
+	s, client := newTestClient(t)
+	s.SetWatchBuffer(1)
+	s.SetSendDelay(time.Hour)
+	stream := watch(t, s, client, bestWatch())
+
+	for _, prefix := range []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"} {
+		s.Announce(NewPath(prefix))
+	}
+	_, err := stream.Recv()
+	assert.ErrorIs(t, err, ErrSlowConsumer)
+	assert.Zero(t, s.Watchers())
+}
@@ -0,0 +1,146 @@
+package gobgptest
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// pathKey identifies a path: a prefix has one path per neighbor.
+type pathKey struct {
+	family   string
+	nlri     string
+	neighbor string
+}
+
+func keyOf(path *apipb.Path) pathKey {
+	return pathKey{
+		family:   path.GetFamily().String(),
+		nlri:     path.GetNlri().GetTypeUrl() + string(path.GetNlri().GetValue()),
+		neighbor: path.GetNeighborIp(),
+	}
+}
+
+func (k pathKey) less(o pathKey) bool {
+	if k.family != o.family {
+		return k.family < o.family
+	}
+	if k.nlri != o.nlri {
+		return k.nlri < o.nlri
+	}
+	return k.neighbor < o.neighbor
+}
+
+// table holds the paths of every neighbor.
+type table struct {
+	entries map[pathKey]*apipb.Path
+}
+
+func newTable() *table {
+	return &table{entries: make(map[pathKey]*apipb.Path)}
+}
+
+// apply adds path, or removes the path it withdraws.
+func (t *table) apply(path *apipb.Path) {
+	key := keyOf(path)
+	if path.IsWithdraw {
+		delete(t.entries, key)
+		return
+	}
+	t.entries[key] = path
+}
+
+// sortedKeys returns the keys of the paths match keeps, in a stable order
+// grouping the paths of a prefix.
+func (t *table) sortedKeys(match func(*apipb.Path) bool) []pathKey {
+	keys := make([]pathKey, 0, len(t.entries))
+	for key, path := range t.entries {
+		if match(path) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	return keys
+}
+
+// paths returns the paths match keeps.
+func (t *table) paths(match func(*apipb.Path) bool) []*apipb.Path {
+	keys := t.sortedKeys(match)
+	paths := make([]*apipb.Path, len(keys))
+	for i, key := range keys {
+		paths[i] = t.entries[key]
+	}
+	return paths
+}
+
+// destinations returns the paths match keeps, grouped by prefix.
+func (t *table) destinations(match func(*apipb.Path) bool) []*apipb.Destination {
+	var destinations []*apipb.Destination
+	var last pathKey
+	for _, key := range t.sortedKeys(match) {
+		if len(destinations) == 0 || key.family != last.family || key.nlri != last.nlri {
+			destinations = append(destinations, &apipb.Destination{})
+		}
+		current := destinations[len(destinations)-1]
+		current.Paths = append(current.Paths, t.entries[key])
+		last = key
+	}
+	return destinations
+}
+
+// listFilter returns the paths a ListPath request selects.
+func listFilter(req *apipb.ListPathRequest) (func(*apipb.Path) bool, error) {
+	family := func(path *apipb.Path) bool {
+		return req.Family == nil || proto.Equal(req.Family, path.Family)
+	}
+	switch req.TableType {
+	case apipb.TableType_GLOBAL:
+		return family, nil
+	case apipb.TableType_ADJ_IN:
+		return func(path *apipb.Path) bool {
+			return family(path) && path.NeighborIp == req.Name && (req.EnableFiltered || !path.Filtered)
+		}, nil
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "gobgptest: ListPath of %s table", req.TableType)
+	}
+}
+
+// NewPath returns the best unicast path of prefix with attrs, such as
+// *apipb.NextHopAttribute or *apipb.CommunitiesAttribute. It panics when
+// prefix or an attribute is invalid.
+func NewPath(prefix string, attrs ...proto.Message) *apipb.Path {
+	p := netip.MustParsePrefix(prefix)
+	nlri := mustAny(&apipb.IPAddressPrefix{Prefix: p.Addr().String(), PrefixLen: uint32(p.Bits())})
+	pattrs := make([]*anypb.Any, len(attrs))
+	for i, attr := range attrs {
+		pattrs[i] = mustAny(attr)
+	}
+
+	family := &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST}
+	if p.Addr().Is6() {
+		family.Afi = apipb.Family_AFI_IP6
+	}
+	return &apipb.Path{Family: family, Nlri: nlri, Pattrs: pattrs, Best: true}
+}
+
+func mustAny(msg proto.Message) *anypb.Any {
+	packed, err := anypb.New(msg)
+	if err != nil {
+		panic(fmt.Sprintf("gobgptest: %v", err))
+	}
+	return packed
+}
+
+// Withdrawal returns the withdrawal of path.
+func Withdrawal(path *apipb.Path) *apipb.Path {
+	withdrawal := proto.Clone(path).(*apipb.Path)
+	withdrawal.IsWithdraw = true
+	withdrawal.Best = false
+	return withdrawal
+}
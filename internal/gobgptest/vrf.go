@@ -0,0 +1,96 @@
+package gobgptest
+
+import (
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// SetVrf adds vrf, or replaces the VRF of the same name.
+func (s *Server) SetVrf(vrf *apipb.Vrf) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.vrfs[vrf.GetName()] = vrf
+}
+
+// ListVrf lists the VRFs, or the VRF of req.Name.
+func (s *Server) ListVrf(req *apipb.ListVrfRequest, stream apipb.GobgpApi_ListVrfServer) error {
+	s.mu.Lock()
+	var vrfs []*apipb.Vrf
+	for name, vrf := range s.vrfs {
+		if req.Name == "" || name == req.Name {
+			vrfs = append(vrfs, vrf)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, vrf := range vrfs {
+		if err := stream.Send(&apipb.ListVrfResponse{Vrf: vrf}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vrfDestinations lists the VPN paths imported into the VRF of req like
+// GoBGP does: as unicast paths, one destination per VPN prefix, and none
+// of them marked best. Callers must hold s.mu.
+func (s *Server) vrfDestinations(req *apipb.ListPathRequest) ([]*apipb.Destination, error) {
+	vrf, ok := s.vrfs[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "gobgptest: VRF %q not found", req.Name)
+	}
+	family := &apipb.Family{Afi: req.GetFamily().GetAfi(), Safi: apipb.Family_SAFI_MPLS_VPN}
+	destinations := s.table.destinations(func(path *apipb.Path) bool {
+		return proto.Equal(family, path.Family) && imports(vrf, path)
+	})
+	for _, destination := range destinations {
+		for i, path := range destination.Paths {
+			local, err := localPath(path)
+			if err != nil {
+				return nil, err
+			}
+			destination.Paths[i] = local
+		}
+	}
+	return destinations, nil
+}
+
+// imports reports whether path carries an import route target of vrf.
+func imports(vrf *apipb.Vrf, path *apipb.Path) bool {
+	for _, packed := range path.Pattrs {
+		attr := &apipb.ExtendedCommunitiesAttribute{}
+		if packed.UnmarshalTo(attr) != nil {
+			continue
+		}
+		for _, community := range attr.Communities {
+			for _, rt := range vrf.ImportRt {
+				if proto.Equal(community, rt) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// localPath returns a copy of a VPN path with the unicast NLRI of its
+// prefix.
+func localPath(path *apipb.Path) (*apipb.Path, error) {
+	vpn := &apipb.LabeledVPNIPAddressPrefix{}
+	if err := path.Nlri.UnmarshalTo(vpn); err != nil {
+		return nil, status.Errorf(codes.Internal, "gobgptest: %v", err)
+	}
+	nlri, err := anypb.New(&apipb.IPAddressPrefix{Prefix: vpn.Prefix, PrefixLen: vpn.PrefixLen})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "gobgptest: %v", err)
+	}
+	local := proto.Clone(path).(*apipb.Path)
+	local.Nlri = nlri
+	local.Family = &apipb.Family{Afi: path.Family.Afi, Safi: apipb.Family_SAFI_UNICAST}
+	local.Best = false
+	return local, nil
+}
@@ -0,0 +1,207 @@
+package gobgptest
+
+import (
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+// watcher is the client of a WatchEvent stream. Its events queue up in a
+// bounded channel; a watcher that would overflow it is dropped.
+type watcher struct {
+	req    *apipb.WatchEventRequest
+	events chan *apipb.WatchEventResponse
+	done   chan struct{}
+	err    error
+}
+
+// WatchEvent sends the table, when a table filter asks for it, and the
+// peers, when peer events are watched, followed by every change.
+func (s *Server) WatchEvent(req *apipb.WatchEventRequest, stream apipb.GobgpApi_WatchEventServer) error {
+	w, initial := s.watch(req)
+	defer s.unwatch(w)
+
+	for _, event := range initial {
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	s.notifyWatched()
+
+	for {
+		select {
+		case <-w.done:
+			return w.err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event := <-w.events:
+			if err := s.send(stream, w, event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watch registers a watcher for req and returns its initial events, taken
+// atomically with the registration so that no change is lost or repeated.
+func (s *Server) watch(req *apipb.WatchEventRequest) (*watcher, []*apipb.WatchEventResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := &watcher{
+		req:    req,
+		events: make(chan *apipb.WatchEventResponse, s.watchBuffer),
+		done:   make(chan struct{}),
+	}
+	s.watchers[w] = true
+
+	var initial []*apipb.WatchEventResponse
+	if initTable(req.GetTable()) {
+		if paths := s.table.paths(w.matches); len(paths) > 0 {
+			initial = append(initial, tableEvent(paths))
+		}
+	}
+	if req.GetPeer() != nil {
+		initial = append(initial, s.peerInit()...)
+	}
+	return w, initial
+}
+
+func (s *Server) unwatch(w *watcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.watchers, w)
+}
+
+func (s *Server) notifyWatched() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	close(s.watched)
+	s.watched = make(chan struct{})
+}
+
+// send sends event after the current send delay, unless w is dropped
+// meanwhile.
+func (s *Server) send(stream apipb.GobgpApi_WatchEventServer, w *watcher, event *apipb.WatchEventResponse) error {
+	s.mu.Lock()
+	delay := s.sendDelay
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-w.done:
+			return w.err
+		}
+	}
+	return stream.Send(event)
+}
+
+// broadcast queues event for the watchers it concerns, and drops those
+// whose queue is full. Callers must hold s.mu.
+func (s *Server) broadcast(event *apipb.WatchEventResponse) {
+	for w := range s.watchers {
+		filtered := w.filter(event)
+		if filtered == nil {
+			continue
+		}
+		select {
+		case w.events <- filtered:
+		default:
+			s.drop(w, ErrSlowConsumer)
+		}
+	}
+}
+
+// drop ends the stream of w with err. Callers must hold s.mu.
+func (s *Server) drop(w *watcher, err error) {
+	delete(s.watchers, w)
+	w.err = err
+	close(w.done)
+}
+
+// peerInit returns the peer events starting a peer watch. Callers must
+// hold s.mu.
+func (s *Server) peerInit() []*apipb.WatchEventResponse {
+	events := make([]*apipb.WatchEventResponse, 0, len(s.peers)+1)
+	for _, peer := range s.peers {
+		event := peerEvent(peer)
+		event.GetPeer().Type = apipb.WatchEventResponse_PeerEvent_INIT
+		events = append(events, event)
+	}
+	end := peerEvent(nil)
+	end.GetPeer().Type = apipb.WatchEventResponse_PeerEvent_END_OF_INIT
+	return append(events, end)
+}
+
+// filter returns the part of event w watches, or nil.
+func (w *watcher) filter(event *apipb.WatchEventResponse) *apipb.WatchEventResponse {
+	if event.GetPeer() != nil {
+		if w.req.GetPeer() == nil {
+			return nil
+		}
+		return event
+	}
+
+	var paths []*apipb.Path
+	for _, path := range event.GetTable().GetPaths() {
+		if w.matches(path) {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return tableEvent(paths)
+}
+
+// matches reports whether path passes one of the table filters of w.
+func (w *watcher) matches(path *apipb.Path) bool {
+	for _, filter := range w.req.GetTable().GetFilters() {
+		if filterMatches(filter, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMatches applies filter like GoBGP: the best filter takes best
+// paths, and the Adj-RIB-In filters take the paths of their peer, or of
+// every peer, before or after import policies.
+func filterMatches(filter *apipb.WatchEventRequest_Table_Filter, path *apipb.Path) bool {
+	switch filter.Type {
+	case apipb.WatchEventRequest_Table_Filter_BEST:
+		return path.Best || path.IsWithdraw
+	case apipb.WatchEventRequest_Table_Filter_POST_POLICY:
+		if path.Filtered {
+			return false
+		}
+	case apipb.WatchEventRequest_Table_Filter_ADJIN:
+	default:
+		return false
+	}
+	return filter.PeerAddress == "" || filter.PeerAddress == path.NeighborIp
+}
+
+func initTable(table *apipb.WatchEventRequest_Table) bool {
+	for _, filter := range table.GetFilters() {
+		if filter.Init {
+			return true
+		}
+	}
+	return false
+}
+
+func tableEvent(paths []*apipb.Path) *apipb.WatchEventResponse {
+	return &apipb.WatchEventResponse{Event: &apipb.WatchEventResponse_Table{
+		Table: &apipb.WatchEventResponse_TableEvent{Paths: paths},
+	}}
+}
+
+func peerEvent(peer *apipb.Peer) *apipb.WatchEventResponse {
+	return &apipb.WatchEventResponse{Event: &apipb.WatchEventResponse_Peer{
+		Peer: &apipb.WatchEventResponse_PeerEvent{Type: apipb.WatchEventResponse_PeerEvent_STATE, Peer: peer},
+	}}
+}
@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+)
+
+// routeAttributes holds the compiled config.RouteAttributes.
+type routeAttributes struct {
+	mtu      int
+	advMSS   int
+	initCwnd int
+	initRwnd int
+	src      netip.Addr
+}
+
+func compileAttributes(cfg config.RouteAttributes) (routeAttributes, error) {
+	src, err := cfg.Source()
+	if err != nil {
+		return routeAttributes{}, err
+	}
+	return routeAttributes{
+		mtu:      cfg.MTU,
+		advMSS:   cfg.AdvMSS,
+		initCwnd: cfg.InitCwnd,
+		initRwnd: cfg.InitRwnd,
+		src:      src,
+	}, nil
+}
+
+// fill sets the attributes route leaves unset. The preferred source only
+// applies to routes of its address family.
+func (a routeAttributes) fill(route *netlink.Route) {
+	fillInt(&route.MTU, a.mtu)
+	fillInt(&route.AdvMSS, a.advMSS)
+	fillInt(&route.InitCwnd, a.initCwnd)
+	fillInt(&route.InitRwnd, a.initRwnd)
+	if route.Src == nil && a.src.IsValid() && a.src.Is4() == prefixOf(route).Addr().Is4() {
+		route.Src = a.src.AsSlice()
+	}
+}
+
+func fillInt(field *int, value int) {
+	if *field == 0 {
+		*field = value
+	}
+}
+
+// tableDefaults holds the attributes of the routes of each routing table.
+type tableDefaults map[int]routeAttributes
+
+// newTableDefaults compiles cfg. It returns nil when no table has
+// attributes.
+func newTableDefaults(cfg map[int]config.RouteAttributes) (tableDefaults, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	defaults := make(tableDefaults, len(cfg))
+	for table, attrs := range cfg {
+		compiled, err := compileAttributes(attrs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attributes of table %d: %w", table, err)
+		}
+		defaults[table] = compiled
+	}
+	return defaults, nil
+}
+
+// fill sets the attributes of the table of route that route leaves unset.
+func (d tableDefaults) fill(route *netlink.Route) {
+	if attrs, ok := d[route.Table]; ok {
+		attrs.fill(route)
+	}
+}
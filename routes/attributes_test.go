@@ -0,0 +1,72 @@
+package routes
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestRouteAttributesFill(t *testing.T) {
+	attrs, err := compileAttributes(config.RouteAttributes{MTU: 1400, AdvMSS: 1360, PrefSrc: "192.0.2.1"})
+	require.NoError(t, err)
+
+	route := &netlink.Route{Dst: mustCIDR(t, "10.0.0.0/24"), MTU: 9000}
+	attrs.fill(route)
+	assert.Equal(t, 9000, route.MTU)
+	assert.Equal(t, 1360, route.AdvMSS)
+	assert.True(t, route.Src.Equal(net.ParseIP("192.0.2.1")))
+
+	route = &netlink.Route{Dst: mustCIDR(t, "2001:db8::/32")}
+	attrs.fill(route)
+	assert.Equal(t, 1400, route.MTU)
+	assert.Nil(t, route.Src)
+}
+
+func TestTableDefaults(t *testing.T) {
+	defaults, err := newTableDefaults(map[int]config.RouteAttributes{
+		100: {MTU: 1400, InitRwnd: 20},
+	})
+	require.NoError(t, err)
+
+	rib := newRIB(nil, newTestPolicy(t, config.PolicyRule{
+		Match: config.PolicyMatch{Communities: []string{"65000:100"}},
+		Action: config.PolicyAction{
+			Table: 100, RouteAttributes: config.RouteAttributes{MTU: 1280},
+		},
+	}), nil)
+	rib.defaults = defaults
+
+	tagged := &apipb.CommunitiesAttribute{Communities: []uint32{65000<<16 | 100}}
+	changes := rib.build([]*apipb.Path{newAttrPath(t, "10.0.0.0", 24, tagged), newAttrPath(t, "10.0.1.0", 24)})
+
+	clamped := changes[RouteKey{Table: 100, Dst: netip.MustParsePrefix("10.0.0.0/24")}]
+	require.NotNil(t, clamped)
+	assert.Equal(t, 1280, clamped.MTU)
+	assert.Equal(t, 20, clamped.InitRwnd)
+
+	main := changes[RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("10.0.1.0/24")}]
+	require.NotNil(t, main)
+	assert.Zero(t, main.MTU)
+
+	_, err = newTableDefaults(map[int]config.RouteAttributes{100: {PrefSrc: "host"}})
+	assert.Error(t, err)
+}
+
+func TestRoutesEqualAttributes(t *testing.T) {
+	desired := &netlink.Route{Dst: mustCIDR(t, "10.0.0.0/24"), InitCwnd: 10, Src: net.ParseIP("192.0.2.1")}
+	actual := *desired
+	assert.True(t, routesEqual(&actual, desired))
+
+	actual.InitCwnd = 0
+	assert.False(t, routesEqual(&actual, desired))
+
+	actual.InitCwnd, actual.Src = 10, net.ParseIP("192.0.2.2")
+	assert.False(t, routesEqual(&actual, desired))
+}
@@ -0,0 +1,268 @@
+package routes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Limits of one multi-message netlink request. The kernel queues an
+// acknowledgement per message before bgtables reads any, so the number of
+// messages is bounded by the receive buffer of the socket.
+const (
+	maxBatchMessages = 128
+	maxBatchBytes    = 64 << 10
+	batchAckTimeout  = 10 * time.Second
+)
+
+// routeBatcher is implemented by the route writers that program several
+// routes with one netlink request.
+type routeBatcher interface {
+	RouteBatch(deltas []RouteDelta) []error
+}
+
+// batchHandle is a netlink handle that also programs batches of routes
+// through a socket of its own: each route is one message of a single
+// request, and the kernel acknowledges every message on its own.
+type batchHandle struct {
+	*netlink.Handle
+	socket *nl.NetlinkSocket
+}
+
+func newBatchHandle(ns *namespace) (*batchHandle, error) {
+	handle, err := ns.newHandle()
+	if err != nil {
+		return nil, err
+	}
+	socket, err := ns.newSocket()
+	if err == nil {
+		err = setupBatchSocket(socket)
+	}
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &batchHandle{Handle: handle, socket: socket}, nil
+}
+
+// setupBatchSocket bounds the wait for acknowledgements, and keeps the
+// acknowledgements of failed messages from echoing the whole message.
+func setupBatchSocket(socket *nl.NetlinkSocket) error {
+	timeout := unix.NsecToTimeval(batchAckTimeout.Nanoseconds())
+	if err := socket.SetReceiveTimeout(&timeout); err != nil {
+		socket.Close()
+		return err
+	}
+	if err := unix.SetsockoptInt(socket.GetFd(), unix.SOL_NETLINK, unix.NETLINK_CAP_ACK, 1); err != nil {
+		socket.Close()
+		return err
+	}
+	return nil
+}
+
+func (h *batchHandle) Close() {
+	h.socket.Close()
+	h.Handle.Close()
+}
+
+// RouteBatch programs deltas and returns the result of each. Routes with
+// attributes the batch encoding does not cover go through the handle.
+func (h *batchHandle) RouteBatch(deltas []RouteDelta) []error {
+	errs := make([]error, len(deltas))
+	batch := newRouteBatch()
+	for i, delta := range deltas {
+		if !batchable(delta.Route) {
+			errs[i] = applyDelta(h.Handle, delta)
+			continue
+		}
+		req := routeRequest(delta)
+		msg := req.Serialize()
+		if batch.full(len(msg)) {
+			h.send(batch, deltas, errs)
+			batch = newRouteBatch()
+		}
+		batch.add(req.Seq, i, msg)
+	}
+	h.send(batch, deltas, errs)
+	return errs
+}
+
+// routeBatch is a multi-message request being built, with the index of the
+// delta of each message by sequence number.
+type routeBatch struct {
+	buf     []byte
+	pending map[uint32]int
+}
+
+func newRouteBatch() *routeBatch {
+	return &routeBatch{pending: make(map[uint32]int)}
+}
+
+func (b *routeBatch) full(size int) bool {
+	return len(b.pending) > 0 && (len(b.pending) == maxBatchMessages || len(b.buf)+size > maxBatchBytes)
+}
+
+func (b *routeBatch) add(seq uint32, index int, msg []byte) {
+	b.buf = append(b.buf, msg...)
+	b.pending[seq] = index
+}
+
+// send sends batch and records the acknowledgement of each message in errs.
+// A message left without one fails with the error that ended the wait.
+func (h *batchHandle) send(batch *routeBatch, deltas []RouteDelta, errs []error) {
+	if len(batch.pending) == 0 {
+		return
+	}
+	err := unix.Sendto(h.socket.GetFd(), batch.buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err == nil {
+		err = h.receiveAcks(batch.pending, deltas, errs)
+	}
+	for _, i := range batch.pending {
+		errs[i] = deltaResult(deltas[i], fmt.Errorf("netlink batch: %w", err))
+	}
+}
+
+// receiveAcks reads acknowledgements until none is pending. Messages of
+// other sequence numbers, left over from a batch that failed, are skipped.
+func (h *batchHandle) receiveAcks(pending map[uint32]int, deltas []RouteDelta, errs []error) error {
+	for len(pending) > 0 {
+		msgs, _, err := h.socket.Receive()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			i, ok := pending[msg.Header.Seq]
+			if !ok || msg.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			delete(pending, msg.Header.Seq)
+			errs[i] = deltaResult(deltas[i], ackError(msg.Data))
+		}
+	}
+	return nil
+}
+
+// ackError returns the error an acknowledgement carries, nil on success.
+func ackError(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("short netlink acknowledgement")
+	}
+	if errno := int32(binary.NativeEndian.Uint32(data)); errno != 0 {
+		return unix.Errno(-errno)
+	}
+	return nil
+}
+
+// batchable reports whether routeRequest encodes every attribute of route.
+func batchable(route *netlink.Route) bool {
+	if route.Dst == nil {
+		return false
+	}
+	encoded := netlink.Route{
+		LinkIndex: route.LinkIndex, Scope: route.Scope, Dst: route.Dst, Src: route.Src, Gw: route.Gw,
+		Protocol: route.Protocol, Priority: route.Priority, Family: route.Family, Table: route.Table,
+		Type: route.Type, Tos: route.Tos, Flags: route.Flags, Realm: route.Realm,
+		MTU: route.MTU, AdvMSS: route.AdvMSS, InitCwnd: route.InitCwnd, InitRwnd: route.InitRwnd,
+	}
+	return reflect.DeepEqual(&encoded, route)
+}
+
+// routeRequest returns the request that replaces or deletes the route of
+// delta, encoded as netlink.Handle does.
+func routeRequest(delta RouteDelta) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE|unix.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	if delta.Remove {
+		req = nl.NewNetlinkRequest(unix.RTM_DELROUTE, unix.NLM_F_ACK)
+		msg = nl.NewRtDelMsg()
+	}
+
+	fillRouteMsg(msg, delta.Route)
+	req.AddData(msg)
+	for _, attr := range routeAttrs(delta.Route) {
+		req.AddData(attr)
+	}
+	return req
+}
+
+// fillRouteMsg sets the header fields of route in msg. Tables above 255
+// only fit the RTA_TABLE attribute.
+func fillRouteMsg(msg *nl.RtMsg, route *netlink.Route) {
+	ones, _ := route.Dst.Mask.Size()
+	msg.Family = uint8(nl.GetIPFamily(route.Dst.IP))
+	msg.Dst_len = uint8(ones)
+	msg.Tos = uint8(route.Tos)
+	msg.Flags = uint32(route.Flags)
+	msg.Scope = uint8(route.Scope)
+	if route.Table > 0 {
+		msg.Table = unix.RT_TABLE_UNSPEC
+	}
+	if route.Table > 0 && route.Table < 256 {
+		msg.Table = uint8(route.Table)
+	}
+	if route.Protocol > 0 {
+		msg.Protocol = uint8(route.Protocol)
+	}
+	if route.Type > 0 {
+		msg.Type = uint8(route.Type)
+	}
+}
+
+func routeAttrs(route *netlink.Route) []*nl.RtAttr {
+	attrs := []*nl.RtAttr{nl.NewRtAttr(unix.RTA_DST, addrBytes(route.Dst.IP))}
+	if route.Src != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PREFSRC, addrBytes(route.Src)))
+	}
+	if route.Gw != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_GATEWAY, addrBytes(route.Gw)))
+	}
+	if route.Table >= 256 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(route.Table))))
+	}
+	if route.Priority > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PRIORITY, nl.Uint32Attr(uint32(route.Priority))))
+	}
+	if route.Realm > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_FLOW, nl.Uint32Attr(uint32(route.Realm))))
+	}
+	if metrics := metricsAttr(route); metrics != nil {
+		attrs = append(attrs, metrics)
+	}
+	return append(attrs, nl.NewRtAttr(unix.RTA_OIF, nl.Uint32Attr(uint32(route.LinkIndex))))
+}
+
+// metricsAttr returns the RTA_METRICS attribute of route, nil when it sets
+// no metric.
+func metricsAttr(route *netlink.Route) *nl.RtAttr {
+	var attr *nl.RtAttr
+	for _, metric := range []struct{ kind, value int }{
+		{unix.RTAX_MTU, route.MTU},
+		{unix.RTAX_ADVMSS, route.AdvMSS},
+		{unix.RTAX_INITCWND, route.InitCwnd},
+		{unix.RTAX_INITRWND, route.InitRwnd},
+	} {
+		if metric.value <= 0 {
+			continue
+		}
+		if attr == nil {
+			attr = nl.NewRtAttr(unix.RTA_METRICS, nil)
+		}
+		attr.AddRtAttr(metric.kind, nl.Uint32Attr(uint32(metric.value)))
+	}
+	return attr
+}
+
+// addrBytes returns ip in the length of its family.
+func addrBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestRouteRequest(t *testing.T) {
+	route := testOp("192.0.2.0/24", opReplace, false).route
+	route.Table = 300
+	route.Src = net.ParseIP("198.51.100.1")
+	route.Priority = 20
+	route.MTU = 1400
+
+	req := routeRequest(RouteDelta{Route: route})
+	data := req.Serialize()
+	assert.Equal(t, uint16(unix.RTM_NEWROUTE), req.Type)
+	assert.NotZero(t, req.Flags&unix.NLM_F_REPLACE)
+
+	msg := nl.DeserializeRtMsg(data[unix.SizeofNlMsghdr:])
+	assert.Equal(t, uint8(unix.AF_INET), msg.Family)
+	assert.Equal(t, uint8(24), msg.Dst_len)
+	assert.Equal(t, uint8(unix.RT_TABLE_UNSPEC), msg.Table, "tables above 255 go to RTA_TABLE")
+	assert.Equal(t, uint8(RouteProtocol), msg.Protocol)
+
+	attrs, err := nl.ParseRouteAttrAsMap(data[unix.SizeofNlMsghdr+unix.SizeofRtMsg:])
+	require.NoError(t, err)
+	assert.Equal(t, []byte{192, 0, 2, 0}, attrs[unix.RTA_DST].Value)
+	assert.Equal(t, []byte{198, 51, 100, 1}, attrs[unix.RTA_PREFSRC].Value)
+	assert.Equal(t, nl.Uint32Attr(300), attrs[unix.RTA_TABLE].Value)
+	assert.Equal(t, nl.Uint32Attr(20), attrs[unix.RTA_PRIORITY].Value)
+	metrics, err := nl.ParseRouteAttrAsMap(attrs[unix.RTA_METRICS].Value)
+	require.NoError(t, err)
+	assert.Equal(t, nl.Uint32Attr(1400), metrics[unix.RTAX_MTU].Value)
+
+	del := routeRequest(RouteDelta{Route: route, Remove: true})
+	assert.Equal(t, uint16(unix.RTM_DELROUTE), del.Type)
+	assert.Zero(t, del.Flags&unix.NLM_F_CREATE)
+}
+
+func TestBatchable(t *testing.T) {
+	route := testOp("192.0.2.0/24", opReplace, false).route
+	assert.True(t, batchable(route))
+	route.Hoplimit = 64
+	assert.False(t, batchable(route), "attributes routeRequest leaves out go through the handle")
+}
+
+// newScratchNamespace returns a new network namespace, which the calling
+// thread does not enter.
+func newScratchNamespace(t *testing.T) *namespace {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	require.NoError(t, err)
+	defer origin.Close()
+	handle, err := netns.New()
+	require.NoError(t, err)
+	require.NoError(t, netns.Set(origin))
+
+	ns := &namespace{name: "scratch", handle: handle}
+	t.Cleanup(ns.close)
+	return ns
+}
+
+func TestBatchHandle(t *testing.T) {
+	h, err := newBatchHandle(newScratchNamespace(t))
+	require.NoError(t, err)
+	defer h.Close()
+
+	var deltas []RouteDelta
+	for i := 0; i < 2*maxBatchMessages+1; i++ {
+		route := testOp(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), opReplace, true).route
+		route.Table, route.Type = 100, unix.RTN_BLACKHOLE
+		deltas = append(deltas, RouteDelta{Route: route})
+	}
+	invalid := testOp("192.0.2.0/24", opReplace, false).route
+	invalid.Table = 100
+	gone := testOp("198.51.100.0/24", opDelete, false).route
+	gone.Table, gone.Type = 100, unix.RTN_BLACKHOLE
+	deltas = append(deltas, RouteDelta{Route: invalid}, RouteDelta{Route: gone, Remove: true})
+
+	errs := h.RouteBatch(deltas)
+	for i, err := range errs[:len(errs)-2] {
+		assert.NoError(t, err, deltas[i].Route.Dst)
+	}
+	assert.Error(t, errs[len(errs)-2], "a unicast route without a next hop is refused on its own")
+	assert.NoError(t, errs[len(errs)-1], "a route already gone counts as removed")
+
+	routes, err := h.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 100}, netlink.RT_FILTER_TABLE)
+	require.NoError(t, err)
+	assert.Len(t, routes, 2*maxBatchMessages+1)
+}
@@ -3,56 +3,79 @@ package routes
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 
+	"github.com/karasz/bgtables/routes/pathattr"
 	apipb "github.com/osrg/gobgp/v3/api"
 	"google.golang.org/protobuf/types/known/anypb"
 )
 
-// FetchRoutes fetches all routes from the GoBGP server.
-func FetchRoutes(client apipb.GobgpApiClient) ([]*apipb.Path, error) {
-	stream, err := client.ListPath(context.Background(), &apipb.ListPathRequest{
-		TableType: apipb.TableType_GLOBAL,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list paths: %w", err)
-	}
+// installFamilies lists the address families bgtables installs into the kernel.
+var installFamilies = []*apipb.Family{
+	{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST},
+	{Afi: apipb.Family_AFI_IP6, Safi: apipb.Family_SAFI_UNICAST},
+}
+
+// vpnFamilies lists the address families of the paths imported into VRFs.
+var vpnFamilies = []*apipb.Family{
+	{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_MPLS_VPN},
+	{Afi: apipb.Family_AFI_IP6, Safi: apipb.Family_SAFI_MPLS_VPN},
+}
 
+// FetchRoutes fetches all routes of the installed families from the GoBGP
+// global table. The listing ends with io.EOF; any other stream error fails
+// it instead of truncating it.
+func FetchRoutes(ctx context.Context, client apipb.GobgpApiClient) ([]*apipb.Path, error) {
 	var paths []*apipb.Path
-	for {
-		resp, err := stream.Recv()
+	for _, req := range familyRequests(&apipb.ListPathRequest{TableType: apipb.TableType_GLOBAL}, installFamilies) {
+		familyPaths, err := listPaths(ctx, client, req)
 		if err != nil {
-			break
+			return nil, err
 		}
-
-		paths = append(paths, resp.Destination.Paths...)
+		paths = append(paths, familyPaths...)
 	}
-
 	return paths, nil
 }
 
-// ParseNlriToCIDR decodes the NLRI from *anypb.Any to a string in CIDR format.
-func ParseNlriToCIDR(nlri *anypb.Any) (string, error) {
-	prefix := &apipb.IPAddressPrefix{}
-	if err := nlri.UnmarshalTo(prefix); err != nil {
-		return "", fmt.Errorf("failed to unmarshal NLRI: %w", err)
+func listPaths(ctx context.Context, client apipb.GobgpApiClient, req *apipb.ListPathRequest) ([]*apipb.Path, error) {
+	stream, err := client.ListPath(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list paths: %w", err)
 	}
 
-	addr, err := net.ResolveIPAddr("ip", prefix.Prefix)
+	var paths []*apipb.Path
+	err = receiveAll(stream, func(resp *apipb.ListPathResponse) {
+		paths = append(paths, resp.GetDestination().GetPaths()...)
+	})
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("failed to receive paths: %w", err)
 	}
+	return paths, nil
+}
 
-	ipStr := addr.IP.String()
-
-	cidr := fmt.Sprintf("%s/%d", ipStr, prefix.PrefixLen)
-
-	_, _, err = net.ParseCIDR(cidr)
+// receiveAll calls fn with every message of a server stream until it ends.
+func receiveAll[T any](stream interface{ Recv() (T, error) }, fn func(T)) error {
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(msg)
+	}
+}
 
+// ParseNlriToCIDR decodes an IP unicast NLRI to a string in CIDR format.
+//
+// Deprecated: use pathattr.DecodePrefix, which returns a netip.Prefix.
+func ParseNlriToCIDR(nlri *anypb.Any) (string, error) {
+	prefix, err := pathattr.DecodePrefix(nlri)
 	if err != nil {
-		return "", fmt.Errorf("invalid CIDR format: %w", err)
+		return "", err
 	}
-
-	return cidr, nil
+	return prefix.String(), nil
 }
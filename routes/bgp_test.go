@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"errors"
 	"io"
 	"testing"
@@ -41,6 +42,20 @@ func TestFetchRoutes(t *testing.T) {
 			expectError: true,
 			expectPaths: 0,
 		},
+		{
+			name: "Stream error",
+			setupMock: func(client *MockGobgpAPIClient, stream *MockListPathClient) {
+				stream.On("Recv").Return(&apipb.ListPathResponse{
+					Destination: &apipb.Destination{
+						Paths: []*apipb.Path{{}},
+					},
+				}, nil).Once()
+				stream.On("Recv").Return((*apipb.ListPathResponse)(nil), errors.New("connection reset"))
+				client.On("ListPath", mock.Anything, mock.Anything).Return(stream, nil)
+			},
+			expectError: true,
+			expectPaths: 0,
+		},
 	}
 
 	for _, tt := range tests {
@@ -49,7 +64,7 @@ func TestFetchRoutes(t *testing.T) {
 			mockStream := new(MockListPathClient)
 			tt.setupMock(mockClient, mockStream)
 
-			paths, err := FetchRoutes(mockClient)
+			paths, err := FetchRoutes(context.Background(), mockClient)
 			if tt.expectError {
 				assert.Error(t, err)
 			} else {
@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// KernelCache mirrors the routes owned by bgtables in a sink, the kernel by
+// default, in the routing tables of its scope. It is seeded with a single
+// listing of the sink and then kept current from netlink notifications and
+// the results of our own operations, so programming never has to list the
+// full kernel table.
+type KernelCache struct {
+	scope vrfScope
+	sink  Sink
+
+	mu     sync.RWMutex
+	routes map[RouteKey]*netlink.Route
+}
+
+// NewKernelCache returns an empty cache of the routes sink owns in every
+// table.
+func NewKernelCache(sink Sink) *KernelCache {
+	return newScopedKernelCache(vrfScope{}, sink)
+}
+
+func newScopedKernelCache(scope vrfScope, sink Sink) *KernelCache {
+	return &KernelCache{scope: scope, sink: sink, routes: make(map[RouteKey]*netlink.Route)}
+}
+
+// Seed replaces the content of the cache with the owned routes currently
+// present in the sink.
+func (c *KernelCache) Seed() error {
+	routes, err := c.sink.List()
+	if err != nil {
+		return err
+	}
+
+	routeMap := make(map[RouteKey]*netlink.Route, len(routes))
+	for _, route := range routes {
+		if key := keyOf(route); key.Dst.IsValid() && c.scope.owns(key.Table) {
+			routeMap[key] = route
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.routes = routeMap
+	return nil
+}
+
+// Observe applies a netlink route notification to the cache.
+func (c *KernelCache) Observe(update netlink.RouteUpdate) {
+	route := update.Route
+	key := keyOf(&route)
+	if !key.Dst.IsValid() || !c.scope.owns(key.Table) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch update.Type {
+	case unix.RTM_DELROUTE:
+		if route.Protocol == RouteProtocol {
+			delete(c.routes, key)
+		}
+	case unix.RTM_NEWROUTE:
+		c.observeNew(key, &route)
+	}
+}
+
+// observeNew records an added route. A foreign route with the same
+// priority replaced ours in the kernel, so it evicts the cached entry.
+// Callers must hold c.mu.
+func (c *KernelCache) observeNew(key RouteKey, route *netlink.Route) {
+	if route.Protocol == RouteProtocol {
+		c.routes[key] = route
+		return
+	}
+	if c.replacedBy(key, route) {
+		delete(c.routes, key)
+	}
+}
+
+// replacedBy reports whether a foreign route took the place of the owned
+// route cached under key. Callers must hold c.mu.
+func (c *KernelCache) replacedBy(key RouteKey, route *netlink.Route) bool {
+	owned, ok := c.routes[key]
+	return ok && priorityOf(owned) == priorityOf(route) && owned.Tos == route.Tos
+}
+
+// Get returns the cached owned route for key, if any.
+func (c *KernelCache) Get(key RouteKey) (*netlink.Route, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	route, ok := c.routes[key]
+	return route, ok
+}
+
+// Snapshot returns a copy of the cached routes.
+func (c *KernelCache) Snapshot() map[RouteKey]*netlink.Route {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	snapshot := make(map[RouteKey]*netlink.Route, len(c.routes))
+	for key, route := range c.routes {
+		snapshot[key] = route
+	}
+	return snapshot
+}
+
+// Len returns the number of cached routes.
+func (c *KernelCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.routes)
+}
+
+// record applies the outcome of a programmed batch to the cache. errs holds
+// the result of each operation in batch.
+func (c *KernelCache) record(batch []*routeOp, errs []error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, op := range batch {
+		switch {
+		case errs[i] != nil:
+		case op.kind == opDelete:
+			delete(c.routes, op.key)
+		default:
+			c.routes[op.key] = op.route
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestKernelCacheObserve(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+	owned := netlink.Route{Dst: dst, Protocol: RouteProtocol, Table: 100}
+	key := RouteKey{Table: 100, Dst: netip.MustParsePrefix("192.0.2.0/24")}
+
+	tests := []struct {
+		name     string
+		updates  []netlink.RouteUpdate
+		expected bool
+	}{
+		{
+			name:     "Owned route added",
+			updates:  []netlink.RouteUpdate{{Type: unix.RTM_NEWROUTE, Route: owned}},
+			expected: true,
+		},
+		{
+			name: "Owned route deleted",
+			updates: []netlink.RouteUpdate{
+				{Type: unix.RTM_NEWROUTE, Route: owned},
+				{Type: unix.RTM_DELROUTE, Route: owned},
+			},
+			expected: false,
+		},
+		{
+			name: "Owned route replaced by foreign route",
+			updates: []netlink.RouteUpdate{
+				{Type: unix.RTM_NEWROUTE, Route: owned},
+				{Type: unix.RTM_NEWROUTE, Route: netlink.Route{Dst: dst, Protocol: unix.RTPROT_STATIC, Table: 100}},
+			},
+			expected: false,
+		},
+		{
+			name: "Foreign route with another priority",
+			updates: []netlink.RouteUpdate{
+				{Type: unix.RTM_NEWROUTE, Route: owned},
+				{Type: unix.RTM_NEWROUTE, Route: netlink.Route{Dst: dst, Protocol: unix.RTPROT_STATIC, Table: 100, Priority: 10}},
+			},
+			expected: true,
+		},
+		{
+			name:     "Foreign route only",
+			updates:  []netlink.RouteUpdate{{Type: unix.RTM_NEWROUTE, Route: netlink.Route{Dst: dst, Table: 100}}},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewKernelCache(nil)
+			for _, update := range tt.updates {
+				cache.Observe(update)
+			}
+
+			_, ok := cache.Get(key)
+			assert.Equal(t, tt.expected, ok)
+		})
+	}
+}
+
+func TestKernelCacheKeysByTable(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+	cache := NewKernelCache(nil)
+
+	cache.Observe(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE,
+		Route: netlink.Route{Dst: dst, Protocol: RouteProtocol, Table: unix.RT_TABLE_MAIN}})
+	cache.Observe(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE,
+		Route: netlink.Route{Dst: dst, Protocol: RouteProtocol, Table: 100}})
+
+	assert.Equal(t, 2, cache.Len())
+}
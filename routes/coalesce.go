@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"sync"
+	"time"
+)
+
+// coalescer collects the keys changed by incoming updates and releases them
+// once per window, so a prefix that changes several times within the window
+// costs a single kernel operation for its final state. The window starts
+// with the first change after a flush, which bounds the added latency.
+type coalescer struct {
+	window time.Duration
+	flush  func(keys []RouteKey)
+
+	mu    sync.Mutex
+	dirty map[RouteKey]struct{}
+	timer *time.Timer
+}
+
+func newCoalescer(window time.Duration, flush func(keys []RouteKey)) *coalescer {
+	return &coalescer{
+		window: window,
+		flush:  flush,
+		dirty:  make(map[RouteKey]struct{}),
+	}
+}
+
+// add marks keys as changed. Without a window they are flushed at once.
+func (c *coalescer) add(keys []RouteKey) {
+	if c.window <= 0 {
+		c.flush(keys)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := c.dirty[key]; ok {
+			Metrics.Add(metricUpdatesCoalesced, 1)
+			continue
+		}
+		c.dirty[key] = struct{}{}
+	}
+	if len(c.dirty) > 0 && c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.fire)
+	}
+}
+
+// pending reports whether key has changes waiting for the window to close.
+func (c *coalescer) pending(key RouteKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.dirty[key]
+	return ok
+}
+
+// fire flushes the changed keys without waiting for the window.
+func (c *coalescer) fire() {
+	keys := c.take()
+	if len(keys) > 0 {
+		c.flush(keys)
+	}
+}
+
+// stop cancels a pending flush.
+func (c *coalescer) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func (c *coalescer) take() []RouteKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	keys := make([]RouteKey, 0, len(c.dirty))
+	for key := range c.dirty {
+		keys = append(keys, key)
+	}
+	c.dirty = make(map[RouteKey]struct{})
+	return keys
+}
@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+type flushRecorder struct {
+	mu      sync.Mutex
+	flushes [][]RouteKey
+}
+
+func (r *flushRecorder) flush(keys []RouteKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.flushes = append(r.flushes, keys)
+}
+
+func (r *flushRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.flushes)
+}
+
+func TestCoalescerWithoutWindow(t *testing.T) {
+	recorder := &flushRecorder{}
+	c := newCoalescer(0, recorder.flush)
+
+	c.add([]RouteKey{{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}})
+
+	assert.Equal(t, 1, recorder.count())
+}
+
+func TestCoalescerCollapsesKeys(t *testing.T) {
+	recorder := &flushRecorder{}
+	c := newCoalescer(20*time.Millisecond, recorder.flush)
+	key := RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}
+
+	c.add([]RouteKey{key})
+	c.add([]RouteKey{key})
+	assert.True(t, c.pending(key))
+	assert.Equal(t, 0, recorder.count())
+
+	assert.Eventually(t, func() bool { return recorder.count() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []RouteKey{key}, recorder.flushes[0])
+	assert.False(t, c.pending(key))
+}
+
+func TestManagerCoalescesFlap(t *testing.T) {
+	kernel := newFakeKernel()
+	m := newTestManager(t, kernel)
+	m.coalescer.window = time.Hour
+
+	for _, withdraw := range []bool{false, true, false, true, false} {
+		assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, withdraw)}))
+	}
+	m.Wait()
+
+	assert.Equal(t, []string{"replace 192.0.2.0/24 table 254"}, kernel.deltas())
+}
+
+func TestManagerCoalescedWithdrawIsNoop(t *testing.T) {
+	kernel := newFakeKernel()
+	m := newTestManager(t, kernel)
+	m.coalescer.window = time.Hour
+
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, false)}))
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, true)}))
+	m.Wait()
+
+	assert.Empty(t, kernel.deltas())
+}
@@ -0,0 +1,183 @@
+package routes
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+)
+
+// Penalties charged for each instability, as suggested by RFC 2439.
+const (
+	withdrawPenalty        = 1000.0
+	attributeChangePenalty = 500.0
+)
+
+// dampeningReuseInterval is how often suppressed prefixes are checked
+// against the reuse threshold.
+const dampeningReuseInterval = 5 * time.Second
+
+// dampener tracks an RFC 2439 figure of merit per prefix. Every withdrawal
+// or attribute change adds a penalty that decays exponentially with the
+// configured half-life. A prefix whose penalty crosses the suppress
+// threshold is kept out of the kernel until the penalty decays below the
+// reuse threshold.
+type dampener struct {
+	halfLife float64
+	suppress float64
+	reuse    float64
+	ceiling  float64
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[RouteKey]*dampState
+}
+
+type dampState struct {
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+// SuppressedPrefix describes a prefix held back by flap dampening.
+type SuppressedPrefix struct {
+	Prefix  string  `json:"prefix"`
+	Table   int     `json:"table"`
+	Penalty float64 `json:"penalty"`
+}
+
+// newDampener returns a dampener for cfg, or nil when dampening is disabled.
+func newDampener(cfg config.Dampening) *dampener {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	halfLife := cfg.HalfLife.Seconds()
+	return &dampener{
+		halfLife: halfLife,
+		suppress: cfg.SuppressThreshold,
+		reuse:    cfg.ReuseThreshold,
+		ceiling:  cfg.ReuseThreshold * math.Exp2(cfg.MaxSuppressTime.Seconds()/halfLife),
+		now:      time.Now,
+		entries:  make(map[RouteKey]*dampState),
+	}
+}
+
+// record charges the penalties for a batch of changes, given the routes
+// the RIB held for the same keys before the batch.
+func (d *dampener) record(previous, changes map[RouteKey]*netlink.Route) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, route := range changes {
+		old := previous[key]
+		switch {
+		case old != nil && route == nil:
+			d.charge(key, withdrawPenalty)
+		case old != nil && !routesEqual(old, route):
+			d.charge(key, attributeChangePenalty)
+		}
+	}
+}
+
+// charge adds penalty to key. Callers must hold d.mu.
+func (d *dampener) charge(key RouteKey, penalty float64) {
+	state, ok := d.entries[key]
+	if !ok {
+		state = &dampState{}
+		d.entries[key] = state
+	}
+
+	state.penalty = math.Min(d.decayed(state)+penalty, d.ceiling)
+	state.updated = d.now()
+	if !state.suppressed && state.penalty >= d.suppress {
+		state.suppressed = true
+		Metrics.Add(metricDampeningSuppressed, 1)
+		log.Printf("Suppressing flapping route %s (penalty %.0f)", key, state.penalty)
+	}
+}
+
+// decayed returns the current penalty of state. Callers must hold d.mu.
+func (d *dampener) decayed(state *dampState) float64 {
+	elapsed := d.now().Sub(state.updated).Seconds()
+	return state.penalty * math.Exp2(-elapsed/d.halfLife)
+}
+
+// suppressed reports whether key is currently held back.
+func (d *dampener) suppressed(key RouteKey) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.entries[key]
+	return ok && state.suppressed
+}
+
+// release lifts the suppression of the prefixes whose penalty decayed
+// below the reuse threshold and returns them. It also forgets prefixes
+// whose penalty no longer matters.
+func (d *dampener) release() []RouteKey {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var reused []RouteKey
+	for key, state := range d.entries {
+		penalty := d.decayed(state)
+		switch {
+		case state.suppressed && penalty < d.reuse:
+			reused = append(reused, key)
+			delete(d.entries, key)
+			log.Printf("Reusing route %s (penalty %.0f)", key, penalty)
+		case !state.suppressed && penalty < d.reuse/2:
+			delete(d.entries, key)
+		}
+	}
+	return reused
+}
+
+// run releases reusable prefixes through reuse until done is closed.
+func (d *dampener) run(done <-chan struct{}, reuse func(keys []RouteKey)) {
+	ticker := time.NewTicker(dampeningReuseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if keys := d.release(); len(keys) > 0 {
+				reuse(keys)
+			}
+		}
+	}
+}
+
+// status lists the suppressed prefixes, most penalised first.
+func (d *dampener) status() []SuppressedPrefix {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var suppressed []SuppressedPrefix
+	for key, state := range d.entries {
+		if state.suppressed {
+			suppressed = append(suppressed, SuppressedPrefix{
+				Prefix:  key.Dst.String(),
+				Table:   key.Table,
+				Penalty: math.Round(d.decayed(state)),
+			})
+		}
+	}
+	sort.Slice(suppressed, func(i, j int) bool { return suppressed[i].Penalty > suppressed[j].Penalty })
+	return suppressed
+}
@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func newTestDampener() (*dampener, *time.Time) {
+	cfg := config.Default().Dampening
+	cfg.Enabled = true
+	d := newDampener(cfg)
+
+	clock := time.Unix(0, 0)
+	d.now = func() time.Time { return clock }
+	return d, &clock
+}
+
+func TestDampenerDisabled(t *testing.T) {
+	d := newDampener(config.Default().Dampening)
+
+	assert.Nil(t, d)
+	assert.False(t, d.suppressed(RouteKey{Dst: netip.MustParsePrefix("192.0.2.0/24")}))
+}
+
+func TestDampenerSuppressesAndReuses(t *testing.T) {
+	d, clock := newTestDampener()
+	route := testOp("192.0.2.0/24", opReplace, false).route
+	key := keyOf(route)
+	withdraw := func() {
+		d.record(map[RouteKey]*netlink.Route{key: route}, map[RouteKey]*netlink.Route{key: nil})
+	}
+
+	withdraw()
+	assert.False(t, d.suppressed(key))
+	withdraw()
+	assert.True(t, d.suppressed(key))
+	assert.Len(t, d.status(), 1)
+
+	*clock = clock.Add(15 * time.Minute)
+	assert.Empty(t, d.release(), "penalty 1000 is above reuse")
+
+	*clock = clock.Add(15 * time.Minute)
+	assert.Equal(t, []RouteKey{key}, d.release())
+	assert.False(t, d.suppressed(key))
+}
+
+func TestDampenerAttributeChange(t *testing.T) {
+	d, _ := newTestDampener()
+	route := testOp("192.0.2.0/24", opReplace, false).route
+	changed := *route
+	changed.Priority = 10
+	key := keyOf(route)
+
+	d.record(map[RouteKey]*netlink.Route{key: route}, map[RouteKey]*netlink.Route{key: &changed})
+	d.record(map[RouteKey]*netlink.Route{key: nil}, map[RouteKey]*netlink.Route{key: route})
+
+	assert.InDelta(t, attributeChangePenalty, d.entries[key].penalty, 0.1)
+}
+
+func TestDampenerCeiling(t *testing.T) {
+	d, _ := newTestDampener()
+	route := testOp("192.0.2.0/24", opReplace, false).route
+	key := keyOf(route)
+
+	for i := 0; i < 100; i++ {
+		d.record(map[RouteKey]*netlink.Route{key: route}, map[RouteKey]*netlink.Route{key: nil})
+	}
+
+	assert.InDelta(t, 750*16, d.entries[key].penalty, 0.1)
+}
+
+func TestManagerKeepsSuppressedPrefixOut(t *testing.T) {
+	kernel := newFakeKernel()
+	m := newTestManager(t, kernel)
+	m.dampener, _ = newTestDampener()
+
+	for _, withdraw := range []bool{false, true, false, true, false} {
+		assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, withdraw)}))
+		m.Wait()
+	}
+
+	assert.Equal(t, 0, m.Kernel().Len())
+	assert.Empty(t, kernel.table(unix.RT_TABLE_MAIN))
+	assert.Equal(t, 1, m.RIB().Len())
+}
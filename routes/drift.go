@@ -0,0 +1,138 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DriftWatcher repairs owned routes that were removed or overwritten outside
+// of bgtables. It inspects the kernel notifications passed to HandleUpdate
+// and runs a periodic audit that catches anything the notifications missed.
+type DriftWatcher struct {
+	manager  *Manager
+	holdDown time.Duration
+	interval time.Duration
+
+	mu         sync.Mutex
+	lastRepair map[RouteKey]time.Time
+}
+
+// NewDriftWatcher returns a watcher that keeps the kernel in line with the
+// RIB of manager.
+func NewDriftWatcher(manager *Manager, cfg config.Drift) *DriftWatcher {
+	return &DriftWatcher{
+		manager:    manager,
+		holdDown:   cfg.RepairHoldDown,
+		interval:   cfg.AuditInterval,
+		lastRepair: make(map[RouteKey]time.Time),
+	}
+}
+
+// Run audits the kernel every audit interval until ctx is cancelled.
+func (w *DriftWatcher) Run(ctx context.Context) {
+	if w.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Audit()
+		}
+	}
+}
+
+// HandleUpdate repairs the owned route affected by a kernel notification,
+// if the notification shows it was removed or overwritten.
+func (w *DriftWatcher) HandleUpdate(update netlink.RouteUpdate) {
+	key := keyOf(&update.Route)
+	if !key.Dst.IsValid() || w.manager.coalescer.pending(key) {
+		return
+	}
+
+	desired, ok := w.manager.desired(key)
+	if !ok || priorityOf(&update.Route) != priorityOf(desired) {
+		return
+	}
+
+	switch update.Type {
+	case unix.RTM_DELROUTE:
+		if routesEqual(&update.Route, desired) {
+			w.repair(key, desired, "deleted")
+		}
+	case unix.RTM_NEWROUTE:
+		if !routesEqual(&update.Route, desired) {
+			w.repair(key, desired, "overwritten")
+		}
+	}
+}
+
+// Audit resynchronises the kernel cache with a fresh dump of the owned
+// routes, then reinstalls the routes that are missing or differ from the RIB.
+// It waits for the queued operations first and skips the keys held by the
+// coalescing window, which would otherwise show up as drift.
+func (w *DriftWatcher) Audit() {
+	w.manager.programming.Lock()
+	defer w.manager.programming.Unlock()
+
+	w.manager.outputs[0].pipeline.wait()
+	if err := w.manager.kernel.Seed(); err != nil {
+		log.Printf("Drift audit failed: %v", err)
+		return
+	}
+
+	w.expireRepairs()
+
+	existing := w.manager.kernel.Snapshot()
+	for key, desired := range w.manager.desiredSnapshot() {
+		if desired != nil && !w.manager.coalescer.pending(key) && !routesEqual(existing[key], desired) {
+			w.repair(key, desired, "audit")
+		}
+	}
+}
+
+func (w *DriftWatcher) repair(key RouteKey, route *netlink.Route, reason string) {
+	if !w.allowRepair(key) {
+		Metrics.Add(metricDriftSuppressed, 1)
+		log.Printf("Drift on %s (%s) within hold-down, not repairing", key, reason)
+		return
+	}
+
+	w.manager.submit(w.manager.outputs[0], []*routeOp{{key: key, route: route, kind: opReplace}})
+	Metrics.Add(metricDriftRepairs, 1)
+	log.Printf("Repairing route %s (%s)", key, reason)
+}
+
+func (w *DriftWatcher) allowRepair(key RouteKey) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := w.lastRepair[key]; ok && now.Sub(last) < w.holdDown {
+		return false
+	}
+	w.lastRepair[key] = now
+	return true
+}
+
+func (w *DriftWatcher) expireRepairs() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for key, last := range w.lastRepair {
+		if time.Since(last) >= w.holdDown {
+			delete(w.lastRepair, key)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package routes
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// driftPrefixes are the IPv4 and IPv6 routes the drift tests install.
+var driftPrefixes = []string{"192.0.2.0/24", "2001:db8:1::/48"}
+
+// newDriftTest returns a watcher of a manager that installed driftPrefixes
+// into kernel, which has no changes left to report.
+func newDriftTest(t *testing.T, kernel *fakeKernel) (*Manager, *DriftWatcher) {
+	t.Helper()
+	m := newTestManager(t, kernel)
+	require.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{
+		newTestPath(t, "192.0.2.0", 24, false),
+		newTestPath(t, "2001:db8:1::", 48, false),
+	}))
+	m.Wait()
+	kernel.deltas()
+	return m, NewDriftWatcher(m, config.Drift{RepairHoldDown: time.Hour})
+}
+
+// notify passes update to the cache of m and to w, as Manager.Start does.
+func notify(m *Manager, w *DriftWatcher, update netlink.RouteUpdate) {
+	m.kernel.Observe(update)
+	w.HandleUpdate(update)
+}
+
+// replaced returns the deltas that reinstall the routes of cidrs in the
+// main table.
+func replaced(cidrs ...string) []string {
+	deltas := make([]string, len(cidrs))
+	for i, cidr := range cidrs {
+		deltas[i] = "replace " + cidr + " table 254"
+	}
+	return deltas
+}
+
+func TestDriftWatcherAllowRepair(t *testing.T) {
+	w := NewDriftWatcher(newTestManager(t), config.Drift{RepairHoldDown: time.Hour})
+
+	assert.True(t, w.allowRepair(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}))
+	assert.False(t, w.allowRepair(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}))
+	assert.True(t, w.allowRepair(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("198.51.100.0/24")}))
+}
+
+func TestDriftWatcherExpireRepairs(t *testing.T) {
+	w := NewDriftWatcher(newTestManager(t), config.Drift{RepairHoldDown: time.Millisecond})
+
+	assert.True(t, w.allowRepair(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}))
+	time.Sleep(2 * time.Millisecond)
+	w.expireRepairs()
+
+	assert.Empty(t, w.lastRepair)
+}
+
+func TestDriftWatcherIgnoresUnownedUpdates(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("203.0.113.0/24")
+	w := NewDriftWatcher(newTestManager(t), config.Drift{RepairHoldDown: time.Hour})
+
+	w.HandleUpdate(netlink.RouteUpdate{
+		Type:  unix.RTM_DELROUTE,
+		Route: netlink.Route{Dst: dst, Table: unix.RT_TABLE_MAIN},
+	})
+	w.HandleUpdate(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE})
+
+	assert.Empty(t, w.lastRepair)
+}
+
+func TestDriftWatcherRepairsDeletedRoute(t *testing.T) {
+	kernel := newFakeKernel()
+	m, w := newDriftTest(t, kernel)
+
+	for _, cidr := range driftPrefixes {
+		route, ok := kernel.route(unix.RT_TABLE_MAIN, cidr)
+		require.True(t, ok, cidr)
+		kernel.remove(route)
+		notify(m, w, netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: route})
+	}
+	m.Wait()
+
+	assert.ElementsMatch(t, replaced(driftPrefixes...), kernel.deltas())
+	assert.Equal(t, []string{"192.0.2.0/24", "2001:db8:1::/48"}, kernel.table(unix.RT_TABLE_MAIN))
+}
+
+func TestDriftWatcherRepairsOverwrittenRoute(t *testing.T) {
+	kernel := newFakeKernel()
+	m, w := newDriftTest(t, kernel)
+
+	for _, cidr := range driftPrefixes {
+		route, ok := kernel.route(unix.RT_TABLE_MAIN, cidr)
+		require.True(t, ok, cidr)
+		route.Protocol = unix.RTPROT_STATIC
+		route.Gw = net.ParseIP("192.0.2.254")
+		if route.Dst.IP.To4() == nil {
+			route.Gw = net.ParseIP("2001:db8:ffff::254")
+		}
+		kernel.install(route)
+		notify(m, w, netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: route})
+	}
+	m.Wait()
+
+	assert.ElementsMatch(t, replaced(driftPrefixes...), kernel.deltas())
+	for _, cidr := range driftPrefixes {
+		route, _ := kernel.route(unix.RT_TABLE_MAIN, cidr)
+		assert.Equal(t, RouteProtocol, route.Protocol, cidr)
+		assert.Nil(t, route.Gw, cidr)
+	}
+}
+
+func TestDriftAuditRestoresMissingRoute(t *testing.T) {
+	kernel := newFakeKernel()
+	m, w := newDriftTest(t, kernel)
+
+	w.Audit()
+	m.Wait()
+	assert.Empty(t, kernel.deltas(), "routes in line with the RIB are left alone")
+
+	route, ok := kernel.route(unix.RT_TABLE_MAIN, "2001:db8:1::/48")
+	require.True(t, ok)
+	kernel.remove(route)
+	w.Audit()
+	m.Wait()
+
+	assert.Equal(t, replaced("2001:db8:1::/48"), kernel.deltas())
+	assert.Equal(t, []string{"192.0.2.0/24", "2001:db8:1::/48"}, kernel.table(unix.RT_TABLE_MAIN))
+}
@@ -0,0 +1,293 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// fakeKernel is an in-memory routing policy database standing in for the
+// netlink sockets of the kernel. Routes live in tables, keyed by
+// destination and metric, and keep their type and protocol; a deletion
+// only matches a route of the protocol it names. IPv6 routes sent without
+// a metric get the metric 1024, as in the kernel. It fails like the kernel
+// on missing routes (ESRCH), missing rules (ENOENT), duplicate rules
+// (EEXIST) and unknown route types (EINVAL), and fails any operation on a
+// prefix with the error injected for it. Successful changes are logged so
+// that tests can assert the exact kernel deltas.
+type fakeKernel struct {
+	mu      sync.Mutex
+	routes  map[fakeRouteKey]netlink.Route
+	rules   map[RuleKey]netlink.Rule
+	faults  map[netip.Prefix]error
+	listErr error
+	changes []string
+}
+
+type fakeRouteKey struct {
+	RouteKey
+	priority int
+}
+
+// fakeRouteTypes are the route types the fake accepts.
+var fakeRouteTypes = map[int]bool{
+	unix.RTN_UNICAST:     true,
+	unix.RTN_LOCAL:       true,
+	unix.RTN_BLACKHOLE:   true,
+	unix.RTN_UNREACHABLE: true,
+	unix.RTN_PROHIBIT:    true,
+}
+
+func newFakeKernel() *fakeKernel {
+	return &fakeKernel{
+		routes: make(map[fakeRouteKey]netlink.Route),
+		rules:  make(map[RuleKey]netlink.Rule),
+		faults: make(map[netip.Prefix]error),
+	}
+}
+
+// fail makes every later operation on cidr fail with err, or succeed again
+// when err is nil.
+func (k *fakeKernel) fail(cidr string, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	prefix := netip.MustParsePrefix(cidr)
+	if err == nil {
+		delete(k.faults, prefix)
+		return
+	}
+	k.faults[prefix] = err
+}
+
+// failList makes route and rule dumps fail with err.
+func (k *fakeKernel) failList(err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.listErr = err
+}
+
+// install adds route without logging it, as another program or an earlier
+// run of bgtables would have.
+func (k *fakeKernel) install(route netlink.Route) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	route.Priority = priorityOf(&route)
+	k.routes[fakeKeyOf(&route)] = route
+}
+
+// remove deletes route without logging it, as another program would have.
+func (k *fakeKernel) remove(route netlink.Route) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.routes, fakeKeyOf(&route))
+}
+
+// deltas returns the changes made since the last call.
+func (k *fakeKernel) deltas() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	changes := k.changes
+	k.changes = nil
+	return changes
+}
+
+// table returns the destinations of the routes in table, in order.
+func (k *fakeKernel) table(table int) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var dsts []string
+	for key := range k.routes {
+		if key.Table == table {
+			dsts = append(dsts, key.Dst.String())
+		}
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+// route returns the route of table and cidr with the lowest metric.
+func (k *fakeKernel) route(table int, cidr string) (netlink.Route, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	routes := k.sortedRoutes()
+	for _, route := range routes {
+		if key := keyOf(&route); key.Table == table && key.Dst.String() == cidr {
+			return route, true
+		}
+	}
+	return netlink.Route{}, false
+}
+
+func fakeKeyOf(route *netlink.Route) fakeRouteKey {
+	return fakeRouteKey{RouteKey: keyOf(route), priority: priorityOf(route)}
+}
+
+// fault returns the error injected for prefix. Callers must hold k.mu.
+func (k *fakeKernel) fault(prefix netip.Prefix) error {
+	return k.faults[prefix]
+}
+
+func (k *fakeKernel) RouteReplace(route *netlink.Route) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := fakeKeyOf(route)
+	if err := k.fault(key.Dst); err != nil {
+		return err
+	}
+	if !fakeRouteTypes[route.Type] {
+		return unix.EINVAL
+	}
+	stored := *route
+	stored.Priority = key.priority
+	k.routes[key] = stored
+	k.changes = append(k.changes, fmt.Sprintf("replace %s", key.RouteKey))
+	return nil
+}
+
+func (k *fakeKernel) RouteDel(route *netlink.Route) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := fakeKeyOf(route)
+	if err := k.fault(key.Dst); err != nil {
+		return err
+	}
+	existing, ok := k.routes[key]
+	if !ok || (route.Protocol != 0 && existing.Protocol != route.Protocol) {
+		return unix.ESRCH
+	}
+	delete(k.routes, key)
+	k.changes = append(k.changes, fmt.Sprintf("delete %s", key.RouteKey))
+	return nil
+}
+
+// RouteListFiltered supports the table and protocol filters, where table
+// RT_TABLE_UNSPEC stands for every table.
+func (k *fakeKernel) RouteListFiltered(_ int, filter *netlink.Route, mask uint64) ([]netlink.Route, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.listErr != nil {
+		return nil, k.listErr
+	}
+	var routes []netlink.Route
+	for _, route := range k.sortedRoutes() {
+		if fakeRouteMatches(&route, filter, mask) {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+func fakeRouteMatches(route, filter *netlink.Route, mask uint64) bool {
+	if mask&netlink.RT_FILTER_PROTOCOL != 0 && route.Protocol != filter.Protocol {
+		return false
+	}
+	return mask&netlink.RT_FILTER_TABLE == 0 || filter.Table == unix.RT_TABLE_UNSPEC ||
+		keyOf(route).Table == filter.Table
+}
+
+// sortedRoutes returns the routes by table, destination and metric.
+// Callers must hold k.mu.
+func (k *fakeKernel) sortedRoutes() []netlink.Route {
+	keys := make([]fakeRouteKey, 0, len(k.routes))
+	for key := range k.routes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.Dst != b.Dst {
+			return a.Dst.String() < b.Dst.String()
+		}
+		return a.priority < b.priority
+	})
+	routes := make([]netlink.Route, len(keys))
+	for i, key := range keys {
+		routes[i] = k.routes[key]
+	}
+	return routes
+}
+
+func (k *fakeKernel) RuleAdd(rule *netlink.Rule) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := fakeRuleKey(rule)
+	if err := k.fault(key.Src); err != nil {
+		return err
+	}
+	if _, ok := k.rules[key]; ok {
+		return unix.EEXIST
+	}
+	k.rules[key] = *rule
+	k.changes = append(k.changes, fmt.Sprintf("rule add %s", key))
+	return nil
+}
+
+func (k *fakeKernel) RuleDel(rule *netlink.Rule) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := fakeRuleKey(rule)
+	if err := k.fault(key.Src); err != nil {
+		return err
+	}
+	if _, ok := k.rules[key]; !ok {
+		return unix.ENOENT
+	}
+	delete(k.rules, key)
+	k.changes = append(k.changes, fmt.Sprintf("rule del %s", key))
+	return nil
+}
+
+func (k *fakeKernel) RuleList(int) ([]netlink.Rule, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.listErr != nil {
+		return nil, k.listErr
+	}
+	rules := make([]netlink.Rule, 0, len(k.rules))
+	for _, rule := range k.rules {
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (*fakeKernel) Close() {}
+
+// ruleKeys returns the rules, in order.
+func (k *fakeKernel) ruleKeys() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make([]string, 0, len(k.rules))
+	for key := range k.rules {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fakeRuleKey identifies rule regardless of its owner.
+func fakeRuleKey(rule *netlink.Rule) RuleKey {
+	owned := *rule
+	owned.Protocol = uint8(RouteProtocol)
+	key, _ := ownedRuleKey(&owned)
+	return key
+}
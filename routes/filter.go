@@ -0,0 +1,229 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/karasz/bgtables/config"
+)
+
+// Reasons a prefix is rejected by the prefix filter.
+const (
+	rejectBogon     = "bogon"
+	rejectMinLength = "min_length"
+	rejectMaxLength = "max_length"
+	rejectDenied    = "denied"
+)
+
+// recentRejections is the number of rejected prefixes kept for display.
+const recentRejections = 100
+
+// bogons lists martian and reserved address space that is never routed on
+// the Internet.
+var bogons = mustParsePrefixes(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24",
+	"192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/8", "100::/64", "2001:2::/48", "2001:10::/28", "2001:db8::/32",
+	"3ffe::/16", "fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8",
+)
+
+// prefixFilter decides which prefixes learned from GoBGP may enter the RIB.
+type prefixFilter struct {
+	bogons        bool
+	ipv4          lengthRange
+	ipv6          lengthRange
+	rules         []prefixRule
+	defaultPermit bool
+
+	mu       sync.Mutex
+	rejected map[string]int64
+	recent   []Rejection
+	next     int
+}
+
+type lengthRange struct {
+	min, max int
+}
+
+type prefixRule struct {
+	prefix netip.Prefix
+	ge, le int
+	permit bool
+}
+
+// FilterStatus reports the prefixes refused by the prefix filter.
+type FilterStatus struct {
+	Reasons map[string]int64 `json:"reasons"`
+	Recent  []Rejection      `json:"recent"`
+}
+
+// Rejection records a prefix refused by the prefix filter.
+type Rejection struct {
+	Prefix string `json:"prefix"`
+	Reason string `json:"reason"`
+}
+
+// newPrefixFilter compiles cfg. It returns nil when cfg accepts everything.
+func newPrefixFilter(cfg config.Filter) (*prefixFilter, error) {
+	if isPermissive(cfg) {
+		return nil, nil
+	}
+
+	rules, err := compileRules(cfg.Prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &prefixFilter{
+		bogons:        cfg.Bogons,
+		ipv4:          compileLengthRange(cfg.IPv4, 32),
+		ipv6:          compileLengthRange(cfg.IPv6, 128),
+		rules:         rules,
+		defaultPermit: cfg.DefaultAction != config.ActionDeny,
+		rejected:      make(map[string]int64),
+	}, nil
+}
+
+func isPermissive(cfg config.Filter) bool {
+	return !cfg.Bogons && cfg.IPv4 == config.LengthRange{} && cfg.IPv6 == config.LengthRange{} &&
+		len(cfg.Prefixes) == 0 && cfg.DefaultAction != config.ActionDeny
+}
+
+func compileLengthRange(cfg config.LengthRange, bits int) lengthRange {
+	r := lengthRange{min: cfg.MinLength, max: cfg.MaxLength}
+	if r.max == 0 {
+		r.max = bits
+	}
+	return r
+}
+
+func compileRules(cfg []config.PrefixRule) ([]prefixRule, error) {
+	rules := make([]prefixRule, 0, len(cfg))
+	for _, rule := range cfg {
+		prefix, err := netip.ParsePrefix(rule.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter prefix %q: %w", rule.Prefix, err)
+		}
+
+		ge, le := prefixRuleRange(prefix, rule.GE, rule.LE)
+		if ge > le || le > prefix.Addr().BitLen() {
+			return nil, fmt.Errorf("invalid length range ge %d le %d for filter prefix %s", rule.GE, rule.LE, prefix)
+		}
+		rules = append(rules, prefixRule{
+			prefix: prefix.Masked(),
+			ge:     ge,
+			le:     le,
+			permit: rule.Action == config.ActionPermit,
+		})
+	}
+	return rules, nil
+}
+
+// prefixRuleRange returns the lengths matched by a rule, following the
+// usual prefix-list semantics of ge and le.
+func prefixRuleRange(prefix netip.Prefix, ge, le int) (int, int) {
+	switch {
+	case ge == 0 && le == 0:
+		return prefix.Bits(), prefix.Bits()
+	case le == 0:
+		return ge, prefix.Addr().BitLen()
+	case ge == 0:
+		return prefix.Bits(), le
+	}
+	return ge, le
+}
+
+// evaluate returns the reason prefix is rejected, or "" when it is accepted.
+// A nil filter accepts everything.
+func (f *prefixFilter) evaluate(prefix netip.Prefix) string {
+	if f == nil {
+		return ""
+	}
+	if f.bogons && isBogon(prefix) {
+		return rejectBogon
+	}
+
+	bounds := f.ipv6
+	if prefix.Addr().Is4() {
+		bounds = f.ipv4
+	}
+	switch {
+	case prefix.Bits() < bounds.min:
+		return rejectMinLength
+	case prefix.Bits() > bounds.max:
+		return rejectMaxLength
+	}
+
+	if !f.permits(prefix) {
+		return rejectDenied
+	}
+	return ""
+}
+
+// permits applies the first matching prefix rule, or the default action.
+func (f *prefixFilter) permits(prefix netip.Prefix) bool {
+	for _, rule := range f.rules {
+		if rule.matches(prefix) {
+			return rule.permit
+		}
+	}
+	return f.defaultPermit
+}
+
+func (r prefixRule) matches(prefix netip.Prefix) bool {
+	return prefix.Addr().Is4() == r.prefix.Addr().Is4() &&
+		prefix.Bits() >= r.ge && prefix.Bits() <= r.le &&
+		r.prefix.Contains(prefix.Addr())
+}
+
+// reject counts a rejection and keeps it among the recent ones.
+func (f *prefixFilter) reject(rejection Rejection) {
+	Metrics.Add(metricFilterRejected, 1)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rejected[rejection.Reason]++
+	if len(f.recent) < recentRejections {
+		f.recent = append(f.recent, rejection)
+		return
+	}
+	f.recent[f.next] = rejection
+	f.next = (f.next + 1) % recentRejections
+}
+
+// status returns the rejection counters per reason and the most recently
+// rejected prefixes.
+func (f *prefixFilter) status() FilterStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reasons := make(map[string]int64, len(f.rejected))
+	for reason, n := range f.rejected {
+		reasons[reason] = n
+	}
+	recent := make([]Rejection, 0, len(f.recent))
+	recent = append(recent, f.recent[f.next:]...)
+	recent = append(recent, f.recent[:f.next]...)
+	return FilterStatus{Reasons: reasons, Recent: recent}
+}
+
+func isBogon(prefix netip.Prefix) bool {
+	for _, bogon := range bogons {
+		if bogon.Bits() <= prefix.Bits() && bogon.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParsePrefixes(prefixes ...string) []netip.Prefix {
+	parsed := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		parsed = append(parsed, netip.MustParsePrefix(prefix))
+	}
+	return parsed
+}
@@ -0,0 +1,141 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFilter(t *testing.T, cfg config.Filter) *prefixFilter {
+	t.Helper()
+	if cfg.DefaultAction == "" {
+		cfg.DefaultAction = config.ActionPermit
+	}
+	filter, err := newPrefixFilter(cfg)
+	require.NoError(t, err)
+	return filter
+}
+
+// accept reports whether filter accepts prefix, counting a rejection as the
+// RIB does for a prefix it did not refuse before.
+func accept(filter *prefixFilter, prefix netip.Prefix) bool {
+	var v verdict
+	v.filtered = filter.evaluate(prefix)
+	v.count(verdict{}, prefix, filter)
+	return v.filtered == ""
+}
+
+func TestPrefixFilterPermissive(t *testing.T) {
+	filter := newTestFilter(t, config.Filter{})
+	assert.Nil(t, filter)
+	assert.True(t, accept(filter, netip.MustParsePrefix("10.0.0.0/8")))
+}
+
+func TestPrefixFilterRules(t *testing.T) {
+	filter := newTestFilter(t, config.Filter{
+		Prefixes: []config.PrefixRule{
+			{Prefix: "198.51.100.0/24", Action: config.ActionPermit},
+			{Prefix: "203.0.113.0/24", GE: 25, LE: 26, Action: config.ActionPermit},
+			{Prefix: "10.0.0.0/8", GE: 16, Action: config.ActionDeny},
+			{Prefix: "2001:db8::/32", LE: 48, Action: config.ActionPermit},
+		},
+		DefaultAction: config.ActionDeny,
+	})
+
+	tests := []struct {
+		cidr   string
+		accept bool
+	}{
+		{"198.51.100.0/24", true},
+		{"198.51.100.0/25", false},
+		{"203.0.113.0/24", false},
+		{"203.0.113.128/25", true},
+		{"203.0.113.64/26", true},
+		{"203.0.113.0/27", false},
+		{"10.1.0.0/16", false},
+		{"10.0.0.0/8", false},
+		{"2001:db8::/32", true},
+		{"2001:db8:1::/48", true},
+		{"2001:db8:1:1::/64", false},
+		{"192.0.2.0/24", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.accept, accept(filter, netip.MustParsePrefix(tt.cidr)), tt.cidr)
+	}
+}
+
+func TestPrefixFilterFirstMatchWins(t *testing.T) {
+	filter := newTestFilter(t, config.Filter{
+		Prefixes: []config.PrefixRule{
+			{Prefix: "10.1.0.0/16", Action: config.ActionPermit},
+			{Prefix: "10.0.0.0/8", LE: 32, Action: config.ActionDeny},
+		},
+	})
+
+	assert.True(t, accept(filter, netip.MustParsePrefix("10.1.0.0/16")))
+	assert.False(t, accept(filter, netip.MustParsePrefix("10.2.0.0/16")))
+	assert.True(t, accept(filter, netip.MustParsePrefix("172.16.0.0/12")))
+}
+
+func TestPrefixFilterBogonsAndLengths(t *testing.T) {
+	filter := newTestFilter(t, config.Filter{
+		Bogons: true,
+		IPv4:   config.LengthRange{MinLength: 8, MaxLength: 24},
+		IPv6:   config.LengthRange{MaxLength: 48},
+	})
+
+	assert.False(t, accept(filter, netip.MustParsePrefix("10.1.0.0/16")))
+	assert.False(t, accept(filter, netip.MustParsePrefix("192.168.1.0/24")))
+	assert.False(t, accept(filter, netip.MustParsePrefix("2001:db8::/32")))
+	assert.False(t, accept(filter, netip.MustParsePrefix("1.0.0.0/7")))
+	assert.False(t, accept(filter, netip.MustParsePrefix("1.1.1.0/25")))
+	assert.False(t, accept(filter, netip.MustParsePrefix("2a00:1::/64")))
+	assert.True(t, accept(filter, netip.MustParsePrefix("1.1.1.0/24")))
+	assert.True(t, accept(filter, netip.MustParsePrefix("2a00::/16")))
+
+	status := filter.status()
+	assert.Equal(t, map[string]int64{rejectBogon: 3, rejectMinLength: 1, rejectMaxLength: 2}, status.Reasons)
+	assert.Len(t, status.Recent, 6)
+	assert.Equal(t, Rejection{Prefix: "10.1.0.0/16", Reason: rejectBogon}, status.Recent[0])
+}
+
+func TestPrefixFilterRecentRejections(t *testing.T) {
+	filter := newTestFilter(t, config.Filter{DefaultAction: config.ActionDeny})
+
+	for i := 0; i < recentRejections+5; i++ {
+		accept(filter, netip.MustParsePrefix(fmt.Sprintf("10.0.%d.0/24", i)))
+	}
+	accept(filter, netip.MustParsePrefix("192.0.2.0/24"))
+
+	recent := filter.status().Recent
+	assert.Len(t, recent, recentRejections)
+	assert.Equal(t, "192.0.2.0/24", recent[len(recent)-1].Prefix)
+}
+
+func TestPrefixFilterInvalidRules(t *testing.T) {
+	for _, rule := range []config.PrefixRule{
+		{Prefix: "10.0.0.0", Action: config.ActionDeny},
+		{Prefix: "10.0.0.0/8", GE: 24, LE: 16, Action: config.ActionDeny},
+		{Prefix: "10.0.0.0/8", LE: 33, Action: config.ActionDeny},
+	} {
+		_, err := newPrefixFilter(config.Filter{Prefixes: []config.PrefixRule{rule}})
+		assert.Error(t, err, rule.Prefix)
+	}
+}
+
+func TestFilterKeepsRejectedPrefixesOutOfRIB(t *testing.T) {
+	m := newTestManager(t)
+	m.rib.filter = newTestFilter(t, config.Filter{IPv4: config.LengthRange{MaxLength: 24}})
+
+	paths := testPaths(t, 2)
+	paths = append(paths, newTestPath(t, "10.1.0.0", 25, false))
+	assert.NoError(t, m.UpdateLocalRoutes(paths))
+	m.Wait()
+
+	assert.Equal(t, 2, m.RIB().Len())
+	assert.Equal(t, 2, m.Kernel().Len())
+}
@@ -1,125 +1,244 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
 
+	"github.com/karasz/bgtables/routes/pathattr"
 	apipb "github.com/osrg/gobgp/v3/api"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-type routeOperation struct {
-	cidr  string
-	route *netlink.Route
-}
+// RouteProtocol marks the kernel routes and ip rules installed, and therefore
+// owned, by bgtables. The kernel and the routing daemons assign no meaning
+// to it, unlike RTPROT_BGP, which FRR uses for its own BGP routes.
+const RouteProtocol netlink.RouteProtocol = 201
 
-// UpdateLocalRoutes updates the local routes with the provided paths.
-func UpdateLocalRoutes(paths []*apipb.Path) error {
-	existingRoutes, err := getExistingRoutes()
-	if err != nil {
-		return err
-	}
+// ip6DefaultMetric is the metric the kernel stores IPv6 routes sent without
+// one with.
+const ip6DefaultMetric = 1024
 
-	desiredRoutes := buildDesiredRoutes(paths)
+// RouteKey identifies a kernel route by routing table and destination prefix.
+type RouteKey struct {
+	Table int
+	Dst   netip.Prefix
+}
 
-	if err := applyRouteChanges(existingRoutes, desiredRoutes); err != nil {
-		return fmt.Errorf("failed to apply route changes: %w", err)
+func (k RouteKey) String() string {
+	return fmt.Sprintf("%s table %d", k.Dst, k.Table)
+}
+
+// keyOf returns the RouteKey of a kernel route. Its Dst is invalid for
+// routes that are neither IPv4 nor IPv6.
+func keyOf(route *netlink.Route) RouteKey {
+	table := route.Table
+	if table == unix.RT_TABLE_UNSPEC {
+		table = unix.RT_TABLE_MAIN
 	}
+	return RouteKey{Table: table, Dst: prefixOf(route)}
+}
 
-	return nil
+// prefixOf returns the destination of route. The kernel omits the
+// destination of default routes, which is then derived from the family.
+func prefixOf(route *netlink.Route) netip.Prefix {
+	return netPrefix(route.Dst, route.Family)
 }
 
-func getExistingRoutes() (map[string]*netlink.Route, error) {
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list kernel routes: %w", err)
+// netPrefix converts a netlink prefix of family to a netip.Prefix, where a
+// nil prefix stands for the whole address space.
+func netPrefix(n *net.IPNet, family int) netip.Prefix {
+	if n == nil {
+		switch family {
+		case netlink.FAMILY_V4:
+			return netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		case netlink.FAMILY_V6:
+			return netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+		return netip.Prefix{}
 	}
 
-	routeMap := make(map[string]*netlink.Route)
-	for _, route := range routes {
-		if route.Dst != nil {
-			routeMap[route.Dst.String()] = &route
-		}
+	addr, ok := netip.AddrFromSlice(n.IP)
+	ones, bits := n.Mask.Size()
+	if !ok || bits == 0 {
+		return netip.Prefix{}
+	}
+	if bits == 8*net.IPv4len {
+		addr = addr.Unmap()
 	}
-	return routeMap, nil
+	return netip.PrefixFrom(addr, ones)
 }
 
-func buildDesiredRoutes(paths []*apipb.Path) map[string]*netlink.Route {
-	desiredRoutes := make(map[string]*netlink.Route)
+// priorityOf returns the metric the kernel holds route with.
+func priorityOf(route *netlink.Route) int {
+	if route.Priority == 0 && prefixOf(route).Addr().Is6() {
+		return ip6DefaultMetric
+	}
+	return route.Priority
+}
 
-	for _, path := range paths {
-		if path.IsWithdraw {
-			continue
-		}
+// ipNetOf converts prefix to the destination of a netlink route.
+func ipNetOf(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
 
-		route := createRouteFromPath(path)
-		if route != nil {
-			desiredRoutes[route.cidr] = route.route
-		}
+// familyOf returns the address family of prefix, netlink.FAMILY_V4 or
+// netlink.FAMILY_V6.
+func familyOf(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return netlink.FAMILY_V4
 	}
+	return netlink.FAMILY_V6
+}
 
-	return desiredRoutes
+type routeOperation struct {
+	prefix netip.Prefix
+	route  *netlink.Route
+	// linkLocal is set when the next hop of the path is an IPv6 link-local
+	// address, which the kernel only reaches through the interface of its
+	// link. bgtables does not know that interface.
+	linkLocal bool
 }
 
+// nlriRegistry decodes the NLRI of the paths the kernel routes are built
+// from.
+var nlriRegistry = NewNLRIRegistry()
+
+// createRouteFromPath returns the route of an IP unicast path, or nil for
+// paths of other families, multicast ones included, and paths that fail to
+// decode. Unknown NLRI types are reported by the registry.
 func createRouteFromPath(path *apipb.Path) *routeOperation {
-	cidr, err := ParseNlriToCIDR(path.Nlri)
+	nlri, err := nlriRegistry.DecodePath(path)
 	if err != nil {
-		log.Printf("Failed to parse Nlri %v: %v", path.Nlri, err)
+		if !errors.Is(err, ErrUnknownNLRI) {
+			log.Printf("Failed to parse Nlri %v: %v", path.Nlri, err)
+		}
 		return nil
 	}
-
-	dst, err := netlink.ParseIPNet(cidr)
-	if err != nil {
-		log.Printf("Invalid route CIDR %s for addition: %v", cidr, err)
+	prefix, ok := installablePrefix(nlri)
+	if !ok {
 		return nil
 	}
 
+	gw, linkLocal := gateway(path, prefix)
 	return &routeOperation{
-		cidr:  cidr,
-		route: &netlink.Route{Dst: dst},
+		prefix: prefix,
+		route: &netlink.Route{
+			Dst:      ipNetOf(prefix),
+			Gw:       gw,
+			Protocol: RouteProtocol,
+			Table:    unix.RT_TABLE_MAIN,
+			Type:     unix.RTN_UNICAST,
+		},
+		linkLocal: linkLocal,
 	}
 }
 
-func applyRouteChanges(existing, desired map[string]*netlink.Route) error {
-	if err := addOrUpdateRoutes(desired); err != nil {
-		return err
+// gateway returns the next hop of path as the gateway of the route of
+// prefix, or nil when the kernel cannot use it: locally originated paths
+// carry an unspecified next hop and one of the other address family needs
+// a RTA_VIA attribute. It reports an IPv6 link-local next hop, which needs
+// an interface, instead of returning it.
+func gateway(path *apipb.Path, prefix netip.Prefix) (net.IP, bool) {
+	hop, err := pathattr.NextHop(path)
+	if err != nil || !hop.IsValid() {
+		return nil, false
+	}
+	hop = hop.Unmap()
+	switch {
+	case hop.IsUnspecified() || hop.Is4() != prefix.Addr().Is4():
+		return nil, false
+	case hop.Is6() && hop.IsLinkLocalUnicast():
+		return nil, true
 	}
+	return hop.AsSlice(), false
+}
 
-	return removeStaleRoutes(existing, desired)
+// installablePrefix returns the prefix of an IP unicast NLRI.
+func installablePrefix(nlri NLRI) (netip.Prefix, bool) {
+	unicast, ok := nlri.(UnicastNLRI)
+	if !ok || unicast.Multicast() {
+		return netip.Prefix{}, false
+	}
+	return unicast.Prefix, true
 }
 
-func addOrUpdateRoutes(desired map[string]*netlink.Route) error {
-	for cidr, route := range desired {
-		if err := updateRoute(cidr, route); err != nil {
-			log.Printf("Failed to manage route %s: %v", cidr, err)
+// deltaOps returns the operations that program the changes produced by
+// RIB.Apply: the removal of withdrawn keys that are installed, and the
+// installation of routes that differ from the kernel.
+func deltaOps(kernel *KernelCache, changes map[RouteKey]*netlink.Route) []*routeOp {
+	ops := make([]*routeOp, 0, len(changes))
+	for key, route := range changes {
+		existing, installed := kernel.Get(key)
+		switch {
+		case route == nil && installed:
+			ops = append(ops, &routeOp{key: key, route: existing, kind: opDelete})
+		case route != nil && !routesEqual(existing, route):
+			ops = append(ops, &routeOp{key: key, route: route, kind: opReplace, bulk: !installed})
 		}
 	}
-	return nil
+	return ops
 }
 
-func removeStaleRoutes(existing, desired map[string]*netlink.Route) error {
-	for cidr, route := range existing {
-		if _, exists := desired[cidr]; !exists {
-			if err := removeRoute(cidr, route); err != nil {
-				log.Printf("Failed to remove route %s: %v", cidr, err)
-			}
+// diffOps returns the operations that turn the existing owned routes into
+// the desired ones. A nil desired route counts as absent.
+func diffOps(existing, desired map[RouteKey]*netlink.Route) []*routeOp {
+	var ops []*routeOp
+	for key, route := range desired {
+		current, installed := existing[key]
+		if route != nil && !routesEqual(current, route) {
+			ops = append(ops, &routeOp{key: key, route: route, kind: opReplace, bulk: !installed})
 		}
 	}
-	return nil
+	for key, route := range existing {
+		if desired[key] == nil {
+			ops = append(ops, &routeOp{key: key, route: route, kind: opDelete})
+		}
+	}
+	return ops
 }
 
-func updateRoute(cidr string, route *netlink.Route) error {
-	if err := netlink.RouteReplace(route); err != nil {
-		return fmt.Errorf("failed to update route: %w", err)
+// routesEqual reports whether the kernel route actual already provides the
+// forwarding behaviour described by desired. A desired route without a
+// device leaves the kernel to resolve it from the gateway.
+func routesEqual(actual, desired *netlink.Route) bool {
+	if actual == nil || desired == nil {
+		return actual == desired
 	}
-	log.Printf("Updated route: %s", cidr)
-	return nil
+
+	return prefixOf(actual) == prefixOf(desired) &&
+		actual.Gw.Equal(desired.Gw) &&
+		(desired.LinkIndex == 0 || actual.LinkIndex == desired.LinkIndex) &&
+		actual.Table == desired.Table &&
+		actual.Type == desired.Type &&
+		priorityOf(actual) == priorityOf(desired) &&
+		actual.Protocol == desired.Protocol &&
+		realmsEqual(actual, desired) &&
+		actual.Src.Equal(desired.Src) &&
+		metricsEqual(actual, desired)
 }
 
-func removeRoute(cidr string, route *netlink.Route) error {
-	if err := netlink.RouteDel(route); err != nil {
-		return fmt.Errorf("failed to delete route: %w", err)
-	}
-	log.Printf("Removed route: %s", cidr)
-	return nil
+// realmsEqual compares the realms of IPv4 routes. IPv6 routes always report
+// realm 0.
+func realmsEqual(actual, desired *netlink.Route) bool {
+	return actual.Realm == desired.Realm || !hasRealm(desired)
+}
+
+// hasRealm reports whether the kernel keeps the realm of route: IPv6
+// ignores RTA_FLOW.
+func hasRealm(route *netlink.Route) bool {
+	return prefixOf(route).Addr().Is4()
+}
+
+func metricsEqual(actual, desired *netlink.Route) bool {
+	return actual.MTU == desired.MTU &&
+		actual.AdvMSS == desired.AdvMSS &&
+		actual.InitCwnd == desired.InitCwnd &&
+		actual.InitRwnd == desired.InitRwnd
 }
@@ -1,10 +1,15 @@
 package routes
 
 import (
+	"net"
+	"net/netip"
 	"testing"
 
 	apipb "github.com/osrg/gobgp/v3/api"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/types/known/anypb"
 )
 
@@ -20,38 +25,72 @@ func TestUpdateLocalRoutes(t *testing.T) {
 	}
 
 	tests := []struct {
-		name        string
-		paths       []*apipb.Path
-		expectError bool
+		name   string
+		paths  []*apipb.Path
+		deltas []string
 	}{
 		{
-			name:        "Empty paths",
-			paths:       []*apipb.Path{},
-			expectError: false,
+			name:  "Empty paths",
+			paths: []*apipb.Path{},
 		},
 		{
 			name: "Valid paths",
 			paths: []*apipb.Path{
 				{
-					Nlri: nlriAny,
+					Family: unicastFamily(prefix.Prefix),
+					Nlri:   nlriAny,
+				},
+			},
+			deltas: []string{"replace 192.168.1.0/24 table 254"},
+		},
+		{
+			name: "Withdrawn path",
+			paths: []*apipb.Path{
+				{
+					Family:     unicastFamily(prefix.Prefix),
+					Nlri:       nlriAny,
+					IsWithdraw: true,
 				},
 			},
-			expectError: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := UpdateLocalRoutes(tt.paths)
-			if tt.expectError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
+			kernel := newFakeKernel()
+			m := newTestManager(t, kernel)
+
+			assert.NoError(t, m.UpdateLocalRoutes(tt.paths))
+			m.Wait()
+			assert.Equal(t, tt.deltas, kernel.deltas())
 		})
 	}
 }
 
+func TestSeedOwnsOnlyBGPRoutes(t *testing.T) {
+	kernel := newFakeKernel()
+	static := testOp("198.51.100.0/24", opReplace, false).route
+	static.Protocol = unix.RTPROT_STATIC
+	kernel.install(*static)
+	kernel.install(*testOp("203.0.113.0/24", opReplace, false).route)
+	m := newTestManager(t, kernel)
+	require.NoError(t, m.Kernel().Seed())
+
+	require.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, false)}))
+	m.Wait()
+	m.resync()
+	m.Wait()
+
+	assert.Equal(t, []string{
+		"replace 192.0.2.0/24 table 254",
+		"delete 203.0.113.0/24 table 254",
+	}, kernel.deltas(), "the stale owned route is removed and the static one kept")
+	assert.Equal(t, []string{"192.0.2.0/24", "198.51.100.0/24"}, kernel.table(unix.RT_TABLE_MAIN))
+
+	kernel.failList(unix.EPERM)
+	assert.ErrorIs(t, m.Kernel().Seed(), unix.EPERM)
+}
+
 func TestCreateRouteFromPath(t *testing.T) {
 	prefix := &apipb.IPAddressPrefix{
 		Prefix:    "192.168.1.0",
@@ -71,13 +110,23 @@ func TestCreateRouteFromPath(t *testing.T) {
 		{
 			name: "Valid path",
 			path: &apipb.Path{
-				Nlri: nlriAny,
+				Family: unicastFamily(prefix.Prefix),
+				Nlri:   nlriAny,
 			},
 			expectNil: false,
 		},
+		{
+			name: "Multicast path",
+			path: &apipb.Path{
+				Family: &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_MULTICAST},
+				Nlri:   nlriAny,
+			},
+			expectNil: true,
+		},
 		{
 			name: "Invalid NLRI",
 			path: &apipb.Path{
+				Family: unicastFamily("192.168.1.0"),
 				Nlri: &anypb.Any{
 					TypeUrl: "type.googleapis.com/apipb.IPAddressPrefix",
 					Value:   []byte(`invalid`),
@@ -99,6 +148,98 @@ func TestCreateRouteFromPath(t *testing.T) {
 	}
 }
 
+func TestCreateRouteGateway(t *testing.T) {
+	tests := []struct {
+		name      string
+		prefix    string
+		length    uint32
+		hop       string
+		want      net.IP
+		linkLocal bool
+	}{
+		{"next hop", "10.0.0.0", 24, "192.0.2.1", net.ParseIP("192.0.2.1").To4(), false},
+		{"ipv6 next hop", "2001:db8::", 32, "2001:db8:1::1", net.ParseIP("2001:db8:1::1"), false},
+		{"locally originated", "10.0.0.0", 24, "0.0.0.0", nil, false},
+		{"link-local", "2001:db8::", 32, "fe80::1", nil, true},
+		{"ipv4 link-local", "10.0.0.0", 24, "169.254.0.1", net.ParseIP("169.254.0.1").To4(), false},
+		{"other family", "10.0.0.0", 24, "2001:db8:1::1", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := newTestPath(t, tt.prefix, tt.length, false)
+			hop, err := anypb.New(&apipb.MpReachNLRIAttribute{NextHops: []string{tt.hop}})
+			require.NoError(t, err)
+			path.Pattrs = append(path.Pattrs, hop)
+
+			op := createRouteFromPath(path)
+			require.NotNil(t, op)
+			assert.Equal(t, tt.want, op.route.Gw)
+			assert.Equal(t, tt.linkLocal, op.linkLocal)
+		})
+	}
+
+	op := createRouteFromPath(newTestPath(t, "10.0.0.0", 24, false))
+	require.NotNil(t, op)
+	assert.Nil(t, op.route.Gw, "a path without next hop is installed without gateway")
+}
+
+func TestRoutesEqual(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+	desired := &netlink.Route{Dst: dst, Protocol: RouteProtocol, Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST}
+
+	same := *desired
+	otherProtocol := *desired
+	otherProtocol.Protocol = unix.RTPROT_STATIC
+	otherGateway := *desired
+	otherGateway.Gw = net.ParseIP("192.0.2.1")
+	resolved := *desired
+	resolved.LinkIndex = 2
+	otherRealm := *desired
+	otherRealm.Realm = 5
+	_, dst6, _ := net.ParseCIDR("2001:db8::/32")
+	desired6 := &netlink.Route{Dst: dst6, Protocol: RouteProtocol, Table: unix.RT_TABLE_MAIN, Realm: 5}
+	realmless := *desired6
+	realmless.Realm = 0
+
+	assert.True(t, routesEqual(nil, nil))
+	assert.False(t, routesEqual(nil, desired))
+	assert.True(t, routesEqual(&same, desired))
+	assert.False(t, routesEqual(&otherProtocol, desired))
+	assert.False(t, routesEqual(&otherGateway, desired))
+	assert.True(t, routesEqual(&resolved, desired), "the kernel resolves the device of the gateway")
+	assert.False(t, routesEqual(&otherRealm, desired))
+	assert.True(t, routesEqual(&realmless, desired6), "IPv6 routes have no realm")
+}
+
+func TestDiffOps(t *testing.T) {
+	kept := testOp("192.0.2.0/24", opReplace, false).route
+	stale := testOp("198.51.100.0/24", opReplace, false).route
+	added := testOp("203.0.113.0/24", opReplace, false).route
+
+	existing := map[RouteKey]*netlink.Route{keyOf(kept): kept, keyOf(stale): stale}
+	desired := map[RouteKey]*netlink.Route{keyOf(kept): kept, keyOf(added): added}
+
+	ops := diffOps(existing, desired)
+
+	assert.ElementsMatch(t, []*routeOp{
+		{key: keyOf(added), route: added, kind: opReplace, bulk: true},
+		{key: keyOf(stale), route: stale, kind: opDelete},
+	}, ops)
+}
+
+func TestDeltaOps(t *testing.T) {
+	installed := testOp("192.0.2.0/24", opReplace, false).route
+	kernel := NewKernelCache(nil)
+	kernel.record([]*routeOp{{key: keyOf(installed), route: installed}}, []error{nil})
+
+	ops := deltaOps(kernel, map[RouteKey]*netlink.Route{
+		keyOf(installed): nil,
+		{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("198.51.100.0/24")}: nil,
+	})
+
+	assert.Equal(t, []*routeOp{{key: keyOf(installed), route: installed, kind: opDelete}}, ops)
+}
+
 /*
 func TestUpdateRoute(t *testing.T) {
 	tests := []struct {
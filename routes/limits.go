@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+)
+
+// limiter enforces the maximum number of routes per address family and per
+// routing table. While a limit is exceeded, the configured action decides
+// which routes of the affected scope may still be programmed.
+type limiter struct {
+	action   string
+	families map[int]int
+	tables   map[int]int
+
+	mu       sync.Mutex
+	breached map[string]bool
+	latched  bool
+}
+
+// LimitStatus describes the state of the route limits.
+type LimitStatus struct {
+	Action   string   `json:"action"`
+	Breached []string `json:"breached"`
+	Latched  bool     `json:"latched"`
+}
+
+func newLimiter(cfg config.Limits) *limiter {
+	families := make(map[int]int)
+	if cfg.IPv4 > 0 {
+		families[netlink.FAMILY_V4] = cfg.IPv4
+	}
+	if cfg.IPv6 > 0 {
+		families[netlink.FAMILY_V6] = cfg.IPv6
+	}
+
+	return &limiter{
+		action:   cfg.Action,
+		families: families,
+		tables:   cfg.Tables,
+		breached: make(map[string]bool),
+	}
+}
+
+// evaluate compares counts with the limits and reports whether the set of
+// breached scopes changed.
+func (l *limiter) evaluate(counts RouteCounts) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	breached := make(map[string]bool)
+	for family, limit := range l.families {
+		l.check(breached, familyScope(family), counts.Families[family], limit)
+	}
+	for table, limit := range l.tables {
+		l.check(breached, tableScope(table), counts.Tables[table], limit)
+	}
+
+	changed := len(breached) != len(l.breached)
+	for scope := range breached {
+		changed = changed || !l.breached[scope]
+	}
+	l.breached = breached
+	if len(breached) > 0 && l.action == config.LimitActionFlush {
+		changed = changed || !l.latched
+		l.latched = true
+	}
+	return changed
+}
+
+// check records scope as breached when count exceeds limit, logging each
+// new breach. Callers must hold l.mu.
+func (l *limiter) check(breached map[string]bool, scope string, count, limit int) {
+	if count <= limit {
+		return
+	}
+	breached[scope] = true
+	if !l.breached[scope] {
+		Metrics.Add(metricLimitBreaches, 1)
+		log.Printf("ROUTE LIMIT EXCEEDED: %s has %d routes, limit is %d, action %q", scope, count, limit, l.action)
+	}
+}
+
+// allows reports whether route may be programmed under key. installed
+// tells whether the key is already in the kernel.
+func (l *limiter) allows(key RouteKey, route *netlink.Route, installed bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.latched {
+		return false
+	}
+	if !l.breached[familyScope(familyOf(key.Dst))] && !l.breached[tableScope(key.Table)] {
+		return true
+	}
+
+	switch l.action {
+	case config.LimitActionDefaultOnly:
+		return key.Dst.Bits() == 0
+	default:
+		return installed
+	}
+}
+
+// reset lifts a latched flush. Limits still exceeded are breached again at
+// the next evaluation.
+func (l *limiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.latched {
+		log.Printf("Route limits reset, resuming installation")
+	}
+	l.latched = false
+	l.breached = make(map[string]bool)
+}
+
+func (l *limiter) status() LimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	breached := make([]string, 0, len(l.breached))
+	for scope := range l.breached {
+		breached = append(breached, scope)
+	}
+	sort.Strings(breached)
+	return LimitStatus{Action: l.action, Breached: breached, Latched: l.latched}
+}
+
+func familyScope(family int) string {
+	if family == netlink.FAMILY_V4 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+func tableScope(table int) string {
+	return fmt.Sprintf("table %d", table)
+}
@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func testPaths(t *testing.T, n int) []*apipb.Path {
+	t.Helper()
+	paths := make([]*apipb.Path, 0, n)
+	for i := 0; i < n; i++ {
+		paths = append(paths, newTestPath(t, fmt.Sprintf("10.0.%d.0", i), 24, false))
+	}
+	return paths
+}
+
+func newLimitedManager(t *testing.T, action string) *Manager {
+	t.Helper()
+	m := newTestManager(t)
+	m.limiter = newLimiter(config.Limits{Action: action, IPv4: 3})
+	return m
+}
+
+func TestLimiterEvaluate(t *testing.T) {
+	l := newLimiter(config.Limits{Action: config.LimitActionStop, IPv6: 1, Tables: map[int]int{100: 2}})
+	counts := newRouteCounts()
+
+	assert.False(t, l.evaluate(counts))
+
+	counts.Families[netlink.FAMILY_V6] = 2
+	assert.True(t, l.evaluate(counts))
+	assert.False(t, l.evaluate(counts))
+	assert.Equal(t, []string{"ipv6"}, l.status().Breached)
+
+	counts.Tables[100] = 3
+	assert.True(t, l.evaluate(counts))
+	assert.Equal(t, []string{"ipv6", "table 100"}, l.status().Breached)
+
+	assert.True(t, l.evaluate(newRouteCounts()))
+	assert.Empty(t, l.status().Breached)
+}
+
+func TestLimitStopKeepsInstalledRoutes(t *testing.T) {
+	m := newLimitedManager(t, config.LimitActionStop)
+
+	assert.NoError(t, m.UpdateLocalRoutes(testPaths(t, 2)))
+	m.Wait()
+	assert.NoError(t, m.UpdateLocalRoutes(testPaths(t, 5)))
+	m.Wait()
+
+	assert.Equal(t, 2, m.Kernel().Len())
+	assert.Equal(t, 5, m.RIB().Len())
+
+	withdrawn := []*apipb.Path{
+		newTestPath(t, "10.0.3.0", 24, true),
+		newTestPath(t, "10.0.4.0", 24, true),
+	}
+	assert.NoError(t, m.UpdateLocalRoutes(withdrawn))
+	m.Wait()
+
+	assert.Equal(t, 3, m.Kernel().Len(), "installation resumes below the limit")
+}
+
+func TestLimitDefaultOnly(t *testing.T) {
+	m := newLimitedManager(t, config.LimitActionDefaultOnly)
+
+	paths := append(testPaths(t, 4), newTestPath(t, "0.0.0.0", 0, false))
+	assert.NoError(t, m.UpdateLocalRoutes(paths))
+	m.Wait()
+
+	_, ok := m.Kernel().Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("0.0.0.0/0")})
+	assert.True(t, ok)
+	assert.Equal(t, 1, m.Kernel().Len())
+}
+
+func TestLimitFlushLatchesUntilReset(t *testing.T) {
+	m := newLimitedManager(t, config.LimitActionFlush)
+
+	assert.NoError(t, m.UpdateLocalRoutes(testPaths(t, 2)))
+	m.Wait()
+	assert.Equal(t, 2, m.Kernel().Len())
+
+	assert.NoError(t, m.UpdateLocalRoutes(testPaths(t, 4)))
+	m.Wait()
+	assert.Equal(t, 0, m.Kernel().Len())
+
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "10.0.3.0", 24, true)}))
+	m.Wait()
+	assert.Equal(t, 0, m.Kernel().Len(), "a flush stays in effect below the limit")
+
+	m.ResetLimits()
+	m.Wait()
+	assert.Equal(t, 3, m.Kernel().Len())
+}
+
+func TestRIBCounts(t *testing.T) {
+	rib := NewRIB()
+	rib.Apply(append(testPaths(t, 2), newTestPath(t, "2001:db8::", 32, false)))
+	rib.Apply([]*apipb.Path{newTestPath(t, "10.0.0.0", 24, true)})
+
+	counts := rib.Counts()
+
+	assert.Equal(t, 1, counts.Families[netlink.FAMILY_V4])
+	assert.Equal(t, 1, counts.Families[netlink.FAMILY_V6])
+	assert.Equal(t, 2, counts.Tables[unix.RT_TABLE_MAIN])
+}
@@ -0,0 +1,422 @@
+package routes
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+)
+
+// Manager keeps the owned kernel routes in line with the routes learned
+// from GoBGP.
+type Manager struct {
+	rib *RIB
+	// outputs receive the routes of the RIB, each from its own cache and
+	// pipeline. kernel is the cache of the first one, which drift repair
+	// and route limits follow.
+	outputs   []*output
+	kernel    *KernelCache
+	coalescer *coalescer
+	dampener  *dampener
+	limiter   *limiter
+	protector *protector
+	source    *Source
+	rules     *ruleSet
+	scope     vrfScope
+	done      chan struct{}
+
+	// programming serialises the passes that bring the kernel in line
+	// with the RIB, so a full reconciliation never interleaves with an
+	// incremental update.
+	programming sync.Mutex
+}
+
+// NewManager returns a Manager of the global table with an empty RIB and
+// kernel cache, and opens the sinks routes are programmed into.
+func NewManager(cfg config.Config) (*Manager, error) {
+	return openManager(cfg, vrfScope{})
+}
+
+// openManager opens the sinks of a manager of scope. Only the manager of
+// the global table maintains ip rules, when routes go to the kernel.
+func openManager(cfg config.Config, scope vrfScope) (*Manager, error) {
+	sinks, err := openSinks(cfg, scope)
+	if err != nil {
+		return nil, err
+	}
+	var rules ruleWriter
+	if scope.vrf == "" && programsKernel(cfg) {
+		if rules, err = scope.ns.newHandle(); err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+		}
+	}
+
+	m, err := newScopedManager(cfg, sinks, scope, rules)
+	if err != nil {
+		closeSinks(sinks)
+		if rules != nil {
+			rules.Close()
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// newManager returns a manager of the global table that programs the
+// kernel through writers, with one worker per writer.
+func newManager(cfg config.Config, writers []routeWriter) (*Manager, error) {
+	cfg.Programming.Workers = len(writers)
+	return newScopedManager(cfg, []Sink{newNetlinkSink(writers)}, vrfScope{}, nil)
+}
+
+// newScopedManager returns the manager of scope. sinks holds the opened
+// sinks of cfg.Sinks, in order; the manager takes them over.
+func newScopedManager(cfg config.Config, sinks []Sink, scope vrfScope, rules ruleWriter) (*Manager, error) {
+	rib, err := newConfiguredRIB(cfg, scope)
+	if err != nil {
+		return nil, err
+	}
+	ruleSet, err := newRuleSet(scope.ns.tableMap().rules(cfg.Rules), rules)
+	if err != nil {
+		return nil, err
+	}
+	protector, err := newScopeProtector(cfg, scope)
+	if err != nil {
+		return nil, err
+	}
+	source, err := newSource(scope.watch(cfg.Watch))
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := newOutputs(cfg, sinks, scope)
+	m := &Manager{
+		rib:       rib,
+		outputs:   outputs,
+		kernel:    outputs[0].cache,
+		dampener:  newDampener(cfg.Dampening),
+		limiter:   newLimiter(cfg.Limits),
+		protector: protector,
+		source:    source,
+		rules:     ruleSet,
+		scope:     scope,
+		done:      make(chan struct{}),
+	}
+	m.publishStatus()
+	m.coalescer = newCoalescer(cfg.Programming.CoalesceWindow, m.programKeys)
+	if m.dampener != nil {
+		go m.dampener.run(m.done, m.programKeys)
+	}
+	return m, nil
+}
+
+// newConfiguredRIB returns the RIB of scope, with the prefix filter, policy,
+// RPKI validation and table attributes of cfg.
+func newConfiguredRIB(cfg config.Config, scope vrfScope) (*RIB, error) {
+	filter, err := newPrefixFilter(cfg.Filter)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := newPolicy(cfg.Policy, cfg.Realms)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := newTableDefaults(cfg.Tables)
+	if err != nil {
+		return nil, err
+	}
+	rib := newRIB(filter, policy, newRPKIValidator(cfg.RPKI))
+	rib.table = scope.table
+	rib.defaults = defaults
+	rib.tableMap = scope.ns.tableMap()
+	return rib, nil
+}
+
+// publishStatus exposes the state of the enabled safeguards in the status
+// map of the manager.
+func (m *Manager) publishStatus() {
+	status := m.statusMap()
+	status.Set(metricPipelinePending, m.outputs[0].pipeline.pending)
+	status.Set(metricSinks, expvar.Func(func() any { return m.sinkStatus() }))
+	status.Set(metricRouteLimits, expvar.Func(func() any { return m.limiter.status() }))
+	if m.rib.filter != nil {
+		status.Set(metricFilterRejections, expvar.Func(func() any { return m.rib.filter.status() }))
+	}
+	if m.rib.policy != nil {
+		status.Set(metricPolicyRules, expvar.Func(func() any { return m.rib.policy.status() }))
+	}
+	if m.rib.rpki != nil {
+		status.Set(metricRPKIStates, expvar.Func(func() any { return m.rib.rpki.status() }))
+	}
+	if m.dampener != nil {
+		status.Set(metricSuppressedPrefixes, expvar.Func(func() any { return m.dampener.status() }))
+	}
+	if realms := m.rib.policy.accountedRealms(); m.scope.vrf == "" && len(realms) > 0 {
+		status.Set(metricRealms, expvar.Func(func() any { return realmStatus(m.scope.ns, realms) }))
+	}
+	if m.rules != nil {
+		status.Set(metricRules, expvar.Func(func() any { return m.rules.status() }))
+	}
+	if m.protector != nil {
+		status.Set(metricProtectedPrefixes, expvar.Func(func() any { return m.protector.status() }))
+	}
+}
+
+// statusMap returns Metrics for the manager of the global table, and the
+// entry of its VRF in the vrfs map of Metrics otherwise. The status of a
+// configured namespace is the entry of its name in the namespaces map of
+// Metrics, holding the vrfs map of its VRFs.
+func (m *Manager) statusMap() *expvar.Map {
+	parent := Metrics
+	if ns := m.scope.ns; ns != nil {
+		namespaces := mapEntry(Metrics, metricNamespaces)
+		if m.scope.vrf == "" {
+			return newMapEntry(namespaces, ns.name)
+		}
+		parent = mapEntry(namespaces, ns.name)
+	}
+	if m.scope.vrf == "" {
+		return parent
+	}
+	return newMapEntry(mapEntry(parent, metricVRFs), m.scope.vrf)
+}
+
+// mapEntry returns the map under key in parent, and creates it when
+// missing.
+func mapEntry(parent *expvar.Map, key string) *expvar.Map {
+	entry, ok := parent.Get(key).(*expvar.Map)
+	if !ok {
+		entry = newMapEntry(parent, key)
+	}
+	return entry
+}
+
+// newMapEntry sets key in parent to a new map, replacing the map of an
+// earlier manager.
+func newMapEntry(parent *expvar.Map, key string) *expvar.Map {
+	entry := new(expvar.Map).Init()
+	parent.Set(key, entry)
+	return entry
+}
+
+// sinkStatus reports the state of every sink by name.
+func (m *Manager) sinkStatus() map[string]SinkStatus {
+	status := make(map[string]SinkStatus, len(m.outputs))
+	for _, out := range m.outputs {
+		status[out.name] = out.status()
+	}
+	return status
+}
+
+// Close stops programming and releases the sinks.
+func (m *Manager) Close() {
+	close(m.done)
+	m.coalescer.stop()
+	for _, out := range m.outputs {
+		out.close()
+	}
+	m.rules.close()
+	if m.scope.vrf == "" {
+		m.scope.ns.close()
+	}
+}
+
+// Wait blocks until every route operation issued so far has been programmed,
+// including the changes still held by the coalescing window.
+func (m *Manager) Wait() {
+	m.coalescer.fire()
+	for _, out := range m.outputs {
+		out.pipeline.wait()
+	}
+}
+
+// RIB returns the desired routes.
+func (m *Manager) RIB() *RIB {
+	return m.rib
+}
+
+// Source returns the part of the GoBGP RIB the manager consumes.
+func (m *Manager) Source() *Source {
+	return m.source
+}
+
+// VRF returns the name of the GoBGP VRF of the manager, or "" for the
+// global table.
+func (m *Manager) VRF() string {
+	return m.scope.vrf
+}
+
+// Kernel returns the cached view of the routes owned in the first sink.
+func (m *Manager) Kernel() *KernelCache {
+	return m.kernel
+}
+
+// Start subscribes to the route notifications of the first sink, seeds
+// the cache of every sink, removes the owned ip rules that are not desired
+// and keeps the first one current until ctx is cancelled. Every notification is passed on to observers once the cache
+// has been updated. Sinks that do not notify are only seeded.
+func (m *Manager) Start(ctx context.Context, observers ...func(netlink.RouteUpdate)) error {
+	updates, err := m.subscribe(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, out := range m.outputs {
+		if err := out.cache.Seed(); err != nil {
+			return fmt.Errorf("failed to seed sink %q: %w", out.name, err)
+		}
+	}
+	if err := m.rules.reconcile(); err != nil {
+		return err
+	}
+	if updates == nil {
+		return nil
+	}
+
+	go func() {
+		for update := range updates {
+			m.kernel.Observe(update)
+			for _, observe := range observers {
+				observe(update)
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe subscribes to the route notifications of the first sink. It
+// returns a nil channel when the sink does not notify.
+func (m *Manager) subscribe(ctx context.Context) (chan netlink.RouteUpdate, error) {
+	notifier, ok := m.outputs[0].sink.(routeNotifier)
+	if !ok {
+		return nil, nil
+	}
+	updates := make(chan netlink.RouteUpdate)
+	if err := notifier.Subscribe(updates, ctx.Done()); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to route updates: %w", err)
+	}
+	return updates, nil
+}
+
+// UpdateLocalRoutes merges the provided paths into the RIB and, once the
+// coalescing window closes, queues the kernel operations that bring the
+// owned routes in line with it.
+func (m *Manager) UpdateLocalRoutes(paths []*apipb.Path) error {
+	m.rules.observe(paths)
+	changes := m.rib.build(paths)
+
+	m.programming.Lock()
+	m.dampener.record(m.rib.update(changes), changes)
+	limitsChanged := m.limiter.evaluate(m.rib.Counts())
+	m.programming.Unlock()
+
+	if limitsChanged {
+		m.resync()
+	}
+
+	keys := make([]RouteKey, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	m.coalescer.add(keys)
+	return nil
+}
+
+// ResetLimits lifts a route limit that flushed the kernel and resumes
+// installation. Limits that are still exceeded take effect again at once.
+func (m *Manager) ResetLimits() {
+	m.limiter.reset()
+
+	m.programming.Lock()
+	m.limiter.evaluate(m.rib.Counts())
+	m.programming.Unlock()
+
+	m.resync()
+}
+
+// resync queues the operations that bring every owned route in line with
+// the desired state, without fetching anything from GoBGP.
+func (m *Manager) resync() {
+	m.programming.Lock()
+	defer m.programming.Unlock()
+
+	m.sync(m.desiredSnapshot())
+}
+
+// sync queues, for every sink, the operations that turn the routes it owns
+// into desired, and brings the ip rules in line with desired. Callers must
+// hold m.programming.
+func (m *Manager) sync(desired map[RouteKey]*netlink.Route) {
+	for _, out := range m.outputs {
+		m.submit(out, diffOps(out.cache.Snapshot(), desired))
+	}
+	m.rules.admitAll(desired)
+}
+
+// programKeys queues the operations for the current RIB state of keys on
+// every sink.
+func (m *Manager) programKeys(keys []RouteKey) {
+	m.programming.Lock()
+	defer m.programming.Unlock()
+
+	changes := m.gate(m.rib.lookup(keys))
+	for _, out := range m.outputs {
+		m.submit(out, deltaOps(out.cache, changes))
+	}
+	m.rules.admit(changes)
+}
+
+// submit queues ops for programming into out, dropping those on protected
+// prefixes.
+func (m *Manager) submit(out *output, ops []*routeOp) {
+	if m.protector != nil {
+		allowed := ops[:0]
+		for _, op := range ops {
+			if !m.protector.refuses(op.key) {
+				allowed = append(allowed, op)
+			}
+		}
+		ops = allowed
+	}
+	out.pipeline.submit(ops)
+}
+
+// desired returns the route key should have in the kernel, if any.
+func (m *Manager) desired(key RouteKey) (*netlink.Route, bool) {
+	route, ok := m.rib.Get(key)
+	if !ok || !m.admits(key, route) {
+		return nil, false
+	}
+	return route, true
+}
+
+// desiredSnapshot returns every route that should be in the kernel.
+func (m *Manager) desiredSnapshot() map[RouteKey]*netlink.Route {
+	return m.gate(m.rib.Snapshot())
+}
+
+// gate clears the routes that must not be programmed right now, such as
+// suppressed flapping prefixes or routes beyond a route limit, so that they
+// are removed from the kernel. Protected prefixes are cleared too, but
+// submit keeps them from being removed.
+func (m *Manager) gate(routes map[RouteKey]*netlink.Route) map[RouteKey]*netlink.Route {
+	for key, route := range routes {
+		if route != nil && !m.admits(key, route) {
+			routes[key] = nil
+		}
+	}
+	return routes
+}
+
+func (m *Manager) admits(key RouteKey, route *netlink.Route) bool {
+	if !m.scope.owns(key.Table) || m.protector.protects(key) || m.dampener.suppressed(key) {
+		return false
+	}
+	_, installed := m.kernel.Get(key)
+	return m.limiter.allows(key, route, installed)
+}
@@ -0,0 +1,53 @@
+package routes
+
+import "expvar"
+
+// Metrics exposes the counters maintained by the routes package. It is
+// published through expvar as "bgtables".
+var Metrics = expvar.NewMap("bgtables")
+
+const (
+	metricDriftRepairs    = "drift_repairs"
+	metricDriftSuppressed = "drift_repairs_suppressed"
+
+	metricReconcileRuns     = "reconcile_runs"
+	metricReconcileFailures = "reconcile_failures"
+
+	metricPipelineCompleted = "pipeline_completed"
+	metricPipelineFailed    = "pipeline_failed"
+	metricPipelinePending   = "pipeline_pending"
+
+	metricUpdatesCoalesced = "updates_coalesced"
+
+	metricDampeningSuppressed = "dampening_suppressions"
+	metricSuppressedPrefixes  = "suppressed_prefixes"
+
+	metricLimitBreaches = "limit_breaches"
+	metricRouteLimits   = "route_limits"
+
+	metricFilterRejected   = "filter_rejected"
+	metricFilterRejections = "filter_rejections"
+
+	metricProtectedRefused  = "protected_refused"
+	metricProtectedPrefixes = "protected_prefixes"
+
+	metricPolicyRejected = "policy_rejected"
+	metricPolicyRules    = "policy_rules"
+
+	metricNLRIUnknown = "nlri_unknown"
+
+	metricLinkLocalRefused = "link_local_refused"
+
+	metricRPKIRejected = "rpki_rejected"
+	metricRPKIStates   = "rpki_states"
+
+	metricVRFs       = "vrfs"
+	metricNamespaces = "namespaces"
+
+	metricRuleFailures = "rule_failures"
+	metricRules        = "rules"
+
+	metricRealms = "realms"
+
+	metricSinks = "sinks"
+)
@@ -3,6 +3,7 @@ package routes
 import (
 	"context"
 	"errors"
+	"io"
 
 	apipb "github.com/osrg/gobgp/v3/api"
 	"github.com/stretchr/testify/mock"
@@ -44,6 +45,25 @@ func (*MockListPathClient) Trailer() metadata.MD         { return nil }
 func (*MockListPathClient) CloseSend() error             { return nil }
 func (*MockListPathClient) Context() context.Context     { return context.Background() }
 
+// sliceStream is a server stream that returns its messages, then io.EOF.
+type sliceStream[T any] struct {
+	grpc.ClientStream
+	msgs []T
+}
+
+func newSliceStream[T any](msgs ...T) *sliceStream[T] {
+	return &sliceStream[T]{msgs: msgs}
+}
+
+func (s *sliceStream[T]) Recv() (T, error) {
+	var msg T
+	if len(s.msgs) == 0 {
+		return msg, io.EOF
+	}
+	msg, s.msgs = s.msgs[0], s.msgs[1:]
+	return msg, nil
+}
+
 func (m *MockGobgpAPIClient) ListPath(ctx context.Context, in *apipb.ListPathRequest,
 	_ ...grpc.CallOption) (apipb.GobgpApi_ListPathClient, error) {
 	args := m.Called(ctx, in)
@@ -252,9 +272,17 @@ func (*MockGobgpAPIClient) ListDynamicNeighbor(_ context.Context, _ *apipb.ListD
 	return nil, nil
 }
 
-func (*MockGobgpAPIClient) ListPeer(_ context.Context, _ *apipb.ListPeerRequest,
+func (m *MockGobgpAPIClient) ListPeer(ctx context.Context, in *apipb.ListPeerRequest,
 	_ ...grpc.CallOption) (apipb.GobgpApi_ListPeerClient, error) {
-	return nil, nil
+	args := m.Called(ctx, in)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	client, ok := args.Get(0).(apipb.GobgpApi_ListPeerClient)
+	if !ok {
+		return nil, errors.New("invalid client type")
+	}
+	return client, args.Error(1)
 }
 
 func (*MockGobgpAPIClient) ListPeerGroup(_ context.Context, _ *apipb.ListPeerGroupRequest,
@@ -272,9 +300,17 @@ func (*MockGobgpAPIClient) ListPolicyAssignment(_ context.Context, _ *apipb.List
 	return nil, nil
 }
 
-func (*MockGobgpAPIClient) ListRpki(_ context.Context, _ *apipb.ListRpkiRequest,
+func (m *MockGobgpAPIClient) ListRpki(ctx context.Context, in *apipb.ListRpkiRequest,
 	_ ...grpc.CallOption) (apipb.GobgpApi_ListRpkiClient, error) {
-	return nil, nil
+	args := m.Called(ctx, in)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	client, ok := args.Get(0).(apipb.GobgpApi_ListRpkiClient)
+	if !ok {
+		return nil, errors.New("invalid client type")
+	}
+	return client, args.Error(1)
 }
 
 func (*MockGobgpAPIClient) ListRpkiTable(_ context.Context, _ *apipb.ListRpkiTableRequest,
@@ -287,9 +323,17 @@ func (*MockGobgpAPIClient) ListStatement(_ context.Context, _ *apipb.ListStateme
 	return nil, nil
 }
 
-func (*MockGobgpAPIClient) ListVrf(_ context.Context, _ *apipb.ListVrfRequest,
+func (m *MockGobgpAPIClient) ListVrf(ctx context.Context, in *apipb.ListVrfRequest,
 	_ ...grpc.CallOption) (apipb.GobgpApi_ListVrfClient, error) {
-	return nil, nil
+	args := m.Called(ctx, in)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	client, ok := args.Get(0).(apipb.GobgpApi_ListVrfClient)
+	if !ok {
+		return nil, errors.New("invalid client type")
+	}
+	return client, args.Error(1)
 }
 
 func (*MockGobgpAPIClient) SetPolicies(_ context.Context, _ *apipb.SetPoliciesRequest,
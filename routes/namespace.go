@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// nsRtAcctPath is rtAcctPath as seen from a thread that entered another
+// network namespace: /proc/net follows the namespace of the process.
+const nsRtAcctPath = "/proc/thread-self/net/rt_acct"
+
+// namespace is a network namespace bgtables programs other than its own.
+// Every netlink socket of its managers is opened inside it. A nil
+// namespace stands for the namespace of bgtables.
+type namespace struct {
+	name   string
+	handle netns.NsHandle
+	tables tableMap
+}
+
+// openNamespace opens the namespace of cfg, by path or by PID.
+func openNamespace(cfg config.Namespace) (*namespace, error) {
+	var handle netns.NsHandle
+	var err error
+	if cfg.Path != "" {
+		handle, err = netns.GetFromPath(cfg.Path)
+	} else {
+		handle, err = netns.GetFromPid(cfg.PID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace %q: %w", cfg.Name, err)
+	}
+	return &namespace{name: cfg.Name, handle: handle, tables: cfg.Tables}, nil
+}
+
+func (n *namespace) close() {
+	if n != nil {
+		n.handle.Close()
+	}
+}
+
+func (n *namespace) String() string {
+	if n == nil {
+		return "own namespace"
+	}
+	return fmt.Sprintf("namespace %s", n.name)
+}
+
+// newHandle opens a netlink route socket in the namespace.
+func (n *namespace) newHandle() (*netlink.Handle, error) {
+	if n == nil {
+		return netlink.NewHandle(unix.NETLINK_ROUTE)
+	}
+	return netlink.NewHandleAt(n.handle, unix.NETLINK_ROUTE)
+}
+
+// newSocket opens a raw netlink route socket in the namespace.
+func (n *namespace) newSocket() (*nl.NetlinkSocket, error) {
+	if n == nil {
+		return nl.GetNetlinkSocketAt(netns.None(), netns.None(), unix.NETLINK_ROUTE)
+	}
+	return nl.GetNetlinkSocketAt(n.handle, netns.None(), unix.NETLINK_ROUTE)
+}
+
+// subscribeOptions returns the options of a route subscription in the
+// namespace.
+func (n *namespace) subscribeOptions(errorCallback func(error)) netlink.RouteSubscribeOptions {
+	options := netlink.RouteSubscribeOptions{ErrorCallback: errorCallback}
+	if n != nil {
+		options.Namespace = &n.handle
+	}
+	return options
+}
+
+// tableMap returns the renumbering of the routing tables in the namespace.
+func (n *namespace) tableMap() tableMap {
+	if n == nil {
+		return nil
+	}
+	return n.tables
+}
+
+// run calls fn from a thread inside the namespace, for the kernel
+// interfaces netlink does not cover.
+func (n *namespace) run(fn func() error) error {
+	if n == nil {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it ends with the goroutine
+		// instead of running other goroutines inside the namespace.
+		runtime.LockOSThread()
+		if err := netns.Set(n.handle); err != nil {
+			done <- fmt.Errorf("failed to enter %s: %w", n, err)
+			return
+		}
+		done <- fn()
+	}()
+	return <-done
+}
+
+// rtAcctPath returns the path of the realm counters of the namespace, as
+// read by run.
+func (n *namespace) rtAcctPath() string {
+	if n == nil {
+		return rtAcctPath
+	}
+	return nsRtAcctPath
+}
+
+// tableMap renumbers routing tables; unmapped tables keep their number.
+type tableMap map[int]int
+
+func (m tableMap) table(table int) int {
+	if mapped, ok := m[table]; ok {
+		return mapped
+	}
+	return table
+}
+
+// rules returns cfg with the tables of the rules renumbered.
+func (m tableMap) rules(cfg []config.Rule) []config.Rule {
+	if len(m) == 0 {
+		return cfg
+	}
+	mapped := make([]config.Rule, len(cfg))
+	for i, rule := range cfg {
+		rule.Table = m.table(rule.Table)
+		mapped[i] = rule
+	}
+	return mapped
+}
@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newTestNamespace returns a namespace standing for the namespace of the
+// test, which it never leaves.
+func newTestNamespace(tables tableMap) *namespace {
+	return &namespace{name: "edge", handle: netns.None(), tables: tables}
+}
+
+func TestTableMap(t *testing.T) {
+	tables := tableMap{unix.RT_TABLE_MAIN: 300}
+	assert.Equal(t, 300, tables.table(unix.RT_TABLE_MAIN))
+	assert.Equal(t, 100, tables.table(100))
+	assert.Equal(t, 100, tableMap(nil).table(100))
+
+	rules := []config.Rule{{Name: "a", Table: unix.RT_TABLE_MAIN}, {Name: "b", Table: 100}}
+	assert.Equal(t, []config.Rule{{Name: "a", Table: 300}, {Name: "b", Table: 100}}, tables.rules(rules))
+	assert.Equal(t, unix.RT_TABLE_MAIN, rules[0].Table, "the configured rules are left alone")
+
+	var own *namespace
+	assert.Nil(t, own.tableMap())
+	assert.Nil(t, own.subscribeOptions(nil).Namespace)
+	assert.Equal(t, rtAcctPath, own.rtAcctPath())
+}
+
+func TestNamespaceScope(t *testing.T) {
+	ns := newTestNamespace(nil)
+	assert.Equal(t, "/run/routes.edge.json", vrfScope{ns: ns}.path("/run/routes.json"))
+	assert.Equal(t, "/run/routes.edge.blue.json", vrfScope{ns: ns, vrf: "blue"}.path("/run/routes.json"))
+	assert.Equal(t, "/run/routes.blue.json", vrfScope{vrf: "blue"}.path("/run/routes.json"))
+	assert.Equal(t, "VRF blue (table 100) of namespace edge", vrfScope{ns: ns, vrf: "blue", table: 100}.String())
+	assert.Equal(t, "global table", vrfScope{}.String())
+}
+
+func TestNamespaceManagers(t *testing.T) {
+	cfg := config.Default()
+	cfg.Programming.ProgressInterval = 0
+	cfg.Programming.CoalesceWindow = 0
+	cfg.Rules = []config.Rule{
+		{Name: "upstream-a", Match: config.PolicyMatch{Communities: []string{"65000:100"}}, Priority: 1000, Table: 100},
+	}
+	ns := newTestNamespace(tableMap{unix.RT_TABLE_MAIN: 300, 100: 301})
+	scopes, err := resolveVRFScopes(ns, []config.VRF{{Name: "blue", Table: 100}})
+	require.NoError(t, err)
+
+	kernels := make([]*fakeKernel, len(scopes))
+	for i, scope := range scopes {
+		kernels[i] = newFakeKernel()
+		var rules ruleWriter
+		if scope.vrf == "" {
+			rules = kernels[i]
+		}
+		m, err := newScopedManager(cfg, []Sink{newNetlinkSink([]routeWriter{kernels[i]})}, scope, rules)
+		require.NoError(t, err)
+		t.Cleanup(m.Close)
+
+		require.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newCommunityPath(t, "192.0.2.0", 24, 65000<<16|100)}))
+		m.Wait()
+	}
+
+	assert.Equal(t, []string{"rule add 1000: from 192.0.2.0/24 lookup 301", "replace 192.0.2.0/24 table 300"},
+		kernels[0].deltas(), "the tables of the global scope are renumbered")
+	assert.Equal(t, []string{"replace 192.0.2.0/24 table 100"}, kernels[1].deltas(),
+		"the table of a VRF is already the table of the namespace")
+
+	namespaces, ok := Metrics.Get(metricNamespaces).(*expvar.Map)
+	require.True(t, ok)
+	edge, ok := namespaces.Get("edge").(*expvar.Map)
+	require.True(t, ok)
+	assert.NotNil(t, edge.Get(metricSinks))
+	vrfs, ok := edge.Get(metricVRFs).(*expvar.Map)
+	require.True(t, ok)
+	assert.NotNil(t, vrfs.Get("blue"))
+}
@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Family is a BGP address family.
+type Family struct {
+	AFI  apipb.Family_Afi
+	SAFI apipb.Family_Safi
+}
+
+// FamilyOf returns the family of a GoBGP family message.
+func FamilyOf(family *apipb.Family) Family {
+	return Family{AFI: family.GetAfi(), SAFI: family.GetSafi()}
+}
+
+func (f Family) String() string {
+	afi := strings.TrimPrefix(f.AFI.String(), "AFI_")
+	if name, ok := afiNames[f.AFI]; ok {
+		afi = name
+	}
+	safi := strings.TrimPrefix(f.SAFI.String(), "SAFI_")
+	return strings.ToLower(afi + "-" + strings.ReplaceAll(safi, "_", "-"))
+}
+
+// afiNames holds the names GoBGP gives the IP address families.
+var afiNames = map[apipb.Family_Afi]string{
+	apipb.Family_AFI_IP:  "ipv4",
+	apipb.Family_AFI_IP6: "ipv6",
+}
+
+// NLRI is a decoded NLRI, such as UnicastNLRI or EVPNNLRI.
+type NLRI interface {
+	fmt.Stringer
+}
+
+// ErrUnknownNLRI is returned for NLRI types without a decoder for their
+// family.
+var ErrUnknownNLRI = errors.New("unknown NLRI type")
+
+type nlriKey struct {
+	family Family
+	name   protoreflect.FullName
+}
+
+type nlriDecoder func(family Family, nlri *anypb.Any) (NLRI, error)
+
+// NLRIRegistry decodes NLRI into typed values according to their family
+// and message type. Sinks switch on the returned types and never parse
+// GoBGP messages themselves.
+type NLRIRegistry struct {
+	decoders map[nlriKey]nlriDecoder
+
+	mu      sync.Mutex
+	unknown map[nlriKey]bool
+}
+
+// NewNLRIRegistry returns a registry that knows every NLRI type GoBGP
+// emits.
+func NewNLRIRegistry() *NLRIRegistry {
+	r := &NLRIRegistry{
+		decoders: make(map[nlriKey]nlriDecoder),
+		unknown:  make(map[nlriKey]bool),
+	}
+	registerBuiltinNLRI(r)
+	return r
+}
+
+// RegisterNLRI makes r decode NLRI of type M in family with decode,
+// replacing any previous decoder. Decoders must be registered before the
+// registry is used.
+func RegisterNLRI[M proto.Message](r *NLRIRegistry, family Family, decode func(M) (NLRI, error)) {
+	registerFamilyNLRI(r, family, func(_ Family, msg M) (NLRI, error) { return decode(msg) })
+}
+
+// registerFamilyNLRI is RegisterNLRI for decoders that record the family
+// in the NLRI, for types shared by several families.
+func registerFamilyNLRI[M proto.Message](r *NLRIRegistry, family Family, decode func(Family, M) (NLRI, error)) {
+	var zero M
+	key := nlriKey{family: family, name: zero.ProtoReflect().Descriptor().FullName()}
+	r.decoders[key] = func(family Family, nlri *anypb.Any) (NLRI, error) {
+		msg := zero.ProtoReflect().New().Interface().(M)
+		if err := nlri.UnmarshalTo(msg); err != nil {
+			return nil, fmt.Errorf("failed to unpack %s NLRI: %w", family, err)
+		}
+		return decode(family, msg)
+	}
+}
+
+// Decode decodes an NLRI of family. Types the registry does not know are
+// logged the first time they are seen and fail with ErrUnknownNLRI.
+func (r *NLRIRegistry) Decode(family Family, nlri *anypb.Any) (NLRI, error) {
+	key := nlriKey{family: family, name: nlriName(nlri)}
+	decode, ok := r.decoders[key]
+	if !ok {
+		r.reportUnknown(key)
+		return nil, fmt.Errorf("%w %s in %s", ErrUnknownNLRI, key.name, family)
+	}
+	return decode(family, nlri)
+}
+
+// DecodePath decodes the NLRI of path.
+func (r *NLRIRegistry) DecodePath(path *apipb.Path) (NLRI, error) {
+	return r.Decode(FamilyOf(path.GetFamily()), path.GetNlri())
+}
+
+func (r *NLRIRegistry) reportUnknown(key nlriKey) {
+	Metrics.Add(metricNLRIUnknown, 1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unknown[key] {
+		return
+	}
+	r.unknown[key] = true
+	log.Printf("Ignoring paths with unknown NLRI type %q in family %s", key.name, key.family)
+}
+
+// nlriName returns the message name of nlri from its type URL.
+func nlriName(nlri *anypb.Any) protoreflect.FullName {
+	url := nlri.GetTypeUrl()
+	return protoreflect.FullName(url[strings.LastIndex(url, "/")+1:])
+}
@@ -0,0 +1,168 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+// EVPNRouteType is the type of an EVPN route.
+type EVPNRouteType uint8
+
+// EVPN route types, as assigned by IANA. EVPNIPMSI is the RFC 9572
+// inclusive P-multicast service interface route.
+const (
+	EVPNAutoDiscovery   EVPNRouteType = 1
+	EVPNMACIP           EVPNRouteType = 2
+	EVPNMulticast       EVPNRouteType = 3
+	EVPNEthernetSegment EVPNRouteType = 4
+	EVPNIPPrefix        EVPNRouteType = 5
+	EVPNIPMSI           EVPNRouteType = 9
+)
+
+// EVPNNLRI is an RFC 7432 or RFC 9136 EVPN route. Fields a route type does
+// not carry are left zero.
+type EVPNNLRI struct {
+	RouteType   EVPNRouteType
+	RD          RouteDistinguisher
+	ESI         ESI
+	EthernetTag uint32
+	MAC         net.HardwareAddr
+	// IP is the address of MAC/IP advertisement, inclusive multicast and
+	// Ethernet segment routes.
+	IP netip.Addr
+	// Prefix and Gateway are set on IP prefix routes.
+	Prefix  netip.Prefix
+	Gateway netip.Addr
+	Labels  []uint32
+	// RouteTarget is set on I-PMSI routes.
+	RouteTarget *pathattr.ExtendedCommunity
+}
+
+func registerEVPN(r *NLRIRegistry) {
+	RegisterNLRI(r, FamilyL2VPNEVPN, decodeEVPNAutoDiscovery)
+	RegisterNLRI(r, FamilyL2VPNEVPN, decodeEVPNMACIP)
+	RegisterNLRI(r, FamilyL2VPNEVPN, decodeEVPNMulticast)
+	RegisterNLRI(r, FamilyL2VPNEVPN, decodeEVPNEthernetSegment)
+	RegisterNLRI(r, FamilyL2VPNEVPN, decodeEVPNIPPrefix)
+	RegisterNLRI(r, FamilyL2VPNEVPN, decodeEVPNIPMSI)
+}
+
+func decodeEVPNAutoDiscovery(msg *apipb.EVPNEthernetAutoDiscoveryRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	return EVPNNLRI{
+		RouteType:   EVPNAutoDiscovery,
+		RD:          rd,
+		ESI:         esiOf(msg.Esi),
+		EthernetTag: msg.EthernetTag,
+		Labels:      []uint32{msg.Label},
+	}, nil
+}
+
+func decodeEVPNMACIP(msg *apipb.EVPNMACIPAdvertisementRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := macAddr(msg.MacAddress)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := optionalAddr(msg.IpAddress)
+	if err != nil {
+		return nil, err
+	}
+	return EVPNNLRI{
+		RouteType:   EVPNMACIP,
+		RD:          rd,
+		ESI:         esiOf(msg.Esi),
+		EthernetTag: msg.EthernetTag,
+		MAC:         mac,
+		IP:          ip,
+		Labels:      msg.Labels,
+	}, nil
+}
+
+func decodeEVPNMulticast(msg *apipb.EVPNInclusiveMulticastEthernetTagRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := optionalAddr(msg.IpAddress)
+	if err != nil {
+		return nil, err
+	}
+	return EVPNNLRI{RouteType: EVPNMulticast, RD: rd, EthernetTag: msg.EthernetTag, IP: ip}, nil
+}
+
+func decodeEVPNEthernetSegment(msg *apipb.EVPNEthernetSegmentRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := optionalAddr(msg.IpAddress)
+	if err != nil {
+		return nil, err
+	}
+	return EVPNNLRI{RouteType: EVPNEthernetSegment, RD: rd, ESI: esiOf(msg.Esi), IP: ip}, nil
+}
+
+func decodeEVPNIPPrefix(msg *apipb.EVPNIPPrefixRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := nlriPrefix(msg.IpPrefix, msg.IpPrefixLen)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := optionalAddr(msg.GwAddress)
+	if err != nil {
+		return nil, err
+	}
+	return EVPNNLRI{
+		RouteType:   EVPNIPPrefix,
+		RD:          rd,
+		ESI:         esiOf(msg.Esi),
+		EthernetTag: msg.EthernetTag,
+		Prefix:      prefix,
+		Gateway:     gateway,
+		Labels:      []uint32{msg.Label},
+	}, nil
+}
+
+func decodeEVPNIPMSI(msg *apipb.EVPNIPMSIRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	n := EVPNNLRI{RouteType: EVPNIPMSI, RD: rd, EthernetTag: msg.EthernetTag}
+	if msg.Rt != nil {
+		rt, err := pathattr.DecodeExtendedCommunity(msg.Rt)
+		if err != nil {
+			return nil, err
+		}
+		n.RouteTarget = &rt
+	}
+	return n, nil
+}
+
+func (n EVPNNLRI) String() string {
+	s := fmt.Sprintf("[type:%d][rd:%s][etag:%d]", n.RouteType, n.RD, n.EthernetTag)
+	if n.MAC != nil {
+		s += fmt.Sprintf("[mac:%s]", n.MAC)
+	}
+	if n.IP.IsValid() {
+		s += fmt.Sprintf("[ip:%s]", n.IP)
+	}
+	if n.Prefix.IsValid() {
+		s += fmt.Sprintf("[prefix:%s]", n.Prefix)
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// FlowSpecNLRI is an RFC 8955 or RFC 8956 flow specification. VPN flow
+// specifications carry a route distinguisher.
+type FlowSpecNLRI struct {
+	RD    *RouteDistinguisher
+	Rules []FlowSpecRule
+}
+
+// FlowSpecRule is a component of a flow specification. Prefix components
+// set Prefix and Offset, MAC components set MAC, and the others set Items.
+type FlowSpecRule struct {
+	Type   uint8
+	Prefix netip.Prefix
+	Offset uint32
+	MAC    net.HardwareAddr
+	Items  []FlowSpecItem
+}
+
+// FlowSpecItem is an operator and value pair of a flow specification
+// component.
+type FlowSpecItem struct {
+	Op    uint8
+	Value uint64
+}
+
+func registerFlowSpec(r *NLRIRegistry) {
+	for _, family := range ipFamily(apipb.Family_SAFI_FLOW_SPEC_UNICAST) {
+		RegisterNLRI(r, family, decodeFlowSpec)
+	}
+	vpn := append(ipFamily(apipb.Family_SAFI_FLOW_SPEC_VPN),
+		Family{AFI: apipb.Family_AFI_L2VPN, SAFI: apipb.Family_SAFI_FLOW_SPEC_VPN})
+	for _, family := range vpn {
+		RegisterNLRI(r, family, decodeVPNFlowSpec)
+	}
+}
+
+func decodeFlowSpec(msg *apipb.FlowSpecNLRI) (NLRI, error) {
+	rules, err := decodeFlowSpecRules(msg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return FlowSpecNLRI{Rules: rules}, nil
+}
+
+func decodeVPNFlowSpec(msg *apipb.VPNFlowSpecNLRI) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := decodeFlowSpecRules(msg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return FlowSpecNLRI{RD: &rd, Rules: rules}, nil
+}
+
+func decodeFlowSpecRules(packed []*anypb.Any) ([]FlowSpecRule, error) {
+	rules := make([]FlowSpecRule, 0, len(packed))
+	for _, p := range packed {
+		msg, err := p.UnmarshalNew()
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack flowspec rule: %w", err)
+		}
+		rule, err := decodeFlowSpecRule(msg)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func decodeFlowSpecRule(msg any) (FlowSpecRule, error) {
+	switch rule := msg.(type) {
+	case *apipb.FlowSpecIPPrefix:
+		prefix, err := nlriPrefix(rule.Prefix, rule.PrefixLen)
+		return FlowSpecRule{Type: uint8(rule.Type), Prefix: prefix, Offset: rule.Offset}, err
+	case *apipb.FlowSpecMAC:
+		mac, err := macAddr(rule.Address)
+		return FlowSpecRule{Type: uint8(rule.Type), MAC: mac}, err
+	case *apipb.FlowSpecComponent:
+		items := make([]FlowSpecItem, len(rule.Items))
+		for i, item := range rule.Items {
+			items[i] = FlowSpecItem{Op: uint8(item.Op), Value: item.Value}
+		}
+		return FlowSpecRule{Type: uint8(rule.Type), Items: items}, nil
+	}
+	return FlowSpecRule{}, fmt.Errorf("unsupported flowspec rule %T", msg)
+}
+
+func (n FlowSpecNLRI) String() string {
+	var b strings.Builder
+	if n.RD != nil {
+		fmt.Fprintf(&b, "[rd:%s]", n.RD)
+	}
+	for _, rule := range n.Rules {
+		fmt.Fprintf(&b, "[%d:%s]", rule.Type, rule.value())
+	}
+	return b.String()
+}
+
+func (r FlowSpecRule) value() string {
+	switch {
+	case r.Prefix.IsValid():
+		return r.Prefix.String()
+	case r.MAC != nil:
+		return r.MAC.String()
+	}
+	items := make([]string, len(r.Items))
+	for i, item := range r.Items {
+		items[i] = fmt.Sprintf("%#x/%d", item.Op, item.Value)
+	}
+	return strings.Join(items, " ")
+}
@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/proto"
+)
+
+// LSNLRIType is the type of a BGP-LS NLRI.
+type LSNLRIType uint8
+
+// BGP-LS NLRI types, as assigned by IANA.
+const (
+	LSNode     LSNLRIType = 1
+	LSLink     LSNLRIType = 2
+	LSPrefixV4 LSNLRIType = 3
+	LSPrefixV6 LSNLRIType = 4
+)
+
+// LSNLRI is an RFC 7752 BGP-LS node, link or prefix. RemoteNode and Link
+// are set on links only, Prefixes on prefixes only.
+type LSNLRI struct {
+	Type LSNLRIType
+	// Protocol is the protocol the object was learned from, such as
+	// IS-IS level 2 or OSPFv2.
+	Protocol   apipb.LsProtocolID
+	Identifier uint64
+	LocalNode  LSNodeDescriptor
+	RemoteNode *LSNodeDescriptor
+	Link       *LSLinkDescriptor
+	Prefixes   []netip.Prefix
+}
+
+// LSNodeDescriptor identifies a BGP-LS node.
+type LSNodeDescriptor struct {
+	ASN         uint32
+	BGPLSID     uint32
+	OSPFAreaID  uint32
+	Pseudonode  bool
+	IGPRouterID string
+	BGPRouterID netip.Addr
+}
+
+// LSLinkDescriptor identifies a BGP-LS link.
+type LSLinkDescriptor struct {
+	LocalID       uint32
+	RemoteID      uint32
+	InterfaceAddr []netip.Addr
+	NeighborAddr  []netip.Addr
+}
+
+func decodeLS(msg *apipb.LsAddrPrefix) (NLRI, error) {
+	n := LSNLRI{Type: LSNLRIType(msg.Type), Protocol: msg.ProtocolId, Identifier: msg.Identifier}
+	inner, err := msg.Nlri.UnmarshalNew()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack BGP-LS NLRI: %w", err)
+	}
+	if err := n.decode(inner); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *LSNLRI) decode(msg proto.Message) error {
+	var err error
+	switch inner := msg.(type) {
+	case *apipb.LsNodeNLRI:
+		n.LocalNode = lsNode(inner.LocalNode)
+	case *apipb.LsLinkNLRI:
+		n.LocalNode = lsNode(inner.LocalNode)
+		remote := lsNode(inner.RemoteNode)
+		n.RemoteNode = &remote
+		n.Link = lsLink(inner.LinkDescriptor)
+	case *apipb.LsPrefixV4NLRI:
+		n.LocalNode = lsNode(inner.LocalNode)
+		n.Prefixes, err = lsPrefixes(inner.PrefixDescriptor)
+	case *apipb.LsPrefixV6NLRI:
+		n.LocalNode = lsNode(inner.LocalNode)
+		n.Prefixes, err = lsPrefixes(inner.PrefixDescriptor)
+	default:
+		err = fmt.Errorf("unsupported BGP-LS NLRI %T", msg)
+	}
+	return err
+}
+
+func lsNode(d *apipb.LsNodeDescriptor) LSNodeDescriptor {
+	node := LSNodeDescriptor{
+		ASN:         d.GetAsn(),
+		BGPLSID:     d.GetBgpLsId(),
+		OSPFAreaID:  d.GetOspfAreaId(),
+		Pseudonode:  d.GetPseudonode(),
+		IGPRouterID: d.GetIgpRouterId(),
+	}
+	if id, err := netip.ParseAddr(d.GetBgpRouterId()); err == nil {
+		node.BGPRouterID = id
+	}
+	return node
+}
+
+func lsLink(d *apipb.LsLinkDescriptor) *LSLinkDescriptor {
+	return &LSLinkDescriptor{
+		LocalID:       d.GetLinkLocalId(),
+		RemoteID:      d.GetLinkRemoteId(),
+		InterfaceAddr: lsAddrs(d.GetInterfaceAddrIpv4(), d.GetInterfaceAddrIpv6()),
+		NeighborAddr:  lsAddrs(d.GetNeighborAddrIpv4(), d.GetNeighborAddrIpv6()),
+	}
+}
+
+// lsAddrs returns the addresses among values that are set.
+func lsAddrs(values ...string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, v := range values {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func lsPrefixes(d *apipb.LsPrefixDescriptor) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(d.GetIpReachability()))
+	for _, text := range d.GetIpReachability() {
+		prefix, err := netip.ParsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BGP-LS prefix: %w", err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (n LSNLRI) String() string {
+	s := fmt.Sprintf("[type:%d][protocol:%d][id:%d][local:%d:%s]",
+		n.Type, n.Protocol, n.Identifier, n.LocalNode.ASN, n.LocalNode.IGPRouterID)
+	if n.RemoteNode != nil {
+		s += fmt.Sprintf("[remote:%d:%s]", n.RemoteNode.ASN, n.RemoteNode.IGPRouterID)
+	}
+	for _, prefix := range n.Prefixes {
+		s += fmt.Sprintf("[prefix:%s]", prefix)
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+// MUPRouteType is the type of a mobile user plane route.
+type MUPRouteType uint8
+
+// MUP route types of the 3GPP 5G architecture type.
+const (
+	MUPInterworkSegmentDiscovery MUPRouteType = 1
+	MUPDirectSegmentDiscovery    MUPRouteType = 2
+	MUPType1SessionTransformed   MUPRouteType = 3
+	MUPType2SessionTransformed   MUPRouteType = 4
+)
+
+// MUPNLRI is a BGP mobile user plane route. Fields a route type does not
+// carry are left zero.
+type MUPNLRI struct {
+	RouteType MUPRouteType
+	RD        RouteDistinguisher
+	// Prefix is set on interwork segment discovery and type 1 session
+	// transformed routes.
+	Prefix netip.Prefix
+	// Address is set on direct segment discovery routes.
+	Address netip.Addr
+	TEID    uint32
+	QFI     uint8
+	// Endpoint and Source are the GTP tunnel addresses of session
+	// transformed routes.
+	Endpoint netip.Addr
+	Source   netip.Addr
+}
+
+func registerMUP(r *NLRIRegistry) {
+	for _, family := range ipFamily(apipb.Family_SAFI_MUP) {
+		RegisterNLRI(r, family, decodeMUPInterwork)
+		RegisterNLRI(r, family, decodeMUPDirect)
+		RegisterNLRI(r, family, decodeMUPType1)
+		RegisterNLRI(r, family, decodeMUPType2)
+	}
+}
+
+func decodeMUPInterwork(msg *apipb.MUPInterworkSegmentDiscoveryRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := netip.ParsePrefix(msg.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MUP prefix: %w", err)
+	}
+	return MUPNLRI{RouteType: MUPInterworkSegmentDiscovery, RD: rd, Prefix: prefix}, nil
+}
+
+func decodeMUPDirect(msg *apipb.MUPDirectSegmentDiscoveryRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := netip.ParseAddr(msg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MUP address: %w", err)
+	}
+	return MUPNLRI{RouteType: MUPDirectSegmentDiscovery, RD: rd, Address: addr}, nil
+}
+
+func decodeMUPType1(msg *apipb.MUPType1SessionTransformedRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := nlriPrefix(msg.Prefix, msg.PrefixLength)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := optionalAddr(msg.EndpointAddress)
+	if err != nil {
+		return nil, err
+	}
+	source, err := optionalAddr(msg.SourceAddress)
+	if err != nil {
+		return nil, err
+	}
+	return MUPNLRI{
+		RouteType: MUPType1SessionTransformed,
+		RD:        rd,
+		Prefix:    prefix,
+		TEID:      msg.Teid,
+		QFI:       uint8(msg.Qfi),
+		Endpoint:  endpoint,
+		Source:    source,
+	}, nil
+}
+
+func decodeMUPType2(msg *apipb.MUPType2SessionTransformedRoute) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := optionalAddr(msg.EndpointAddress)
+	if err != nil {
+		return nil, err
+	}
+	return MUPNLRI{RouteType: MUPType2SessionTransformed, RD: rd, TEID: msg.Teid, Endpoint: endpoint}, nil
+}
+
+func (n MUPNLRI) String() string {
+	s := fmt.Sprintf("[type:%d][rd:%s]", n.RouteType, n.RD)
+	switch n.RouteType {
+	case MUPInterworkSegmentDiscovery:
+		s += fmt.Sprintf("[prefix:%s]", n.Prefix)
+	case MUPDirectSegmentDiscovery:
+		s += fmt.Sprintf("[address:%s]", n.Address)
+	case MUPType1SessionTransformed:
+		s += fmt.Sprintf("[prefix:%s][teid:%d][qfi:%d][endpoint:%s]", n.Prefix, n.TEID, n.QFI, n.Endpoint)
+	case MUPType2SessionTransformed:
+		s += fmt.Sprintf("[endpoint:%s][teid:%d]", n.Endpoint, n.TEID)
+	}
+	return s
+}
@@ -0,0 +1,272 @@
+package routes
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func packNLRI(t *testing.T, msg proto.Message) *anypb.Any {
+	t.Helper()
+	packed, err := anypb.New(msg)
+	require.NoError(t, err)
+	return packed
+}
+
+func TestNLRIRegistryDecode(t *testing.T) {
+	rd := packNLRI(t, &apipb.RouteDistinguisherTwoOctetASN{Admin: 65000, Assigned: 100})
+	rt := packNLRI(t, &apipb.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: 65000, LocalAdmin: 1})
+	target := pathattr.ExtendedCommunity{SubType: pathattr.SubTypeRouteTarget, Global: "65000", Local: 1}
+	distinguisher := RouteDistinguisher{Admin: "65000", Assigned: 100}
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	tests := []struct {
+		family Family
+		msg    proto.Message
+		want   NLRI
+		text   string
+	}{
+		{
+			FamilyIPv6Unicast,
+			&apipb.IPAddressPrefix{Prefix: "2001:db8::", PrefixLen: 32},
+			UnicastNLRI{Family: FamilyIPv6Unicast, Prefix: netip.MustParsePrefix("2001:db8::/32")},
+			"2001:db8::/32",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_MULTICAST},
+			&apipb.IPAddressPrefix{Prefix: "192.0.2.0", PrefixLen: 24},
+			UnicastNLRI{
+				Family: Family{apipb.Family_AFI_IP, apipb.Family_SAFI_MULTICAST},
+				Prefix: netip.MustParsePrefix("192.0.2.0/24"),
+			},
+			"192.0.2.0/24",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_MPLS_LABEL},
+			&apipb.LabeledIPAddressPrefix{Prefix: "192.0.2.0", PrefixLen: 24, Labels: []uint32{16, 17}},
+			LabeledNLRI{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Labels: []uint32{16, 17}},
+			"192.0.2.0/24 labels 16,17",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_MPLS_VPN},
+			&apipb.LabeledVPNIPAddressPrefix{Rd: rd, Prefix: "10.0.0.0", PrefixLen: 8, Labels: []uint32{100}},
+			VPNNLRI{
+				Family: Family{apipb.Family_AFI_IP, apipb.Family_SAFI_MPLS_VPN},
+				RD:     distinguisher, Prefix: netip.MustParsePrefix("10.0.0.0/8"), Labels: []uint32{100},
+			},
+			"65000:100:10.0.0.0/8 labels 100",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_ENCAPSULATION},
+			&apipb.EncapsulationNLRI{Address: "192.0.2.1"},
+			EncapsulationNLRI{Endpoint: netip.MustParseAddr("192.0.2.1")},
+			"192.0.2.1",
+		},
+		{
+			Family{apipb.Family_AFI_IP6, apipb.Family_SAFI_SR_POLICY},
+			&apipb.SRPolicyNLRI{Distinguisher: 1, Color: 100, Endpoint: netip.MustParseAddr("2001:db8::1").AsSlice()},
+			SRPolicyNLRI{Distinguisher: 1, Color: 100, Endpoint: netip.MustParseAddr("2001:db8::1")},
+			"[1][100][2001:db8::1]",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_ROUTE_TARGET_CONSTRAINTS},
+			&apipb.RouteTargetMembershipNLRI{Asn: 65001, Rt: rt},
+			RouteTargetNLRI{ASN: 65001, RouteTarget: &target},
+			"65001:rt:65000:1",
+		},
+		{
+			FamilyL2VPNVPLS,
+			&apipb.VPLSNLRI{Rd: rd, VeId: 1, VeBlockOffset: 1, VeBlockSize: 10, LabelBlockBase: 1000},
+			VPLSNLRI{RD: distinguisher, VEID: 1, VEBlockOffset: 1, VEBlockSize: 10, LabelBlockBase: 1000},
+			"65000:100:1:1",
+		},
+		{
+			FamilyL2VPNEVPN,
+			&apipb.EVPNMACIPAdvertisementRoute{
+				Rd: rd, Esi: &apipb.EthernetSegmentIdentifier{}, EthernetTag: 10,
+				MacAddress: "02:00:00:00:00:01", IpAddress: "192.0.2.10", Labels: []uint32{10010},
+			},
+			EVPNNLRI{
+				RouteType: EVPNMACIP, RD: distinguisher, EthernetTag: 10,
+				MAC: mac, IP: netip.MustParseAddr("192.0.2.10"), Labels: []uint32{10010},
+			},
+			"[type:2][rd:65000:100][etag:10][mac:02:00:00:00:00:01][ip:192.0.2.10]",
+		},
+		{
+			FamilyL2VPNEVPN,
+			&apipb.EVPNIPPrefixRoute{Rd: rd, IpPrefix: "10.1.0.0", IpPrefixLen: 16, GwAddress: "0.0.0.0", Label: 5000},
+			EVPNNLRI{
+				RouteType: EVPNIPPrefix, RD: distinguisher, Prefix: netip.MustParsePrefix("10.1.0.0/16"),
+				Gateway: netip.MustParseAddr("0.0.0.0"), Labels: []uint32{5000},
+			},
+			"[type:5][rd:65000:100][etag:0][prefix:10.1.0.0/16]",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_FLOW_SPEC_UNICAST},
+			&apipb.FlowSpecNLRI{Rules: []*anypb.Any{
+				packNLRI(t, &apipb.FlowSpecIPPrefix{Type: 1, Prefix: "198.51.100.0", PrefixLen: 24}),
+				packNLRI(t, &apipb.FlowSpecComponent{Type: 3, Items: []*apipb.FlowSpecComponentItem{{Op: 0x81, Value: 6}}}),
+			}},
+			FlowSpecNLRI{Rules: []FlowSpecRule{
+				{Type: 1, Prefix: netip.MustParsePrefix("198.51.100.0/24")},
+				{Type: 3, Items: []FlowSpecItem{{Op: 0x81, Value: 6}}},
+			}},
+			"[1:198.51.100.0/24][3:0x81/6]",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_FLOW_SPEC_VPN},
+			&apipb.VPNFlowSpecNLRI{Rd: rd, Rules: []*anypb.Any{
+				packNLRI(t, &apipb.FlowSpecIPPrefix{Type: 2, Prefix: "192.0.2.0", PrefixLen: 24}),
+			}},
+			FlowSpecNLRI{RD: &distinguisher, Rules: []FlowSpecRule{{Type: 2, Prefix: netip.MustParsePrefix("192.0.2.0/24")}}},
+			"[rd:65000:100][2:192.0.2.0/24]",
+		},
+		{
+			Family{apipb.Family_AFI_IP, apipb.Family_SAFI_MUP},
+			&apipb.MUPType1SessionTransformedRoute{
+				Rd: rd, Prefix: "192.0.2.0", PrefixLength: 24, Teid: 12345, Qfi: 9,
+				EndpointAddressLength: 32, EndpointAddress: "198.51.100.1",
+			},
+			MUPNLRI{
+				RouteType: MUPType1SessionTransformed, RD: distinguisher, Prefix: netip.MustParsePrefix("192.0.2.0/24"),
+				TEID: 12345, QFI: 9, Endpoint: netip.MustParseAddr("198.51.100.1"),
+			},
+			"[type:3][rd:65000:100][prefix:192.0.2.0/24][teid:12345][qfi:9][endpoint:198.51.100.1]",
+		},
+		{
+			Family{apipb.Family_AFI_IP6, apipb.Family_SAFI_MUP},
+			&apipb.MUPInterworkSegmentDiscoveryRoute{Rd: rd, Prefix: "2001:db8::/64"},
+			MUPNLRI{RouteType: MUPInterworkSegmentDiscovery, RD: distinguisher, Prefix: netip.MustParsePrefix("2001:db8::/64")},
+			"[type:1][rd:65000:100][prefix:2001:db8::/64]",
+		},
+		{
+			FamilyLS,
+			&apipb.LsAddrPrefix{
+				Type:       apipb.LsNLRIType_LS_NLRI_PREFIX_V4,
+				ProtocolId: apipb.LsProtocolID_LS_PROTOCOL_ISIS_L2,
+				Identifier: 1,
+				Nlri: packNLRI(t, &apipb.LsPrefixV4NLRI{
+					LocalNode:        &apipb.LsNodeDescriptor{Asn: 65000, IgpRouterId: "0000.0000.0001"},
+					PrefixDescriptor: &apipb.LsPrefixDescriptor{IpReachability: []string{"10.0.0.0/24"}},
+				}),
+			},
+			LSNLRI{
+				Type:       LSPrefixV4,
+				Protocol:   apipb.LsProtocolID_LS_PROTOCOL_ISIS_L2,
+				Identifier: 1,
+				LocalNode:  LSNodeDescriptor{ASN: 65000, IGPRouterID: "0000.0000.0001"},
+				Prefixes:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+			},
+			"[type:3][protocol:2][id:1][local:65000:0000.0000.0001][prefix:10.0.0.0/24]",
+		},
+		{
+			FamilyKeyValue,
+			&apipb.OpaqueNLRI{Key: []byte("key"), Value: []byte("value")},
+			OpaqueNLRI{Key: []byte("key"), Value: []byte("value")},
+			`"key"`,
+		},
+	}
+
+	r := NewNLRIRegistry()
+	for _, tt := range tests {
+		nlri, err := r.Decode(tt.family, packNLRI(t, tt.msg))
+		require.NoError(t, err, tt.text)
+		assert.Equal(t, tt.want, nlri, tt.text)
+		assert.Equal(t, tt.text, nlri.String())
+	}
+}
+
+func TestNLRIRegistryDecodeLink(t *testing.T) {
+	nlri, err := NewNLRIRegistry().Decode(FamilyLS, packNLRI(t, &apipb.LsAddrPrefix{
+		Type: apipb.LsNLRIType_LS_NLRI_LINK,
+		Nlri: packNLRI(t, &apipb.LsLinkNLRI{
+			LocalNode:      &apipb.LsNodeDescriptor{Asn: 65000, BgpRouterId: "192.0.2.1"},
+			RemoteNode:     &apipb.LsNodeDescriptor{Asn: 65000, BgpRouterId: "192.0.2.2"},
+			LinkDescriptor: &apipb.LsLinkDescriptor{InterfaceAddrIpv4: "10.0.0.1", NeighborAddrIpv4: "10.0.0.2"},
+		}),
+	}))
+	require.NoError(t, err)
+
+	link := nlri.(LSNLRI)
+	assert.Equal(t, LSLink, link.Type)
+	assert.Equal(t, netip.MustParseAddr("192.0.2.1"), link.LocalNode.BGPRouterID)
+	require.NotNil(t, link.RemoteNode)
+	assert.Equal(t, netip.MustParseAddr("192.0.2.2"), link.RemoteNode.BGPRouterID)
+	require.NotNil(t, link.Link)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.1")}, link.Link.InterfaceAddr)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.2")}, link.Link.NeighborAddr)
+}
+
+func TestNLRIRegistryErrors(t *testing.T) {
+	r := NewNLRIRegistry()
+
+	_, err := r.Decode(FamilyIPv4Unicast, packNLRI(t, &apipb.IPAddressPrefix{Prefix: "192.0.2.1", PrefixLen: 24}))
+	assert.ErrorIs(t, err, pathattr.ErrHostBits)
+
+	evpn := packNLRI(t, &apipb.EVPNMACIPAdvertisementRoute{MacAddress: "bogus"})
+	_, err = r.Decode(FamilyL2VPNEVPN, evpn)
+	assert.Error(t, err)
+
+	_, err = r.Decode(FamilyL2VPNEVPN, packNLRI(t, &apipb.EVPNMACIPAdvertisementRoute{
+		Rd: packNLRI(t, &apipb.RouteDistinguisherIPAddress{Admin: "192.0.2.1", Assigned: 1}), MacAddress: "bogus",
+	}))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrUnknownNLRI))
+}
+
+func TestNLRIRegistryReportsUnknownOnce(t *testing.T) {
+	r := NewNLRIRegistry()
+	unknown := func() int64 {
+		v, _ := Metrics.Get(metricNLRIUnknown).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	before := unknown()
+
+	// A known message type in a family it does not belong to.
+	nlri := packNLRI(t, &apipb.IPAddressPrefix{Prefix: "192.0.2.0", PrefixLen: 24})
+	for i := 0; i < 3; i++ {
+		_, err := r.Decode(FamilyL2VPNEVPN, nlri)
+		assert.ErrorIs(t, err, ErrUnknownNLRI)
+	}
+	_, err := r.DecodePath(&apipb.Path{Nlri: nlri})
+	assert.ErrorIs(t, err, ErrUnknownNLRI)
+
+	assert.Equal(t, before+4, unknown())
+	assert.Len(t, r.unknown, 2)
+}
+
+func TestRegisterNLRI(t *testing.T) {
+	type custom struct{ NLRI }
+	r := NewNLRIRegistry()
+	RegisterNLRI(r, FamilyIPv4Unicast, func(msg *apipb.LabeledIPAddressPrefix) (NLRI, error) {
+		return custom{UnicastNLRI{Prefix: netip.MustParsePrefix("192.0.2.0/24")}}, nil
+	})
+
+	nlri, err := r.Decode(FamilyIPv4Unicast, packNLRI(t, &apipb.LabeledIPAddressPrefix{}))
+	require.NoError(t, err)
+	assert.IsType(t, custom{}, nlri)
+
+	// The built-in decoder of the family is left alone.
+	nlri, err = r.Decode(FamilyIPv4Unicast, packNLRI(t, &apipb.IPAddressPrefix{Prefix: "192.0.2.0", PrefixLen: 24}))
+	require.NoError(t, err)
+	assert.IsType(t, UnicastNLRI{}, nlri)
+}
+
+func TestFamilyString(t *testing.T) {
+	assert.Equal(t, "ipv4-unicast", FamilyIPv4Unicast.String())
+	assert.Equal(t, "l2vpn-evpn", FamilyL2VPNEVPN.String())
+	assert.Equal(t, "ipv6-flow-spec-vpn", Family{apipb.Family_AFI_IP6, apipb.Family_SAFI_FLOW_SPEC_VPN}.String())
+	assert.Equal(t, FamilyIPv6Unicast, FamilyOf(&apipb.Family{Afi: apipb.Family_AFI_IP6, Safi: apipb.Family_SAFI_UNICAST}))
+}
@@ -0,0 +1,330 @@
+package routes
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Address families GoBGP carries NLRI for.
+var (
+	FamilyIPv4Unicast = Family{apipb.Family_AFI_IP, apipb.Family_SAFI_UNICAST}
+	FamilyIPv6Unicast = Family{apipb.Family_AFI_IP6, apipb.Family_SAFI_UNICAST}
+	FamilyL2VPNEVPN   = Family{apipb.Family_AFI_L2VPN, apipb.Family_SAFI_EVPN}
+	FamilyL2VPNVPLS   = Family{apipb.Family_AFI_L2VPN, apipb.Family_SAFI_VPLS}
+	FamilyLS          = Family{apipb.Family_AFI_LS, apipb.Family_SAFI_LS}
+	FamilyKeyValue    = Family{apipb.Family_AFI_OPAQUE, apipb.Family_SAFI_KEY_VALUE}
+)
+
+var ipFamilies = []apipb.Family_Afi{apipb.Family_AFI_IP, apipb.Family_AFI_IP6}
+
+// ipFamily returns the family with safi of both IP versions.
+func ipFamily(safi apipb.Family_Safi) []Family {
+	families := make([]Family, 0, len(ipFamilies))
+	for _, afi := range ipFamilies {
+		families = append(families, Family{AFI: afi, SAFI: safi})
+	}
+	return families
+}
+
+func registerBuiltinNLRI(r *NLRIRegistry) {
+	for _, family := range append(ipFamily(apipb.Family_SAFI_UNICAST), ipFamily(apipb.Family_SAFI_MULTICAST)...) {
+		r.decoders[nlriKey{family: family, name: "apipb.IPAddressPrefix"}] = decodeUnicast
+	}
+	for _, family := range ipFamily(apipb.Family_SAFI_MPLS_LABEL) {
+		RegisterNLRI(r, family, decodeLabeled)
+	}
+	vpn := append(ipFamily(apipb.Family_SAFI_MPLS_VPN), ipFamily(apipb.Family_SAFI_MPLS_VPN_MULTICAST)...)
+	for _, family := range vpn {
+		registerFamilyNLRI(r, family, decodeVPN)
+	}
+	for _, family := range ipFamily(apipb.Family_SAFI_ENCAPSULATION) {
+		RegisterNLRI(r, family, decodeEncapsulation)
+	}
+	for _, family := range ipFamily(apipb.Family_SAFI_SR_POLICY) {
+		RegisterNLRI(r, family, decodeSRPolicy)
+	}
+	RegisterNLRI(r, Family{apipb.Family_AFI_IP, apipb.Family_SAFI_ROUTE_TARGET_CONSTRAINTS}, decodeRouteTarget)
+	RegisterNLRI(r, FamilyL2VPNVPLS, decodeVPLS)
+	RegisterNLRI(r, FamilyLS, decodeLS)
+	RegisterNLRI(r, FamilyKeyValue, decodeOpaque)
+	registerEVPN(r)
+	registerFlowSpec(r)
+	registerMUP(r)
+}
+
+// RouteDistinguisher is the RFC 4364 route distinguisher of VPN NLRI.
+type RouteDistinguisher struct {
+	// Admin is an AS number or an IPv4 address.
+	Admin    string
+	Assigned uint32
+}
+
+func (rd RouteDistinguisher) String() string {
+	return fmt.Sprintf("%s:%d", rd.Admin, rd.Assigned)
+}
+
+func decodeRD(packed *anypb.Any) (RouteDistinguisher, error) {
+	msg, err := packed.UnmarshalNew()
+	if err != nil {
+		return RouteDistinguisher{}, fmt.Errorf("failed to unpack route distinguisher: %w", err)
+	}
+	switch rd := msg.(type) {
+	case *apipb.RouteDistinguisherTwoOctetASN:
+		return RouteDistinguisher{Admin: strconv.FormatUint(uint64(rd.Admin), 10), Assigned: rd.Assigned}, nil
+	case *apipb.RouteDistinguisherFourOctetASN:
+		return RouteDistinguisher{Admin: strconv.FormatUint(uint64(rd.Admin), 10), Assigned: rd.Assigned}, nil
+	case *apipb.RouteDistinguisherIPAddress:
+		return RouteDistinguisher{Admin: rd.Admin, Assigned: rd.Assigned}, nil
+	}
+	return RouteDistinguisher{}, fmt.Errorf("unsupported route distinguisher %s", packed.GetTypeUrl())
+}
+
+// nlriPrefix parses a prefix of a non-unicast NLRI.
+func nlriPrefix(text string, bits uint32) (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid NLRI prefix: %w", err)
+	}
+	prefix := netip.PrefixFrom(addr, int(bits))
+	if !prefix.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("invalid NLRI prefix length %d for %s", bits, addr)
+	}
+	return prefix, nil
+}
+
+// optionalAddr parses an address that NLRI may leave empty.
+func optionalAddr(text string) (netip.Addr, error) {
+	if text == "" {
+		return netip.Addr{}, nil
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid NLRI address: %w", err)
+	}
+	return addr, nil
+}
+
+// UnicastNLRI is an IP unicast or multicast prefix. Both share the NLRI
+// type, so Family tells them apart: multicast prefixes only feed the
+// reverse path checks of multicast routing and are never installed.
+type UnicastNLRI struct {
+	Family Family
+	Prefix netip.Prefix
+}
+
+func decodeUnicast(family Family, nlri *anypb.Any) (NLRI, error) {
+	prefix, err := pathattr.DecodePrefix(nlri)
+	if err != nil {
+		return nil, err
+	}
+	return UnicastNLRI{Family: family, Prefix: prefix}, nil
+}
+
+// Multicast reports whether n is a multicast prefix.
+func (n UnicastNLRI) Multicast() bool {
+	return n.Family.SAFI == apipb.Family_SAFI_MULTICAST
+}
+
+func (n UnicastNLRI) String() string {
+	return n.Prefix.String()
+}
+
+// LabeledNLRI is an RFC 8277 labeled unicast prefix.
+type LabeledNLRI struct {
+	Prefix netip.Prefix
+	Labels []uint32
+}
+
+func decodeLabeled(msg *apipb.LabeledIPAddressPrefix) (NLRI, error) {
+	prefix, err := nlriPrefix(msg.Prefix, msg.PrefixLen)
+	if err != nil {
+		return nil, err
+	}
+	return LabeledNLRI{Prefix: prefix, Labels: msg.Labels}, nil
+}
+
+func (n LabeledNLRI) String() string {
+	return n.Prefix.String() + labelsString(n.Labels)
+}
+
+// VPNNLRI is an RFC 4364 VPN prefix, of a unicast or, in Family, a
+// multicast VPN.
+type VPNNLRI struct {
+	Family Family
+	RD     RouteDistinguisher
+	Prefix netip.Prefix
+	Labels []uint32
+}
+
+func decodeVPN(family Family, msg *apipb.LabeledVPNIPAddressPrefix) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := nlriPrefix(msg.Prefix, msg.PrefixLen)
+	if err != nil {
+		return nil, err
+	}
+	return VPNNLRI{Family: family, RD: rd, Prefix: prefix, Labels: msg.Labels}, nil
+}
+
+// Multicast reports whether n is a multicast VPN prefix.
+func (n VPNNLRI) Multicast() bool {
+	return n.Family.SAFI == apipb.Family_SAFI_MPLS_VPN_MULTICAST
+}
+
+func (n VPNNLRI) String() string {
+	return fmt.Sprintf("%s:%s%s", n.RD, n.Prefix, labelsString(n.Labels))
+}
+
+// EncapsulationNLRI is an RFC 5512 tunnel endpoint.
+type EncapsulationNLRI struct {
+	Endpoint netip.Addr
+}
+
+func decodeEncapsulation(msg *apipb.EncapsulationNLRI) (NLRI, error) {
+	addr, err := netip.ParseAddr(msg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encapsulation endpoint: %w", err)
+	}
+	return EncapsulationNLRI{Endpoint: addr}, nil
+}
+
+func (n EncapsulationNLRI) String() string {
+	return n.Endpoint.String()
+}
+
+// SRPolicyNLRI is a segment routing policy candidate path, for SR-MPLS as
+// well as SRv6.
+type SRPolicyNLRI struct {
+	Distinguisher uint32
+	Color         uint32
+	Endpoint      netip.Addr
+}
+
+func decodeSRPolicy(msg *apipb.SRPolicyNLRI) (NLRI, error) {
+	endpoint, ok := netip.AddrFromSlice(msg.Endpoint)
+	if !ok {
+		return nil, fmt.Errorf("invalid SR policy endpoint %x", msg.Endpoint)
+	}
+	return SRPolicyNLRI{Distinguisher: msg.Distinguisher, Color: msg.Color, Endpoint: endpoint.Unmap()}, nil
+}
+
+func (n SRPolicyNLRI) String() string {
+	return fmt.Sprintf("[%d][%d][%s]", n.Distinguisher, n.Color, n.Endpoint)
+}
+
+// RouteTargetNLRI is an RFC 4684 route target membership. The default
+// membership has no route target.
+type RouteTargetNLRI struct {
+	ASN         uint32
+	RouteTarget *pathattr.ExtendedCommunity
+}
+
+func decodeRouteTarget(msg *apipb.RouteTargetMembershipNLRI) (NLRI, error) {
+	n := RouteTargetNLRI{ASN: msg.Asn}
+	if msg.Rt == nil {
+		return n, nil
+	}
+	rt, err := pathattr.DecodeExtendedCommunity(msg.Rt)
+	if err != nil {
+		return nil, err
+	}
+	n.RouteTarget = &rt
+	return n, nil
+}
+
+func (n RouteTargetNLRI) String() string {
+	if n.RouteTarget == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%d:%s", n.ASN, n.RouteTarget)
+}
+
+// VPLSNLRI is an RFC 4761 VPLS label block.
+type VPLSNLRI struct {
+	RD             RouteDistinguisher
+	VEID           uint32
+	VEBlockOffset  uint32
+	VEBlockSize    uint32
+	LabelBlockBase uint32
+}
+
+func decodeVPLS(msg *apipb.VPLSNLRI) (NLRI, error) {
+	rd, err := decodeRD(msg.Rd)
+	if err != nil {
+		return nil, err
+	}
+	return VPLSNLRI{
+		RD:             rd,
+		VEID:           msg.VeId,
+		VEBlockOffset:  msg.VeBlockOffset,
+		VEBlockSize:    msg.VeBlockSize,
+		LabelBlockBase: msg.LabelBlockBase,
+	}, nil
+}
+
+func (n VPLSNLRI) String() string {
+	return fmt.Sprintf("%s:%d:%d", n.RD, n.VEID, n.VEBlockOffset)
+}
+
+// OpaqueNLRI is a key of the GoBGP key-value family.
+type OpaqueNLRI struct {
+	Key   []byte
+	Value []byte
+}
+
+func decodeOpaque(msg *apipb.OpaqueNLRI) (NLRI, error) {
+	return OpaqueNLRI{Key: msg.Key, Value: msg.Value}, nil
+}
+
+func (n OpaqueNLRI) String() string {
+	return strconv.Quote(string(n.Key))
+}
+
+// ESI is an RFC 7432 Ethernet segment identifier.
+type ESI struct {
+	Type  uint8
+	Value []byte
+}
+
+func esiOf(esi *apipb.EthernetSegmentIdentifier) ESI {
+	return ESI{Type: uint8(esi.GetType()), Value: esi.GetValue()}
+}
+
+func (e ESI) String() string {
+	return fmt.Sprintf("%d:%s", e.Type, hex.EncodeToString(e.Value))
+}
+
+// macAddr parses a MAC address that NLRI may leave empty.
+func macAddr(text string) (net.HardwareAddr, error) {
+	if text == "" {
+		return nil, nil
+	}
+	mac, err := net.ParseMAC(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NLRI MAC address: %w", err)
+	}
+	return mac, nil
+}
+
+// labelsString formats labels for String methods, or returns nothing when
+// there are none.
+func labelsString(labels []uint32) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = strconv.FormatUint(uint64(label), 10)
+	}
+	return " labels " + strings.Join(parts, ",")
+}
@@ -0,0 +1,197 @@
+package pathattr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Community is a standard RFC 1997 community.
+type Community uint32
+
+// ParseCommunity parses a community written as "ASN:value".
+func ParseCommunity(s string) (Community, error) {
+	high, low, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid community %q", s)
+	}
+	asn, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q: %w", s, err)
+	}
+	value, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q: %w", s, err)
+	}
+	return Community(asn<<16 | value), nil
+}
+
+func (c Community) String() string {
+	return fmt.Sprintf("%d:%d", uint32(c)>>16, uint32(c)&0xffff)
+}
+
+// LargeCommunity is an RFC 8092 large community.
+type LargeCommunity struct {
+	GlobalAdmin uint32
+	LocalData1  uint32
+	LocalData2  uint32
+}
+
+// ParseLargeCommunity parses a large community written as
+// "global:local1:local2".
+func ParseLargeCommunity(s string) (LargeCommunity, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return LargeCommunity{}, fmt.Errorf("invalid large community %q", s)
+	}
+
+	var values [3]uint32
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return LargeCommunity{}, fmt.Errorf("invalid large community %q: %w", s, err)
+		}
+		values[i] = uint32(v)
+	}
+	return LargeCommunity{GlobalAdmin: values[0], LocalData1: values[1], LocalData2: values[2]}, nil
+}
+
+func (c LargeCommunity) String() string {
+	return fmt.Sprintf("%d:%d:%d", c.GlobalAdmin, c.LocalData1, c.LocalData2)
+}
+
+// Sub-types of AS and address specific extended communities with a
+// well-known name.
+const (
+	SubTypeRouteTarget   = 0x02
+	SubTypeRouteOrigin   = 0x03
+	SubTypeLinkBandwidth = 0x04
+)
+
+var subTypeNames = map[uint8]string{
+	SubTypeRouteTarget:   "rt",
+	SubTypeRouteOrigin:   "soo",
+	SubTypeLinkBandwidth: "lb",
+}
+
+// ExtendedKind tells how the value of an extended community is held.
+type ExtendedKind uint8
+
+// Kinds of extended communities. Specific communities carry an
+// administrator and a local value qualified by a sub-type; the others carry
+// a single value.
+const (
+	KindSpecific ExtendedKind = iota
+	KindColor
+	KindEncap
+	KindValidation
+	KindOpaque
+	KindRouterMAC
+	KindUnknown
+)
+
+var kindNames = map[ExtendedKind]string{
+	KindColor:      "color",
+	KindEncap:      "encap",
+	KindValidation: "validation",
+	KindOpaque:     "opaque",
+	KindRouterMAC:  "router-mac",
+	KindUnknown:    "unknown",
+}
+
+// ExtendedCommunity is an RFC 4360 or RFC 5701 extended community.
+type ExtendedCommunity struct {
+	Kind ExtendedKind
+	// SubType qualifies specific communities, or holds the type of
+	// unknown ones.
+	SubType uint8
+	// Global is the administrator of specific communities, an AS number
+	// or an IP address, and the value of opaque, router MAC and unknown
+	// communities.
+	Global string
+	// Local is the local value of specific communities and the value of
+	// color, encapsulation and validation communities. Link bandwidth is
+	// in bytes per second.
+	Local uint32
+}
+
+// ParseExtendedCommunity parses an extended community written as
+// "rt:global:local", "soo:global:local", "lb:asn:bandwidth",
+// "0xNN:global:local", "color:N", "encap:N", "validation:N", "opaque:hex"
+// or "router-mac:mac", where global is an AS number or an IP address.
+func ParseExtendedCommunity(s string) (ExtendedCommunity, error) {
+	name, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return ExtendedCommunity{}, fmt.Errorf("invalid extended community %q", s)
+	}
+
+	var c ExtendedCommunity
+	var err error
+	switch kind := kindOf(name); kind {
+	case KindSpecific:
+		c, err = parseSpecific(name, rest)
+	case KindColor, KindEncap, KindValidation:
+		var v uint64
+		v, err = strconv.ParseUint(rest, 10, 32)
+		c = ExtendedCommunity{Kind: kind, Local: uint32(v)}
+	case KindOpaque, KindRouterMAC:
+		c = ExtendedCommunity{Kind: kind, Global: rest}
+	default:
+		err = fmt.Errorf("unknown kind %q", name)
+	}
+	if err != nil {
+		return ExtendedCommunity{}, fmt.Errorf("invalid extended community %q: %w", s, err)
+	}
+	return c, nil
+}
+
+func kindOf(name string) ExtendedKind {
+	for kind, n := range kindNames {
+		if n == name {
+			return kind
+		}
+	}
+	return KindSpecific
+}
+
+func parseSpecific(name, rest string) (ExtendedCommunity, error) {
+	i := strings.LastIndex(rest, ":")
+	if i <= 0 {
+		return ExtendedCommunity{}, fmt.Errorf("missing administrator or local value")
+	}
+	subType, err := parseSubType(name)
+	if err != nil {
+		return ExtendedCommunity{}, err
+	}
+	local, err := strconv.ParseUint(rest[i+1:], 10, 32)
+	if err != nil {
+		return ExtendedCommunity{}, err
+	}
+	return ExtendedCommunity{SubType: subType, Global: rest[:i], Local: uint32(local)}, nil
+}
+
+func parseSubType(name string) (uint8, error) {
+	for subType, n := range subTypeNames {
+		if n == name {
+			return subType, nil
+		}
+	}
+	v, err := strconv.ParseUint(name, 0, 8)
+	return uint8(v), err
+}
+
+func (c ExtendedCommunity) String() string {
+	switch c.Kind {
+	case KindSpecific:
+		name, ok := subTypeNames[c.SubType]
+		if !ok {
+			name = fmt.Sprintf("0x%02x", c.SubType)
+		}
+		return fmt.Sprintf("%s:%s:%d", name, c.Global, c.Local)
+	case KindColor, KindEncap, KindValidation:
+		return fmt.Sprintf("%s:%d", kindNames[c.Kind], c.Local)
+	case KindUnknown:
+		return fmt.Sprintf("unknown:0x%02x:%s", c.SubType, c.Global)
+	}
+	return fmt.Sprintf("%s:%s", kindNames[c.Kind], c.Global)
+}
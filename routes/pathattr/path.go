@@ -0,0 +1,105 @@
+package pathattr
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ValidationState is the RPKI origin validation state of a path.
+type ValidationState uint8
+
+// Validation states, as reported by GoBGP.
+const (
+	ValidationNone ValidationState = iota
+	ValidationNotFound
+	ValidationValid
+	ValidationInvalid
+)
+
+func (v ValidationState) String() string {
+	switch v {
+	case ValidationNotFound:
+		return "not-found"
+	case ValidationValid:
+		return "valid"
+	case ValidationInvalid:
+		return "invalid"
+	}
+	return "none"
+}
+
+// Path is a decoded GoBGP path.
+type Path struct {
+	// Prefix is the destination of IP unicast paths, and invalid for the
+	// other address families.
+	Prefix     netip.Prefix
+	Withdrawn  bool
+	Best       bool
+	Stale      bool
+	Validation ValidationState
+	// Age is the time the path was received, or zero when unknown.
+	Age time.Time
+	Attributes
+}
+
+// DecodePath decodes path with its attributes.
+func DecodePath(path *apipb.Path) (*Path, error) {
+	attrs, err := Decode(path)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := decodePrefix(path.GetNlri())
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Path{
+		Prefix:     prefix,
+		Withdrawn:  path.GetIsWithdraw(),
+		Best:       path.GetBest(),
+		Stale:      path.GetStale(),
+		Validation: ValidationState(path.GetValidation().GetState()),
+		Attributes: *attrs,
+	}
+	if path.GetAge() != nil {
+		p.Age = path.GetAge().AsTime()
+	}
+	return p, nil
+}
+
+// decodePrefix returns the destination of an IP unicast NLRI. Other NLRI
+// types have none.
+func decodePrefix(nlri *anypb.Any) (netip.Prefix, error) {
+	if !isIPAddressPrefix(nlri) {
+		return netip.Prefix{}, nil
+	}
+	return DecodePrefix(nlri)
+}
+
+// String summarises the path for logging.
+func (p *Path) String() string {
+	var b strings.Builder
+	b.WriteString(p.Prefix.String())
+	if p.Withdrawn {
+		b.WriteString(" withdrawn")
+	}
+	for _, nh := range p.NextHops {
+		fmt.Fprintf(&b, " via %s", nh)
+	}
+	if len(p.ASPath) > 0 {
+		fmt.Fprintf(&b, " as-path [%s]", p.ASPathString())
+	}
+	fmt.Fprintf(&b, " origin %s", p.Origin)
+	if p.Peer.Address.IsValid() {
+		fmt.Fprintf(&b, " from %s", p.Peer.Address)
+	}
+	if p.Validation != ValidationNone {
+		fmt.Fprintf(&b, " rpki %s", p.Validation)
+	}
+	return b.String()
+}
@@ -0,0 +1,85 @@
+package pathattr
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDecodePath(t *testing.T) {
+	age := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	path := &apipb.Path{
+		Nlri:       mustAny(t, &apipb.IPAddressPrefix{Prefix: "2001:db8::", PrefixLen: 32}),
+		Best:       true,
+		Age:        timestamppb.New(age),
+		Validation: &apipb.Validation{State: apipb.Validation_STATE_INVALID},
+		NeighborIp: "2001:db8::1",
+		Pattrs: []*anypb.Any{
+			mustAny(t, &apipb.OriginAttribute{Origin: 2}),
+			mustAny(t, &apipb.MpReachNLRIAttribute{NextHops: []string{"2001:db8::1"}}),
+			mustAny(t, &apipb.AsPathAttribute{Segments: []*apipb.AsSegment{
+				{Type: apipb.AsSegment_AS_SEQUENCE, Numbers: []uint32{65001}},
+			}}),
+			mustAny(t, &apipb.MultiExitDiscAttribute{Med: 10}),
+			mustAny(t, &apipb.LocalPrefAttribute{LocalPref: 200}),
+			mustAny(t, &apipb.AtomicAggregateAttribute{}),
+			mustAny(t, &apipb.AggregatorAttribute{Asn: 65001, Address: "192.0.2.1"}),
+			mustAny(t, &apipb.OriginatorIdAttribute{Id: "192.0.2.10"}),
+			mustAny(t, &apipb.ClusterListAttribute{Ids: []string{"192.0.2.20", "192.0.2.21"}}),
+		},
+	}
+
+	p, err := DecodePath(path)
+	require.NoError(t, err)
+
+	med, localPref := uint32(10), uint32(200)
+	assert.Equal(t, &Path{
+		Prefix:     netip.MustParsePrefix("2001:db8::/32"),
+		Best:       true,
+		Validation: ValidationInvalid,
+		Age:        age,
+		Attributes: Attributes{
+			Origin:          OriginIncomplete,
+			NextHops:        []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+			ASPath:          []ASSegment{{Type: ASSequence, ASNs: []uint32{65001}}},
+			MED:             &med,
+			LocalPref:       &localPref,
+			AtomicAggregate: true,
+			Aggregator:      &Aggregator{ASN: 65001, Address: netip.MustParseAddr("192.0.2.1")},
+			OriginatorID:    netip.MustParseAddr("192.0.2.10"),
+			ClusterList:     []netip.Addr{netip.MustParseAddr("192.0.2.20"), netip.MustParseAddr("192.0.2.21")},
+			Peer:            Peer{Address: netip.MustParseAddr("2001:db8::1")},
+		},
+	}, p)
+	assert.Equal(t, "2001:db8::/32 via 2001:db8::1 as-path [65001] origin incomplete from 2001:db8::1 rpki invalid",
+		p.String())
+}
+
+func TestDecodePathPrefix(t *testing.T) {
+	p, err := DecodePath(&apipb.Path{
+		Nlri:       mustAny(t, &apipb.IPAddressPrefix{Prefix: "192.0.2.0", PrefixLen: 24}),
+		IsWithdraw: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.0/24"), p.Prefix)
+	assert.Equal(t, "192.0.2.0/24 withdrawn origin igp", p.String())
+
+	vpn := mustAny(t, &apipb.LabeledVPNIPAddressPrefix{Prefix: "192.0.2.0", PrefixLen: 24})
+	p, err = DecodePath(&apipb.Path{Nlri: vpn})
+	require.NoError(t, err)
+	assert.False(t, p.Prefix.IsValid())
+
+	for _, nlri := range []*apipb.IPAddressPrefix{
+		{Prefix: "192.0.2.0", PrefixLen: 33},
+		{Prefix: "example.com", PrefixLen: 24},
+	} {
+		_, err := DecodePath(&apipb.Path{Nlri: mustAny(t, nlri)})
+		assert.Error(t, err, nlri.Prefix)
+	}
+}
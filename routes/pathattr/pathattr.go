@@ -0,0 +1,334 @@
+// Package pathattr decodes the path attributes of GoBGP paths into typed
+// Go values.
+package pathattr
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// SegmentType is the type of an AS path segment.
+type SegmentType int
+
+// AS path segment types.
+const (
+	ASSet SegmentType = iota + 1
+	ASSequence
+	ASConfedSequence
+	ASConfedSet
+)
+
+// ASSegment is one segment of an AS path.
+type ASSegment struct {
+	Type SegmentType
+	ASNs []uint32
+}
+
+// Origin is the ORIGIN attribute of a path.
+type Origin uint8
+
+// Origin values.
+const (
+	OriginIGP Origin = iota
+	OriginEGP
+	OriginIncomplete
+)
+
+func (o Origin) String() string {
+	switch o {
+	case OriginIGP:
+		return "igp"
+	case OriginEGP:
+		return "egp"
+	}
+	return "incomplete"
+}
+
+// Aggregator is the AGGREGATOR attribute of a path.
+type Aggregator struct {
+	ASN     uint32
+	Address netip.Addr
+}
+
+// Peer identifies the BGP neighbour a path was learned from.
+type Peer struct {
+	Address  netip.Addr
+	ASN      uint32
+	RouterID netip.Addr
+}
+
+// Attributes holds the decoded attributes of a path. Optional attributes
+// that are absent are nil or zero.
+type Attributes struct {
+	Origin              Origin
+	NextHops            []netip.Addr
+	ASPath              []ASSegment
+	MED                 *uint32
+	LocalPref           *uint32
+	AtomicAggregate     bool
+	Aggregator          *Aggregator
+	Communities         []Community
+	ExtendedCommunities []ExtendedCommunity
+	LargeCommunities    []LargeCommunity
+	OriginatorID        netip.Addr
+	ClusterList         []netip.Addr
+	Peer                Peer
+}
+
+// Decode unpacks the attributes of path. Attributes of unknown types are
+// skipped.
+func Decode(path *apipb.Path) (*Attributes, error) {
+	attrs := &Attributes{Peer: decodePeer(path)}
+	for _, packed := range path.GetPattrs() {
+		msg, err := packed.UnmarshalNew()
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack path attribute %s: %w", packed.GetTypeUrl(), err)
+		}
+		if err := attrs.decode(msg); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+// NextHop returns the first next hop of path, from its NEXT_HOP or
+// MP_REACH_NLRI attribute, without decoding its other attributes. The
+// address is invalid when path has no next hop.
+func NextHop(path *apipb.Path) (netip.Addr, error) {
+	for _, packed := range path.GetPattrs() {
+		hops, err := nextHops(packed)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		if len(hops) > 0 {
+			return parseAddr("next hop", hops[0])
+		}
+	}
+	return netip.Addr{}, nil
+}
+
+// nextHops returns the next hops of a NEXT_HOP or MP_REACH_NLRI attribute,
+// and nothing for the other attributes.
+func nextHops(packed *anypb.Any) ([]string, error) {
+	switch {
+	case packed.MessageIs((*apipb.NextHopAttribute)(nil)):
+		var attr apipb.NextHopAttribute
+		if err := packed.UnmarshalTo(&attr); err != nil {
+			return nil, fmt.Errorf("failed to unpack next hop: %w", err)
+		}
+		return []string{attr.NextHop}, nil
+	case packed.MessageIs((*apipb.MpReachNLRIAttribute)(nil)):
+		var attr apipb.MpReachNLRIAttribute
+		if err := packed.UnmarshalTo(&attr); err != nil {
+			return nil, fmt.Errorf("failed to unpack next hop: %w", err)
+		}
+		return attr.NextHops, nil
+	}
+	return nil, nil
+}
+
+// decode stores the attributes that carry addresses, which may fail to
+// parse, and hands the others to decodeValue.
+func (a *Attributes) decode(msg proto.Message) error {
+	var err error
+	switch attr := msg.(type) {
+	case *apipb.NextHopAttribute:
+		a.NextHops, err = appendAddrs(a.NextHops, "next hop", attr.NextHop)
+	case *apipb.MpReachNLRIAttribute:
+		a.NextHops, err = appendAddrs(a.NextHops, "next hop", attr.NextHops...)
+	case *apipb.OriginatorIdAttribute:
+		a.OriginatorID, err = parseAddr("originator id", attr.Id)
+	case *apipb.ClusterListAttribute:
+		a.ClusterList, err = appendAddrs(nil, "cluster id", attr.Ids...)
+	case *apipb.AggregatorAttribute:
+		a.Aggregator = &Aggregator{ASN: attr.Asn}
+		a.Aggregator.Address, err = parseAddr("aggregator", attr.Address)
+	case *apipb.ExtendedCommunitiesAttribute:
+		err = a.addExtendedCommunities(attr)
+	default:
+		a.decodeValue(msg)
+	}
+	return err
+}
+
+func (a *Attributes) decodeValue(msg proto.Message) {
+	switch attr := msg.(type) {
+	case *apipb.OriginAttribute:
+		a.Origin = Origin(attr.Origin)
+	case *apipb.AsPathAttribute:
+		a.ASPath = decodeASPath(attr)
+	case *apipb.MultiExitDiscAttribute:
+		a.MED = &attr.Med
+	case *apipb.LocalPrefAttribute:
+		a.LocalPref = &attr.LocalPref
+	case *apipb.AtomicAggregateAttribute:
+		a.AtomicAggregate = true
+	case *apipb.CommunitiesAttribute:
+		for _, c := range attr.Communities {
+			a.Communities = append(a.Communities, Community(c))
+		}
+	case *apipb.LargeCommunitiesAttribute:
+		for _, c := range attr.Communities {
+			a.LargeCommunities = append(a.LargeCommunities, LargeCommunity{c.GlobalAdmin, c.LocalData1, c.LocalData2})
+		}
+	}
+}
+
+func appendAddrs(addrs []netip.Addr, what string, values ...string) ([]netip.Addr, error) {
+	for _, value := range values {
+		addr, err := parseAddr(what, value)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func parseAddr(what, value string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid %s %q: %w", what, value, err)
+	}
+	return addr, nil
+}
+
+func decodeASPath(attr *apipb.AsPathAttribute) []ASSegment {
+	segments := make([]ASSegment, 0, len(attr.Segments))
+	for _, s := range attr.Segments {
+		segments = append(segments, ASSegment{Type: SegmentType(s.Type), ASNs: s.Numbers})
+	}
+	return segments
+}
+
+// addExtendedCommunities decodes the extended communities, skipping the
+// flowspec actions and other kinds that do not describe the route.
+func (a *Attributes) addExtendedCommunities(attr *apipb.ExtendedCommunitiesAttribute) error {
+	for _, packed := range attr.Communities {
+		msg, err := packed.UnmarshalNew()
+		if err != nil {
+			return fmt.Errorf("failed to unpack extended community %s: %w", packed.GetTypeUrl(), err)
+		}
+		if c, ok := extendedCommunity(msg); ok {
+			a.ExtendedCommunities = append(a.ExtendedCommunities, c)
+		}
+	}
+	return nil
+}
+
+func extendedCommunity(msg proto.Message) (ExtendedCommunity, bool) {
+	switch c := msg.(type) {
+	case *apipb.TwoOctetAsSpecificExtended:
+		return asSpecific(c.SubType, c.Asn, c.LocalAdmin), true
+	case *apipb.FourOctetAsSpecificExtended:
+		return asSpecific(c.SubType, c.Asn, c.LocalAdmin), true
+	case *apipb.IPv4AddressSpecificExtended:
+		return ExtendedCommunity{SubType: uint8(c.SubType), Global: c.Address, Local: c.LocalAdmin}, true
+	case *apipb.IPv6AddressSpecificExtended:
+		return ExtendedCommunity{SubType: uint8(c.SubType), Global: c.Address, Local: c.LocalAdmin}, true
+	case *apipb.LinkBandwidthExtended:
+		return asSpecific(SubTypeLinkBandwidth, c.Asn, uint32(c.Bandwidth)), true
+	}
+	return valueCommunity(msg)
+}
+
+// DecodeExtendedCommunity decodes a single extended community, such as the
+// route target of a route target constraint NLRI.
+func DecodeExtendedCommunity(packed *anypb.Any) (ExtendedCommunity, error) {
+	msg, err := packed.UnmarshalNew()
+	if err != nil {
+		return ExtendedCommunity{}, fmt.Errorf("failed to unpack extended community %s: %w", packed.GetTypeUrl(), err)
+	}
+	c, ok := extendedCommunity(msg)
+	if !ok {
+		return ExtendedCommunity{}, fmt.Errorf("unsupported extended community %s", packed.GetTypeUrl())
+	}
+	return c, nil
+}
+
+func valueCommunity(msg proto.Message) (ExtendedCommunity, bool) {
+	switch c := msg.(type) {
+	case *apipb.ColorExtended:
+		return ExtendedCommunity{Kind: KindColor, Local: c.Color}, true
+	case *apipb.EncapExtended:
+		return ExtendedCommunity{Kind: KindEncap, Local: c.TunnelType}, true
+	case *apipb.ValidationExtended:
+		return ExtendedCommunity{Kind: KindValidation, Local: c.State}, true
+	case *apipb.OpaqueExtended:
+		return ExtendedCommunity{Kind: KindOpaque, Global: hex.EncodeToString(c.Value)}, true
+	case *apipb.RouterMacExtended:
+		return ExtendedCommunity{Kind: KindRouterMAC, Global: c.Mac}, true
+	case *apipb.UnknownExtended:
+		return ExtendedCommunity{Kind: KindUnknown, SubType: uint8(c.Type), Global: hex.EncodeToString(c.Value)}, true
+	}
+	return ExtendedCommunity{}, false
+}
+
+func asSpecific(subType, asn, local uint32) ExtendedCommunity {
+	return ExtendedCommunity{SubType: uint8(subType), Global: strconv.FormatUint(uint64(asn), 10), Local: local}
+}
+
+func decodePeer(path *apipb.Path) Peer {
+	peer := Peer{ASN: path.GetSourceAsn()}
+	if addr, err := netip.ParseAddr(path.GetNeighborIp()); err == nil {
+		peer.Address = addr
+	}
+	if id, err := netip.ParseAddr(path.GetSourceId()); err == nil {
+		peer.RouterID = id
+	}
+	return peer
+}
+
+// OriginAS returns the AS that originated the path: the last AS of the AS
+// path when it ends with a sequence. Locally originated paths and paths
+// ending with an AS set have none.
+func (a *Attributes) OriginAS() (uint32, bool) {
+	if len(a.ASPath) == 0 {
+		return 0, false
+	}
+	last := a.ASPath[len(a.ASPath)-1]
+	if last.Type != ASSequence || len(last.ASNs) == 0 {
+		return 0, false
+	}
+	return last.ASNs[len(last.ASNs)-1], true
+}
+
+// ASPathString formats the AS path the way GoBGP prints it, for example
+// "65001 65002 {65003,65004}".
+func (a *Attributes) ASPathString() string {
+	var b strings.Builder
+	for _, segment := range a.ASPath {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		open, sep, end := segmentDelimiters(segment.Type)
+		b.WriteString(open)
+		for i, asn := range segment.ASNs {
+			if i > 0 {
+				b.WriteByte(sep)
+			}
+			b.WriteString(strconv.FormatUint(uint64(asn), 10))
+		}
+		b.WriteString(end)
+	}
+	return b.String()
+}
+
+func segmentDelimiters(t SegmentType) (string, byte, string) {
+	switch t {
+	case ASSet:
+		return "{", ',', "}"
+	case ASConfedSequence:
+		return "(", ' ', ")"
+	case ASConfedSet:
+		return "[", ',', "]"
+	}
+	return "", ' ', ""
+}
@@ -0,0 +1,163 @@
+package pathattr
+
+import (
+	"net/netip"
+	"testing"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func mustAny(t *testing.T, msg proto.Message) *anypb.Any {
+	t.Helper()
+	a, err := anypb.New(msg)
+	require.NoError(t, err)
+	return a
+}
+
+func TestDecode(t *testing.T) {
+	path := &apipb.Path{
+		NeighborIp: "192.0.2.1",
+		SourceAsn:  65001,
+		SourceId:   "192.0.2.254",
+		Pattrs: []*anypb.Any{
+			mustAny(t, &apipb.OriginAttribute{Origin: 0}),
+			mustAny(t, &apipb.NextHopAttribute{NextHop: "192.0.2.1"}),
+			mustAny(t, &apipb.AsPathAttribute{Segments: []*apipb.AsSegment{
+				{Type: apipb.AsSegment_AS_SEQUENCE, Numbers: []uint32{65001, 65002}},
+			}}),
+			mustAny(t, &apipb.CommunitiesAttribute{Communities: []uint32{65535<<16 | 666}}),
+			mustAny(t, &apipb.ExtendedCommunitiesAttribute{Communities: []*anypb.Any{
+				mustAny(t, &apipb.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: 65000, LocalAdmin: 1}),
+				mustAny(t, &apipb.IPv4AddressSpecificExtended{SubType: 0x03, Address: "192.0.2.1", LocalAdmin: 7}),
+				mustAny(t, &apipb.EncapExtended{TunnelType: 8}),
+				mustAny(t, &apipb.TrafficRateExtended{Asn: 65000, Rate: 0}),
+			}}),
+			mustAny(t, &apipb.LargeCommunitiesAttribute{Communities: []*apipb.LargeCommunity{
+				{GlobalAdmin: 4200000000, LocalData1: 1, LocalData2: 2},
+			}}),
+		},
+	}
+
+	attrs, err := Decode(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, attrs.NextHops)
+	assert.Equal(t, "65001 65002", attrs.ASPathString())
+	assert.Equal(t, []Community{65535<<16 | 666}, attrs.Communities)
+	assert.Equal(t, []ExtendedCommunity{
+		{SubType: SubTypeRouteTarget, Global: "65000", Local: 1},
+		{SubType: SubTypeRouteOrigin, Global: "192.0.2.1", Local: 7},
+		{Kind: KindEncap, Local: 8},
+	}, attrs.ExtendedCommunities)
+	assert.Equal(t, []LargeCommunity{{4200000000, 1, 2}}, attrs.LargeCommunities)
+	assert.Equal(t, Peer{
+		Address:  netip.MustParseAddr("192.0.2.1"),
+		ASN:      65001,
+		RouterID: netip.MustParseAddr("192.0.2.254"),
+	}, attrs.Peer)
+
+	origin, ok := attrs.OriginAS()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(65002), origin)
+}
+
+func TestDecodeMpReachNextHops(t *testing.T) {
+	attrs, err := Decode(&apipb.Path{Pattrs: []*anypb.Any{
+		mustAny(t, &apipb.MpReachNLRIAttribute{NextHops: []string{"2001:db8::1", "fe80::1"}}),
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("fe80::1")}, attrs.NextHops)
+
+	_, err = Decode(&apipb.Path{Pattrs: []*anypb.Any{mustAny(t, &apipb.NextHopAttribute{NextHop: "bogus"})}})
+	assert.Error(t, err)
+}
+
+func TestNextHop(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs []*anypb.Any
+		want  netip.Addr
+	}{
+		{"next hop", []*anypb.Any{
+			mustAny(t, &apipb.OriginAttribute{}),
+			mustAny(t, &apipb.NextHopAttribute{NextHop: "192.0.2.1"}),
+		}, netip.MustParseAddr("192.0.2.1")},
+		{"mp reach", []*anypb.Any{
+			mustAny(t, &apipb.MpReachNLRIAttribute{NextHops: []string{"2001:db8::1", "fe80::1"}}),
+		}, netip.MustParseAddr("2001:db8::1")},
+		{"none", []*anypb.Any{mustAny(t, &apipb.OriginAttribute{})}, netip.Addr{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop, err := NextHop(&apipb.Path{Pattrs: tt.attrs})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, hop)
+		})
+	}
+
+	_, err := NextHop(&apipb.Path{Pattrs: []*anypb.Any{mustAny(t, &apipb.NextHopAttribute{NextHop: "bogus"})}})
+	assert.Error(t, err)
+}
+
+func TestOriginAS(t *testing.T) {
+	tests := []struct {
+		path   []ASSegment
+		origin uint32
+		ok     bool
+		text   string
+	}{
+		{nil, 0, false, ""},
+		{[]ASSegment{{Type: ASSequence, ASNs: []uint32{65001}}}, 65001, true, "65001"},
+		{[]ASSegment{
+			{Type: ASSequence, ASNs: []uint32{65001}},
+			{Type: ASSet, ASNs: []uint32{65002, 65003}},
+		}, 0, false, "65001 {65002,65003}"},
+		{[]ASSegment{
+			{Type: ASConfedSequence, ASNs: []uint32{64512, 64513}},
+			{Type: ASSequence, ASNs: []uint32{65001, 65002}},
+		}, 65002, true, "(64512 64513) 65001 65002"},
+	}
+	for _, tt := range tests {
+		attrs := &Attributes{ASPath: tt.path}
+		origin, ok := attrs.OriginAS()
+		assert.Equal(t, tt.ok, ok, tt.text)
+		assert.Equal(t, tt.origin, origin, tt.text)
+		assert.Equal(t, tt.text, attrs.ASPathString())
+	}
+}
+
+func TestParseCommunities(t *testing.T) {
+	c, err := ParseCommunity("65535:666")
+	require.NoError(t, err)
+	assert.Equal(t, "65535:666", c.String())
+
+	l, err := ParseLargeCommunity("4200000000:1:2")
+	require.NoError(t, err)
+	assert.Equal(t, "4200000000:1:2", l.String())
+
+	for _, s := range []string{
+		"rt:65000:1", "soo:192.0.2.1:7", "0x05:65000:1", "lb:65000:125000",
+		"color:100", "encap:8", "validation:2", "opaque:0a0b", "router-mac:02:00:00:00:00:01",
+	} {
+		e, err := ParseExtendedCommunity(s)
+		require.NoError(t, err)
+		assert.Equal(t, s, e.String())
+	}
+
+	for _, s := range []string{"65536:1", "1", "1:x"} {
+		_, err := ParseCommunity(s)
+		assert.Error(t, err, s)
+	}
+	for _, s := range []string{"1:2", "1:2:4294967296"} {
+		_, err := ParseLargeCommunity(s)
+		assert.Error(t, err, s)
+	}
+	for _, s := range []string{"rt:65000", "xx:65000:1", "rt::1", "color:x", "unknown:0x01:00", "rt"} {
+		_, err := ParseExtendedCommunity(s)
+		assert.Error(t, err, s)
+	}
+}
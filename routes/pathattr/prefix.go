@@ -0,0 +1,97 @@
+package pathattr
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Field numbers of apipb.IPAddressPrefix.
+const (
+	prefixLenField = 1
+	prefixField    = 2
+)
+
+// ipAddressPrefixName is the full name of the NLRI type of IP unicast paths.
+const ipAddressPrefixName = "apipb.IPAddressPrefix"
+
+// Errors returned by DecodePrefix.
+var (
+	ErrNotIPPrefix  = errors.New("NLRI is not an IP address prefix")
+	ErrHostBits     = errors.New("prefix has host bits set")
+	ErrMappedPrefix = errors.New("IPv4-mapped IPv6 prefixes are not supported")
+)
+
+// DecodePrefix decodes an IP unicast NLRI. It reads the wire format
+// directly instead of unpacking a message and never resolves names. The
+// prefix must be in canonical form, without host bits beyond its length.
+// IPv4-mapped IPv6 prefixes are refused: the kernel would program them as
+// IPv4 routes.
+func DecodePrefix(nlri *anypb.Any) (netip.Prefix, error) {
+	if !isIPAddressPrefix(nlri) {
+		return netip.Prefix{}, ErrNotIPPrefix
+	}
+
+	text, bits, err := scanIPAddressPrefix(nlri.GetValue())
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("failed to decode NLRI: %w", err)
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid NLRI prefix: %w", err)
+	}
+	return checkPrefix(addr, bits)
+}
+
+func isIPAddressPrefix(nlri *anypb.Any) bool {
+	url := nlri.GetTypeUrl()
+	return strings.HasSuffix(url, "/"+ipAddressPrefixName) || url == ipAddressPrefixName
+}
+
+// scanIPAddressPrefix extracts the fields of an encoded apipb.IPAddressPrefix.
+func scanIPAddressPrefix(b []byte) (string, uint64, error) {
+	var text []byte
+	var bits uint64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == prefixLenField && typ == protowire.VarintType:
+			bits, n = protowire.ConsumeVarint(b)
+		case num == prefixField && typ == protowire.BytesType:
+			text, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return string(text), bits, nil
+}
+
+func checkPrefix(addr netip.Addr, bits uint64) (netip.Prefix, error) {
+	switch {
+	case addr.Zone() != "":
+		return netip.Prefix{}, fmt.Errorf("invalid NLRI prefix %s: zones are not allowed", addr)
+	case addr.Is4In6():
+		return netip.Prefix{}, fmt.Errorf("%w: %s/%d", ErrMappedPrefix, addr, bits)
+	case bits > uint64(addr.BitLen()):
+		return netip.Prefix{}, fmt.Errorf("invalid NLRI prefix length %d for %s", bits, addr)
+	}
+
+	prefix := netip.PrefixFrom(addr, int(bits))
+	if prefix.Masked() != prefix {
+		return netip.Prefix{}, fmt.Errorf("%w: %s", ErrHostBits, prefix)
+	}
+	return prefix, nil
+}
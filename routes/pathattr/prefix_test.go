@@ -0,0 +1,117 @@
+package pathattr
+
+import (
+	"net/netip"
+	"testing"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestDecodePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		length uint32
+		want   string
+		err    error
+	}{
+		{"192.0.2.0", 24, "192.0.2.0/24", nil},
+		{"0.0.0.0", 0, "0.0.0.0/0", nil},
+		{"2001:db8::", 32, "2001:db8::/32", nil},
+		{"2001:db8::1", 128, "2001:db8::1/128", nil},
+		{"192.0.2.1", 24, "", ErrHostBits},
+		{"2001:db8::1", 64, "", ErrHostBits},
+		{"::ffff:192.0.2.0", 120, "", ErrMappedPrefix},
+		{"192.0.2.0", 33, "", nil},
+		{"2001:db8::", 129, "", nil},
+		{"fe80::%eth0", 64, "", nil},
+		{"localhost", 32, "", nil},
+		{"", 0, "", nil},
+	}
+	for _, tt := range tests {
+		nlri, err := anypb.New(&apipb.IPAddressPrefix{Prefix: tt.prefix, PrefixLen: tt.length})
+		require.NoError(t, err)
+
+		prefix, err := DecodePrefix(nlri)
+		if tt.want == "" {
+			assert.Error(t, err, tt.prefix)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err, tt.prefix)
+			}
+			continue
+		}
+		assert.NoError(t, err, tt.prefix)
+		assert.Equal(t, netip.MustParsePrefix(tt.want), prefix)
+	}
+}
+
+func TestDecodePrefixOtherNLRI(t *testing.T) {
+	nlri, err := anypb.New(&apipb.LabeledIPAddressPrefix{Prefix: "192.0.2.0", PrefixLen: 24})
+	require.NoError(t, err)
+	_, err = DecodePrefix(nlri)
+	assert.ErrorIs(t, err, ErrNotIPPrefix)
+
+	_, err = DecodePrefix(nil)
+	assert.ErrorIs(t, err, ErrNotIPPrefix)
+
+	nlri = &anypb.Any{TypeUrl: "type.googleapis.com/" + ipAddressPrefixName, Value: []byte{0x0a, 0xff}}
+	_, err = DecodePrefix(nlri)
+	assert.Error(t, err)
+}
+
+func TestDecodePrefixAllocations(t *testing.T) {
+	nlri, err := anypb.New(&apipb.IPAddressPrefix{Prefix: "2001:db8:1234::", PrefixLen: 48})
+	require.NoError(t, err)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = DecodePrefix(nlri)
+	})
+	assert.LessOrEqual(t, allocs, 1.0)
+}
+
+func BenchmarkDecodePrefix(b *testing.B) {
+	nlri, err := anypb.New(&apipb.IPAddressPrefix{Prefix: "198.51.100.0", PrefixLen: 24})
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodePrefix(nlri); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzDecodePrefix(f *testing.F) {
+	for _, seed := range []*apipb.IPAddressPrefix{
+		{Prefix: "192.0.2.0", PrefixLen: 24},
+		{Prefix: "2001:db8::", PrefixLen: 32},
+		{Prefix: "::ffff:192.0.2.0", PrefixLen: 120},
+		{Prefix: "192.0.2.1", PrefixLen: 24},
+		{Prefix: "fe80::1%eth0", PrefixLen: 64},
+	} {
+		nlri, err := anypb.New(seed)
+		require.NoError(f, err)
+		f.Add(nlri.Value)
+	}
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		nlri := &anypb.Any{TypeUrl: "type.googleapis.com/" + ipAddressPrefixName, Value: value}
+		prefix, err := DecodePrefix(nlri)
+		if err != nil {
+			return
+		}
+
+		assert.True(t, prefix.IsValid())
+		assert.Equal(t, prefix.Masked(), prefix)
+		assert.False(t, prefix.Addr().Is4In6())
+		assert.Empty(t, prefix.Addr().Zone())
+
+		// The decoder agrees with unpacking the message.
+		var msg apipb.IPAddressPrefix
+		require.NoError(t, nlri.UnmarshalTo(&msg))
+		assert.Equal(t, netip.MustParseAddr(msg.Prefix), prefix.Addr())
+		assert.Equal(t, int(msg.PrefixLen), prefix.Bits())
+	})
+}
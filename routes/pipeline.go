@@ -0,0 +1,347 @@
+package routes
+
+import (
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+)
+
+// routeWriter is the subset of netlink.Handle the netlink sink uses.
+type routeWriter interface {
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	Close()
+}
+
+type opKind int
+
+const (
+	opReplace opKind = iota
+	opDelete
+)
+
+// routeOp is a single kernel operation. Bulk operations add keys that are
+// not installed yet; they yield to withdrawals and changes.
+type routeOp struct {
+	key   RouteKey
+	route *netlink.Route
+	kind  opKind
+	bulk  bool
+}
+
+// delta returns the change op makes to a sink.
+func (op *routeOp) delta() RouteDelta {
+	return RouteDelta{Key: op.key, Route: op.route, Remove: op.kind == opDelete}
+}
+
+// pipeline programs route operations into a sink with a pool of workers.
+// Operations are partitioned by key so that every key is always handled by
+// the same worker, and a key queued more than once is programmed only in
+// its latest state.
+type pipeline struct {
+	kernel    *KernelCache
+	sink      Sink
+	workers   []*worker
+	batchSize int
+	done      chan struct{}
+	running   sync.WaitGroup
+
+	mu          sync.Mutex
+	idle        *sync.Cond
+	closed      bool
+	outstanding int
+	completed   int
+	pending     *expvar.Int
+}
+
+type worker struct {
+	wake chan struct{}
+
+	mu       sync.Mutex
+	ops      map[RouteKey]*routeOp
+	priority []RouteKey
+	bulk     []RouteKey
+}
+
+func newPipeline(kernel *KernelCache, cfg config.Programming, sink Sink) *pipeline {
+	p := &pipeline{
+		kernel:    kernel,
+		sink:      sink,
+		batchSize: max(cfg.BatchSize, 1),
+		done:      make(chan struct{}),
+		pending:   new(expvar.Int),
+	}
+	p.idle = sync.NewCond(&p.mu)
+
+	for i := 0; i < max(cfg.Workers, 1); i++ {
+		w := &worker{
+			wake: make(chan struct{}, 1),
+			ops:  make(map[RouteKey]*routeOp),
+		}
+		p.workers = append(p.workers, w)
+		p.running.Add(1)
+		go p.run(w)
+	}
+	if cfg.ProgressInterval > 0 {
+		go p.reportProgress(cfg.ProgressInterval)
+	}
+	return p
+}
+
+// newNetlinkWriters opens the netlink sockets of one batch handle in ns per
+// configured worker.
+func newNetlinkWriters(ns *namespace, workers int) ([]routeWriter, error) {
+	writers := make([]routeWriter, 0, max(workers, 1))
+	for len(writers) < cap(writers) {
+		handle, err := newBatchHandle(ns)
+		if err != nil {
+			closeWriters(writers)
+			return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+		}
+		writers = append(writers, handle)
+	}
+	return writers, nil
+}
+
+func closeWriters(writers []routeWriter) {
+	for _, writer := range writers {
+		writer.Close()
+	}
+}
+
+// submit queues ops for programming and returns without waiting for them.
+// Once the pipeline is closed, ops are dropped.
+func (p *pipeline) submit(ops []*routeOp) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	for _, op := range ops {
+		if p.workers[p.partition(op.key)].enqueue(op) {
+			p.outstanding++
+		}
+	}
+	p.pending.Set(int64(p.outstanding))
+	p.mu.Unlock()
+
+	for _, w := range p.workers {
+		w.signal()
+	}
+}
+
+// wait blocks until every submitted operation has been programmed.
+func (p *pipeline) wait() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.outstanding > 0 {
+		p.idle.Wait()
+	}
+}
+
+// close stops the workers once their current batch is done. Operations
+// still queued are dropped, so that wait returns.
+func (p *pipeline) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	close(p.done)
+	p.running.Wait()
+
+	dropped := 0
+	for _, w := range p.workers {
+		dropped += w.drop()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outstanding -= dropped
+	p.pending.Set(int64(p.outstanding))
+	p.idle.Broadcast()
+}
+
+func (p *pipeline) partition(key RouteKey) int {
+	h := fnv.New32a()
+	addr := key.Dst.Addr().As16()
+	_, _ = h.Write(addr[:])
+	_, _ = h.Write([]byte{byte(key.Dst.Bits())})
+	return int(h.Sum32() % uint32(len(p.workers)))
+}
+
+func (p *pipeline) run(w *worker) {
+	defer p.running.Done()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-w.wake:
+		}
+
+		if !p.drain(w) {
+			return
+		}
+	}
+}
+
+// drain programs the queue of w until it is empty. It returns false when
+// the pipeline was closed in the meantime.
+func (p *pipeline) drain(w *worker) bool {
+	for batch := w.next(p.batchSize); len(batch) > 0; batch = w.next(p.batchSize) {
+		p.finish(batch, p.execute(batch))
+
+		select {
+		case <-p.done:
+			return false
+		default:
+		}
+	}
+	return true
+}
+
+// finish records the outcome of a batch in the kernel cache and the
+// pipeline counters.
+func (p *pipeline) finish(batch []*routeOp, errs []error) {
+	p.kernel.record(batch, errs)
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	Metrics.Add(metricPipelineCompleted, int64(len(batch)-failed))
+	Metrics.Add(metricPipelineFailed, int64(failed))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.outstanding -= len(batch)
+	p.completed += len(batch)
+	p.pending.Set(int64(p.outstanding))
+	if p.outstanding == 0 {
+		p.idle.Broadcast()
+	}
+}
+
+func (p *pipeline) reportProgress(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := 0
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			last = p.logProgress(last, interval)
+		}
+	}
+}
+
+func (p *pipeline) logProgress(last int, interval time.Duration) int {
+	p.mu.Lock()
+	completed, outstanding := p.completed, p.outstanding
+	p.mu.Unlock()
+
+	if completed != last || outstanding > 0 {
+		rate := float64(completed-last) / interval.Seconds()
+		log.Printf("Programmed %d routes (%.0f/s), %d pending", completed, rate, outstanding)
+	}
+	return completed
+}
+
+// enqueue stores op as the latest state of its key and reports whether the
+// key was not already queued.
+func (w *worker) enqueue(op *routeOp) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queued, ok := w.ops[op.key]
+	w.ops[op.key] = op
+	switch {
+	case !ok && op.bulk:
+		w.bulk = append(w.bulk, op.key)
+	case !ok || (queued.bulk && !op.bulk):
+		w.priority = append(w.priority, op.key)
+	}
+	return !ok
+}
+
+// drop empties the queue of w and returns the number of operations it held.
+func (w *worker) drop() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dropped := len(w.ops)
+	w.ops = make(map[RouteKey]*routeOp)
+	w.priority, w.bulk = nil, nil
+	return dropped
+}
+
+func (w *worker) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes up to n queued operations, withdrawals and changes first.
+func (w *worker) next(n int) []*routeOp {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	batch := make([]*routeOp, 0, n)
+	batch, w.priority = w.take(batch, w.priority, n)
+	batch, w.bulk = w.take(batch, w.bulk, n)
+	return batch
+}
+
+// take moves operations for the keys at the front of queue into batch until
+// it holds n operations. Keys already programmed through the other queue
+// are skipped. Callers must hold w.mu.
+func (w *worker) take(batch []*routeOp, queue []RouteKey, n int) ([]*routeOp, []RouteKey) {
+	for len(queue) > 0 && len(batch) < n {
+		key := queue[0]
+		queue = queue[1:]
+		if op, ok := w.ops[key]; ok {
+			delete(w.ops, key)
+			batch = append(batch, op)
+		}
+	}
+	return batch, queue
+}
+
+// execute programs batch into the sink and returns the result of each
+// operation.
+func (p *pipeline) execute(batch []*routeOp) []error {
+	deltas := make([]RouteDelta, len(batch))
+	for i, op := range batch {
+		deltas[i] = op.delta()
+	}
+	errs := p.sink.Apply(deltas)
+	for i, op := range batch {
+		logResult(op, errs[i])
+	}
+	return errs
+}
+
+// logResult logs the outcome of op. Bulk adds are not logged one by one;
+// the progress report covers them.
+func logResult(op *routeOp, err error) {
+	switch {
+	case err != nil:
+		log.Printf("Failed to program route %s: %v", op.key, err)
+	case op.kind == opDelete:
+		log.Printf("Removed route: %s", op.key)
+	case !op.bulk:
+		log.Printf("Updated route: %s", op.key)
+	}
+}
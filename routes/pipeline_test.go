@@ -0,0 +1,225 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func newTestManager(t testing.TB, writers ...routeWriter) *Manager {
+	t.Helper()
+	if len(writers) == 0 {
+		writers = []routeWriter{newFakeKernel()}
+	}
+	cfg := config.Default()
+	cfg.Programming.ProgressInterval = 0
+	m, err := newManager(cfg, writers)
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func testOp(cidr string, kind opKind, bulk bool) *routeOp {
+	_, dst, _ := net.ParseCIDR(cidr)
+	route := &netlink.Route{Dst: dst, Protocol: RouteProtocol, Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST}
+	return &routeOp{key: keyOf(route), route: route, kind: kind, bulk: bulk}
+}
+
+func TestWorkerPrioritisesChanges(t *testing.T) {
+	w := &worker{ops: make(map[RouteKey]*routeOp)}
+
+	w.enqueue(testOp("192.0.2.0/24", opReplace, true))
+	w.enqueue(testOp("198.51.100.0/24", opReplace, true))
+	w.enqueue(testOp("203.0.113.0/24", opDelete, false))
+
+	batch := w.next(10)
+
+	var order []string
+	for _, op := range batch {
+		order = append(order, op.key.Dst.String())
+	}
+	assert.Equal(t, []string{"203.0.113.0/24", "192.0.2.0/24", "198.51.100.0/24"}, order)
+}
+
+func TestWorkerCoalescesKey(t *testing.T) {
+	w := &worker{ops: make(map[RouteKey]*routeOp)}
+
+	assert.True(t, w.enqueue(testOp("192.0.2.0/24", opReplace, true)))
+	assert.False(t, w.enqueue(testOp("192.0.2.0/24", opDelete, false)))
+
+	batch := w.next(10)
+
+	assert.Len(t, batch, 1)
+	assert.Equal(t, opDelete, batch[0].kind)
+	assert.Empty(t, w.next(10))
+}
+
+func TestWorkerBatchSize(t *testing.T) {
+	w := &worker{ops: make(map[RouteKey]*routeOp)}
+	for i := 0; i < 5; i++ {
+		w.enqueue(testOp(fmt.Sprintf("10.0.%d.0/24", i), opReplace, true))
+	}
+
+	assert.Len(t, w.next(2), 2)
+	assert.Len(t, w.next(2), 2)
+	assert.Len(t, w.next(2), 1)
+}
+
+func TestPipelineProgramsAndCaches(t *testing.T) {
+	kernel := newFakeKernel()
+	m := newTestManager(t, kernel, kernel, kernel)
+
+	var ops []*routeOp
+	for i := 0; i < 1000; i++ {
+		ops = append(ops, testOp(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), opReplace, true))
+	}
+	m.outputs[0].pipeline.submit(ops)
+	m.Wait()
+
+	assert.Equal(t, 1000, m.Kernel().Len())
+	assert.Len(t, kernel.table(unix.RT_TABLE_MAIN), 1000)
+
+	m.outputs[0].pipeline.submit([]*routeOp{testOp("10.0.0.0/24", opDelete, false)})
+	m.Wait()
+
+	assert.Equal(t, 999, m.Kernel().Len())
+	assert.Equal(t, []string{"delete 10.0.0.0/24 table 254"}, kernel.deltas()[1000:])
+}
+
+func TestPipelineFailureLeavesCache(t *testing.T) {
+	kernel := newFakeKernel()
+	kernel.fail("192.0.2.0/24", unix.ENETUNREACH)
+	m := newTestManager(t, kernel)
+
+	m.outputs[0].pipeline.submit([]*routeOp{
+		testOp("192.0.2.0/24", opReplace, true),
+		testOp("198.51.100.0/24", opReplace, true),
+	})
+	m.Wait()
+
+	assert.Equal(t, 1, m.Kernel().Len())
+	assert.Equal(t, []string{"replace 198.51.100.0/24 table 254"}, kernel.deltas())
+}
+
+func TestRemoveRouteAlreadyGone(t *testing.T) {
+	op := testOp("192.0.2.0/24", opDelete, false)
+
+	assert.NoError(t, applyDelta(newFakeKernel(), op.delta()))
+
+	kernel := newFakeKernel()
+	kernel.fail("192.0.2.0/24", unix.EPERM)
+	assert.ErrorIs(t, applyDelta(kernel, op.delta()), unix.EPERM)
+}
+
+func benchmarkOps(n int) []*routeOp {
+	ops := make([]*routeOp, 0, n)
+	for i := 0; i < n; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		route := &netlink.Route{
+			Dst:      &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)},
+			Protocol: RouteProtocol,
+			Table:    4242,
+			Type:     unix.RTN_BLACKHOLE,
+		}
+		ops = append(ops, &routeOp{key: keyOf(route), route: route, kind: opReplace, bulk: true})
+	}
+	return ops
+}
+
+// BenchmarkPipeline measures the overhead of queueing, partitioning and
+// caching, with writers that do not touch the kernel.
+func BenchmarkPipeline(b *testing.B) {
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			writers := make([]routeWriter, workers)
+			for i := range writers {
+				writers[i] = newFakeKernel()
+			}
+			benchmarkInstall(b, newTestManager(b, writers...))
+		})
+	}
+}
+
+// BenchmarkKernelInstall measures install throughput into the real kernel,
+// using blackhole routes in table 4242. It requires CAP_NET_ADMIN.
+func BenchmarkKernelInstall(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("requires root")
+	}
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			writers, err := newNetlinkWriters(nil, workers)
+			if err != nil {
+				b.Fatal(err)
+			}
+			m := newTestManager(b, writers...)
+			benchmarkInstall(b, m)
+
+			m.outputs[0].pipeline.submit(diffOps(m.Kernel().Snapshot(), nil))
+			m.Wait()
+		})
+	}
+}
+
+func benchmarkInstall(b *testing.B, m *Manager) {
+	const routes = 10000
+	ops := benchmarkOps(routes)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.outputs[0].pipeline.submit(ops)
+		m.Wait()
+	}
+	b.ReportMetric(float64(routes*b.N)/b.Elapsed().Seconds(), "routes/s")
+}
+
+// blockingSink holds every batch until release is closed.
+type blockingSink struct {
+	applying chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingSink) Apply(deltas []RouteDelta) []error {
+	s.applying <- struct{}{}
+	<-s.release
+	return make([]error, len(deltas))
+}
+
+func (*blockingSink) List() ([]*netlink.Route, error) { return nil, nil }
+func (*blockingSink) Close()                          {}
+
+func TestPipelineCloseDropsQueued(t *testing.T) {
+	sink := &blockingSink{applying: make(chan struct{}, 1), release: make(chan struct{})}
+	p := newPipeline(NewKernelCache(sink), config.Programming{Workers: 1, BatchSize: 1}, sink)
+	p.submit([]*routeOp{testOp("192.0.2.0/24", opReplace, true), testOp("198.51.100.0/24", opReplace, true)})
+	<-sink.applying
+
+	closed := make(chan struct{})
+	go func() {
+		p.close()
+		close(closed)
+	}()
+	close(sink.release)
+	<-closed
+
+	waited := make(chan struct{})
+	go func() {
+		p.wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait blocks on operations dropped by close")
+	}
+	p.submit([]*routeOp{testOp("203.0.113.0/24", opReplace, true)})
+	assert.Zero(t, p.pending.Value(), "a closed pipeline drops new operations")
+}
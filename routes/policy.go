@@ -0,0 +1,336 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// routeTypes maps the route types of policy actions to their kernel values.
+var routeTypes = map[string]int{
+	config.RouteTypeUnicast:     unix.RTN_UNICAST,
+	config.RouteTypeBlackhole:   unix.RTN_BLACKHOLE,
+	config.RouteTypeUnreachable: unix.RTN_UNREACHABLE,
+	config.RouteTypeProhibit:    unix.RTN_PROHIBIT,
+}
+
+// policy decides, from the path attributes, whether a route is installed
+// and with which table, metric, type, realm, route metrics and preferred
+// source. Realm rules then assign a realm to the routes the matching policy
+// rule left without one.
+type policy struct {
+	rules  []*policyRule
+	realms []*policyRule
+}
+
+type policyRule struct {
+	name   string
+	match  *pathMatch
+	action config.PolicyAction
+	attrs  routeAttributes
+	hits   atomic.Int64
+}
+
+// pathMatch holds the compiled conditions of a policy rule. Empty
+// conditions match every path.
+type pathMatch struct {
+	communities map[pathattr.Community]bool
+	extended    map[pathattr.ExtendedCommunity]bool
+	large       map[pathattr.LargeCommunity]bool
+	asPath      *regexp.Regexp
+	originAS    map[uint32]bool
+	nextHops    []netip.Prefix
+	peers       []netip.Prefix
+	peerAS      map[uint32]bool
+}
+
+// PolicyRuleStatus reports how often a policy rule matched.
+type PolicyRuleStatus struct {
+	Name    string `json:"name"`
+	Matches int64  `json:"matches"`
+}
+
+// newPolicy compiles the policy and realm rules. It returns nil when there
+// are no rules.
+func newPolicy(cfg []config.PolicyRule, realms []config.RealmRule) (*policy, error) {
+	if len(cfg) == 0 && len(realms) == 0 {
+		return nil, nil
+	}
+
+	p := &policy{rules: make([]*policyRule, 0, len(cfg))}
+	for i, rule := range cfg {
+		compiled, err := compilePolicyRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %d %q: %w", i, rule.Name, err)
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	realmRules, err := compileRealms(realms)
+	if err != nil {
+		return nil, err
+	}
+	p.realms = realmRules
+	return p, nil
+}
+
+func compilePolicyRule(rule config.PolicyRule) (*policyRule, error) {
+	match, err := compileMatch(rule.Match)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := compileAttributes(rule.Action.RouteAttributes)
+	if err != nil {
+		return nil, err
+	}
+	return &policyRule{name: rule.Name, match: match, action: rule.Action, attrs: attrs}, nil
+}
+
+func compileRealms(cfg []config.RealmRule) ([]*policyRule, error) {
+	realms := make([]*policyRule, 0, len(cfg))
+	for i, rule := range cfg {
+		match, err := compileMatch(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid realm rule %d %q: %w", i, rule.Name, err)
+		}
+		action := config.PolicyAction{Realm: rule.Realm}
+		realms = append(realms, &policyRule{name: rule.Name, match: match, action: action})
+	}
+	return realms, nil
+}
+
+func compileMatch(cfg config.PolicyMatch) (*pathMatch, error) {
+	m := &pathMatch{originAS: setOf(cfg.OriginAS), peerAS: setOf(cfg.PeerAS)}
+
+	var errs [6]error
+	m.communities, errs[0] = parseSet(cfg.Communities, pathattr.ParseCommunity)
+	m.extended, errs[1] = parseSet(cfg.ExtendedCommunities, pathattr.ParseExtendedCommunity)
+	m.large, errs[2] = parseSet(cfg.LargeCommunities, pathattr.ParseLargeCommunity)
+	m.asPath, errs[3] = compileASPath(cfg.ASPath)
+	m.nextHops, errs[4] = parseAddrPrefixes(cfg.NextHop)
+	m.peers, errs[5] = parseAddrPrefixes(cfg.Peer)
+	if err := errors.Join(errs[:]...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseSet[T comparable](values []string, parse func(string) (T, error)) (map[T]bool, error) {
+	set := make(map[T]bool, len(values))
+	for _, value := range values {
+		v, err := parse(value)
+		if err != nil {
+			return nil, err
+		}
+		set[v] = true
+	}
+	return set, nil
+}
+
+func setOf[T comparable](values []T) map[T]bool {
+	set := make(map[T]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func compileASPath(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid as_path: %w", err)
+	}
+	return re, nil
+}
+
+// parseAddrPrefixes parses a list of prefixes, where a plain address stands
+// for its host prefix.
+func parseAddrPrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, hostPrefix(addr))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// apply runs the rules against path and adjusts route with the action of
+// the first matching rule, then with the first matching realm rule, which
+// IPv6 routes skip as they have no realm. It
+// records the matching rules in v and reports false when the route is
+// rejected. A nil policy accepts every route unchanged.
+func (p *policy) apply(path *apipb.Path, route *netlink.Route, v *verdict) bool {
+	if p == nil {
+		return true
+	}
+
+	attrs, err := pathattr.Decode(path)
+	if err != nil {
+		log.Printf("Not applying policy to %s: %v", route.Dst, err)
+		return true
+	}
+
+	if v.rule = firstMatch(p.rules, attrs); v.rule != nil && !v.rule.apply(route) {
+		return false
+	}
+	if !hasRealm(route) {
+		return true
+	}
+	if v.realm = firstMatch(p.realms, attrs); v.realm != nil && route.Realm == 0 {
+		route.Realm = v.realm.action.Realm
+	}
+	return true
+}
+
+// firstMatch returns the first of rules attrs match.
+func firstMatch(rules []*policyRule, attrs *pathattr.Attributes) *policyRule {
+	for _, rule := range rules {
+		if rule.match.matches(attrs) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// apply adjusts route with the action of the rule. It reports false when
+// the action rejects the route.
+func (r *policyRule) apply(route *netlink.Route) bool {
+	if !applyAction(r.action, route) {
+		return false
+	}
+	r.attrs.fill(route)
+	return true
+}
+
+func applyAction(action config.PolicyAction, route *netlink.Route) bool {
+	if action.Reject {
+		return false
+	}
+	if action.Table > 0 {
+		route.Table = action.Table
+	}
+	if action.Metric > 0 {
+		route.Priority = action.Metric
+	}
+	if action.Type != "" {
+		route.Type = routeTypes[action.Type]
+	}
+	if route.Type != unix.RTN_UNICAST {
+		// The kernel refuses a gateway on routes that drop traffic.
+		route.Gw = nil
+	}
+	if action.Realm > 0 && hasRealm(route) {
+		route.Realm = action.Realm
+	}
+	return true
+}
+
+func (p *policy) status() []PolicyRuleStatus {
+	status := make([]PolicyRuleStatus, 0, len(p.rules)+len(p.realms))
+	for _, rule := range p.allRules() {
+		status = append(status, PolicyRuleStatus{Name: rule.name, Matches: rule.hits.Load()})
+	}
+	return status
+}
+
+// allRules returns the policy rules followed by the realm rules.
+func (p *policy) allRules() []*policyRule {
+	rules := make([]*policyRule, 0, len(p.rules)+len(p.realms))
+	return append(append(rules, p.rules...), p.realms...)
+}
+
+// accountedRealms returns the realms the rules assign that the kernel keeps
+// traffic counters for, in ascending order.
+func (p *policy) accountedRealms() []int {
+	if p == nil {
+		return nil
+	}
+	seen := make(map[int]bool)
+	var realms []int
+	for _, rule := range p.allRules() {
+		realm := rule.action.Realm
+		if realm > 0 && realm <= config.MaxAccountedRealm && !seen[realm] {
+			seen[realm] = true
+			realms = append(realms, realm)
+		}
+	}
+	sort.Ints(realms)
+	return realms
+}
+
+func (m *pathMatch) matches(attrs *pathattr.Attributes) bool {
+	return m.matchesCommunities(attrs) && m.matchesASPath(attrs) &&
+		containsAny(m.nextHops, attrs.NextHops...) &&
+		containsAny(m.peers, attrs.Peer.Address) &&
+		(len(m.peerAS) == 0 || m.peerAS[attrs.Peer.ASN])
+}
+
+func (m *pathMatch) matchesCommunities(attrs *pathattr.Attributes) bool {
+	return hasAny(m.communities, attrs.Communities) &&
+		hasAny(m.extended, attrs.ExtendedCommunities) &&
+		hasAny(m.large, attrs.LargeCommunities)
+}
+
+func (m *pathMatch) matchesASPath(attrs *pathattr.Attributes) bool {
+	if m.asPath != nil && !m.asPath.MatchString(attrs.ASPathString()) {
+		return false
+	}
+	if len(m.originAS) == 0 {
+		return true
+	}
+	origin, ok := attrs.OriginAS()
+	return ok && m.originAS[origin]
+}
+
+// hasAny reports whether set is empty or holds one of values.
+func hasAny[T comparable](set map[T]bool, values []T) bool {
+	if len(set) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if set[v] {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny reports whether prefixes is empty or one of them contains one
+// of addrs.
+func containsAny(prefixes []netip.Prefix, addrs ...netip.Addr) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, addr := range addrs {
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package routes
+
+import (
+	"expvar"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// newAttrPath returns an announcement of prefix/length carrying attrs.
+func newAttrPath(t *testing.T, prefix string, length uint32, attrs ...proto.Message) *apipb.Path {
+	t.Helper()
+	path := newTestPath(t, prefix, length, false)
+	for _, attr := range attrs {
+		packed, err := anypb.New(attr)
+		require.NoError(t, err)
+		path.Pattrs = append(path.Pattrs, packed)
+	}
+	return path
+}
+
+func asPath(asns ...uint32) *apipb.AsPathAttribute {
+	return &apipb.AsPathAttribute{Segments: []*apipb.AsSegment{{Type: apipb.AsSegment_AS_SEQUENCE, Numbers: asns}}}
+}
+
+func newTestPolicy(t *testing.T, rules ...config.PolicyRule) *policy {
+	t.Helper()
+	p, err := newPolicy(rules, nil)
+	require.NoError(t, err)
+	return p
+}
+
+// applyPolicy applies p to route, counting the matches as the RIB does for
+// a prefix that matched no rule before.
+func applyPolicy(p *policy, path *apipb.Path, route *netlink.Route) bool {
+	var v verdict
+	accepted := p.apply(path, route, &v)
+	v.count(verdict{}, netip.Prefix{}, nil)
+	return accepted
+}
+
+func TestPolicyMatch(t *testing.T) {
+	blackhole := &apipb.CommunitiesAttribute{Communities: []uint32{65535<<16 | 666}}
+	target := &apipb.ExtendedCommunitiesAttribute{Communities: []*anypb.Any{}}
+	packed, err := anypb.New(&apipb.TwoOctetAsSpecificExtended{SubType: 0x02, Asn: 65000, LocalAdmin: 10})
+	require.NoError(t, err)
+	target.Communities = append(target.Communities, packed)
+	large := &apipb.LargeCommunitiesAttribute{Communities: []*apipb.LargeCommunity{
+		{GlobalAdmin: 65000, LocalData1: 1, LocalData2: 2},
+	}}
+	path := func(attrs ...proto.Message) *apipb.Path { return newAttrPath(t, "10.0.0.0", 24, attrs...) }
+
+	tests := []struct {
+		name  string
+		match config.PolicyMatch
+		path  *apipb.Path
+		want  bool
+	}{
+		{"empty", config.PolicyMatch{}, path(), true},
+		{"community", config.PolicyMatch{Communities: []string{"65535:666"}}, path(blackhole), true},
+		{"no community", config.PolicyMatch{Communities: []string{"65535:666"}}, path(), false},
+		{"extended", config.PolicyMatch{ExtendedCommunities: []string{"rt:65000:10"}}, path(target), true},
+		{"large", config.PolicyMatch{LargeCommunities: []string{"65000:1:3", "65000:1:2"}}, path(large), true},
+		{"as path", config.PolicyMatch{ASPath: "^65001 "}, path(asPath(65001, 65002)), true},
+		{"as path miss", config.PolicyMatch{ASPath: "^65002"}, path(asPath(65001, 65002)), false},
+		{"origin", config.PolicyMatch{OriginAS: []uint32{65002}}, path(asPath(65001, 65002)), true},
+		{"origin local", config.PolicyMatch{OriginAS: []uint32{65002}}, path(), false},
+		{
+			"next hop", config.PolicyMatch{NextHop: []string{"192.0.2.0/24"}},
+			path(&apipb.NextHopAttribute{NextHop: "192.0.2.7"}), true,
+		},
+		{
+			"all conditions", config.PolicyMatch{Communities: []string{"65535:666"}, OriginAS: []uint32{65003}},
+			path(blackhole, asPath(65001, 65002)), false,
+		},
+	}
+	for _, tt := range tests {
+		match, err := compileMatch(tt.match)
+		require.NoError(t, err, tt.name)
+
+		p := &policy{rules: []*policyRule{{name: tt.name, match: match, action: config.PolicyAction{Reject: true}}}}
+		route := &netlink.Route{Dst: mustCIDR(t, "10.0.0.0/24")}
+		assert.Equal(t, !tt.want, applyPolicy(p, tt.path, route), tt.name)
+	}
+}
+
+func TestPolicyMatchPeer(t *testing.T) {
+	p := newTestPolicy(t, config.PolicyRule{
+		Match:  config.PolicyMatch{Peer: []string{"192.0.2.1", "2001:db8::/32"}, PeerAS: []uint32{65001}},
+		Action: config.PolicyAction{Reject: true},
+	})
+	path := newAttrPath(t, "10.0.0.0", 24)
+	route := &netlink.Route{Dst: mustCIDR(t, "10.0.0.0/24")}
+
+	path.NeighborIp, path.SourceAsn = "192.0.2.1", 65001
+	assert.False(t, applyPolicy(p, path, route))
+	path.NeighborIp = "2001:db8::1"
+	assert.False(t, applyPolicy(p, path, route))
+	path.SourceAsn = 65002
+	assert.True(t, applyPolicy(p, path, route))
+	path.NeighborIp, path.SourceAsn = "192.0.2.2", 65001
+	assert.True(t, applyPolicy(p, path, route))
+}
+
+func TestPolicyActions(t *testing.T) {
+	p := newTestPolicy(t,
+		config.PolicyRule{
+			Name:  "blackhole",
+			Match: config.PolicyMatch{Communities: []string{"65535:666"}},
+			Action: config.PolicyAction{
+				Type: config.RouteTypeBlackhole, Table: 100, Metric: 10, Realm: 7,
+				RouteAttributes: config.RouteAttributes{MTU: 1400, InitCwnd: 10},
+			},
+		},
+		config.PolicyRule{Name: "all", Action: config.PolicyAction{Metric: 20}},
+	)
+
+	route := &netlink.Route{
+		Dst: mustCIDR(t, "10.0.0.0/24"), Gw: net.ParseIP("192.0.2.1"), Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST,
+	}
+	path := newAttrPath(t, "10.0.0.0", 24, &apipb.CommunitiesAttribute{Communities: []uint32{65535<<16 | 666}})
+	assert.True(t, applyPolicy(p, path, route))
+	assert.Equal(t, netlink.Route{
+		Dst:      route.Dst,
+		Table:    100,
+		Type:     unix.RTN_BLACKHOLE,
+		Priority: 10,
+		Realm:    7,
+		MTU:      1400,
+		InitCwnd: 10,
+	}, *route)
+
+	route = &netlink.Route{
+		Dst: mustCIDR(t, "10.0.1.0/24"), Gw: net.ParseIP("192.0.2.1"), Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST,
+	}
+	assert.True(t, applyPolicy(p, newAttrPath(t, "10.0.1.0", 24), route))
+	assert.Equal(t, 20, route.Priority)
+	assert.Equal(t, "192.0.2.1", route.Gw.String(), "unicast routes keep their gateway")
+	assert.Equal(t, unix.RT_TABLE_MAIN, route.Table)
+
+	assert.Equal(t, []PolicyRuleStatus{{Name: "blackhole", Matches: 1}, {Name: "all", Matches: 1}}, p.status())
+}
+
+func TestPolicyInvalidRules(t *testing.T) {
+	for _, match := range []config.PolicyMatch{
+		{Communities: []string{"666"}},
+		{ExtendedCommunities: []string{"rt:1"}},
+		{LargeCommunities: []string{"1:2"}},
+		{ASPath: "("},
+		{NextHop: []string{"192.0.2.0/33"}},
+		{Peer: []string{"peer"}},
+	} {
+		_, err := newPolicy([]config.PolicyRule{{Match: match}}, nil)
+		assert.Error(t, err, "%+v", match)
+	}
+}
+
+func TestPolicyMovesPrefixBetweenTables(t *testing.T) {
+	rib := newRIB(nil, newTestPolicy(t, config.PolicyRule{
+		Match:  config.PolicyMatch{Communities: []string{"65000:100"}},
+		Action: config.PolicyAction{Table: 100},
+	}), nil)
+	tagged := &apipb.CommunitiesAttribute{Communities: []uint32{65000<<16 | 100}}
+
+	rib.Apply([]*apipb.Path{newAttrPath(t, "10.0.0.0", 24, tagged)})
+	_, ok := rib.Get(RouteKey{Table: 100, Dst: netip.MustParsePrefix("10.0.0.0/24")})
+	assert.True(t, ok)
+
+	changes := rib.Apply([]*apipb.Path{newAttrPath(t, "10.0.0.0", 24)})
+	assert.Equal(t, map[RouteKey]bool{
+		{Table: 100, Dst: netip.MustParsePrefix("10.0.0.0/24")}:                false,
+		{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("10.0.0.0/24")}: true,
+	}, present(changes))
+	assert.Equal(t, 1, rib.Len())
+
+	rib.Apply([]*apipb.Path{newAttrPath(t, "10.0.0.0", 24, tagged)})
+	changes = rib.Apply([]*apipb.Path{newTestPath(t, "10.0.0.0", 24, true)})
+	assert.Equal(t, map[RouteKey]bool{{Table: 100, Dst: netip.MustParsePrefix("10.0.0.0/24")}: false}, present(changes))
+	assert.Equal(t, 0, rib.Len())
+	assert.Equal(t, 0, rib.Counts().Tables[100])
+}
+
+func TestRIBRefusesLinkLocalNextHop(t *testing.T) {
+	rib := newRIB(nil, newTestPolicy(t, config.PolicyRule{
+		Match:  config.PolicyMatch{Communities: []string{"65535:666"}},
+		Action: config.PolicyAction{Type: config.RouteTypeBlackhole},
+	}), nil)
+	refused := func() int64 {
+		v, _ := Metrics.Get(metricLinkLocalRefused).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	before := refused()
+	linkLocal := &apipb.MpReachNLRIAttribute{NextHops: []string{"fe80::1"}}
+	blackhole := &apipb.CommunitiesAttribute{Communities: []uint32{65535<<16 | 666}}
+
+	for i := 0; i < 2; i++ {
+		rib.Apply([]*apipb.Path{newAttrPath(t, "2001:db8:1::", 48, linkLocal)})
+	}
+	assert.Equal(t, 0, rib.Len(), "a unicast route needs the interface of a link-local next hop")
+	assert.Equal(t, before+1, refused(), "refusals are counted once per prefix")
+
+	rib.Apply([]*apipb.Path{newAttrPath(t, "2001:db8:1::", 48, linkLocal, blackhole)})
+	route, ok := rib.Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("2001:db8:1::/48")})
+	require.True(t, ok, "a blackhole route needs no next hop")
+	assert.Equal(t, unix.RTN_BLACKHOLE, route.Type)
+}
+
+func TestPolicyRejectRemovesRoute(t *testing.T) {
+	kernel := newFakeKernel()
+	m := newTestManager(t, kernel)
+	m.rib.policy = newTestPolicy(t, config.PolicyRule{
+		Match:  config.PolicyMatch{OriginAS: []uint32{64666}},
+		Action: config.PolicyAction{Reject: true},
+	})
+
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newAttrPath(t, "10.0.0.0", 24, asPath(65001))}))
+	m.Wait()
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newAttrPath(t, "10.0.0.0", 24, asPath(65001, 64666))}))
+	m.Wait()
+
+	assert.Equal(t, []string{"replace 10.0.0.0/24 table 254", "delete 10.0.0.0/24 table 254"}, kernel.deltas())
+	assert.Equal(t, 0, m.RIB().Len())
+}
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	dst, err := netlink.ParseIPNet(cidr)
+	require.NoError(t, err)
+	return dst
+}
+
+func present(changes map[RouteKey]*netlink.Route) map[RouteKey]bool {
+	keys := make(map[RouteKey]bool, len(changes))
+	for key, route := range changes {
+		keys[key] = route != nil
+	}
+	return keys
+}
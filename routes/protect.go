@@ -0,0 +1,264 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// protector keeps bgtables away from destinations it must never redirect,
+// such as the management network or the GoBGP API endpoint. A route that
+// equals, covers or falls within a protected prefix is neither installed
+// nor removed, nor is a route that would redirect the connection to GoBGP.
+type protector struct {
+	prefixes     []netip.Prefix
+	defaultRoute bool
+	servers      []serverRoute
+
+	mu      sync.Mutex
+	refused map[RouteKey]bool
+}
+
+// routeLister lists the routes of a network namespace.
+type routeLister interface {
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+}
+
+// newScopeProtector returns the protector of scope. GoBGP is reached from
+// the network namespace of bgtables, so only the managers of that
+// namespace protect the gobgp_server address, against its routes.
+func newScopeProtector(cfg config.Config, scope vrfScope) (*protector, error) {
+	if !cfg.Protection.GoBGPServer || scope.ns != nil {
+		return newProtector(cfg.Protection, "", nil)
+	}
+	handle, err := netlink.NewHandle(unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink handle for protection: %w", err)
+	}
+	defer handle.Close()
+	return newProtector(cfg.Protection, cfg.GoBGPServer, handle)
+}
+
+// newProtector compiles cfg. server is the gobgp_server address, protected
+// against the current routes to it, which routes lists, when cfg asks for
+// it. It returns nil when nothing is protected.
+func newProtector(cfg config.Protection, server string, routes routeLister) (*protector, error) {
+	prefixes := make([]netip.Prefix, 0, len(cfg.Prefixes))
+	for _, p := range cfg.Prefixes {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protected prefix %q: %w", p, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	var servers []serverRoute
+	if cfg.GoBGPServer && routes != nil {
+		var err error
+		if servers, err = resolveServerRoutes(server, routes); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(prefixes) == 0 && len(servers) == 0 && !cfg.DefaultRoute {
+		return nil, nil
+	}
+	return &protector{
+		prefixes:     prefixes,
+		defaultRoute: cfg.DefaultRoute,
+		servers:      servers,
+		refused:      make(map[RouteKey]bool),
+	}, nil
+}
+
+// serverRoute is an address of gobgp_server and the length of the route
+// the kernel reaches it through. Only a route covering the address that is
+// at least as long redirects the connection to GoBGP: covering aggregates
+// and default routes lose to the current route.
+type serverRoute struct {
+	addr netip.Addr
+	bits int
+}
+
+func (s serverRoute) redirectedBy(dst netip.Prefix) bool {
+	return dst.Bits() >= s.bits && dst.Contains(s.addr)
+}
+
+func (s serverRoute) String() string {
+	return fmt.Sprintf("gobgp_server %s (routes of /%d and longer)", s.addr, s.bits)
+}
+
+// resolveServerRoutes returns the server route of every address of the
+// gobgp_server target that is not local to the host. A name that does not
+// resolve is logged and left unprotected, rather than keeping bgtables
+// from starting.
+func resolveServerRoutes(server string, routes routeLister) ([]serverRoute, error) {
+	addrs, err := serverAddrs(server)
+	if err != nil {
+		log.Printf("Not protecting gobgp_server: %v", err)
+		return nil, nil
+	}
+
+	servers := make([]serverRoute, 0, len(addrs))
+	for _, addr := range addrs {
+		bits, local, err := currentRoute(routes, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !local {
+			servers = append(servers, serverRoute{addr: addr, bits: bits})
+		}
+	}
+	return servers, nil
+}
+
+// serverAddrs returns the addresses a gRPC target connects to. Unix socket
+// targets have none.
+func serverAddrs(server string) ([]netip.Addr, error) {
+	host := targetHost(server)
+	if host == "" {
+		return nil, nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs, nil
+}
+
+// currentRoute returns the length of the longest route of the main table
+// covering addr, other than the routes of bgtables, and whether addr is
+// local to the host, which no route redirects.
+func currentRoute(routes routeLister, addr netip.Addr) (int, bool, error) {
+	family := netlink.FAMILY_V4
+	if addr.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	local, err := routes.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_LOCAL}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to list local routes: %w", err)
+	}
+	if _, ok := longestRoute(local, addr, func(route *netlink.Route) bool { return route.Type == unix.RTN_LOCAL }); ok {
+		return 0, true, nil
+	}
+
+	main, err := routes.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to list routes: %w", err)
+	}
+	bits, _ := longestRoute(main, addr, func(route *netlink.Route) bool { return route.Protocol != RouteProtocol })
+	return bits, false, nil
+}
+
+// longestRoute returns the length of the longest of the routes keep keeps
+// that covers addr, and whether there is one.
+func longestRoute(routes []netlink.Route, addr netip.Addr, keep func(*netlink.Route) bool) (int, bool) {
+	bits, found := 0, false
+	for i := range routes {
+		prefix := prefixOf(&routes[i])
+		if keep(&routes[i]) && prefix.Contains(addr) && (!found || prefix.Bits() > bits) {
+			bits, found = prefix.Bits(), true
+		}
+	}
+	return bits, found
+}
+
+// targetHost extracts the host of a gRPC target, or "" for Unix sockets.
+func targetHost(target string) string {
+	switch {
+	case strings.HasPrefix(target, "unix:"), strings.HasPrefix(target, "unix-abstract:"):
+		return ""
+	case strings.HasPrefix(target, "dns:"):
+		target = strings.TrimPrefix(target, "dns:")
+		if strings.HasPrefix(target, "//") {
+			_, target, _ = strings.Cut(strings.TrimPrefix(target, "//"), "/")
+		}
+	case strings.HasPrefix(target, "passthrough:///"):
+		target = strings.TrimPrefix(target, "passthrough:///")
+	}
+
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+func hostPrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// protects reports whether key must be left alone. A nil protector
+// protects nothing.
+func (p *protector) protects(key RouteKey) bool {
+	if p == nil {
+		return false
+	}
+
+	if p.defaultRoute && key.Dst.Bits() == 0 {
+		return true
+	}
+	for _, protected := range p.prefixes {
+		if protected.Overlaps(key.Dst) {
+			return true
+		}
+	}
+	for _, server := range p.servers {
+		if server.redirectedBy(key.Dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuses reports whether key must be left alone, logging and counting the
+// first refusal of each key.
+func (p *protector) refuses(key RouteKey) bool {
+	if !p.protects(key) {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.refused[key] {
+		p.refused[key] = true
+		Metrics.Add(metricProtectedRefused, 1)
+		log.Printf("Refusing to program %s, it is protected", key)
+	}
+	return true
+}
+
+// status lists the protected prefixes.
+func (p *protector) status() []string {
+	protected := make([]string, 0, len(p.prefixes)+len(p.servers)+2)
+	for _, prefix := range p.prefixes {
+		protected = append(protected, prefix.String())
+	}
+	for _, server := range p.servers {
+		protected = append(protected, server.String())
+	}
+	if p.defaultRoute {
+		protected = append(protected, "0.0.0.0/0", "::/0")
+	}
+	sort.Strings(protected)
+	return protected
+}
@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func mainKey(dst string) RouteKey {
+	return RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix(dst)}
+}
+
+func TestTargetHost(t *testing.T) {
+	tests := map[string]string{
+		"localhost:50051":              "localhost",
+		"192.0.2.1:50051":              "192.0.2.1",
+		"[2001:db8::1]:50051":          "2001:db8::1",
+		"dns:///gobgp.example:50051":   "gobgp.example",
+		"dns://8.8.8.8/gobgp.example":  "gobgp.example",
+		"passthrough:///192.0.2.1:179": "192.0.2.1",
+		"unix:///run/gobgp.sock":       "",
+		"unixhost:50051":               "unixhost",
+		"":                             "",
+	}
+	for target, host := range tests {
+		assert.Equal(t, host, targetHost(target), target)
+	}
+}
+
+// serverKernel returns a kernel that reaches 192.0.2.1 through the /24 of
+// its network and holds 198.51.100.1 as a local address.
+func serverKernel(t *testing.T) *fakeKernel {
+	kernel := newFakeKernel()
+	kernel.install(netlink.Route{Family: netlink.FAMILY_V4, Table: unix.RT_TABLE_MAIN, Gw: net.ParseIP("192.0.2.254")})
+	kernel.install(netlink.Route{
+		Dst: mustCIDR(t, "192.0.2.0/24"), Table: unix.RT_TABLE_MAIN, Protocol: unix.RTPROT_KERNEL,
+	})
+	kernel.install(netlink.Route{Dst: mustCIDR(t, "192.0.2.0/26"), Table: unix.RT_TABLE_MAIN, Protocol: RouteProtocol})
+	kernel.install(netlink.Route{
+		Dst: mustCIDR(t, "198.51.100.1/32"), Table: unix.RT_TABLE_LOCAL, Type: unix.RTN_LOCAL,
+	})
+	return kernel
+}
+
+func TestProtectorProtects(t *testing.T) {
+	p, err := newProtector(config.Protection{
+		Prefixes:    []string{"203.0.113.0/24"},
+		GoBGPServer: true,
+	}, "192.0.2.1:50051", serverKernel(t))
+	require.NoError(t, err)
+
+	tests := map[string]bool{
+		"203.0.113.0/24":   true,
+		"203.0.0.0/16":     true,
+		"203.0.113.128/25": true,
+		"0.0.0.0/0":        true,
+		"192.0.0.0/16":     false,
+		"192.0.2.0/24":     true,
+		"192.0.2.0/25":     true,
+		"192.0.2.1/32":     true,
+		"192.0.2.128/25":   false,
+		"198.51.100.0/24":  false,
+	}
+	for dst, protected := range tests {
+		assert.Equal(t, protected, p.protects(mainKey(dst)), dst)
+	}
+	assert.Equal(t, []string{"203.0.113.0/24", "gobgp_server 192.0.2.1 (routes of /24 and longer)"}, p.status())
+}
+
+func TestProtectorServerRoutes(t *testing.T) {
+	kernel := serverKernel(t)
+
+	p, err := newProtector(config.Protection{GoBGPServer: true}, "198.51.100.1:50051", kernel)
+	require.NoError(t, err)
+	assert.Nil(t, p, "a local address is reached through no route")
+
+	p, err = newProtector(config.Protection{GoBGPServer: true}, "203.0.113.1:50051", kernel)
+	require.NoError(t, err)
+	assert.True(t, p.protects(mainKey("0.0.0.0/0")), "the default route reaches the server")
+	assert.True(t, p.protects(mainKey("203.0.113.0/24")))
+
+	p, err = newProtector(config.Protection{GoBGPServer: true}, "gobgp.invalid:50051", kernel)
+	assert.NoError(t, err, "a name that does not resolve leaves the server unprotected")
+	assert.Nil(t, p)
+
+	kernel.failList(errors.New("netlink failure"))
+	_, err = newProtector(config.Protection{GoBGPServer: true}, "192.0.2.1:50051", kernel)
+	assert.Error(t, err)
+}
+
+func TestProtectorDefaultRoute(t *testing.T) {
+	p, err := newProtector(config.Protection{DefaultRoute: true}, "", nil)
+	require.NoError(t, err)
+
+	assert.True(t, p.protects(mainKey("0.0.0.0/0")))
+	assert.True(t, p.protects(mainKey("::/0")))
+	assert.False(t, p.protects(mainKey("0.0.0.0/1")))
+}
+
+func TestProtectorDisabled(t *testing.T) {
+	p, err := newProtector(config.Protection{GoBGPServer: true}, "unix:///run/gobgp.sock", newFakeKernel())
+	require.NoError(t, err)
+	assert.Nil(t, p)
+	assert.False(t, p.protects(mainKey("0.0.0.0/0")))
+
+	_, err = newProtector(config.Protection{Prefixes: []string{"192.0.2.0"}}, "", nil)
+	assert.Error(t, err)
+}
+
+func TestProtectedPrefixesAreNeverProgrammed(t *testing.T) {
+	kernel := newFakeKernel()
+	m := newTestManager(t, kernel)
+	var err error
+	m.protector, err = newProtector(config.Protection{Prefixes: []string{"10.0.1.0/24"}}, "", nil)
+	require.NoError(t, err)
+
+	// An owned route on a protected prefix, left over from before.
+	stale := testOp("10.0.1.0/24", opReplace, false)
+	m.kernel.record([]*routeOp{stale}, []error{nil})
+
+	assert.NoError(t, m.UpdateLocalRoutes(append(testPaths(t, 3), newTestPath(t, "10.0.0.0", 16, false))))
+	m.Wait()
+	assert.ElementsMatch(t, []string{"replace 10.0.0.0/24 table 254", "replace 10.0.2.0/24 table 254"}, kernel.deltas())
+
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "10.0.1.0", 24, true)}))
+	m.Wait()
+	m.resync()
+	m.Wait()
+	assert.Empty(t, kernel.deltas())
+	_, ok := m.kernel.Get(mainKey("10.0.1.0/24"))
+	assert.True(t, ok)
+}
@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// rtAcctPath is the kernel table of per-realm traffic counters, present
+// when the kernel is built with CONFIG_IP_ROUTE_CLASSID.
+var rtAcctPath = "/proc/net/rt_acct"
+
+// rtAcctSize is the size of the counters of one realm in rtAcctPath.
+const rtAcctSize = 16
+
+// RealmCounters holds the traffic the kernel routed through the routes of
+// a realm, summed over all CPUs. The kernel counters are 32 bits wide and
+// wrap around.
+type RealmCounters struct {
+	InBytes    uint32 `json:"in_bytes"`
+	InPackets  uint32 `json:"in_packets"`
+	OutBytes   uint32 `json:"out_bytes"`
+	OutPackets uint32 `json:"out_packets"`
+}
+
+// readRealmCounters reads the counters of realms from the kernel table at
+// path, keyed by realm number.
+func readRealmCounters(path string, realms []int) (map[string]RealmCounters, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read realm counters: %w", err)
+	}
+
+	counters := make(map[string]RealmCounters, len(realms))
+	for _, realm := range realms {
+		offset := realm * rtAcctSize
+		if offset+rtAcctSize > len(data) {
+			continue
+		}
+		entry := data[offset : offset+rtAcctSize]
+		counters[strconv.Itoa(realm)] = RealmCounters{
+			OutBytes:   binary.NativeEndian.Uint32(entry[0:]),
+			OutPackets: binary.NativeEndian.Uint32(entry[4:]),
+			InBytes:    binary.NativeEndian.Uint32(entry[8:]),
+			InPackets:  binary.NativeEndian.Uint32(entry[12:]),
+		}
+	}
+	return counters, nil
+}
+
+// realmStatus returns the counters of realms in ns, or the reason they
+// cannot be read.
+func realmStatus(ns *namespace, realms []int) any {
+	var counters map[string]RealmCounters
+	err := ns.run(func() (err error) {
+		counters, err = readRealmCounters(ns.rtAcctPath(), realms)
+		return err
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return counters
+}
@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestPolicyRealms(t *testing.T) {
+	p, err := newPolicy([]config.PolicyRule{
+		{Name: "tagged", Match: config.PolicyMatch{OriginAS: []uint32{65100}}, Action: config.PolicyAction{Realm: 300}},
+	}, []config.RealmRule{
+		{Name: "upstream-a", Match: config.PolicyMatch{Communities: []string{"65000:1"}}, Realm: 10},
+		{Name: "customers", Match: config.PolicyMatch{OriginAS: []uint32{65100}}, Realm: 20},
+	})
+	require.NoError(t, err)
+
+	route := &netlink.Route{Dst: mustCIDR(t, "10.0.0.0/24")}
+	path := newAttrPath(t, "10.0.0.0", 24, &apipb.CommunitiesAttribute{Communities: []uint32{65000<<16 | 1}})
+	assert.True(t, applyPolicy(p, path, route))
+	assert.Equal(t, 10, route.Realm)
+
+	route = &netlink.Route{Dst: mustCIDR(t, "10.0.1.0/24")}
+	path = newAttrPath(t, "10.0.1.0", 24, &apipb.AsPathAttribute{
+		Segments: []*apipb.AsSegment{{Type: 2, Numbers: []uint32{65000, 65100}}},
+	})
+	assert.True(t, applyPolicy(p, path, route))
+	assert.Equal(t, 300, route.Realm, "a realm set by a policy action stands")
+
+	route = &netlink.Route{Dst: mustCIDR(t, "10.0.2.0/24")}
+	assert.True(t, applyPolicy(p, newAttrPath(t, "10.0.2.0", 24), route))
+	assert.Zero(t, route.Realm)
+
+	route = &netlink.Route{Dst: mustCIDR(t, "2001:db8::/32")}
+	path = newAttrPath(t, "2001:db8::", 32, &apipb.AsPathAttribute{
+		Segments: []*apipb.AsSegment{{Type: 2, Numbers: []uint32{65000, 65100}}},
+	})
+	assert.True(t, applyPolicy(p, path, route))
+	assert.Zero(t, route.Realm, "IPv6 routes have no realm")
+
+	assert.Equal(t, []int{10, 20}, p.accountedRealms(), "realms above 255 have no counters")
+	assert.Equal(t, []PolicyRuleStatus{
+		{Name: "tagged", Matches: 2}, {Name: "upstream-a", Matches: 1}, {Name: "customers", Matches: 1},
+	}, p.status())
+}
+
+func TestReadRealmCounters(t *testing.T) {
+	data := make([]byte, 256*rtAcctSize)
+	for i, v := range []uint32{1000, 10, 2000, 20} {
+		binary.NativeEndian.PutUint32(data[10*rtAcctSize+4*i:], v)
+	}
+	path := filepath.Join(t.TempDir(), "rt_acct")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	defer func(saved string) { rtAcctPath = saved }(rtAcctPath)
+	rtAcctPath = path
+
+	counters, err := readRealmCounters(rtAcctPath, []int{10, 20})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]RealmCounters{
+		"10": {OutBytes: 1000, OutPackets: 10, InBytes: 2000, InPackets: 20},
+		"20": {},
+	}, counters)
+
+	rtAcctPath = filepath.Join(t.TempDir(), "missing")
+	assert.IsType(t, "", realmStatus(nil, []int{10}))
+}
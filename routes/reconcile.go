@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+// Reconcile rebuilds the RIB and the ip rules from the paths currently in
+// the source, queues the kernel operations that bring the owned routes in
+// line with them and reconciles the owned rules. It repairs any divergence
+// left behind by missed watch events.
+func (m *Manager) Reconcile(ctx context.Context, client apipb.GobgpApiClient) error {
+	m.programming.Lock()
+	defer m.programming.Unlock()
+
+	paths, err := m.source.Fetch(ctx, client)
+	if err != nil {
+		return err
+	}
+	return m.rebuild(paths)
+}
+
+// rebuild replaces the RIB and the ip rules with paths, as just fetched
+// from the source, and brings the owned routes and rules in line with them.
+// Callers must hold m.programming.
+func (m *Manager) rebuild(paths []*apipb.Path) error {
+	m.rib.Replace(paths)
+	m.rules.replace(paths)
+	m.limiter.evaluate(m.rib.Counts())
+	m.sync(m.desiredSnapshot())
+
+	return m.rules.reconcile()
+}
+
+// RunReconciler calls Reconcile every interval until ctx is cancelled.
+func (m *Manager) RunReconciler(ctx context.Context, client apipb.GobgpApiClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.runReconcile(ctx, client)
+		}
+	}
+}
+
+func (m *Manager) runReconcile(ctx context.Context, client apipb.GobgpApiClient) {
+	start := time.Now()
+	if err := m.Reconcile(ctx, client); err != nil {
+		Metrics.Add(metricReconcileFailures, 1)
+		log.Printf("Reconciliation failed: %v", err)
+		return
+	}
+	Metrics.Add(metricReconcileRuns, 1)
+	log.Printf("Reconciled %d routes of the %s in %s", m.rib.Len(), m.scope, time.Since(start))
+}
+
+// bestPaths returns the paths GoBGP selected as best, mirroring what the
+// BEST watch filter delivers.
+func bestPaths(paths []*apipb.Path) []*apipb.Path {
+	best := make([]*apipb.Path, 0, len(paths))
+	for _, path := range paths {
+		if path.Best && !path.IsWithdraw {
+			best = append(best, path)
+		}
+	}
+	return best
+}
@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/internal/gobgptest"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestBestPaths(t *testing.T) {
+	best := newTestPath(t, "192.0.2.0", 24, false)
+	best.Best = true
+	withdrawn := newTestPath(t, "198.51.100.0", 24, true)
+	withdrawn.Best = true
+
+	paths := bestPaths([]*apipb.Path{
+		best,
+		newTestPath(t, "192.0.2.0", 24, false),
+		withdrawn,
+	})
+
+	assert.Equal(t, []*apipb.Path{best}, paths)
+}
+
+func TestReconcileFetchError(t *testing.T) {
+	client := new(MockGobgpAPIClient)
+	client.On("ListPath", mock.Anything, mock.Anything).Return(nil, errors.New("connection error"))
+
+	m := newTestManager(t)
+	m.RIB().Apply([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, false)})
+
+	err := m.Reconcile(context.Background(), client)
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, m.RIB().Len(), "a failed fetch must leave the RIB untouched")
+}
+
+func TestRIBReplace(t *testing.T) {
+	rib := NewRIB()
+	rib.Apply([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, false)})
+
+	rib.Replace([]*apipb.Path{newTestPath(t, "198.51.100.0", 24, false)})
+
+	_, ok := rib.Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+	assert.False(t, ok)
+	_, ok = rib.Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("198.51.100.0/24")})
+	assert.True(t, ok)
+}
+
+func TestReconcileVRF(t *testing.T) {
+	server := gobgptest.NewServer()
+	t.Cleanup(server.Close)
+	conn, err := server.Dial()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := apipb.NewGobgpApiClient(conn)
+
+	rt := routeTarget(t, 65000, 1)
+	server.SetVrf(&apipb.Vrf{Name: "blue", ImportRt: []*anypb.Any{rt}})
+	server.Announce(newVPNPath(t, "198.51.100.0", 1, false, rt), newVPNPath(t, "198.51.100.0", 2, false, rt))
+
+	cfg := config.Default()
+	cfg.Programming.ProgressInterval = 0
+	scopes, err := resolveVRFScopes(nil, []config.VRF{{Name: "blue", Table: 100}})
+	require.NoError(t, err)
+	m, err := newScopedManager(cfg, []Sink{newNetlinkSink([]routeWriter{newFakeKernel()})}, scopes[1], nil)
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+	require.NoError(t, m.Source().Load(context.Background(), client))
+
+	require.NoError(t, m.Reconcile(context.Background(), client))
+	assert.Equal(t, 1, m.RIB().Len(), "the paths imported into the VRF are kept")
+
+	server.Withdraw(newVPNPath(t, "198.51.100.0", 1, false, rt))
+	require.NoError(t, m.Reconcile(context.Background(), client))
+	_, ok := m.RIB().Get(RouteKey{Table: 100, Dst: netip.MustParsePrefix("198.51.100.0/24")})
+	assert.True(t, ok, "the prefix stays while another route distinguisher imports it")
+}
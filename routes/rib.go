@@ -0,0 +1,278 @@
+package routes
+
+import (
+	"net/netip"
+	"sync"
+
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// RIB holds the routes bgtables wants installed in the kernel, keyed by
+// routing table and destination prefix. Each prefix is placed in a single
+// table, chosen by policy.
+type RIB struct {
+	mu     sync.RWMutex
+	routes map[RouteKey]*netlink.Route
+	tables map[netip.Prefix]int
+	counts RouteCounts
+	filter *prefixFilter
+	policy *policy
+	rpki   *rpkiValidator
+	// verdicts counts how the filter, the policy and the RPKI validation
+	// treat the prefixes.
+	verdicts *verdicts
+	// table pins every route to one routing table, the table of a VRF,
+	// when it is not zero.
+	table    int
+	defaults tableDefaults
+	// tableMap renumbers the other tables for the network namespace the
+	// routes go to.
+	tableMap tableMap
+}
+
+// RouteCounts tallies routes per address family (netlink.FAMILY_V4 or
+// netlink.FAMILY_V6) and per routing table.
+type RouteCounts struct {
+	Families map[int]int
+	Tables   map[int]int
+}
+
+func newRouteCounts() RouteCounts {
+	return RouteCounts{Families: make(map[int]int), Tables: make(map[int]int)}
+}
+
+func (c RouteCounts) add(key RouteKey, n int) {
+	c.Families[familyOf(key.Dst)] += n
+	c.Tables[key.Table] += n
+}
+
+// NewRIB returns an empty RIB that accepts every prefix unchanged.
+func NewRIB() *RIB {
+	return newRIB(nil, nil, nil)
+}
+
+func newRIB(filter *prefixFilter, policy *policy, rpki *rpkiValidator) *RIB {
+	return &RIB{
+		routes: make(map[RouteKey]*netlink.Route),
+		tables: make(map[netip.Prefix]int),
+		counts: newRouteCounts(),
+		filter: filter,
+		policy: policy,
+		rpki:   rpki,
+
+		verdicts: newVerdicts(),
+	}
+}
+
+// build maps every prefix in paths to the route it should have, or to nil
+// when the prefix was withdrawn or is rejected, without changing the RIB.
+// When a prefix appears several times, the last path wins.
+func (r *RIB) build(paths []*apipb.Path) map[RouteKey]*netlink.Route {
+	desiredRoutes := make(map[RouteKey]*netlink.Route)
+	placed := make(map[netip.Prefix]RouteKey)
+
+	for _, path := range paths {
+		op := createRouteFromPath(path)
+		if op == nil {
+			continue
+		}
+
+		route := r.admit(path, op)
+		key := keyOf(op.route)
+		if previous, ok := placed[key.Dst]; ok && previous != key {
+			delete(desiredRoutes, previous)
+		}
+		placed[key.Dst] = key
+		desiredRoutes[key] = route
+	}
+
+	return desiredRoutes
+}
+
+// admit adjusts the route of path as the filter, the policy and the RPKI
+// validation require, then pins its table, fills in the attributes of the
+// table and renumbers it for the namespace. It returns nil when the route
+// is not installed.
+func (r *RIB) admit(path *apipb.Path, op *routeOperation) *netlink.Route {
+	state := r.rpki.observe(path, op.prefix)
+	var v verdict
+	accepted := !path.IsWithdraw && r.check(path, op, state, &v)
+	r.verdicts.record(op.prefix, v, r.filter)
+	if r.table != 0 {
+		op.route.Table = r.table
+	}
+	if accepted {
+		r.defaults.fill(op.route)
+	}
+	if r.table == 0 {
+		op.route.Table = r.tableMap.table(op.route.Table)
+	}
+	if !accepted {
+		return nil
+	}
+	return op.route
+}
+
+// check runs the filter, the policy and the RPKI validation on the route of
+// path, recording their verdict in v, and refuses unicast routes through a
+// link-local next hop. It reports whether the route passed.
+func (r *RIB) check(path *apipb.Path, op *routeOperation, state pathattr.ValidationState, v *verdict) bool {
+	if v.filtered = r.filter.evaluate(op.prefix); v.filtered != "" {
+		return false
+	}
+	if !r.policy.apply(path, op.route, v) {
+		return false
+	}
+	if v.rpkiRejected = !r.rpki.apply(state, op.route); v.rpkiRejected {
+		return false
+	}
+	// Routes that drop traffic need no next hop.
+	v.linkLocal = op.linkLocal && op.route.Type == unix.RTN_UNICAST
+	return !v.linkLocal
+}
+
+// Apply merges a batch of paths into the RIB, adding announced prefixes and
+// removing withdrawn or rejected ones. It returns the changes it made, with
+// a nil route for every removed key.
+func (r *RIB) Apply(paths []*apipb.Path) map[RouteKey]*netlink.Route {
+	changes := r.build(paths)
+	r.update(changes)
+	return changes
+}
+
+// update applies changes, where a nil route removes the prefix, and returns
+// the routes the changed keys held before. Changes are first relocated to
+// the tables their prefixes occupy.
+func (r *RIB) update(changes map[RouteKey]*netlink.Route) map[RouteKey]*netlink.Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.relocate(changes)
+	previous := make(map[RouteKey]*netlink.Route, len(changes))
+	for key, route := range changes {
+		old, ok := r.routes[key]
+		previous[key] = old
+		if ok {
+			r.counts.add(key, -1)
+		}
+		if route == nil {
+			delete(r.routes, key)
+			if r.tables[key.Dst] == key.Table {
+				delete(r.tables, key.Dst)
+			}
+			continue
+		}
+		r.routes[key] = route
+		r.tables[key.Dst] = key.Table
+		r.counts.add(key, 1)
+	}
+	return previous
+}
+
+// relocate retargets changes at the table each prefix occupies: a removal
+// applies to that table, and a route placed in another table also removes
+// the prefix from the old one. Callers must hold r.mu.
+func (r *RIB) relocate(changes map[RouteKey]*netlink.Route) {
+	var moved []RouteKey
+	for key, route := range changes {
+		table, ok := r.tables[key.Dst]
+		if !ok || table == key.Table {
+			continue
+		}
+		if route == nil {
+			delete(changes, key)
+		}
+		moved = append(moved, RouteKey{Table: table, Dst: key.Dst})
+	}
+	for _, key := range moved {
+		if _, ok := changes[key]; !ok {
+			changes[key] = nil
+		}
+	}
+}
+
+// Replace discards the content of the RIB and rebuilds it from paths.
+func (r *RIB) Replace(paths []*apipb.Path) {
+	r.rpki.reset()
+	routes := make(map[RouteKey]*netlink.Route)
+	tables := make(map[netip.Prefix]int)
+	counts := newRouteCounts()
+	built := r.build(paths)
+	seen := make(map[netip.Prefix]bool, len(built))
+	for key, route := range built {
+		seen[key.Dst] = true
+		if route != nil {
+			routes[key] = route
+			tables[key.Dst] = key.Table
+			counts.add(key, 1)
+		}
+	}
+	r.verdicts.retain(seen)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.routes = routes
+	r.tables = tables
+	r.counts = counts
+}
+
+// Get returns the desired route for key, if any.
+func (r *RIB) Get(key RouteKey) (*netlink.Route, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	route, ok := r.routes[key]
+	return route, ok
+}
+
+// lookup returns the desired route of every key, with a nil route for the
+// keys the RIB does not hold.
+func (r *RIB) lookup(keys []RouteKey) map[RouteKey]*netlink.Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	routes := make(map[RouteKey]*netlink.Route, len(keys))
+	for _, key := range keys {
+		routes[key] = r.routes[key]
+	}
+	return routes
+}
+
+// Snapshot returns a copy of the desired routes.
+func (r *RIB) Snapshot() map[RouteKey]*netlink.Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snapshot := make(map[RouteKey]*netlink.Route, len(r.routes))
+	for key, route := range r.routes {
+		snapshot[key] = route
+	}
+	return snapshot
+}
+
+// Len returns the number of desired routes.
+func (r *RIB) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.routes)
+}
+
+// Counts returns the number of desired routes per family and table.
+func (r *RIB) Counts() RouteCounts {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := newRouteCounts()
+	for family, n := range r.counts.Families {
+		counts.Families[family] = n
+	}
+	for table, n := range r.counts.Tables {
+		counts.Tables[table] = n
+	}
+	return counts
+}
@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func newTestPath(t *testing.T, prefix string, length uint32, withdraw bool) *apipb.Path {
+	t.Helper()
+	nlri, err := anypb.New(&apipb.IPAddressPrefix{Prefix: prefix, PrefixLen: length})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apipb.Path{Family: unicastFamily(prefix), Nlri: nlri, IsWithdraw: withdraw}
+}
+
+func unicastFamily(prefix string) *apipb.Family {
+	if strings.Contains(prefix, ":") {
+		return &apipb.Family{Afi: apipb.Family_AFI_IP6, Safi: apipb.Family_SAFI_UNICAST}
+	}
+	return &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST}
+}
+
+func TestRIBApply(t *testing.T) {
+	rib := NewRIB()
+
+	rib.Apply([]*apipb.Path{
+		newTestPath(t, "192.0.2.0", 24, false),
+		newTestPath(t, "2001:db8::", 32, false),
+	})
+	assert.Equal(t, 2, rib.Len())
+
+	route, ok := rib.Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+	assert.True(t, ok)
+	assert.Equal(t, RouteProtocol, route.Protocol)
+
+	rib.Apply([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, true)})
+	_, ok = rib.Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+	assert.False(t, ok)
+	assert.Equal(t, 1, rib.Len())
+}
+
+func TestRIBSnapshotIsCopy(t *testing.T) {
+	rib := NewRIB()
+	rib.Apply([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, false)})
+
+	snapshot := rib.Snapshot()
+	delete(snapshot, RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+
+	assert.Equal(t, 1, rib.Len())
+}
@@ -0,0 +1,247 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+)
+
+// rpkiValidator applies the RPKI origin validation state GoBGP attaches to
+// paths. GoBGP only validates the paths it lists: the paths of watch events
+// carry no state, so the state last listed for a prefix stands until the
+// next revalidation.
+type rpkiValidator struct {
+	rejectInvalid  bool
+	notFoundMetric int
+
+	mu     sync.Mutex
+	states map[netip.Prefix]pathattr.ValidationState
+	// servers holds the RPKI servers of GoBGP as last polled, nil before
+	// the first poll.
+	servers map[string]rpkiServer
+}
+
+// rpkiServer is the part of the state of a GoBGP RPKI server that changes
+// with the ROAs it serves.
+type rpkiServer struct {
+	up       bool
+	serial   uint32
+	records  [2]uint32
+	prefixes [2]uint32
+}
+
+// newRPKIValidator returns nil when RPKI handling is disabled.
+func newRPKIValidator(cfg config.RPKI) *rpkiValidator {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &rpkiValidator{
+		rejectInvalid:  cfg.RejectInvalid,
+		notFoundMetric: cfg.NotFoundMetric,
+		states:         make(map[netip.Prefix]pathattr.ValidationState),
+	}
+}
+
+// observe records the validation state of path and returns the state that
+// applies to prefix. Withdrawn paths forget the prefix.
+func (v *rpkiValidator) observe(path *apipb.Path, prefix netip.Prefix) pathattr.ValidationState {
+	if v == nil {
+		return pathattr.ValidationNone
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if path.IsWithdraw {
+		delete(v.states, prefix)
+		return pathattr.ValidationNone
+	}
+	state := pathattr.ValidationState(path.GetValidation().GetState())
+	if state == pathattr.ValidationNone {
+		return v.states[prefix]
+	}
+	v.states[prefix] = state
+	return state
+}
+
+// apply refuses invalid routes and raises the metric of routes no ROA
+// covers, as configured. It reports false when the route is refused.
+func (v *rpkiValidator) apply(state pathattr.ValidationState, route *netlink.Route) bool {
+	if v == nil {
+		return true
+	}
+	switch {
+	case state == pathattr.ValidationInvalid && v.rejectInvalid:
+		return false
+	case state == pathattr.ValidationNotFound:
+		route.Priority += v.notFoundMetric
+	}
+	return true
+}
+
+// changed returns the paths whose validation state differs from the state
+// last seen for their prefix.
+func (v *rpkiValidator) changed(paths []*apipb.Path) []*apipb.Path {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var changed []*apipb.Path
+	for _, path := range paths {
+		prefix, err := pathattr.DecodePrefix(path.GetNlri())
+		if err != nil {
+			continue
+		}
+		state := pathattr.ValidationState(path.GetValidation().GetState())
+		if state != pathattr.ValidationNone && state != v.states[prefix] {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// serversChanged records servers and reports whether they differ from the
+// servers last recorded. The first servers are only recorded.
+func (v *rpkiValidator) serversChanged(servers map[string]rpkiServer) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	changed := v.servers != nil && !maps.Equal(v.servers, servers)
+	v.servers = servers
+	return changed
+}
+
+// listRPKIServers returns the state of the RPKI servers of GoBGP by
+// address.
+func listRPKIServers(ctx context.Context, client apipb.GobgpApiClient) (map[string]rpkiServer, error) {
+	stream, err := client.ListRpki(ctx, &apipb.ListRpkiRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list RPKI servers: %w", err)
+	}
+	servers := make(map[string]rpkiServer)
+	err = receiveAll(stream, func(resp *apipb.ListRpkiResponse) {
+		conf, state := resp.GetServer().GetConf(), resp.GetServer().GetState()
+		servers[net.JoinHostPort(conf.GetAddress(), strconv.Itoa(int(conf.GetRemotePort())))] = rpkiServer{
+			up:       state.GetUp(),
+			serial:   state.GetSerial(),
+			records:  [2]uint32{state.GetRecordIpv4(), state.GetRecordIpv6()},
+			prefixes: [2]uint32{state.GetPrefixIpv4(), state.GetPrefixIpv6()},
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list RPKI servers: %w", err)
+	}
+	return servers, nil
+}
+
+// reset forgets every state, before the RIB is rebuilt from scratch.
+func (v *rpkiValidator) reset() {
+	if v == nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.states = make(map[netip.Prefix]pathattr.ValidationState)
+}
+
+// status counts the prefixes per validation state.
+func (v *rpkiValidator) status() map[string]int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, state := range v.states {
+		counts[state.String()]++
+	}
+	return counts
+}
+
+// Revalidate fetches the source paths, with their validation state, from
+// GoBGP and rebuilds the RIB from them as Reconcile does. Fetching resets
+// the source, so the RIB has to follow it in full: applying only the paths
+// whose state changed would lose the withdrawals still queued in the watch.
+func (m *Manager) Revalidate(ctx context.Context, client apipb.GobgpApiClient) error {
+	m.programming.Lock()
+	defer m.programming.Unlock()
+
+	paths, err := m.source.Fetch(ctx, client)
+	if err != nil {
+		return err
+	}
+	if changed := m.rib.rpki.changed(paths); len(changed) > 0 {
+		log.Printf("RPKI validation state changed for %d prefixes", len(changed))
+	}
+	return m.rebuild(paths)
+}
+
+// RevalidateOnChange polls the RPKI servers of GoBGP and calls Revalidate
+// when their ROAs changed since the last poll. The first poll only records
+// the servers.
+func (m *Manager) RevalidateOnChange(ctx context.Context, client apipb.GobgpApiClient) error {
+	servers, err := listRPKIServers(ctx, client)
+	if err != nil {
+		return err
+	}
+	if !m.rib.rpki.serversChanged(servers) {
+		return nil
+	}
+	log.Printf("RPKI servers changed, revalidating the %s", m.scope)
+	return m.Revalidate(ctx, client)
+}
+
+// RunRevalidator polls the RPKI servers every cfg.PollInterval, revalidating
+// when their ROAs change, and calls Revalidate every cfg.RevalidateInterval,
+// until ctx is cancelled. A zero interval disables its part. It returns at
+// once when RPKI handling is disabled.
+func (m *Manager) RunRevalidator(ctx context.Context, client apipb.GobgpApiClient, cfg config.RPKI) {
+	if m.rib.rpki == nil || (cfg.PollInterval <= 0 && cfg.RevalidateInterval <= 0) {
+		return
+	}
+
+	poll, stopPoll := tick(cfg.PollInterval)
+	defer stopPoll()
+	revalidate, stopRevalidate := tick(cfg.RevalidateInterval)
+	defer stopRevalidate()
+	if cfg.PollInterval > 0 {
+		logRevalidation(m.RevalidateOnChange(ctx, client))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll:
+			logRevalidation(m.RevalidateOnChange(ctx, client))
+		case <-revalidate:
+			logRevalidation(m.Revalidate(ctx, client))
+		}
+	}
+}
+
+func logRevalidation(err error) {
+	if err != nil {
+		log.Printf("RPKI revalidation failed: %v", err)
+	}
+}
+
+// tick returns the channel of a ticker of interval and the function that
+// stops it. The channel of a zero interval never delivers.
+func tick(interval time.Duration) (<-chan time.Time, func()) {
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
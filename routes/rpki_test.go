@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func newValidatedPath(t *testing.T, prefix string, length uint32, state apipb.Validation_State) *apipb.Path {
+	t.Helper()
+	path := newTestPath(t, prefix, length, false)
+	path.Best = true
+	path.Validation = &apipb.Validation{State: state}
+	return path
+}
+
+func TestRPKIValidator(t *testing.T) {
+	v := newRPKIValidator(config.RPKI{Enabled: true, RejectInvalid: true, NotFoundMetric: 500})
+	rib := newRIB(nil, nil, v)
+	key := RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}
+
+	rib.Apply([]*apipb.Path{newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_NOT_FOUND)})
+	route, ok := rib.Get(key)
+	require.True(t, ok)
+	assert.Equal(t, 500, route.Priority)
+
+	rib.Apply([]*apipb.Path{newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_VALID)})
+	route, ok = rib.Get(key)
+	require.True(t, ok)
+	assert.Equal(t, 0, route.Priority)
+
+	rib.Apply([]*apipb.Path{newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_INVALID)})
+	_, ok = rib.Get(key)
+	assert.False(t, ok)
+
+	// Watch events carry no state: the state last listed still applies.
+	rib.Apply([]*apipb.Path{newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_NONE)})
+	_, ok = rib.Get(key)
+	assert.False(t, ok)
+
+	rib.Apply([]*apipb.Path{newValidatedPath(t, "198.51.100.0", 24, apipb.Validation_STATE_VALID)})
+	assert.Equal(t, map[string]int{"invalid": 1, "valid": 1}, v.status())
+
+	rib.Apply([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, true)})
+	assert.Equal(t, map[string]int{"valid": 1}, v.status())
+}
+
+func TestRPKIValidatorKeepsInvalid(t *testing.T) {
+	rib := newRIB(nil, nil, newRPKIValidator(config.RPKI{Enabled: true}))
+
+	rib.Apply([]*apipb.Path{newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_INVALID)})
+	_, ok := rib.Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+	assert.True(t, ok)
+
+	assert.Nil(t, newRPKIValidator(config.RPKI{RejectInvalid: true}))
+}
+
+func TestRevalidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.RPKI.Enabled = true
+	m, err := newManager(cfg, []routeWriter{newFakeKernel()})
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+
+	key := RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}
+	require.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{
+		newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_VALID),
+	}))
+	_, ok := m.RIB().Get(key)
+	require.True(t, ok)
+
+	listed := func(state apipb.Validation_State) *MockGobgpAPIClient {
+		stream := new(MockListPathClient)
+		stream.On("Recv").Return(&apipb.ListPathResponse{Destination: &apipb.Destination{
+			Paths: []*apipb.Path{newValidatedPath(t, "192.0.2.0", 24, state)},
+		}}, nil).Once()
+		stream.On("Recv").Return((*apipb.ListPathResponse)(nil), io.EOF)
+		client := new(MockGobgpAPIClient)
+		client.On("ListPath", mock.Anything, mock.Anything).Return(stream, nil)
+		return client
+	}
+
+	require.NoError(t, m.Revalidate(context.Background(), listed(apipb.Validation_STATE_INVALID)))
+	_, ok = m.RIB().Get(key)
+	assert.False(t, ok, "a prefix that turned invalid must be removed")
+
+	assert.Empty(t, m.rib.rpki.changed([]*apipb.Path{
+		newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_INVALID),
+		newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_NONE),
+	}))
+
+	require.NoError(t, m.Revalidate(context.Background(), listed(apipb.Validation_STATE_VALID)))
+	_, ok = m.RIB().Get(key)
+	assert.True(t, ok, "a prefix that turned valid must be installed again")
+}
+
+func TestRevalidateOnChange(t *testing.T) {
+	cfg := config.Default()
+	cfg.RPKI.Enabled = true
+	m, err := newManager(cfg, []routeWriter{newFakeKernel()})
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+
+	key := RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")}
+	require.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{
+		newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_VALID),
+	}))
+
+	polled := func(serial uint32) *MockGobgpAPIClient {
+		client := new(MockGobgpAPIClient)
+		client.On("ListRpki", mock.Anything, mock.Anything).Return(newSliceStream(&apipb.ListRpkiResponse{
+			Server: &apipb.Rpki{
+				Conf:  &apipb.RPKIConf{Address: "192.0.2.10", RemotePort: 323},
+				State: &apipb.RPKIState{Up: true, Serial: serial, RecordIpv4: 100},
+			},
+		}), nil)
+		client.On("ListPath", mock.Anything, mock.Anything).Return(newSliceStream(&apipb.ListPathResponse{
+			Destination: &apipb.Destination{
+				Paths: []*apipb.Path{newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_INVALID)},
+			},
+		}), nil)
+		return client
+	}
+
+	for _, client := range []*MockGobgpAPIClient{polled(1), polled(1)} {
+		require.NoError(t, m.RevalidateOnChange(context.Background(), client))
+		client.AssertNotCalled(t, "ListPath", mock.Anything, mock.Anything)
+	}
+	_, ok := m.RIB().Get(key)
+	require.True(t, ok, "the first poll and unchanged servers revalidate nothing")
+
+	client := polled(2)
+	require.NoError(t, m.RevalidateOnChange(context.Background(), client))
+	client.AssertCalled(t, "ListPath", mock.Anything, mock.Anything)
+	_, ok = m.RIB().Get(key)
+	assert.False(t, ok, "new ROAs revalidate the paths")
+}
+
+func TestRevalidateFollowsWithdrawals(t *testing.T) {
+	cfg := config.Default()
+	cfg.RPKI.Enabled = true
+	m, err := newManager(cfg, []routeWriter{newFakeKernel()})
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+
+	withdrawn := newValidatedPath(t, "192.0.2.0", 24, apipb.Validation_STATE_VALID)
+	kept := newValidatedPath(t, "198.51.100.0", 24, apipb.Validation_STATE_VALID)
+	require.NoError(t, m.UpdateLocalRoutes(m.Source().Select([]*apipb.Path{withdrawn, kept})))
+
+	// GoBGP no longer lists the withdrawn path, whose withdrawal is still
+	// queued in the watch.
+	client := new(MockGobgpAPIClient)
+	client.On("ListPath", mock.Anything, mock.Anything).Return(newSliceStream(&apipb.ListPathResponse{
+		Destination: &apipb.Destination{Paths: []*apipb.Path{kept}},
+	}), nil)
+	require.NoError(t, m.Revalidate(context.Background(), client))
+	require.NoError(t, m.UpdateLocalRoutes(m.Source().Select([]*apipb.Path{
+		newTestPath(t, "192.0.2.0", 24, true),
+	})))
+
+	_, ok := m.RIB().Get(RouteKey{Table: unix.RT_TABLE_MAIN, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+	assert.False(t, ok, "the withdrawn prefix must be removed")
+	assert.Equal(t, 1, m.RIB().Len())
+}
@@ -0,0 +1,380 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ruleWriter is the subset of netlink.Handle used to program ip rules.
+type ruleWriter interface {
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleList(family int) ([]netlink.Rule, error)
+	Close()
+}
+
+// RuleKey identifies an ip rule: traffic from Src looks up Table. A
+// non-zero Mask restricts the rule to packets whose firewall mark, under
+// Mask, equals Mark.
+type RuleKey struct {
+	Priority int
+	Src      netip.Prefix
+	Mark     uint32
+	Mask     uint32
+	Table    int
+}
+
+func (k RuleKey) String() string {
+	if k.Mask == 0 {
+		return fmt.Sprintf("%d: from %s lookup %d", k.Priority, k.Src, k.Table)
+	}
+	return fmt.Sprintf("%d: from %s fwmark %#x/%#x lookup %d", k.Priority, k.Src, k.Mark, k.Mask, k.Table)
+}
+
+// rule returns the netlink rule of k, tagged as owned by bgtables.
+func (k RuleKey) rule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = familyOf(k.Src)
+	rule.Priority = k.Priority
+	rule.Src = ipNetOf(k.Src)
+	rule.Table = k.Table
+	rule.Protocol = uint8(RouteProtocol)
+	if k.Mask != 0 {
+		mask := k.Mask
+		rule.Mark = k.Mark
+		rule.Mask = &mask
+	}
+	return rule
+}
+
+// ownedRuleKey returns the key of a kernel rule, and whether bgtables owns
+// it.
+func ownedRuleKey(rule *netlink.Rule) (RuleKey, bool) {
+	if rule.Protocol != uint8(RouteProtocol) {
+		return RuleKey{}, false
+	}
+	key := RuleKey{
+		Priority: rule.Priority,
+		Src:      netPrefix(rule.Src, rule.Family),
+		Mark:     rule.Mark,
+		Table:    rule.Table,
+	}
+	if rule.Mask != nil {
+		key.Mask = *rule.Mask
+	}
+	return key, key.Src.IsValid()
+}
+
+// ruleSet maintains the ip rules derived from the admitted routes: a prefix
+// yields at most one rule, from the first configured rule its path matches,
+// once its route passed the filter, the policy, the RPKI validation, the
+// protection and the dampening. Owned rules carry the bgp protocol, so
+// rules left behind by an earlier run or configuration are removed on
+// reconciliation.
+type ruleSet struct {
+	templates []*ruleTemplate
+	writer    ruleWriter
+
+	mu sync.Mutex
+	// matched holds the template the path of each prefix matched, and
+	// desired the rules of the matched prefixes whose routes are admitted.
+	matched map[netip.Prefix]*ruleTemplate
+	desired map[netip.Prefix]RuleKey
+}
+
+type ruleTemplate struct {
+	name     string
+	match    *pathMatch
+	priority int
+	table    int
+	mark     uint32
+	mask     uint32
+	hits     atomic.Int64
+}
+
+// newRuleSet compiles cfg. It returns nil without a writer.
+func newRuleSet(cfg []config.Rule, writer ruleWriter) (*ruleSet, error) {
+	if writer == nil {
+		return nil, nil
+	}
+
+	s := &ruleSet{
+		writer:  writer,
+		matched: make(map[netip.Prefix]*ruleTemplate),
+		desired: make(map[netip.Prefix]RuleKey),
+	}
+	for i, rule := range cfg {
+		match, err := compileMatch(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %d %q: %w", i, rule.Name, err)
+		}
+		mask := rule.Mask
+		if mask == 0 && rule.Mark != 0 {
+			mask = ^uint32(0)
+		}
+		s.templates = append(s.templates, &ruleTemplate{
+			name: rule.Name, match: match, priority: rule.Priority, table: rule.Table, mark: rule.Mark, mask: mask,
+		})
+	}
+	return s, nil
+}
+
+func (t *ruleTemplate) key(prefix netip.Prefix) RuleKey {
+	return RuleKey{Priority: t.priority, Src: prefix, Mark: t.mark, Mask: t.mask, Table: t.table}
+}
+
+// observe records the templates the prefixes of paths match. The rules
+// follow once admit learns whether their routes are admitted.
+func (s *ruleSet) observe(paths []*apipb.Path) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, path := range paths {
+		prefix, ok := unicastPrefix(path)
+		if !ok {
+			continue
+		}
+		if t := s.count(s.matched[prefix], s.templateFor(path, prefix)); t != nil {
+			s.matched[prefix] = t
+		} else {
+			delete(s.matched, prefix)
+		}
+	}
+}
+
+// replace rebuilds the matched templates from paths, ahead of a
+// reconciliation.
+func (s *ruleSet) replace(paths []*apipb.Path) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matched := make(map[netip.Prefix]*ruleTemplate)
+	for _, path := range paths {
+		prefix, ok := unicastPrefix(path)
+		if !ok {
+			continue
+		}
+		if t := s.count(s.matched[prefix], s.templateFor(path, prefix)); t != nil {
+			matched[prefix] = t
+		}
+	}
+	s.matched = matched
+}
+
+// count counts a match of t when a prefix moves to it from old, so that a
+// prefix counts once however often its path is seen. It returns t.
+func (s *ruleSet) count(old, t *ruleTemplate) *ruleTemplate {
+	if t != nil && t != old {
+		t.hits.Add(1)
+	}
+	return t
+}
+
+// templateFor returns the template path matches for prefix, if any.
+func (s *ruleSet) templateFor(path *apipb.Path, prefix netip.Prefix) *ruleTemplate {
+	if path.IsWithdraw || len(s.templates) == 0 {
+		return nil
+	}
+	attrs, err := pathattr.Decode(path)
+	if err != nil {
+		log.Printf("Not deriving rules from %s: %v", prefix, err)
+		return nil
+	}
+	for _, t := range s.templates {
+		if t.match.matches(attrs) {
+			return t
+		}
+	}
+	return nil
+}
+
+// admit updates the rules of the prefixes of routes, the routes as they go
+// to the kernel, and programs the difference at once. A prefix is admitted
+// when one of its routes is not nil.
+func (s *ruleSet) admit(routes map[RouteKey]*netlink.Route) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for prefix, admitted := range admittedPrefixes(routes) {
+		s.update(prefix, admitted)
+	}
+}
+
+// admitAll is admit for routes holding every admitted route: the rules of
+// the other prefixes are removed.
+func (s *ruleSet) admitAll(routes map[RouteKey]*netlink.Route) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	admitted := admittedPrefixes(routes)
+	for prefix := range s.desired {
+		if _, ok := admitted[prefix]; !ok {
+			admitted[prefix] = false
+		}
+	}
+	for prefix, ok := range admitted {
+		s.update(prefix, ok)
+	}
+}
+
+func admittedPrefixes(routes map[RouteKey]*netlink.Route) map[netip.Prefix]bool {
+	admitted := make(map[netip.Prefix]bool, len(routes))
+	for key, route := range routes {
+		admitted[key.Dst] = admitted[key.Dst] || route != nil
+	}
+	return admitted
+}
+
+// update brings the rule of prefix in line with its template and whether
+// its route is admitted. Callers must hold s.mu.
+func (s *ruleSet) update(prefix netip.Prefix, admitted bool) {
+	t := s.matched[prefix]
+	ok := admitted && t != nil
+	var key RuleKey
+	if ok {
+		key = t.key(prefix)
+	}
+
+	old, had := s.desired[prefix]
+	switch {
+	case had && ok && old == key:
+		return
+	case had:
+		delete(s.desired, prefix)
+		s.remove(old)
+	}
+	if ok {
+		s.desired[prefix] = key
+		s.install(key)
+	}
+}
+
+// reconcile lists the owned rules in the kernel, removes those that are not
+// desired and installs the missing ones.
+func (s *ruleSet) reconcile() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.listOwned()
+	if err != nil {
+		return err
+	}
+	s.sync(existing)
+	return nil
+}
+
+// listOwned returns the keys of the owned rules in the kernel.
+func (s *ruleSet) listOwned() (map[RuleKey]bool, error) {
+	rules, err := s.writer.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules: %w", err)
+	}
+	owned := make(map[RuleKey]bool)
+	for i := range rules {
+		if key, ok := ownedRuleKey(&rules[i]); ok {
+			owned[key] = true
+		}
+	}
+	return owned, nil
+}
+
+// sync brings the existing owned rules in line with the desired ones.
+// Callers must hold s.mu.
+func (s *ruleSet) sync(existing map[RuleKey]bool) {
+	desired := make(map[RuleKey]bool, len(s.desired))
+	for _, key := range s.desired {
+		desired[key] = true
+	}
+	for key := range desired {
+		if !existing[key] {
+			s.install(key)
+		}
+	}
+	for key := range existing {
+		if !desired[key] {
+			s.remove(key)
+		}
+	}
+}
+
+// install adds the rule of key. Callers must hold s.mu.
+func (s *ruleSet) install(key RuleKey) {
+	err := s.writer.RuleAdd(key.rule())
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		Metrics.Add(metricRuleFailures, 1)
+		log.Printf("Failed to add rule %s: %v", key, err)
+	}
+}
+
+// remove deletes the rule of key. Callers must hold s.mu.
+func (s *ruleSet) remove(key RuleKey) {
+	err := s.writer.RuleDel(key.rule())
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		Metrics.Add(metricRuleFailures, 1)
+		log.Printf("Failed to delete rule %s: %v", key, err)
+	}
+}
+
+func (s *ruleSet) close() {
+	if s != nil {
+		s.writer.Close()
+	}
+}
+
+// status reports how often each configured rule matched, and the number of
+// desired rules.
+func (s *ruleSet) status() RuleSetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := RuleSetStatus{Desired: len(s.desired)}
+	for _, t := range s.templates {
+		status.Rules = append(status.Rules, PolicyRuleStatus{Name: t.name, Matches: t.hits.Load()})
+	}
+	return status
+}
+
+// RuleSetStatus reports the ip rules derived from paths.
+type RuleSetStatus struct {
+	Desired int                `json:"desired"`
+	Rules   []PolicyRuleStatus `json:"rules"`
+}
+
+// unicastPrefix returns the prefix of an IP unicast path.
+func unicastPrefix(path *apipb.Path) (netip.Prefix, bool) {
+	nlri, err := nlriRegistry.DecodePath(path)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return installablePrefix(nlri)
+}
@@ -0,0 +1,185 @@
+package routes
+
+import (
+	"errors"
+	"expvar"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func newCommunityPath(t *testing.T, prefix string, length uint32, communities ...uint32) *apipb.Path {
+	t.Helper()
+	path := newTestPath(t, prefix, length, false)
+	attr, err := anypb.New(&apipb.CommunitiesAttribute{Communities: communities})
+	require.NoError(t, err)
+	path.Pattrs = []*anypb.Any{attr}
+	return path
+}
+
+func newTestRuleSet(t *testing.T, writer ruleWriter) *ruleSet {
+	t.Helper()
+	s, err := newRuleSet([]config.Rule{
+		{Name: "upstream-a", Match: config.PolicyMatch{Communities: []string{"65000:100"}}, Priority: 1000, Table: 100},
+		{Name: "marked", Match: config.PolicyMatch{Communities: []string{"65000:200"}}, Priority: 1001, Table: 200,
+			Mark: 0x10},
+	}, writer)
+	require.NoError(t, err)
+	return s
+}
+
+func TestRuleKey(t *testing.T) {
+	key := RuleKey{Priority: 1000, Src: netip.MustParsePrefix("2001:db8::/32"), Mark: 0x10, Mask: 0xff, Table: 100}
+	rule := key.rule()
+	assert.Equal(t, netlink.FAMILY_V6, rule.Family)
+
+	owned, ok := ownedRuleKey(rule)
+	assert.True(t, ok)
+	assert.Equal(t, key, owned)
+	assert.Equal(t, "1000: from 2001:db8::/32 fwmark 0x10/0xff lookup 100", key.String())
+
+	rule.Protocol = unix.RTPROT_BOOT
+	_, ok = ownedRuleKey(rule)
+	assert.False(t, ok)
+}
+
+// admitted returns the routes of prefixes as gated for the kernel, where a
+// prefix with a trailing "!" is not admitted.
+func admitted(prefixes ...string) map[RouteKey]*netlink.Route {
+	routes := make(map[RouteKey]*netlink.Route, len(prefixes))
+	for _, prefix := range prefixes {
+		op := testOp(strings.TrimSuffix(prefix, "!"), opReplace, false)
+		routes[op.key] = op.route
+		if strings.HasSuffix(prefix, "!") {
+			routes[op.key] = nil
+		}
+	}
+	return routes
+}
+
+func TestRuleSetAdmit(t *testing.T) {
+	writer := newFakeKernel()
+	s := newTestRuleSet(t, writer)
+
+	s.observe([]*apipb.Path{
+		newCommunityPath(t, "192.0.2.0", 24, 65000<<16|100),
+		newCommunityPath(t, "198.51.100.0", 24, 65000<<16|200),
+		newCommunityPath(t, "203.0.113.0", 24, 65000<<16|300),
+	})
+	assert.Empty(t, writer.ruleKeys(), "rules wait for their routes to be admitted")
+
+	s.admit(admitted("192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"))
+	assert.Equal(t, []string{
+		"1000: from 192.0.2.0/24 lookup 100",
+		"1001: from 198.51.100.0/24 fwmark 0x10/0xffffffff lookup 200",
+	}, writer.ruleKeys())
+
+	s.observe([]*apipb.Path{
+		newCommunityPath(t, "192.0.2.0", 24, 65000<<16|200),
+		newCommunityPath(t, "198.51.100.0", 24, 65000<<16|200),
+	})
+	s.admit(admitted("192.0.2.0/24", "198.51.100.0/24!"))
+	assert.Equal(t, []string{"1001: from 192.0.2.0/24 fwmark 0x10/0xffffffff lookup 200"}, writer.ruleKeys())
+	assert.Equal(t, RuleSetStatus{Desired: 1, Rules: []PolicyRuleStatus{
+		{Name: "upstream-a", Matches: 1},
+		{Name: "marked", Matches: 2},
+	}}, s.status(), "a prefix that keeps its match counts once")
+
+	s.admitAll(admitted())
+	assert.Empty(t, writer.ruleKeys())
+}
+
+func TestRulesFollowAdmittedRoutes(t *testing.T) {
+	kernel := newFakeKernel()
+	m := newTestManager(t, kernel)
+	m.rules = newTestRuleSet(t, kernel)
+	var err error
+	m.protector, err = newProtector(config.Protection{Prefixes: []string{"10.0.1.0/24"}}, "", nil)
+	require.NoError(t, err)
+
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{
+		newCommunityPath(t, "10.0.0.0", 24, 65000<<16|100),
+		newCommunityPath(t, "10.0.1.0", 24, 65000<<16|100),
+	}))
+	m.Wait()
+	assert.Equal(t, []string{"1000: from 10.0.0.0/24 lookup 100"}, kernel.ruleKeys(), "protected prefixes yield no rule")
+
+	m.rib.filter = newTestFilter(t, config.Filter{
+		Prefixes: []config.PrefixRule{{Prefix: "10.0.0.0/8", GE: 24, Action: config.ActionDeny}},
+	})
+	assert.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newCommunityPath(t, "10.0.0.0", 24, 65000<<16|100)}))
+	m.Wait()
+	assert.Empty(t, kernel.ruleKeys(), "filtered prefixes lose their rule")
+}
+
+func TestRuleSetReconcile(t *testing.T) {
+	writer := newFakeKernel()
+	foreign := RuleKey{Priority: 1000, Src: netip.MustParsePrefix("10.0.0.0/8"), Table: 100}.rule()
+	foreign.Protocol = unix.RTPROT_BOOT
+	stale := RuleKey{Priority: 1000, Src: netip.MustParsePrefix("172.16.0.0/12"), Table: 100}.rule()
+	for _, rule := range []*netlink.Rule{foreign, stale} {
+		require.NoError(t, writer.RuleAdd(rule))
+	}
+
+	s := newTestRuleSet(t, writer)
+	s.replace([]*apipb.Path{newCommunityPath(t, "192.0.2.0", 24, 65000<<16|100)})
+	s.admitAll(admitted("192.0.2.0/24"))
+	require.NoError(t, s.reconcile())
+	assert.Equal(t, []string{
+		"1000: from 10.0.0.0/8 lookup 100",
+		"1000: from 192.0.2.0/24 lookup 100",
+	}, writer.ruleKeys(), "stale owned rules are removed and foreign rules kept")
+	assert.Equal(t, unix.RTPROT_BOOT, int(writer.rules[fakeRuleKey(foreign)].Protocol))
+
+	s.observe([]*apipb.Path{newCommunityPath(t, "192.0.2.0", 24, 65000<<16|100)})
+	s.admit(admitted("192.0.2.0/24"))
+	require.NoError(t, s.reconcile())
+	assert.Len(t, writer.ruleKeys(), 2)
+}
+
+func TestRuleSetInjectedErrors(t *testing.T) {
+	kernel := newFakeKernel()
+	s := newTestRuleSet(t, kernel)
+	failures := func() int64 {
+		v, _ := Metrics.Get(metricRuleFailures).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	before := failures()
+
+	kernel.fail("192.0.2.0/24", unix.EEXIST)
+	kernel.fail("198.51.100.0/24", unix.EPERM)
+	s.observe([]*apipb.Path{
+		newCommunityPath(t, "192.0.2.0", 24, 65000<<16|100),
+		newCommunityPath(t, "198.51.100.0", 24, 65000<<16|100),
+	})
+	s.admit(admitted("192.0.2.0/24", "198.51.100.0/24"))
+	assert.Empty(t, kernel.deltas())
+	assert.Equal(t, before+1, failures(), "an existing rule is not a failure")
+
+	kernel.fail("198.51.100.0/24", nil)
+	require.NoError(t, s.reconcile())
+	assert.Equal(t, []string{"rule add 1000: from 198.51.100.0/24 lookup 100"}, kernel.deltas())
+}
+
+func TestRuleSetReconcileFailure(t *testing.T) {
+	kernel := newFakeKernel()
+	kernel.failList(errors.New("dump interrupted"))
+	s := newTestRuleSet(t, kernel)
+	assert.ErrorContains(t, s.reconcile(), "dump interrupted")
+
+	var disabled *ruleSet
+	assert.NoError(t, disabled.reconcile())
+	disabled.observe([]*apipb.Path{newCommunityPath(t, "192.0.2.0", 24, 65000<<16|100)})
+	disabled.admit(admitted("192.0.2.0/24"))
+}
@@ -0,0 +1,202 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Sink is a consumer of the routes of the RIB, such as the kernel. Routes
+// are programmed into a sink as deltas, and a sink lists the routes it
+// owns so that bgtables picks up where it left off after a restart. A Sink
+// must be safe for concurrent use.
+type Sink interface {
+	// Apply programs deltas in order and returns the result of each one.
+	Apply(deltas []RouteDelta) []error
+	// List returns the routes the sink owns.
+	List() ([]*netlink.Route, error)
+	// Close releases the resources of the sink.
+	Close()
+}
+
+// RouteDelta is a change to the routes of a sink: Route replaces the route
+// of Key, or is removed from the sink when Remove is set.
+type RouteDelta struct {
+	Key    RouteKey
+	Route  *netlink.Route
+	Remove bool
+}
+
+// routeNotifier is implemented by sinks that report the changes made to
+// their routes, including those made outside of bgtables.
+type routeNotifier interface {
+	Subscribe(updates chan<- netlink.RouteUpdate, done <-chan struct{}) error
+}
+
+// output is a sink with the cache of the routes it owns and the pipeline
+// that programs it.
+type output struct {
+	name     string
+	sink     Sink
+	cache    *KernelCache
+	pipeline *pipeline
+}
+
+func newOutput(name string, sink Sink, scope vrfScope, cfg config.Programming) *output {
+	cache := newScopedKernelCache(scope, sink)
+	return &output{name: name, sink: sink, cache: cache, pipeline: newPipeline(cache, cfg, sink)}
+}
+
+// newOutputs returns the outputs of the opened sinks of cfg.Sinks.
+func newOutputs(cfg config.Config, sinks []Sink, scope vrfScope) []*output {
+	outputs := make([]*output, len(sinks))
+	for i, sink := range sinks {
+		outputs[i] = newOutput(cfg.Sinks[i].Name, sink, scope, cfg.Programming)
+	}
+	return outputs
+}
+
+// close stops the pipeline of the output and releases its sink.
+func (o *output) close() {
+	o.pipeline.close()
+	o.sink.Close()
+}
+
+// SinkStatus reports the routes a sink owns and the operations still
+// queued for it.
+type SinkStatus struct {
+	Routes  int   `json:"routes"`
+	Pending int64 `json:"pending"`
+}
+
+func (o *output) status() SinkStatus {
+	return SinkStatus{Routes: o.cache.Len(), Pending: o.pipeline.pending.Value()}
+}
+
+// openSinks opens the sinks of cfg for scope, in order.
+func openSinks(cfg config.Config, scope vrfScope) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(cfg.Sinks))
+	for _, sinkCfg := range cfg.Sinks {
+		sink, err := openSink(sinkCfg, scope, cfg.Programming.Workers)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to open sink %q: %w", sinkCfg.Name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func openSink(cfg config.Sink, scope vrfScope, workers int) (Sink, error) {
+	if cfg.Type == config.SinkFile {
+		return newFileSink(scope.path(cfg.Path))
+	}
+	writers, err := newNetlinkWriters(scope.ns, workers)
+	if err != nil {
+		return nil, err
+	}
+	sink := newNetlinkSink(writers)
+	sink.ns = scope.ns
+	return sink, nil
+}
+
+func closeSinks(sinks []Sink) {
+	for _, sink := range sinks {
+		sink.Close()
+	}
+}
+
+// programsKernel reports whether the routes of cfg go to the kernel, whose
+// sink always comes first.
+func programsKernel(cfg config.Config) bool {
+	return len(cfg.Sinks) > 0 && cfg.Sinks[0].Type == config.SinkNetlink
+}
+
+// netlinkSink programs the kernel routing tables of a network namespace.
+// It holds a pool of netlink sockets, so that the workers of a pipeline
+// program routes in parallel.
+type netlinkSink struct {
+	writers []routeWriter
+	pool    chan routeWriter
+	ns      *namespace
+}
+
+func newNetlinkSink(writers []routeWriter) *netlinkSink {
+	s := &netlinkSink{writers: writers, pool: make(chan routeWriter, len(writers))}
+	for _, writer := range writers {
+		s.pool <- writer
+	}
+	return s
+}
+
+// Apply programs deltas over one of the sockets of the pool, with
+// multi-message requests when the socket supports them.
+func (s *netlinkSink) Apply(deltas []RouteDelta) []error {
+	writer := <-s.pool
+	defer func() { s.pool <- writer }()
+
+	if batcher, ok := writer.(routeBatcher); ok {
+		return batcher.RouteBatch(deltas)
+	}
+	errs := make([]error, len(deltas))
+	for i, delta := range deltas {
+		errs[i] = applyDelta(writer, delta)
+	}
+	return errs
+}
+
+// List dumps the kernel routes carrying the protocol of bgtables.
+func (s *netlinkSink) List() ([]*netlink.Route, error) {
+	writer := <-s.pool
+	defer func() { s.pool <- writer }()
+
+	filter := &netlink.Route{Protocol: RouteProtocol, Table: unix.RT_TABLE_UNSPEC}
+	routes, err := writer.RouteListFiltered(netlink.FAMILY_ALL, filter,
+		netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list kernel routes: %w", err)
+	}
+	owned := make([]*netlink.Route, len(routes))
+	for i := range routes {
+		owned[i] = &routes[i]
+	}
+	return owned, nil
+}
+
+// Subscribe passes the kernel route notifications to updates until done is
+// closed.
+func (s *netlinkSink) Subscribe(updates chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribeWithOptions(updates, done, s.ns.subscribeOptions(func(err error) {
+		log.Printf("Route subscription error: %v", err)
+	}))
+}
+
+// Close releases the netlink sockets.
+func (s *netlinkSink) Close() {
+	closeWriters(s.writers)
+}
+
+// applyDelta programs delta with a request of its own.
+func applyDelta(writer routeWriter, delta RouteDelta) error {
+	if delta.Remove {
+		return deltaResult(delta, writer.RouteDel(delta.Route))
+	}
+	return deltaResult(delta, writer.RouteReplace(delta.Route))
+}
+
+// deltaResult returns the outcome of programming delta given the error of
+// the kernel, treating a removed route that is already gone as removed.
+func deltaResult(delta RouteDelta, err error) error {
+	switch {
+	case err == nil || (delta.Remove && errors.Is(err, unix.ESRCH)):
+		return nil
+	case delta.Remove:
+		return fmt.Errorf("failed to delete route: %w", err)
+	default:
+		return fmt.Errorf("failed to update route: %w", err)
+	}
+}
@@ -0,0 +1,337 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// minCompactLines is the number of lines below which a file sink is never
+// compacted.
+const minCompactLines = 1024
+
+// fileSink keeps the routes it owns in a file of JSON lines, for consumers
+// that do not read the kernel. Every batch is appended with a line per
+// delta, where a later line of a table and destination replaces the earlier
+// ones, and the file is replaced atomically by a line per route once most
+// of its lines are stale. The file is read back when the sink is opened.
+type fileSink struct {
+	path string
+
+	mu     sync.Mutex
+	routes map[RouteKey]*netlink.Route
+	file   *os.File
+	// size and lines are the length of the file and its number of lines.
+	size  int64
+	lines int
+}
+
+// fileRoute is the JSON form of a route, or of its removal.
+type fileRoute struct {
+	Table    int    `json:"table"`
+	Dst      string `json:"dst"`
+	Type     string `json:"type,omitempty"`
+	Gateway  string `json:"gateway,omitempty"`
+	Metric   int    `json:"metric,omitempty"`
+	Realm    int    `json:"realm,omitempty"`
+	MTU      int    `json:"mtu,omitempty"`
+	AdvMSS   int    `json:"advmss,omitempty"`
+	InitCwnd int    `json:"initcwnd,omitempty"`
+	InitRwnd int    `json:"initrwnd,omitempty"`
+	PrefSrc  string `json:"prefsrc,omitempty"`
+	Removed  bool   `json:"removed,omitempty"`
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	s := &fileSink{path: path, routes: make(map[RouteKey]*netlink.Route)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.replay(data); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay applies the lines of data to the routes. An unterminated last
+// line, left by an interrupted write, is ignored.
+func (s *fileSink) replay(data []byte) error {
+	lines := bytes.Split(data, []byte{'\n'})
+	for _, line := range lines[:len(lines)-1] {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var r fileRoute
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if err := s.replayRoute(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) replayRoute(r fileRoute) error {
+	if r.Removed {
+		key, err := r.key()
+		delete(s.routes, key)
+		return err
+	}
+	route, err := r.route()
+	if err != nil {
+		return err
+	}
+	s.routes[keyOf(route)] = route
+	return nil
+}
+
+// Apply appends deltas to the file and then updates the routes. Every
+// delta fails, leaving the routes unchanged, when the file cannot be
+// written.
+func (s *fileSink) Apply(deltas []RouteDelta) []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.append(deltas)
+	if err == nil {
+		s.update(deltas)
+		s.compactStale()
+	}
+
+	errs := make([]error, len(deltas))
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// append writes a line per delta at the end of the file. A partial write
+// is truncated away, so that the next batch starts on a line of its own.
+// Callers must hold s.mu.
+func (s *fileSink) append(deltas []RouteDelta) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, delta := range deltas {
+		if err := enc.Encode(newFileDelta(delta)); err != nil {
+			return err
+		}
+	}
+
+	if err := s.open(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, errors.Join(err, s.file.Truncate(s.size)))
+	}
+	s.size += int64(buf.Len())
+	s.lines += len(deltas)
+	return nil
+}
+
+// open opens the file for appending, unless it is open. Callers must hold
+// s.mu.
+func (s *fileSink) open() error {
+	if s.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// update applies deltas to the routes. Callers must hold s.mu.
+func (s *fileSink) update(deltas []RouteDelta) {
+	for _, delta := range deltas {
+		if delta.Remove {
+			delete(s.routes, delta.Key)
+		} else {
+			s.routes[delta.Key] = delta.Route
+		}
+	}
+}
+
+// compactStale compacts the file once most of its lines are stale. The
+// deltas are already in the file, so a failure is only logged. Callers
+// must hold s.mu.
+func (s *fileSink) compactStale() {
+	if s.lines < minCompactLines || s.lines <= 2*len(s.routes) {
+		return
+	}
+	if err := s.compact(); err != nil {
+		log.Printf("Failed to compact file sink: %v", err)
+	}
+}
+
+// compact replaces the file with a line per route. Callers must hold s.mu.
+func (s *fileSink) compact() error {
+	routes := make([]fileRoute, 0, len(s.routes))
+	for _, route := range s.routes {
+		routes = append(routes, newFileRoute(route))
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Table != routes[j].Table {
+			return routes[i].Table < routes[j].Table
+		}
+		return routes[i].Dst < routes[j].Dst
+	})
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, route := range routes {
+		if err := enc.Encode(route); err != nil {
+			return err
+		}
+	}
+
+	if err := s.replace(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	s.closeFile()
+	s.size, s.lines = int64(buf.Len()), len(routes)
+	return nil
+}
+
+// replace atomically replaces the file with data. The new file keeps the
+// permissions of the old one, or gets those open gives a new file, rather
+// than the 0600 of a temporary file.
+func (s *fileSink) replace(data []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(s.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err = errors.Join(err, tmp.Chmod(mode), tmp.Close()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// closeFile closes the file opened for appending. Callers must hold s.mu.
+func (s *fileSink) closeFile() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// List returns the routes in the file.
+func (s *fileSink) List() ([]*netlink.Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := make([]*netlink.Route, 0, len(s.routes))
+	for _, route := range s.routes {
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (s *fileSink) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeFile()
+}
+
+// newFileDelta returns the line of delta.
+func newFileDelta(delta RouteDelta) fileRoute {
+	if delta.Remove {
+		return fileRoute{Table: delta.Key.Table, Dst: delta.Key.Dst.String(), Removed: true}
+	}
+	return newFileRoute(delta.Route)
+}
+
+func newFileRoute(route *netlink.Route) fileRoute {
+	r := fileRoute{
+		Table:    route.Table,
+		Dst:      prefixOf(route).String(),
+		Type:     routeTypeName(route.Type),
+		Metric:   route.Priority,
+		Realm:    route.Realm,
+		MTU:      route.MTU,
+		AdvMSS:   route.AdvMSS,
+		InitCwnd: route.InitCwnd,
+		InitRwnd: route.InitRwnd,
+	}
+	if route.Gw != nil {
+		r.Gateway = route.Gw.String()
+	}
+	if route.Src != nil {
+		r.PrefSrc = route.Src.String()
+	}
+	return r
+}
+
+// key returns the key of the route r describes.
+func (r fileRoute) key() (RouteKey, error) {
+	dst, err := netip.ParsePrefix(r.Dst)
+	return RouteKey{Table: r.Table, Dst: dst}, err
+}
+
+// route returns the route r describes, owned by bgtables.
+func (r fileRoute) route() (*netlink.Route, error) {
+	dst, err := netip.ParsePrefix(r.Dst)
+	if err != nil {
+		return nil, err
+	}
+	routeType, ok := routeTypes[r.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q of route %s", r.Type, r.Dst)
+	}
+	return &netlink.Route{
+		Dst:      ipNetOf(dst),
+		Gw:       net.ParseIP(r.Gateway),
+		Protocol: RouteProtocol,
+		Table:    r.Table,
+		Type:     routeType,
+		Priority: r.Metric,
+		Realm:    r.Realm,
+		MTU:      r.MTU,
+		AdvMSS:   r.AdvMSS,
+		InitCwnd: r.InitCwnd,
+		InitRwnd: r.InitRwnd,
+		Src:      net.ParseIP(r.PrefSrc),
+	}, nil
+}
+
+// routeTypeName returns the policy action type of a kernel route type.
+func routeTypeName(routeType int) string {
+	for name, value := range routeTypes {
+		if value == routeType {
+			return name
+		}
+	}
+	return fmt.Sprint(routeType)
+}
@@ -0,0 +1,157 @@
+package routes
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFileSinkRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	sink, err := newFileSink(path)
+	require.NoError(t, err)
+
+	route := &netlink.Route{
+		Dst: mustCIDR(t, "192.0.2.0/24"), Protocol: RouteProtocol, Table: 100, Type: unix.RTN_BLACKHOLE,
+		Priority: 10, MTU: 1400, Src: net.ParseIP("198.51.100.1").To4(),
+	}
+	via := &netlink.Route{
+		Dst: mustCIDR(t, "198.51.100.0/24"), Gw: net.ParseIP("192.0.2.1").To4(), Protocol: RouteProtocol,
+		Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST,
+	}
+	gone := &netlink.Route{
+		Dst: mustCIDR(t, "2001:db8::/32"), Protocol: RouteProtocol, Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST,
+	}
+	assert.Equal(t, []error{nil, nil, nil}, sink.Apply([]RouteDelta{
+		{Key: keyOf(route), Route: route},
+		{Key: keyOf(via), Route: via},
+		{Key: keyOf(gone), Route: gone},
+	}))
+	assert.Equal(t, []error{nil}, sink.Apply([]RouteDelta{{Key: keyOf(gone), Route: gone, Remove: true}}))
+
+	reopened, err := newFileSink(path)
+	require.NoError(t, err)
+	routes, err := reopened.List()
+	require.NoError(t, err)
+	require.Len(t, routes, 2)
+	listed := make(map[RouteKey]*netlink.Route, len(routes))
+	for _, r := range routes {
+		listed[keyOf(r)] = r
+	}
+	assert.True(t, routesEqual(listed[keyOf(route)], route), "%v", listed[keyOf(route)])
+	assert.True(t, routesEqual(listed[keyOf(via)], via), "%v", listed[keyOf(via)])
+}
+
+func TestFileSinkWriteFailure(t *testing.T) {
+	sink, err := newFileSink(filepath.Join(t.TempDir(), "missing", "routes.json"))
+	require.NoError(t, err)
+
+	op := testOp("192.0.2.0/24", opReplace, false)
+	errs := sink.Apply([]RouteDelta{op.delta()})
+	assert.Error(t, errs[0])
+	routes, err := sink.List()
+	require.NoError(t, err)
+	assert.Empty(t, routes, "routes that were not written are not owned")
+}
+
+func fileLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestFileSinkAppendsAndCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	sink, err := newFileSink(path)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	kept := testOp("192.0.2.0/24", opReplace, false)
+	flapping := testOp("198.51.100.0/24", opReplace, false)
+	sink.Apply([]RouteDelta{kept.delta(), flapping.delta()})
+	sink.Apply([]RouteDelta{{Key: flapping.key, Route: flapping.route, Remove: true}})
+	assert.Equal(t, []string{
+		`{"table":254,"dst":"192.0.2.0/24","type":"unicast"}`,
+		`{"table":254,"dst":"198.51.100.0/24","type":"unicast"}`,
+		`{"table":254,"dst":"198.51.100.0/24","removed":true}`,
+	}, fileLines(t, path), "batches are appended")
+	require.NoError(t, os.Chmod(path, 0o640))
+
+	for len(fileLines(t, path)) < minCompactLines-1 {
+		sink.Apply([]RouteDelta{flapping.delta()})
+	}
+	sink.Apply([]RouteDelta{{Key: flapping.key, Route: flapping.route, Remove: true}})
+	assert.Equal(t, []string{`{"table":254,"dst":"192.0.2.0/24","type":"unicast"}`}, fileLines(t, path))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm(), "compaction keeps the permissions of the file")
+
+	sink.Apply([]RouteDelta{flapping.delta()})
+	assert.Len(t, fileLines(t, path), 2, "appending resumes after compaction")
+}
+
+func TestFileSinkTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	data := `{"table":254,"dst":"192.0.2.0/24","type":"unicast"}` + "\n" + `{"table":254,"dst":"198.51`
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	sink, err := newFileSink(path)
+	require.NoError(t, err)
+	routes, err := sink.List()
+	require.NoError(t, err)
+	assert.Len(t, routes, 1, "a line cut short by an interrupted write is dropped")
+	assert.Equal(t, []string{`{"table":254,"dst":"192.0.2.0/24","type":"unicast"}`}, fileLines(t, path))
+}
+
+func TestFileSinkInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"table": 254, "dst": "192.0.2.0/24", "type": "anycast"}`+"\n"), 0o600))
+
+	_, err := newFileSink(path)
+	assert.Error(t, err)
+}
+
+func TestScopePath(t *testing.T) {
+	assert.Equal(t, "/run/routes.json", vrfScope{}.path("/run/routes.json"))
+	assert.Equal(t, "/run/routes.blue.json", vrfScope{vrf: "blue", table: 100}.path("/run/routes.json"))
+}
+
+func TestManagerFansOutToSinks(t *testing.T) {
+	cfg := config.Default()
+	cfg.Programming.ProgressInterval = 0
+	cfg.Sinks = append(cfg.Sinks, config.Sink{Name: "export", Type: config.SinkFile})
+	kernel := newFakeKernel()
+	file, err := newFileSink(filepath.Join(t.TempDir(), "routes.json"))
+	require.NoError(t, err)
+
+	m, err := newScopedManager(cfg, []Sink{newNetlinkSink([]routeWriter{kernel}), file}, vrfScope{}, nil)
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+
+	require.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, false)}))
+	m.Wait()
+
+	assert.Equal(t, []string{"replace 192.0.2.0/24 table 254"}, kernel.deltas())
+	routes, err := file.List()
+	require.NoError(t, err)
+	assert.Len(t, routes, 1)
+	assert.Equal(t, map[string]SinkStatus{"kernel": {Routes: 1}, "export": {Routes: 1}}, m.sinkStatus())
+
+	require.NoError(t, m.UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, true)}))
+	m.Wait()
+
+	assert.Equal(t, []string{"delete 192.0.2.0/24 table 254"}, kernel.deltas())
+	routes, err = file.List()
+	require.NoError(t, err)
+	assert.Empty(t, routes)
+}
@@ -0,0 +1,423 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/karasz/bgtables/routes/pathattr"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// watchFilters maps the configured watch filters to their GoBGP types.
+var watchFilters = map[string]apipb.WatchEventRequest_Table_Filter_Type{
+	config.WatchFilterBest:       apipb.WatchEventRequest_Table_Filter_BEST,
+	config.WatchFilterAdjIn:      apipb.WatchEventRequest_Table_Filter_ADJIN,
+	config.WatchFilterPostPolicy: apipb.WatchEventRequest_Table_Filter_POST_POLICY,
+}
+
+// Source is the slice of the GoBGP RIB bgtables consumes: the paths of the
+// global table or of a VRF, taken with a watch filter type and restricted
+// to some peers.
+//
+// GoBGP has no watch events for VRF tables. The best paths of the VPN
+// families are watched and listed instead, and those carrying an import
+// route target of the VRF are converted to unicast paths.
+//
+// The source keeps the path of every origin of a prefix, the peer it was
+// received from for the Adj-RIB-In or the route distinguisher of the VPN
+// path it was imported from, and selects the path of the lowest origin, so
+// that a prefix stays while any origin still announces it.
+type Source struct {
+	filter apipb.WatchEventRequest_Table_Filter_Type
+	peers  []netip.Addr
+	peerAS map[uint32]bool
+	vrf    string
+
+	mu        sync.Mutex
+	importRTs map[pathattr.ExtendedCommunity]bool
+	announced announcements
+}
+
+func newSource(cfg config.Watch) (*Source, error) {
+	peers, err := parseAddrs(cfg.Peers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid watch.peers: %w", err)
+	}
+
+	s := &Source{
+		filter:    watchFilters[cfg.Filter],
+		peers:     peers,
+		peerAS:    setOf(cfg.PeerAS),
+		announced: make(announcements),
+	}
+	if cfg.Table != config.TableGlobal {
+		s.vrf = cfg.Table
+	}
+	return s, nil
+}
+
+func parseAddrs(values []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(values))
+	for _, value := range values {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
+
+// Load fetches the import route targets of the VRF of the source. It does
+// nothing for the global table.
+func (s *Source) Load(ctx context.Context, client apipb.GobgpApiClient) error {
+	if s.vrf == "" {
+		return nil
+	}
+
+	stream, err := client.ListVrf(ctx, &apipb.ListVrfRequest{Name: s.vrf})
+	if err != nil {
+		return fmt.Errorf("failed to list VRF %q: %w", s.vrf, err)
+	}
+	var vrf *apipb.Vrf
+	err = receiveAll(stream, func(resp *apipb.ListVrfResponse) {
+		if resp.GetVrf().GetName() == s.vrf {
+			vrf = resp.GetVrf()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list VRF %q: %w", s.vrf, err)
+	}
+	if vrf == nil {
+		return fmt.Errorf("VRF %q not found", s.vrf)
+	}
+	return s.setImportRTs(vrf.GetImportRt())
+}
+
+func (s *Source) setImportRTs(packed []*anypb.Any) error {
+	rts := make(map[pathattr.ExtendedCommunity]bool, len(packed))
+	for _, p := range packed {
+		rt, err := pathattr.DecodeExtendedCommunity(p)
+		if err != nil {
+			return fmt.Errorf("invalid import route target of VRF %q: %w", s.vrf, err)
+		}
+		rts[rt] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.importRTs = rts
+	return nil
+}
+
+// WatchRequest returns the request of the watch stream of the source.
+func (s *Source) WatchRequest() *apipb.WatchEventRequest {
+	filters := []*apipb.WatchEventRequest_Table_Filter{{Type: s.filter, Init: true}}
+	if s.filter != apipb.WatchEventRequest_Table_Filter_BEST && len(s.peers) > 0 {
+		filters = filters[:0]
+		for _, peer := range s.peers {
+			filters = append(filters, &apipb.WatchEventRequest_Table_Filter{
+				Type:        s.filter,
+				Init:        true,
+				PeerAddress: peer.String(),
+			})
+		}
+	}
+	return &apipb.WatchEventRequest{Table: &apipb.WatchEventRequest_Table{Filters: filters}}
+}
+
+// Fetch lists the paths of the source from GoBGP, which replace the paths
+// the source knows of, and returns the path it selects for every prefix.
+func (s *Source) Fetch(ctx context.Context, client apipb.GobgpApiClient) ([]*apipb.Path, error) {
+	requests, err := s.listRequests(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []*apipb.Path
+	for _, req := range requests {
+		listed, err := listPaths(ctx, client, req)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, listed...)
+	}
+	if s.filter == apipb.WatchEventRequest_Table_Filter_BEST {
+		paths = bestPaths(paths)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.announced = make(announcements)
+	for _, path := range paths {
+		if path.Filtered {
+			continue
+		}
+		if path, origin, ok := s.origin(path); ok && !path.IsWithdraw && s.fromPeer(path) {
+			s.announced.update(prefixKey(path), origin, path)
+		}
+	}
+	return s.announced.selected(), nil
+}
+
+// listRequests returns the ListPath requests covering the source: one per
+// family, and per peer for the Adj-RIB-In. The VPN families of the global
+// table cover a VRF, as for its watch.
+func (s *Source) listRequests(ctx context.Context, client apipb.GobgpApiClient) ([]*apipb.ListPathRequest, error) {
+	if s.filter == apipb.WatchEventRequest_Table_Filter_BEST {
+		families := installFamilies
+		if s.vrf != "" {
+			families = vpnFamilies
+		}
+		return familyRequests(&apipb.ListPathRequest{TableType: apipb.TableType_GLOBAL}, families), nil
+	}
+
+	peers, err := s.adjInPeers(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var requests []*apipb.ListPathRequest
+	for _, peer := range peers {
+		requests = append(requests, familyRequests(&apipb.ListPathRequest{
+			TableType:      apipb.TableType_ADJ_IN,
+			Name:           peer,
+			EnableFiltered: s.filter == apipb.WatchEventRequest_Table_Filter_POST_POLICY,
+		}, installFamilies)...)
+	}
+	return requests, nil
+}
+
+// familyRequests copies req for every family of families.
+func familyRequests(req *apipb.ListPathRequest, families []*apipb.Family) []*apipb.ListPathRequest {
+	requests := make([]*apipb.ListPathRequest, 0, len(families))
+	for _, family := range families {
+		r := proto.Clone(req).(*apipb.ListPathRequest)
+		r.Family = family
+		requests = append(requests, r)
+	}
+	return requests
+}
+
+// adjInPeers returns the peers whose Adj-RIB-In is listed: the configured
+// ones, or every peer of GoBGP.
+func (s *Source) adjInPeers(ctx context.Context, client apipb.GobgpApiClient) ([]string, error) {
+	if len(s.peers) > 0 {
+		peers := make([]string, 0, len(s.peers))
+		for _, peer := range s.peers {
+			peers = append(peers, peer.String())
+		}
+		return peers, nil
+	}
+
+	stream, err := client.ListPeer(ctx, &apipb.ListPeerRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+	var peers []string
+	err = receiveAll(stream, func(resp *apipb.ListPeerResponse) {
+		peers = append(peers, resp.GetPeer().GetConf().GetNeighborAddress())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+	return peers, nil
+}
+
+// Select returns the paths the source selects for the prefixes of the paths
+// of a watch event, or withdrawals for the prefixes no origin announces any
+// more. A best path from another peer withdraws its prefix, and VPN paths
+// imported into the VRF of the source become unicast paths.
+func (s *Source) Select(paths []*apipb.Path) []*apipb.Path {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	selected := make([]*apipb.Path, 0, len(paths))
+	for _, path := range paths {
+		path, origin, ok := s.origin(path)
+		if !ok {
+			continue
+		}
+		if !s.fromPeer(path) {
+			if s.filter != apipb.WatchEventRequest_Table_Filter_BEST {
+				continue
+			}
+			path = withdrawal(path)
+		}
+		if path = s.announced.update(prefixKey(path), origin, path); path != nil {
+			selected = append(selected, path)
+		}
+	}
+	return selected
+}
+
+// origin returns path as announced or withdrawn by its origin in the
+// source. It returns false for the paths of other VRFs. Callers must hold
+// s.mu.
+func (s *Source) origin(path *apipb.Path) (*apipb.Path, string, bool) {
+	switch {
+	case s.vrf != "":
+		return s.imported(path)
+	case s.filter != apipb.WatchEventRequest_Table_Filter_BEST:
+		return path, path.GetNeighborIp(), true
+	}
+	return path, "", true
+}
+
+// fromPeer reports whether path was received from one of the peers of the
+// source.
+func (s *Source) fromPeer(path *apipb.Path) bool {
+	if len(s.peerAS) > 0 && !s.peerAS[path.GetSourceAsn()] {
+		return false
+	}
+	if len(s.peers) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(path.GetNeighborIp())
+	if err != nil {
+		return false
+	}
+	for _, peer := range s.peers {
+		if peer == addr.Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// imported converts a VPN path of the VRF of the source to a unicast path,
+// originated by the route distinguisher of the VPN path. An announcement
+// without an import route target of the VRF withdraws its prefix. It
+// returns false for paths that are not unicast VPN paths. Callers must
+// hold s.mu.
+func (s *Source) imported(path *apipb.Path) (*apipb.Path, string, bool) {
+	nlri, err := nlriRegistry.DecodePath(path)
+	if err != nil {
+		return nil, "", false
+	}
+	vpn, ok := nlri.(VPNNLRI)
+	if !ok || vpn.Multicast() {
+		return nil, "", false
+	}
+	unicast := unicastPath(path, vpn.Prefix)
+	if unicast == nil {
+		return nil, "", false
+	}
+	if !path.IsWithdraw && !s.importsPath(path) {
+		unicast.IsWithdraw = true
+	}
+	return unicast, vpn.RD.String(), true
+}
+
+// importsPath reports whether path carries an import route target of the
+// VRF. Callers must hold s.mu.
+func (s *Source) importsPath(path *apipb.Path) bool {
+	attrs, err := pathattr.Decode(path)
+	if err != nil {
+		return false
+	}
+	for _, c := range attrs.ExtendedCommunities {
+		if s.importRTs[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// unicastPath returns a copy of a VPN path with the unicast NLRI of prefix.
+func unicastPath(path *apipb.Path, prefix netip.Prefix) *apipb.Path {
+	nlri, err := anypb.New(&apipb.IPAddressPrefix{Prefix: prefix.Addr().String(), PrefixLen: uint32(prefix.Bits())})
+	if err != nil {
+		return nil
+	}
+	unicast := proto.Clone(path).(*apipb.Path)
+	unicast.Nlri = nlri
+	unicast.Family = &apipb.Family{Afi: path.GetFamily().GetAfi(), Safi: apipb.Family_SAFI_UNICAST}
+	return unicast
+}
+
+// withdrawal returns a copy of path that withdraws its prefix.
+func withdrawal(path *apipb.Path) *apipb.Path {
+	withdrawn := proto.Clone(path).(*apipb.Path)
+	withdrawn.IsWithdraw = true
+	return withdrawn
+}
+
+// prefixKey identifies the prefix of path.
+func prefixKey(path *apipb.Path) string {
+	family := path.GetFamily()
+	if nlri, err := nlriRegistry.DecodePath(path); err == nil {
+		return fmt.Sprintf("%d/%d %s", family.GetAfi(), family.GetSafi(), nlri)
+	}
+	return fmt.Sprintf("%d/%d %s %x", family.GetAfi(), family.GetSafi(), path.GetNlri().GetTypeUrl(),
+		path.GetNlri().GetValue())
+}
+
+// originPaths holds the path every origin announces for a prefix.
+type originPaths map[string]*apipb.Path
+
+// chosen returns the path of the lowest origin, nil when there is none.
+func (o originPaths) chosen() *apipb.Path {
+	var path *apipb.Path
+	lowest := ""
+	for origin, p := range o {
+		if path == nil || origin < lowest {
+			path, lowest = p, origin
+		}
+	}
+	return path
+}
+
+// announcements holds the origin paths of every prefix, by prefixKey.
+type announcements map[string]originPaths
+
+// update records path, announced or withdrawn by origin. It returns the
+// path now chosen for the prefix, the withdrawal when no origin is left,
+// or nil when the choice did not change.
+func (a announcements) update(key, origin string, path *apipb.Path) *apipb.Path {
+	origins := a[key]
+	before := origins.chosen()
+	if path.IsWithdraw {
+		delete(origins, origin)
+	} else {
+		if origins == nil {
+			origins = make(originPaths)
+			a[key] = origins
+		}
+		origins[origin] = path
+	}
+	after := origins.chosen()
+	if len(origins) == 0 {
+		delete(a, key)
+	}
+
+	switch {
+	case after == before:
+		return nil
+	case after == nil:
+		return path
+	}
+	return after
+}
+
+// selected returns the chosen path of every prefix, in the order of their
+// keys.
+func (a announcements) selected() []*apipb.Path {
+	keys := make([]string, 0, len(a))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	paths := make([]*apipb.Path, 0, len(keys))
+	for _, key := range keys {
+		paths = append(paths, a[key].chosen())
+	}
+	return paths
+}
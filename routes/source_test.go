@@ -0,0 +1,218 @@
+package routes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func newPeerPath(t *testing.T, prefix, peer string, asn uint32) *apipb.Path {
+	t.Helper()
+	path := newTestPath(t, prefix, 24, false)
+	path.Best = true
+	path.NeighborIp = peer
+	path.SourceAsn = asn
+	return path
+}
+
+func routeTarget(t *testing.T, asn, local uint32) *anypb.Any {
+	t.Helper()
+	return packNLRI(t, &apipb.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: asn, LocalAdmin: local})
+}
+
+func newVPNPath(t *testing.T, prefix string, assigned uint32, withdraw bool, rts ...*anypb.Any) *apipb.Path {
+	t.Helper()
+	rd := packNLRI(t, &apipb.RouteDistinguisherTwoOctetASN{Admin: 65000, Assigned: assigned})
+	nlri := &apipb.LabeledVPNIPAddressPrefix{Rd: rd, Prefix: prefix, PrefixLen: 24, Labels: []uint32{16}}
+	attrs := []*anypb.Any{packNLRI(t, &apipb.ExtendedCommunitiesAttribute{Communities: rts})}
+	return &apipb.Path{
+		Family:     &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_MPLS_VPN},
+		Nlri:       packNLRI(t, nlri),
+		Pattrs:     attrs,
+		Best:       true,
+		IsWithdraw: withdraw,
+	}
+}
+
+func newTestSource(t *testing.T, cfg config.Watch) *Source {
+	t.Helper()
+	s, err := newSource(cfg)
+	require.NoError(t, err)
+	return s
+}
+
+func prefixesOf(t *testing.T, paths []*apipb.Path) map[string]bool {
+	t.Helper()
+	prefixes := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		nlri, err := nlriRegistry.DecodePath(path)
+		require.NoError(t, err)
+		prefixes[nlri.String()] = path.IsWithdraw
+	}
+	return prefixes
+}
+
+func TestSourceWatchRequest(t *testing.T) {
+	best := newTestSource(t, config.Watch{Filter: config.WatchFilterBest, Peers: []string{"192.0.2.1"}})
+	assert.Equal(t, []*apipb.WatchEventRequest_Table_Filter{
+		{Type: apipb.WatchEventRequest_Table_Filter_BEST, Init: true},
+	}, best.WatchRequest().GetTable().GetFilters())
+
+	adjIn := newTestSource(t, config.Watch{Filter: config.WatchFilterAdjIn, Peers: []string{"192.0.2.1", "2001:db8::1"}})
+	assert.Equal(t, []*apipb.WatchEventRequest_Table_Filter{
+		{Type: apipb.WatchEventRequest_Table_Filter_ADJIN, Init: true, PeerAddress: "192.0.2.1"},
+		{Type: apipb.WatchEventRequest_Table_Filter_ADJIN, Init: true, PeerAddress: "2001:db8::1"},
+	}, adjIn.WatchRequest().GetTable().GetFilters())
+
+	_, err := newSource(config.Watch{Filter: config.WatchFilterBest, Peers: []string{"peer1"}})
+	assert.Error(t, err)
+}
+
+func TestSourceSelectPeers(t *testing.T) {
+	best := newTestSource(t, config.Watch{
+		Filter: config.WatchFilterBest,
+		Peers:  []string{"192.0.2.1", "192.0.2.2"},
+		PeerAS: []uint32{65001},
+	})
+	paths := []*apipb.Path{
+		newPeerPath(t, "198.51.100.0", "192.0.2.1", 65001),
+		newPeerPath(t, "203.0.113.0", "192.0.2.2", 65002),
+		newPeerPath(t, "10.0.0.0", "192.0.2.3", 65001),
+	}
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": false}, prefixesOf(t, best.Select(paths)))
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": true},
+		prefixesOf(t, best.Select([]*apipb.Path{newPeerPath(t, "198.51.100.0", "192.0.2.3", 65001)})),
+		"a best path from another peer withdraws its prefix")
+
+	adjIn := newTestSource(t, config.Watch{Filter: config.WatchFilterAdjIn, PeerAS: []uint32{65001}})
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": false, "10.0.0.0/24": false},
+		prefixesOf(t, adjIn.Select(paths)))
+}
+
+// newVRFSource returns the source of VRF blue, importing route target
+// 65000:1.
+func newVRFSource(t *testing.T) *Source {
+	t.Helper()
+	s := newTestSource(t, config.Watch{Filter: config.WatchFilterBest, Table: "blue"})
+	vrf := &apipb.Vrf{Name: "blue", ImportRt: []*anypb.Any{routeTarget(t, 65000, 1)}}
+	client := new(MockGobgpAPIClient)
+	client.On("ListVrf", mock.Anything, &apipb.ListVrfRequest{Name: "blue"}).
+		Return(newSliceStream(&apipb.ListVrfResponse{Vrf: vrf}), nil)
+	require.NoError(t, s.Load(context.Background(), client))
+	return s
+}
+
+func TestSourceSelectAdjInPeers(t *testing.T) {
+	s := newTestSource(t, config.Watch{Filter: config.WatchFilterAdjIn})
+	first := newPeerPath(t, "198.51.100.0", "192.0.2.1", 65001)
+	second := newPeerPath(t, "198.51.100.0", "192.0.2.2", 65002)
+	assert.Equal(t, []*apipb.Path{first}, s.Select([]*apipb.Path{first, second}))
+
+	assert.Equal(t, []*apipb.Path{second}, s.Select([]*apipb.Path{withdrawal(first)}),
+		"the prefix stays while another peer announces it")
+	assert.Empty(t, s.Select([]*apipb.Path{withdrawal(first)}))
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": true}, prefixesOf(t, s.Select([]*apipb.Path{withdrawal(second)})))
+}
+
+func TestSourceSelectVRF(t *testing.T) {
+	s := newVRFSource(t)
+
+	multicast := newVPNPath(t, "192.0.2.0", 1, false, routeTarget(t, 65000, 1))
+	multicast.Family.Safi = apipb.Family_SAFI_MPLS_VPN_MULTICAST
+	selected := s.Select([]*apipb.Path{
+		newPeerPath(t, "192.0.2.0", "192.0.2.1", 65001),
+		newVPNPath(t, "198.51.100.0", 1, false, routeTarget(t, 65000, 1)),
+		newVPNPath(t, "203.0.113.0", 2, false, routeTarget(t, 65000, 2)),
+		multicast,
+	})
+	require.Len(t, selected, 1)
+	assert.Equal(t, apipb.Family_SAFI_UNICAST, selected[0].GetFamily().GetSafi())
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": false}, prefixesOf(t, selected))
+
+	selected = s.Select([]*apipb.Path{
+		newVPNPath(t, "198.51.100.0", 1, true),
+		newVPNPath(t, "203.0.113.0", 2, true),
+	})
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": true}, prefixesOf(t, selected))
+
+	missing := newTestSource(t, config.Watch{Filter: config.WatchFilterBest, Table: "red"})
+	client := new(MockGobgpAPIClient)
+	client.On("ListVrf", mock.Anything, &apipb.ListVrfRequest{Name: "red"}).
+		Return(newSliceStream[*apipb.ListVrfResponse](), nil)
+	assert.ErrorContains(t, missing.Load(context.Background(), client), "not found")
+}
+
+func TestSourceFetchAdjIn(t *testing.T) {
+	s := newTestSource(t, config.Watch{Filter: config.WatchFilterPostPolicy})
+	client := new(MockGobgpAPIClient)
+	client.On("ListPeer", mock.Anything, mock.Anything).Return(newSliceStream(
+		&apipb.ListPeerResponse{Peer: &apipb.Peer{Conf: &apipb.PeerConf{NeighborAddress: "192.0.2.1"}}},
+	), nil)
+
+	accepted := newPeerPath(t, "198.51.100.0", "192.0.2.1", 65001)
+	accepted.Best = false
+	filtered := newPeerPath(t, "203.0.113.0", "192.0.2.1", 65001)
+	filtered.Filtered = true
+	var requests []*apipb.ListPathRequest
+	client.On("ListPath", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		requests = append(requests, args.Get(1).(*apipb.ListPathRequest))
+	}).Return(newSliceStream(&apipb.ListPathResponse{Destination: &apipb.Destination{
+		Paths: []*apipb.Path{accepted, filtered},
+	}}), nil).Once()
+	client.On("ListPath", mock.Anything, mock.Anything).Return(newSliceStream[*apipb.ListPathResponse](), nil)
+
+	paths, err := s.Fetch(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, []*apipb.Path{accepted}, paths)
+	require.Len(t, requests, 1)
+	assert.Equal(t, apipb.TableType_ADJ_IN, requests[0].TableType)
+	assert.Equal(t, "192.0.2.1", requests[0].Name)
+	assert.True(t, requests[0].EnableFiltered)
+}
+
+func TestSourceSelectVRFRouteDistinguishers(t *testing.T) {
+	s := newVRFSource(t)
+	rt := routeTarget(t, 65000, 1)
+	first := s.Select([]*apipb.Path{
+		newVPNPath(t, "198.51.100.0", 1, false, rt),
+		newVPNPath(t, "198.51.100.0", 2, false, rt),
+	})
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": false}, prefixesOf(t, first))
+
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": false},
+		prefixesOf(t, s.Select([]*apipb.Path{newVPNPath(t, "198.51.100.0", 1, true)})),
+		"the prefix stays while another route distinguisher imports it")
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": true},
+		prefixesOf(t, s.Select([]*apipb.Path{newVPNPath(t, "198.51.100.0", 2, false)})),
+		"an announcement without the route target withdraws the prefix")
+}
+
+func TestSourceFetchVRF(t *testing.T) {
+	s := newVRFSource(t)
+	rt := routeTarget(t, 65000, 1)
+	client := new(MockGobgpAPIClient)
+	client.On("ListPath", mock.Anything, mock.MatchedBy(func(req *apipb.ListPathRequest) bool {
+		return req.TableType == apipb.TableType_GLOBAL && req.Family.Safi == apipb.Family_SAFI_MPLS_VPN
+	})).Return(newSliceStream(&apipb.ListPathResponse{Destination: &apipb.Destination{Paths: []*apipb.Path{
+		newVPNPath(t, "198.51.100.0", 1, false, rt),
+		newVPNPath(t, "198.51.100.0", 2, false, rt),
+		newVPNPath(t, "203.0.113.0", 3, false),
+	}}}), nil).Once()
+	client.On("ListPath", mock.Anything, mock.Anything).Return(newSliceStream[*apipb.ListPathResponse](), nil).Once()
+
+	paths, err := s.Fetch(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": false}, prefixesOf(t, paths))
+	assert.Equal(t, apipb.Family_SAFI_UNICAST, paths[0].GetFamily().GetSafi())
+	client.AssertExpectations(t)
+
+	assert.Equal(t, map[string]bool{"198.51.100.0/24": false},
+		prefixesOf(t, s.Select([]*apipb.Path{newVPNPath(t, "198.51.100.0", 1, true)})),
+		"the fetched paths of every route distinguisher are kept")
+}
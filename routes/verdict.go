@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+)
+
+// verdict records how the RIB treated the path of a prefix: the reason the
+// prefix filter refused it, the policy and realm rules it matched, whether
+// RPKI validation refused it and whether it was refused for its link-local
+// next hop. The zero verdict accepts the prefix without matching any rule.
+type verdict struct {
+	filtered     string
+	rule, realm  *policyRule
+	rpkiRejected bool
+	linkLocal    bool
+}
+
+// verdicts counts the verdicts of the RIB once per prefix and change of
+// its verdict: reconciliations evaluate every prefix again, and must not
+// count it again.
+type verdicts struct {
+	mu   sync.Mutex
+	last map[netip.Prefix]verdict
+}
+
+func newVerdicts() *verdicts {
+	return &verdicts{last: make(map[netip.Prefix]verdict)}
+}
+
+// record counts what v changes from the verdict last recorded for prefix,
+// and remembers it. Rejections go to the status of filter.
+func (vs *verdicts) record(prefix netip.Prefix, v verdict, filter *prefixFilter) {
+	vs.mu.Lock()
+	old := vs.last[prefix]
+	if v == (verdict{}) {
+		delete(vs.last, prefix)
+	} else {
+		vs.last[prefix] = v
+	}
+	vs.mu.Unlock()
+
+	v.count(old, prefix, filter)
+}
+
+// retain forgets the prefixes keep does not hold, once the RIB was rebuilt
+// without them.
+func (vs *verdicts) retain(keep map[netip.Prefix]bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	for prefix := range vs.last {
+		if !keep[prefix] {
+			delete(vs.last, prefix)
+		}
+	}
+}
+
+// count adds what v holds and old did not to the counters.
+func (v verdict) count(old verdict, prefix netip.Prefix, filter *prefixFilter) {
+	if v.filtered != "" && v.filtered != old.filtered {
+		filter.reject(Rejection{Prefix: prefix.String(), Reason: v.filtered})
+	}
+	v.countRules(old)
+	if v.rpkiRejected && !old.rpkiRejected {
+		Metrics.Add(metricRPKIRejected, 1)
+	}
+	if v.linkLocal && !old.linkLocal {
+		Metrics.Add(metricLinkLocalRefused, 1)
+		log.Printf("Not installing %s: its next hop is link-local, on an unknown interface", prefix)
+	}
+}
+
+// countRules adds the policy and realm rules v matched and old did not to
+// their hits.
+func (v verdict) countRules(old verdict) {
+	if v.rule != nil && v.rule != old.rule {
+		v.rule.hits.Add(1)
+		if v.rule.action.Reject {
+			Metrics.Add(metricPolicyRejected, 1)
+		}
+	}
+	if v.realm != nil && v.realm != old.realm {
+		v.realm.hits.Add(1)
+	}
+}
@@ -0,0 +1,37 @@
+package routes
+
+import (
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerdictsCountChanges(t *testing.T) {
+	filter := newTestFilter(t, config.Filter{IPv4: config.LengthRange{MaxLength: 24}})
+	p := newTestPolicy(t, config.PolicyRule{
+		Name:   "tagged",
+		Match:  config.PolicyMatch{Communities: []string{"65000:100"}},
+		Action: config.PolicyAction{Table: 100},
+	})
+	rib := newRIB(filter, p, nil)
+	tagged := newAttrPath(t, "10.0.0.0", 24, &apipb.CommunitiesAttribute{Communities: []uint32{65000<<16 | 100}})
+	long := newTestPath(t, "10.1.0.0", 25, false)
+
+	rib.Replace([]*apipb.Path{tagged, long})
+	rib.Replace([]*apipb.Path{tagged, long})
+	rib.Apply([]*apipb.Path{tagged, long})
+	assert.Equal(t, map[string]int64{rejectMaxLength: 1}, filter.status().Reasons)
+	assert.Equal(t, []PolicyRuleStatus{{Name: "tagged", Matches: 1}}, p.status(),
+		"reconciliations evaluate prefixes again without counting them again")
+
+	rib.Apply([]*apipb.Path{newTestPath(t, "10.1.0.0", 25, true)})
+	rib.Apply([]*apipb.Path{long})
+	assert.Equal(t, map[string]int64{rejectMaxLength: 2}, filter.status().Reasons, "a withdrawn prefix counts anew")
+
+	rib.Replace([]*apipb.Path{long})
+	rib.Replace([]*apipb.Path{tagged, long})
+	assert.Equal(t, []PolicyRuleStatus{{Name: "tagged", Matches: 2}}, p.status(),
+		"a prefix gone from the RIB counts anew")
+}
@@ -0,0 +1,187 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/karasz/bgtables/config"
+	"github.com/vishvananda/netlink"
+)
+
+// vrfScope is the part of the kernel a manager owns. The manager of a VRF
+// owns the routing table of its Linux VRF, and the manager of the global
+// table owns every other table, in the network namespace ns.
+type vrfScope struct {
+	vrf   string
+	table int
+	// excluded holds the tables of the VRFs, in the global scope.
+	excluded map[int]bool
+	ns       *namespace
+}
+
+// owns reports whether routes in table belong to the scope.
+func (s vrfScope) owns(table int) bool {
+	if s.vrf != "" {
+		return table == s.table
+	}
+	return !s.excluded[table]
+}
+
+func (s vrfScope) String() string {
+	scope := "global table"
+	if s.vrf != "" {
+		scope = fmt.Sprintf("VRF %s (table %d)", s.vrf, s.table)
+	}
+	if s.ns != nil {
+		scope += " of " + s.ns.String()
+	}
+	return scope
+}
+
+// watch returns the watch configuration of the scope: a VRF takes the best
+// paths of its GoBGP VRF from the peers of watch.
+func (s vrfScope) watch(watch config.Watch) config.Watch {
+	if s.vrf != "" {
+		watch.Filter = config.WatchFilterBest
+		watch.Table = s.vrf
+	}
+	return watch
+}
+
+// path returns the file a file sink of the scope writes to: the file of a
+// namespace or VRF carries their names ahead of the extension of path.
+func (s vrfScope) path(path string) string {
+	ext := filepath.Ext(path)
+	path = strings.TrimSuffix(path, ext)
+	if s.ns != nil {
+		path += "." + s.ns.name
+	}
+	if s.vrf != "" {
+		path += "." + s.vrf
+	}
+	return path + ext
+}
+
+// NewManagers returns, for the namespace of bgtables or for every
+// configured namespace, the manager of the global table followed by one
+// manager per configured VRF. Each manager fetches, watches and reconciles
+// its own table, so the routes of a VRF never leave its Linux VRF.
+func NewManagers(cfg config.Config) ([]*Manager, error) {
+	if len(cfg.Namespaces) == 0 {
+		return newNamespaceManagers(cfg, nil)
+	}
+
+	var managers []*Manager
+	for _, nsCfg := range cfg.Namespaces {
+		ns, err := openNamespace(nsCfg)
+		if err != nil {
+			CloseManagers(managers)
+			return nil, err
+		}
+		nsManagers, err := newNamespaceManagers(cfg, ns)
+		if err != nil {
+			CloseManagers(managers)
+			return nil, fmt.Errorf("%s: %w", ns, err)
+		}
+		managers = append(managers, nsManagers...)
+	}
+	return managers, nil
+}
+
+// newNamespaceManagers returns the managers of ns. The manager of its
+// global table owns ns, and closes it.
+func newNamespaceManagers(cfg config.Config, ns *namespace) ([]*Manager, error) {
+	scopes, err := resolveVRFScopes(ns, cfg.VRFs)
+	if err != nil {
+		ns.close()
+		return nil, err
+	}
+
+	managers := make([]*Manager, 0, len(scopes))
+	for _, scope := range scopes {
+		m, err := openManager(cfg, scope)
+		if err != nil {
+			if len(managers) == 0 {
+				ns.close()
+			}
+			CloseManagers(managers)
+			return nil, err
+		}
+		managers = append(managers, m)
+	}
+	return managers, nil
+}
+
+// CloseManagers closes every manager.
+func CloseManagers(managers []*Manager) {
+	for _, m := range managers {
+		m.Close()
+	}
+}
+
+// resolveVRFScopes returns the global scope of ns followed by the scope of
+// every VRF, whose devices are looked up and created in ns.
+func resolveVRFScopes(ns *namespace, vrfs []config.VRF) ([]vrfScope, error) {
+	global := vrfScope{excluded: make(map[int]bool, len(vrfs)), ns: ns}
+	scopes := []vrfScope{global}
+	if len(vrfs) == 0 {
+		return scopes, nil
+	}
+
+	links, err := ns.newHandle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer links.Close()
+	for _, vrf := range vrfs {
+		table, err := resolveVRFTable(links, vrf)
+		if err != nil {
+			return nil, fmt.Errorf("VRF %q: %w", vrf.Name, err)
+		}
+		if global.excluded[table] {
+			return nil, fmt.Errorf("VRF %q: table %d is mapped twice", vrf.Name, table)
+		}
+		global.excluded[table] = true
+		scopes = append(scopes, vrfScope{vrf: vrf.Name, table: table, ns: ns})
+	}
+	return scopes, nil
+}
+
+// resolveVRFTable returns the routing table of the Linux VRF of vrf, and
+// creates its device when it is missing.
+func resolveVRFTable(links *netlink.Handle, vrf config.VRF) (int, error) {
+	if vrf.Device == "" {
+		return vrf.Table, nil
+	}
+
+	link, err := links.LinkByName(vrf.Device)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) && vrf.Table != 0 {
+		return vrf.Table, createVRFDevice(links, vrf)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find VRF device %q: %w", vrf.Device, err)
+	}
+
+	device, ok := link.(*netlink.Vrf)
+	switch {
+	case !ok:
+		return 0, fmt.Errorf("%q is not a VRF device", vrf.Device)
+	case vrf.Table != 0 && int(device.Table) != vrf.Table:
+		return 0, fmt.Errorf("VRF device %q uses table %d, not %d", vrf.Device, device.Table, vrf.Table)
+	}
+	return int(device.Table), nil
+}
+
+func createVRFDevice(links *netlink.Handle, vrf config.VRF) error {
+	device := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: vrf.Device}, Table: uint32(vrf.Table)}
+	if err := links.LinkAdd(device); err != nil {
+		return fmt.Errorf("failed to create VRF device %q: %w", vrf.Device, err)
+	}
+	if err := links.LinkSetUp(device); err != nil {
+		return fmt.Errorf("failed to bring up VRF device %q: %w", vrf.Device, err)
+	}
+	return nil
+}
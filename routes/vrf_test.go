@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"expvar"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/karasz/bgtables/config"
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestVRFScope(t *testing.T) {
+	scopes, err := resolveVRFScopes(nil, []config.VRF{{Name: "blue", Table: 100}, {Name: "red", Table: 200}})
+	require.NoError(t, err)
+	require.Len(t, scopes, 3)
+
+	global, blue := scopes[0], scopes[1]
+	assert.True(t, global.owns(unix.RT_TABLE_MAIN))
+	assert.False(t, global.owns(100))
+	assert.True(t, blue.owns(100))
+	assert.False(t, blue.owns(unix.RT_TABLE_MAIN))
+	assert.False(t, blue.owns(200))
+
+	watch := config.Watch{Filter: config.WatchFilterPostPolicy, PeerAS: []uint32{65001}, Table: config.TableGlobal}
+	assert.Equal(t, watch, global.watch(watch))
+	assert.Equal(t, config.Watch{Filter: config.WatchFilterBest, PeerAS: []uint32{65001}, Table: "blue"},
+		blue.watch(watch))
+
+	_, err = resolveVRFScopes(nil, []config.VRF{{Name: "blue", Table: 100}, {Name: "red", Table: 100}})
+	assert.Error(t, err)
+	_, err = resolveVRFScopes(nil, []config.VRF{{Name: "blue", Device: "bgt-missing0"}})
+	assert.Error(t, err, "a missing device needs a table to be created")
+}
+
+func TestKernelCacheScope(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+	cache := newScopedKernelCache(vrfScope{vrf: "blue", table: 100}, nil)
+
+	for _, table := range []int{unix.RT_TABLE_MAIN, 100} {
+		cache.Observe(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE,
+			Route: netlink.Route{Dst: dst, Protocol: RouteProtocol, Table: table}})
+	}
+	_, ok := cache.Get(RouteKey{Table: 100, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+	assert.True(t, ok)
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestVRFManagers(t *testing.T) {
+	cfg := config.Default()
+	cfg.Programming.ProgressInterval = 0
+	cfg.Programming.CoalesceWindow = 0
+	cfg.Policy = []config.PolicyRule{{Name: "blue", Action: config.PolicyAction{Table: 100}}}
+	scopes, err := resolveVRFScopes(nil, []config.VRF{{Name: "blue", Table: 100}, {Name: "red", Table: 200}})
+	require.NoError(t, err)
+
+	kernels := make([]*fakeKernel, len(scopes))
+	managers := make([]*Manager, len(scopes))
+	for i, scope := range scopes {
+		kernels[i] = newFakeKernel()
+		managers[i], err = newScopedManager(cfg, []Sink{newNetlinkSink([]routeWriter{kernels[i]})}, scope, nil)
+		require.NoError(t, err)
+		t.Cleanup(managers[i].Close)
+
+		require.NoError(t, managers[i].UpdateLocalRoutes([]*apipb.Path{newTestPath(t, "192.0.2.0", 24, false)}))
+		managers[i].Wait()
+	}
+
+	assert.Empty(t, kernels[0].deltas(), "the global table must not program the table of a VRF")
+	assert.Equal(t, []string{"replace 192.0.2.0/24 table 100"}, kernels[1].deltas())
+	assert.Equal(t, []string{"replace 192.0.2.0/24 table 200"}, kernels[2].deltas())
+
+	_, ok := managers[2].RIB().Get(RouteKey{Table: 200, Dst: netip.MustParsePrefix("192.0.2.0/24")})
+	assert.True(t, ok, "routes of a VRF are pinned to its table")
+	assert.Equal(t, "red", managers[2].VRF())
+
+	vrfs, ok := Metrics.Get(metricVRFs).(*expvar.Map)
+	require.True(t, ok)
+	assert.NotNil(t, vrfs.Get("red"))
+}